@@ -26,30 +26,174 @@
 // the path's value depends on the arguments list (among other things). As that
 // can only be read through environment variables, some wrapper (shell script or
 // this) is always neccessary.
+//
+// # Hermeticity
+//
+// Everything "go build" reads from its environment is set here, rather than
+// left to whatever the derivation happens to pass. Caches and temporary files
+// go in the sandbox's build directory, so nothing outside it is touched and
+// "nix build --keep-failed" keeps them for debugging. The toolchain is pinned
+// to the one running the build, and the module proxy is disabled, so the build
+// never goes to the network. If the workspace has been vendored with "go work
+// vendor", the vendored copies are used. Cgo is disabled, since the sandbox
+// has no C compiler.
+//
+// # Cross compilation
+//
+// The builder has to run on the machine building the derivations using it,
+// which for remote builds may not be the one which builds the builder. Each
+// output of the derivation gets its own copy of the builder: "out" for
+// $goos/$goarch (the platform running this by default), and any other for the
+// platform it's named after, like "linux_arm64". These aren't read from $GOOS
+// and $GOARCH, which would also cross-compile this program under "go run".
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 func main() {
+	log.SetFlags(0)
+	log.SetPrefix("bootstrap: ")
+
 	goBin := filepath.Join(os.Getenv("go"), "bin", "go")
 
-	outDir := os.Getenv("out")
 	modName := os.Getenv("moduleName")
 
-	out := filepath.Join(outDir, "bin", "builder")
-	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
-		log.Fatalf("failed to create bin directory: %v", err)
+	env, err := goEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outputs := strings.Fields(os.Getenv("outputs"))
+	if len(outputs) == 0 {
+		outputs = []string{"out"}
+	}
+	for _, output := range outputs {
+		platform, err := outputPlatform(output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("building %s for %s", output, platform)
+
+		out := filepath.Join(os.Getenv(output), "bin", "builder")
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			log.Fatalf("failed to create bin directory: %v", err)
+		}
+
+		cmd := exec.Command(goBin, "build", "-o", out, modName)
+		cmd.Env = append(os.Environ(), env...)
+		if platform.goos != "" {
+			cmd.Env = append(cmd.Env, "GOOS="+platform.goos, "GOARCH="+platform.goarch)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Fatalf("failed to compile bootstrap binary: %v", err)
+		}
+	}
+}
+
+// A platform is a GOOS and GOARCH to build for. Both are empty for the
+// platform go defaults to.
+type platform struct {
+	goos, goarch string
+}
+
+func (p platform) String() string {
+	if p.goos == "" {
+		return "the build platform"
+	}
+	return p.goos + "/" + p.goarch
+}
+
+// outputPlatform returns the platform the builder in output is built for. Only
+// "out" follows $goos and $goarch, which must be set together.
+func outputPlatform(output string) (platform, error) {
+	if output != "out" {
+		goos, goarch, ok := strings.Cut(output, "_")
+		if !ok || goos == "" || goarch == "" {
+			return platform{}, fmt.Errorf("output %s must be named GOOS_GOARCH", output)
+		}
+		return platform{goos, goarch}, nil
+	}
+
+	goos, goarch := os.Getenv("goos"), os.Getenv("goarch")
+	if (goos == "") != (goarch == "") {
+		return platform{}, fmt.Errorf("$goos and $goarch must be set together")
+	}
+	return platform{goos, goarch}, nil
+}
+
+// goEnv returns the environment variables "go build" should be run with. Each
+// is logged, so failed builds show what they were given. Variables set by the
+// derivation are kept, except GOFLAGS, which is only added to.
+func goEnv() ([]string, error) {
+	workFile := os.Getenv("GOWORK")
+	if workFile == "" || workFile == "off" {
+		return nil, fmt.Errorf("$GOWORK must be set to the bootstrap workspace")
+	}
+	if _, err := os.Stat(workFile); err != nil {
+		return nil, fmt.Errorf("failed to find bootstrap workspace: %w", err)
+	}
+
+	tmp := os.Getenv("NIX_BUILD_TOP")
+	if tmp == "" {
+		tmp = os.TempDir()
+	}
+	defaults := [][2]string{
+		{"GOCACHE", filepath.Join(tmp, "go-cache")},
+		{"GOTMPDIR", filepath.Join(tmp, "go-tmp")},
+		{"GOPATH", filepath.Join(tmp, "go")},
+		{"GOPROXY", "off"},
+		{"GOSUMDB", "off"},
+		{"GOTOOLCHAIN", "local"},
+		{"CGO_ENABLED", "0"},
+	}
+
+	env := []string{"GOWORK=" + workFile}
+	for _, variable := range defaults {
+		name, value := variable[0], variable[1]
+		if set := os.Getenv(name); set != "" {
+			value = set
+		}
+		if name == "GOTMPDIR" {
+			// Unlike GOCACHE, go won't create it.
+			if err := os.MkdirAll(value, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create GOTMPDIR: %w", err)
+			}
+		}
+		env = append(env, name+"="+value)
+	}
+	env = append(env, "GOFLAGS="+goFlags(workFile))
+
+	for _, variable := range env {
+		log.Print(variable)
+	}
+	return env, nil
+}
+
+// goFlags adds "-mod" to $GOFLAGS, unless it's already there: "vendor" if the
+// workspace of workFile has been vendored, or "readonly" otherwise, so
+// "go build" fails instead of trying to fetch or record missing modules.
+func goFlags(workFile string) string {
+	flags := strings.Fields(os.Getenv("GOFLAGS"))
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "-mod=") || strings.HasPrefix(flag, "--mod=") {
+			return strings.Join(flags, " ")
+		}
 	}
 
-	cmd := exec.Command(goBin, "build", "-o", out, modName)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("failed to compile bootstrap binary: %v", err)
+	vendored := filepath.Join(filepath.Dir(workFile), "vendor", "modules.txt")
+	if _, err := os.Stat(vendored); err == nil {
+		flags = append(flags, "-mod=vendor")
+	} else {
+		flags = append(flags, "-mod=readonly")
 	}
+	return strings.Join(flags, " ")
 }
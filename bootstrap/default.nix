@@ -5,68 +5,114 @@
   buildGoBinary,
   buildGoLibrary,
   useCaDerivations ? false,
+  toolAttrs ? { },
+  # The system and Go toolchain building the stage 1 builder, which is
+  # cross-compiled for `system` if they differ.
+  bootstrapSystem ? system,
+  bootstrapGo ? go,
+  # Extra platforms to build the stage 1 builder for, as "GOOS_GOARCH". Each is
+  # an output of the same name.
+  builderPlatforms ? [ ],
 }:
 
 let
-  inherit (lib) fileset;
+  inherit (lib) fileset optionalAttrs;
+
+  buildPlatform = (lib.systems.elaborate system).go;
 
 in
 rec {
   stage1 = {
-    builder = derivation {
-      inherit system;
-      name = "builder-stage1";
+    builder = derivation (
+      {
+        system = bootstrapSystem;
+        name = "builder-stage1";
+        outputs = [ "out" ] ++ builderPlatforms;
 
-      __contentAddressed = useCaDerivations;
+        __contentAddressed = useCaDerivations;
 
-      builder = "${go}/bin/go";
-      args = [
-        "run"
-        "${./bootstrap.go}"
-      ];
+        builder = "${bootstrapGo}/bin/go";
+        args = [
+          "run"
+          "${./bootstrap.go}"
+        ];
 
-      GOCACHE = "/tmp/go-cache";
-      GOPATH = "/tmp/go";
-      GOSUMDB = "off";
-      GOWORK =
-        let
-          workspaceDir = fileset.toSource {
-            root = ../.;
-            fileset = fileset.unions [
-              ./cmd
-              ./go.work
-              ./pkg/nix
-              ../builder
-              ../internal/nix/derivation
-            ];
-          };
-        in
-        "${workspaceDir}/bootstrap/go.work";
-
-      inherit go;
-      moduleName = "cmd/builder";
-    };
+        # bootstrap.go sets the rest of Go's environment to stay in the sandbox.
+        GOWORK =
+          let
+            workspaceDir = fileset.toSource {
+              root = ../.;
+              fileset = fileset.unions [
+                ./cmd
+                ./go.work
+                ./pkg/nix
+                # From "go work vendor", if the workspace ever needs modules.
+                (fileset.maybeMissing ./vendor)
+                ../builder
+                ../internal/nix/derivation
+              ];
+            };
+          in
+          "${workspaceDir}/bootstrap/go.work";
+
+        go = bootstrapGo;
+        moduleName = "cmd/builder";
+      }
+      // optionalAttrs (bootstrapSystem != system) {
+        goos = buildPlatform.GOOS;
+        goarch = buildPlatform.GOARCH;
+      }
+    );
   };
 
   stage2 = {
     stdlib = import ../stdlib.nix {
       inherit system lib go;
       inherit (stage1) builder;
-      inherit buildGoLibrary;
+      inherit buildGoLibrary toolAttrs;
     };
 
     derivation = buildGoLibrary {
       packagePath = "nix/derivation";
       srcs = [
         ../internal/nix/derivation/attrs.go
+        ../internal/nix/derivation/build.go
+        ../internal/nix/derivation/closure.go
+        ../internal/nix/derivation/env.go
         ../internal/nix/derivation/path.go
       ];
       imports = with stage2; [
+        stdlib.bufio
+        stdlib.bytes
         stdlib."encoding/json"
+        stdlib.errors
         stdlib.fmt
         stdlib.log
+        stdlib.maps
         stdlib.os
         stdlib."path/filepath"
+        stdlib.reflect
+        stdlib.runtime
+        stdlib.slices
+        stdlib.strconv
+        stdlib.strings
+        stdlib.unicode
+      ];
+
+      noStd = true;
+      builder = "${stage1.builder}/bin/builder";
+    };
+
+    gometa = buildGoLibrary {
+      packagePath = "cmd/builder/gometa";
+      srcs = [
+        ../builder/gometa/gometa.go
+      ];
+      imports = with stage2; [
+        stdlib.fmt
+        stdlib.maps
+        stdlib."path/filepath"
+        stdlib.slices
         stdlib.strings
       ];
 
@@ -80,32 +126,106 @@ rec {
           packagePath = "main";
 
           srcs = [
+            ../builder/archive.go
+            ../builder/attest.go
             ../builder/builder.go
+            ../builder/buildid.go
+            ../builder/cache.go
+            ../builder/cgo.go
+            ../builder/clause.go
+            ../builder/closure.go
             ../builder/compile.go
+            ../builder/constraints.go
             ../builder/context.go
+            ../builder/cover.go
+            ../builder/daemon.go
+            ../builder/darwin.go
+            ../builder/deadcode.go
+            ../builder/diagnostics.go
+            ../builder/doctor.go
+            ../builder/emulator.go
+            ../builder/errors.go
+            ../builder/gccgo.go
+            ../builder/generated.go
+            ../builder/gopackages.go
+            ../builder/graph.go
+            ../builder/layout.go
             ../builder/link.go
+            ../builder/linkname.go
+            ../builder/lock.go
+            ../builder/manifest.go
+            ../builder/matrix.go
+            ../builder/metapkg.go
+            ../builder/module.go
+            ../builder/modfile.go
+            ../builder/modsrc.go
+            ../builder/native.go
+            ../builder/nixexpr.go
+            ../builder/nixlog.go
             ../builder/package.go
+            ../builder/pack.go
+            ../builder/postprocess.go
+            ../builder/profile.go
             ../builder/sdk.go
+            ../builder/shared.go
+            ../builder/source.go
+            ../builder/srcindex.go
+            ../builder/static.go
+            ../builder/stdbuild.go
             ../builder/stdlib.go
+            ../builder/suggest.go
+            ../builder/test.go
+            ../builder/timeout.go
+            ../builder/toolchain.go
+            ../builder/whyrebuild.go
+            ../builder/windows.go
           ];
           imports = with stage2; [
             stage2.derivation
+            stage2.gometa
+            stdlib."archive/zip"
+            stdlib.bufio
+            stdlib.bytes
+            stdlib.cmp
+            stdlib."crypto/ed25519"
+            stdlib."crypto/sha256"
+            stdlib."debug/elf"
+            stdlib."debug/macho"
+            stdlib."debug/pe"
+            stdlib."encoding/base64"
+            stdlib."encoding/binary"
+            stdlib."encoding/hex"
             stdlib."encoding/json"
+            stdlib.errors
             stdlib.fmt
+            stdlib."go/ast"
             stdlib."go/build"
+            stdlib."go/build/constraint"
             stdlib."go/parser"
             stdlib."go/token"
+            stdlib.hash
             stdlib.io
+            stdlib."io/fs"
             stdlib.log
             stdlib.maps
+            stdlib.net
+            stdlib."net/rpc"
+            stdlib."net/rpc/jsonrpc"
             stdlib.os
             stdlib."os/exec"
+            stdlib."os/signal"
+            stdlib.path
             stdlib."path/filepath"
+            stdlib.regexp
             stdlib.runtime
+            stdlib."runtime/debug"
             stdlib.slices
             stdlib.strconv
             stdlib.strings
             stdlib.sync
+            stdlib.syscall
+            stdlib.time
+            stdlib.unicode
           ];
 
           noStd = true;
@@ -118,10 +238,27 @@ rec {
 
         linkFlags = [
           "-X"
-          "'nix/derivation.Name=builder'"
+          "nix/derivation.Name=builder"
+          "-X"
+          "main.Version=${lib.fileContents ../VERSION}"
         ];
 
         builder = "${stage1.builder}/bin/builder";
       };
+
+    # Fails unless the linker stamped the builder with the version in VERSION,
+    # which a malformed "-X" flag silently skips.
+    versionCheck = derivation {
+      inherit system;
+      name = "builder-version-check";
+
+      __contentAddressed = useCaDerivations;
+
+      builder = "${stage2.builder}/bin/builder";
+      args = [
+        "version"
+        (lib.fileContents ../VERSION)
+      ];
+    };
   };
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Magic string at the start of every Unix ar archive.
+	arMagic = "!<arch>\n"
+
+	// Size of an ar file header.
+	arHeaderSize = 60
+)
+
+var (
+	// Rewrite paths from the SDK and check every archive for paths from the
+	// build environment. See [AuditArchive].
+	StrictDeterminism bool
+)
+
+// ArchiveError records when an archive contains something which depends on
+// the build environment, rather than only its inputs.
+type ArchiveError struct {
+	Path   string
+	Member string
+	Reason string
+}
+
+func (e ArchiveError) Error() string {
+	if e.Member == "" {
+		return fmt.Sprintf("archive %s is not deterministic: %s", e.Path, e.Reason)
+	}
+	return fmt.Sprintf(
+		"archive %s is not deterministic: member %s %s",
+		e.Path,
+		e.Member,
+		e.Reason,
+	)
+}
+
+// isCompiledPackage reports whether the file at path is an archive written by
+// the Go compiler, which starts with the package's export data.
+func isCompiledPackage(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(arMagic)+arHeaderSize)
+	if _, err := io.ReadFull(file, header); errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	name := strings.TrimSpace(string(header[len(arMagic) : len(arMagic)+16]))
+
+	return string(header[:len(arMagic)]) == arMagic && name == "__.PKGDEF", nil
+}
+
+// extractArchive writes every member of the ar archive at path to dir, in
+// order, and returns their paths, or nil if path isn't an archive. Symbol
+// tables are left out, and the long names of GNU and BSD archives resolved.
+// Members are named after the archive and their index, since archives may
+// hold several members of the same name.
+func extractArchive(path, dir string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	} else if !bytes.HasPrefix(data, []byte(arMagic)) {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var members []string
+	var longNames []byte
+	for offset := len(arMagic); offset < len(data); {
+		if len(data)-offset < arHeaderSize {
+			return nil, fmt.Errorf("archive %s has a truncated member header", path)
+		}
+		header := string(data[offset : offset+arHeaderSize])
+		var size int
+		if _, err := fmt.Sscan(strings.TrimSpace(header[48:58]), &size); err != nil || size < 0 || offset+arHeaderSize+size > len(data) {
+			return nil, fmt.Errorf("archive %s has a member with an invalid size", path)
+		}
+		body := data[offset+arHeaderSize : offset+arHeaderSize+size]
+		// Members are padded to an even length.
+		offset += arHeaderSize + size + size%2
+
+		name := strings.TrimRight(header[0:16], " ")
+		switch {
+		case name == "/" || name == "/SYM64/" || strings.HasPrefix(name, "__.SYMDEF"):
+			continue
+		case name == "//":
+			longNames = body
+			continue
+		case strings.HasPrefix(name, "#1/"):
+			var length int
+			if _, err := fmt.Sscan(name[3:], &length); err != nil || length > len(body) {
+				return nil, fmt.Errorf("archive %s has a member with an invalid name", path)
+			}
+			name, body = strings.TrimRight(string(body[:length]), "\x00"), body[length:]
+		case strings.HasPrefix(name, "/"):
+			var start int
+			if _, err := fmt.Sscan(name[1:], &start); err != nil || start >= len(longNames) {
+				return nil, fmt.Errorf("archive %s has a member with an invalid name", path)
+			}
+			name, _, _ = strings.Cut(string(longNames[start:]), "/\n")
+		default:
+			name = strings.TrimSuffix(name, "/")
+		}
+
+		member := filepath.Join(dir, fmt.Sprintf("%s_%d_%s", filepath.Base(path), len(members), filepath.Base(name)))
+		if err := os.WriteFile(member, body, 0644); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+// AuditArchive checks that the headers of every member of the archive at path
+// have no timestamps or owners, and that none of the forbidden strings (like
+// the path of the SDK or build directory) appear anywhere in it. The Go tools
+// already produce archives like this, so a failure means a path leaked through
+// "-trimpath" or an object came from somewhere else.
+func AuditArchive(path string, forbidden []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(arMagic)) {
+		return &ArchiveError{path, "", "missing archive header"}
+	}
+
+	for offset := len(arMagic); offset < len(data); {
+		if len(data)-offset < arHeaderSize {
+			return &ArchiveError{path, "", "truncated member header"}
+		}
+		header := string(data[offset : offset+arHeaderSize])
+		name := strings.TrimSpace(header[0:16])
+
+		for _, field := range []struct {
+			name  string
+			value string
+			want  string
+		}{
+			{"timestamp", header[16:28], "0"},
+			{"owner", header[28:34], "0"},
+			{"group", header[34:40], "0"},
+		} {
+			if value := strings.TrimSpace(field.value); value != field.want {
+				return &ArchiveError{
+					path,
+					name,
+					fmt.Sprintf("has %s %s, expected %s", field.name, value, field.want),
+				}
+			}
+		}
+
+		var size int
+		if _, err := fmt.Sscan(strings.TrimSpace(header[48:58]), &size); err != nil {
+			return &ArchiveError{path, name, "has an invalid size"}
+		}
+		// Members are padded to an even length.
+		offset += arHeaderSize + size + size%2
+	}
+
+	for _, s := range forbidden {
+		if s != "" && bytes.Contains(data, []byte(s)) {
+			return &ArchiveError{path, "", fmt.Sprintf("contains the path %s", s)}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	inTotoPayloadType   = "application/vnd.in-toto+json"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	compileBuildType    = "https://github.com/jbellerb/gopkg2nix-incremental/compile/v1"
+)
+
+type AttestAttrs struct {
+	// Compiled packages to attest, keyed by import path.
+	Packages map[string]PackageOutputs `nix:"required"`
+
+	// File holding the secret key signing every statement, as written by "nix
+	// key generate-secret". Statements are left unsigned without one.
+	SigningKeyFile string
+}
+
+// A Subject is an artifact described by a [Statement], with its digests keyed
+// by algorithm.
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// A Statement is an in-toto statement, describing how its subjects were made
+// by its predicate.
+type Statement struct {
+	Type          string     `json:"_type"`
+	Subject       []Subject  `json:"subject"`
+	PredicateType string     `json:"predicateType"`
+	Predicate     Provenance `json:"predicate"`
+}
+
+// Provenance is a SLSA provenance predicate, recording how a package was
+// compiled and the packages it was compiled against.
+type Provenance struct {
+	BuildDefinition struct {
+		BuildType            string         `json:"buildType"`
+		ExternalParameters   map[string]any `json:"externalParameters"`
+		ResolvedDependencies []Subject      `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+	} `json:"runDetails"`
+}
+
+// An Envelope is a DSSE envelope holding a signed statement.
+type Envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     []byte              `json:"payload"`
+	Signatures  []EnvelopeSignature `json:"signatures"`
+}
+
+// An EnvelopeSignature is the signature of an [Envelope] by the key KeyID.
+type EnvelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// A SigningKey is a named ed25519 key, like the keys Nix signs store paths
+// with.
+type SigningKey struct {
+	Name string
+	Key  ed25519.PrivateKey
+}
+
+// LoadSigningKey reads a secret key in the format of "nix key
+// generate-secret", which is its name and base64 encoded key separated by ":".
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	name, encoded, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("%s is not a secret key of the form NAME:KEY", path)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s does not hold an ed25519 secret key", path)
+	}
+
+	return &SigningKey{name, ed25519.PrivateKey(key)}, nil
+}
+
+// preAuthEncoding is the message signed for a DSSE payload, as defined by the
+// DSSE protocol.
+func preAuthEncoding(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+// Sign wraps statement in an envelope, signed by key unless it's nil.
+func (statement *Statement) Sign(key *SigningKey) (*Envelope, error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &Envelope{
+		PayloadType: inTotoPayloadType,
+		Payload:     payload,
+		Signatures:  []EnvelopeSignature{},
+	}
+	if key != nil {
+		sig := ed25519.Sign(key.Key, preAuthEncoding(envelope.PayloadType, payload))
+		envelope.Signatures = append(envelope.Signatures, EnvelopeSignature{key.Name, sig})
+	}
+
+	return envelope, nil
+}
+
+// packageDigests checks the export data and archive of a compiled package
+// against the digests in its metadata and build record, returning them as
+// subjects.
+func packageDigests(importPath string, outputs PackageOutputs, pkg *Package) ([]Subject, error) {
+	record, err := LoadBuildRecord(outputs.Lib, importPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build record: %w", err)
+	}
+
+	name := filepath.Base(importPath)
+	files := []struct {
+		path, digest string
+	}{
+		{filepath.Join(outputs.Export, name+".x"), pkg.ExportSHA256},
+		{filepath.Join(outputs.Lib, name+".a"), record.ArchiveSHA256},
+	}
+
+	var subjects []Subject
+	for _, file := range files {
+		if file.digest == "" {
+			continue
+		}
+		digest, err := fileDigest(file.path)
+		if err != nil {
+			return nil, err
+		}
+		if digest != file.digest {
+			return nil, fmt.Errorf("%s has digest %s, but %s was recorded when it was built", file.path, digest, file.digest)
+		}
+		subjects = append(subjects, Subject{
+			Name:   importPath + filepath.Ext(file.path),
+			Digest: map[string]string{"sha256": digest},
+		})
+	}
+	if len(subjects) == 0 {
+		return nil, fmt.Errorf("package %s has no digests in its metadata, it may be from an older builder", importPath)
+	}
+
+	return subjects, nil
+}
+
+// NewStatement describes how the package importPath was compiled. Imports
+// also attested are listed with the digest of their export data.
+func NewStatement(importPath string, pkg *Package, subjects []Subject, attested map[string]*Package) *Statement {
+	statement := &Statement{
+		Type:          inTotoStatementType,
+		Subject:       subjects,
+		PredicateType: slsaProvenanceType,
+	}
+
+	definition := &statement.Predicate.BuildDefinition
+	definition.BuildType = compileBuildType
+	definition.ExternalParameters = map[string]any{
+		"importPath": importPath,
+		"goos":       pkg.GOOS,
+		"goarch":     pkg.GOARCH,
+	}
+	if len(pkg.BuildTags) > 0 {
+		definition.ExternalParameters["buildTags"] = pkg.BuildTags
+	}
+	if len(pkg.ArchFeatures) > 0 {
+		definition.ExternalParameters["archFeatures"] = pkg.ArchFeatures
+	}
+	if len(pkg.Experiments) > 0 {
+		definition.ExternalParameters["experiments"] = pkg.Experiments
+	}
+	for _, dep := range pkg.Imports {
+		subject := Subject{Name: dep, Digest: map[string]string{}}
+		if attested[dep] != nil && attested[dep].ExportSHA256 != "" {
+			subject.Digest["sha256"] = attested[dep].ExportSHA256
+		}
+		definition.ResolvedDependencies = append(definition.ResolvedDependencies, subject)
+	}
+	statement.Predicate.RunDetails.Builder.ID = "https://github.com/jbellerb/gopkg2nix-incremental/builder@" + Version
+
+	return statement
+}
+
+// attest writes a provenance statement for each compiled package, named after
+// its import path with ".intoto.json" appended, after checking its outputs
+// against their digests.
+func attest() {
+	attrs := derivation.GetAttrs[AttestAttrs]()
+
+	outDir := derivation.MustOutput("out")
+
+	var key *SigningKey
+	if attrs.SigningKeyFile != "" {
+		var err error
+		if key, err = LoadSigningKey(attrs.SigningKeyFile); err != nil {
+			Fatal(&AttrError{"signingKeyFile", err})
+		}
+	}
+
+	pkgs := make(map[string]*Package, len(attrs.Packages))
+	for importPath, outputs := range attrs.Packages {
+		pkg, err := LoadMetadata[Package](outputs.Export, importPath)
+		if err != nil {
+			Fatalf("failed to load %s: %v", importPath, err)
+		}
+		pkgs[importPath] = &pkg
+	}
+
+	for _, importPath := range SortedKeys(attrs.Packages) {
+		subjects, err := packageDigests(importPath, attrs.Packages[importPath], pkgs[importPath])
+		if err != nil {
+			Fatalf("failed to attest %s: %v", importPath, err)
+		}
+		envelope, err := NewStatement(importPath, pkgs[importPath], subjects, pkgs).Sign(key)
+		if err != nil {
+			Fatalf("failed to sign statement for %s: %v", importPath, err)
+		}
+
+		path := filepath.Join(outDir, filepath.FromSlash(importPath)+".intoto.json")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			Fatal(err)
+		}
+		err = WriteGenerated(path, func(w io.Writer) error {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(envelope)
+		})
+		if err != nil {
+			Fatalf("failed to write statement for %s: %v", importPath, err)
+		}
+	}
+	if key == nil {
+		log.Print("warning: no signingKeyFile was given, so statements are unsigned")
+	}
+}
@@ -5,66 +5,508 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"nix/derivation"
 	"os"
+	"slices"
+	"strings"
+	"time"
 )
 
 const (
 	usage = `
-Usage: builder [command]
+Usage: builder [--attrs-file FILE] [--dry-run] [command]
 
 Commands:
+  attest
   compile
+  daemon SOCKET
+  doctor
+  gopackages-driver
+  graph
   link
-  stdlib`
+  lock
+  matrix compile|link
+  metapkg
+  module
+  module-src
+  shlib
+  stdlib
+  test
+  test-build
+  test-run
+  typecheck
+  version [EXPECTED]
+  why-rebuild OLD.build.json NEW.build.json`
+)
+
+var (
+	// The version of the builder. Set by the linker when bootstrapping.
+	Version = "devel"
+
+	// Features supported by this version of the builder which derivations may
+	// require with "requiredFeatures".
+	Features = []string{
+		"actionCache",
+		"actionManifests",
+		"allowMissingStd",
+		"archFeatures",
+		"attest",
+		"attrFiles",
+		"auditDeterminism",
+		"cgoGenerated",
+		"codesign",
+		"constraintReport",
+		"coverMode",
+		"deadcodeReport",
+		"defaultGodebug",
+		"diagnosticFilters",
+		"dynLink",
+		"emulator",
+		"extraObjects",
+		"goExperiment",
+		"goMod",
+		"gopackagesDriver",
+		"instrument",
+		"mainPath",
+		"matrix",
+		"metaConflicts",
+		"metaPackages",
+		"module",
+		"moduleSrc",
+		"outputLayout",
+		"packMetadata",
+		"postProcess",
+		"profileTools",
+		"releaseTags",
+		"requiredFeatures",
+		"sdks",
+		"shlib",
+		"static",
+		"std",
+		"stdlibBuild",
+		"strictAttrs",
+		"strictDeterminism",
+		"strictImports",
+		"strictLinknames",
+		"testBuild",
+		"toolTags",
+		"toolTimeout",
+		"toolchain",
+		"toolexecWrapper",
+		"typecheck",
+		"windowsResources",
+	}
 )
 
 type Attrs struct {
 	SDK             string
 	GoCompatVersion string
+
+	// SDKs to choose from instead of SDK, keyed by the version of Go they
+	// contain. See [SelectSDK] for how one is chosen, using SDKVersion if set.
+	SDKs       map[string]string
+	SDKVersion string
+
+	// go.mod of the module being built. The build fails early if the SDK is
+	// older than its go directive requires.
+	GoMod string
+
+	// Tags satisfied by the build, replacing the release tags implied by
+	// GoCompatVersion (like "go1.21"), or added to the tool tags.
+	ReleaseTags []string
+	ToolTags    []string
+
+	// Micro-architecture feature levels. Each is passed to the tools as the
+	// environment variable of the same name, uppercased.
+	Go386     string
+	GoAmd64   string
+	GoArm     string
+	GoArm64   string
+	GoMips    string
+	GoMips64  string
+	GoPpc64   string
+	GoRiscv64 string
+
+	// Toolchain experiments to enable, as in GOEXPERIMENT.
+	GoExperiment []string
+
+	// Instrumentation to build with: "race", "msan", or "asan".
+	Instrument string
+
+	// Compile every package with "-dynlink", to link them into shared
+	// libraries with "shlib", or binaries against those libraries.
+	DynLink bool
+
+	// Toolchain compiling and linking packages instead of the SDK's own, like
+	// "gccgo". See [Toolchain].
+	Toolchain string
+
+	// Check that every generated file is byte-for-byte reproducible, by
+	// generating it twice in the same build. See [WriteGenerated].
+	AuditDeterminism bool
+
+	// Keep paths of the SDK out of compiled packages, and check their archives
+	// for anything else depending on the build environment.
+	StrictDeterminism bool
+
+	// Directory for generated files, relative to $NIX_BUILD_TOP, and whether
+	// to keep it after a successful build.
+	BuildDir     string
+	KeepBuildDir bool
+
+	// Rules for classifying lines of tool output. See [DiagnosticFilters].
+	DiagnosticFilters []DiagnosticFilterAttrs
+	WarningsAsErrors  bool
+
+	// Directory to show sources under in diagnostics, instead of the store.
+	DiagnosticPathPrefix string
+
+	// Highlight diagnostics with ANSI colors. See [DiagnosticWriter].
+	DiagnosticColor bool
+
+	// Command to run every tool through, as with "go build -toolexec". This
+	// should be an absolute path, followed by any arguments.
+	ToolexecWrapper string
+
+	// Environment variables for every tool, like GOCOMPILEDEBUG, set over the
+	// baseline environment. See [GoSDK.Env].
+	ToolEnv map[string]string
+
+	// Features the builder must support to correctly build the derivation, and
+	// the version of the Nix library which requested them.
+	RequiredFeatures []string
+	LibraryVersion   string
+
+	// Command prefix running binaries built for another platform during the
+	// build, like test binaries and post-link hooks. This should be an absolute
+	// path to an emulator such as qemu-user, followed by any arguments.
+	Emulator []string
+
+	// Longest a single tool may run before it's killed, as a duration like
+	// "10m". Unlimited if unset.
+	ToolTimeout string
+
+	// Fail on any attribute which isn't read by the builder, catching
+	// misspelled attribute names.
+	StrictAttrs bool
+
+	// Record the exact invocation of every compile, asm, and link in the
+	// "manifests" output.
+	ActionManifests bool
+
+	// Write CPU and memory profiles of compile and link, and the time and
+	// memory used by every tool, to the "profiles" output.
+	ProfileTools bool
+}
+
+// commandAttrs are the attributes read by each subcommand, in addition to
+// Attrs. Nested subcommands like "stdlib build" also read the attributes of
+// their parent.
+var commandAttrs = map[string]any{
+	"attest":  AttestAttrs{},
+	"compile": CompileAttrs{},
+	"graph":   GraphAttrs{},
+	"link":    LinkAttrs{},
+	"lock":    LockAttrs{},
+	"metapkg": MetaPackageAttrs{},
+	"module": struct {
+		CompileAttrs
+		ModuleAttrs
+	}{},
+	"module-src":   ModuleSrcAttrs{},
+	"shlib":        ShlibAttrs{},
+	"stdlib":       PackageStdlibAttrs{},
+	"stdlib build": BuildStdlibAttrs{},
+	"test":         TestAttrs{},
+	"test-build":   TestAttrs{},
+	"test-run":     TestRunAttrs{},
+	"typecheck":    CompileAttrs{},
 }
 
-// OutputPath looks up a derivation output and creates an empty directory there.
-func OutputPath(output string) (string, error) {
-	dir := derivation.Outputs[output]
-	if dir == "" {
-		return "", fmt.Errorf(
-			"derivation was expected to produce an output \"%s\"",
-			output,
-		)
+// checkFeatures fails if the builder is missing any of the required features.
+// This happens when the Nix library and builder are upgraded out of sync.
+func checkFeatures(required []string, libraryVersion string) {
+	for _, feature := range required {
+		if slices.Contains(Features, feature) {
+			continue
+		}
+		if libraryVersion != "" {
+			fatal(CategoryAttr, fmt.Sprintf(
+				"builder %s does not support feature %s, need version %s",
+				Version,
+				feature,
+				libraryVersion,
+			), nil)
+		}
+		fatal(CategoryAttr, fmt.Sprintf("builder %s does not support feature %s", Version, feature), nil)
 	}
-	if err := os.Mkdir(dir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create output directory: %w", err)
+}
+
+// SelectSDK returns the path of the SDK to build with, either SDK or one of
+// SDKs chosen by [SelectSDK]. modFile is the go.mod of the module being built,
+// if known.
+func (a *Attrs) SelectSDK(modFile *ModFile) (string, error) {
+	if a.SDKs == nil {
+		return a.SDK, nil
+	} else if a.SDK != "" {
+		return "", &AttrError{"sdks", errors.New("cannot be set along with sdk")}
 	}
 
-	return dir, nil
+	return SelectSDK(a.SDKs, a.SDKVersion, modFile)
+}
+
+// ArchFeatures collects the feature levels which were set into a map keyed by
+// environment variable.
+func (a *Attrs) ArchFeatures() map[string]string {
+	features := make(map[string]string)
+	for name, value := range map[string]string{
+		"GO386":     a.Go386,
+		"GOAMD64":   a.GoAmd64,
+		"GOARM":     a.GoArm,
+		"GOARM64":   a.GoArm64,
+		"GOMIPS":    a.GoMips,
+		"GOMIPS64":  a.GoMips64,
+		"GOPPC64":   a.GoPpc64,
+		"GORISCV64": a.GoRiscv64,
+	} {
+		if value != "" {
+			features[name] = value
+		}
+	}
+
+	return features
 }
 
 func main() {
+	defer recoverInternal()
+	derivation.Fatal = fatalAttrs
+	os.Args, DryRun = dryRunArg(os.Args)
+	if len(os.Args) > 1 {
+		Command = os.Args[1]
+	}
+
+	// The daemon reads the attributes of each job instead, matrix runs a job
+	// for every platform, why-rebuild and version only read their arguments,
+	// and doctor diagnoses the attributes and SDK, so it can't rely on either
+	// loading.
+	switch Command {
+	case "daemon":
+		daemon()
+	case "doctor":
+		doctor()
+	case "matrix":
+		matrix()
+	case "why-rebuild":
+		whyRebuild(os.Args[2:])
+	case "version":
+		version(os.Args[2:])
+	default:
+		run()
+	}
+}
+
+// version prints the version of the builder. Given the version it should be,
+// like the bootstrap checking the linker stamped it, it fails if they differ.
+// When run as a derivation, the version is also written to "out".
+func version(args []string) {
+	if len(args) > 1 {
+		fatal(CategoryAttr, fmt.Sprintf("version takes at most the expected version\n%s", usage), nil)
+	}
+	fmt.Println(Version)
+	if len(args) == 1 && args[0] != Version {
+		fatal(CategoryAttr, fmt.Sprintf("builder is version %s, expected %s", Version, args[0]), nil)
+	}
+
+	if out := derivation.Outputs["out"]; out != "" {
+		if err := os.WriteFile(out, []byte(Version+"\n"), 0644); err != nil {
+			Fatalf("failed to write version: %v", err)
+		}
+	}
+}
+
+// dryRunArg finds a "--dry-run" argument before the command in args,
+// returning whether it was given and the rest of the arguments.
+func dryRunArg(args []string) ([]string, bool) {
+	for i := 1; i < len(args) && strings.HasPrefix(args[i], "--"); i++ {
+		if args[i] == "--dry-run" {
+			return slices.Delete(slices.Clone(args), i, i+1), true
+		}
+	}
+
+	return args, false
+}
+
+// run runs the subcommand in os.Args with the loaded derivation attributes.
+func run() {
 	attrs := derivation.GetAttrs[Attrs]()
+	checkFeatures(attrs.RequiredFeatures, attrs.LibraryVersion)
+	AuditDeterminism = attrs.AuditDeterminism
+	StrictDeterminism = attrs.StrictDeterminism
+	WarningsAsErrors = attrs.WarningsAsErrors
+	DiagnosticPathPrefix = attrs.DiagnosticPathPrefix
+	DiagnosticColor = attrs.DiagnosticColor
+	if attrs.BuildDir != "" {
+		if err := derivation.CheckBuildDirPath(attrs.BuildDir); err != nil {
+			Fatal(&AttrError{"buildDir", err})
+		}
+		derivation.BuildDirPath = attrs.BuildDir
+	}
+	if err := SetDiagnosticFilters(attrs.DiagnosticFilters); err != nil {
+		Fatal(&AttrError{"diagnosticFilters", err})
+	}
+	Emulator = attrs.Emulator
+	// Tools found by name, like the emulator, are looked up the same way as
+	// by the tools the builder runs. See [NativeEnv].
+	if derivation.Path() != "" {
+		if err := derivation.SetPath(); err != nil {
+			Fatalf("failed to set $PATH: %v", err)
+		}
+	}
+	ActionManifests = attrs.ActionManifests
+	// Tools don't run in a dry run, so there's nothing to profile.
+	ProfileTools = attrs.ProfileTools && !DryRun
+	if attrs.ToolTimeout != "" {
+		timeout, err := time.ParseDuration(attrs.ToolTimeout)
+		if err != nil {
+			Fatal(&AttrError{"toolTimeout", err})
+		}
+		ToolTimeout = timeout
+	}
 
 	if len(os.Args) < 2 {
-		log.Fatalf("no subcommand provided\n%s", usage)
+		fatal(CategoryAttr, fmt.Sprintf("no subcommand provided\n%s", usage), nil)
+	}
+	command := os.Args[1]
+	if DryRun && command != "compile" && command != "link" {
+		fatal(CategoryAttr, fmt.Sprintf("--dry-run only plans compile or link, not \"%s\"", command), nil)
+	}
+
+	if attrs.StrictAttrs {
+		schemas := []any{attrs}
+		if schema, ok := commandAttrs[command]; ok {
+			schemas = append(schemas, schema)
+		}
+		if len(os.Args) > 2 {
+			if schema, ok := commandAttrs[command+" "+os.Args[2]]; ok {
+				schemas = append(schemas, schema)
+			}
+		}
+		if err := derivation.CheckUnknownAttrs(schemas...); err != nil {
+			fatalAttrs(err)
+		}
 	}
 
-	sdk, err := LoadSDK(attrs.SDK, attrs.GoCompatVersion)
+	var modFile *ModFile
+	if attrs.GoMod != "" {
+		loaded, err := LoadModFile(attrs.GoMod)
+		if err != nil {
+			Fatalf("failed to read go.mod: %v", err)
+		}
+		modFile = loaded
+	}
+	sdkPath, err := attrs.SelectSDK(modFile)
 	if err != nil {
-		log.Fatalf(`failed to load sdk: %v
+		Fatal(err)
+	}
+	sdk, err := CachedSDK(sdkPath, attrs.GoCompatVersion)
+	if err != nil {
+		fatal(CategoryAttr, fmt.Sprintf(`failed to load sdk: %v
 
-  Was "sdk" set in your derivation attributes?`, err)
+  Was "sdk" set in your derivation attributes?`, err), err)
+	}
+	if modFile != nil {
+		if err := modFile.CheckGoVersion(sdk.Version); err != nil {
+			Fatal(err)
+		}
+	}
+	if attrs.ReleaseTags != nil {
+		Context.ReleaseTags = attrs.ReleaseTags
+	} else if Context.ReleaseTags, err = sdk.ReleaseTags(); err != nil {
+		Fatal(err)
+	}
+	Context.ToolTags = append(Context.ToolTags, attrs.ToolTags...)
+	sdk.ArchFeatures = attrs.ArchFeatures()
+	sdk.Toolexec = strings.Fields(attrs.ToolexecWrapper)
+	sdk.Experiments = slices.Compact(slices.Sorted(slices.Values(attrs.GoExperiment)))
+	for name := range attrs.ToolEnv {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			Fatal(&AttrError{"toolEnv", fmt.Errorf("invalid variable name \"%s\"", name)})
+		}
 	}
+	sdk.ToolEnv = attrs.ToolEnv
+	Context.ToolTags = experimentToolTags(Context.ToolTags, attrs.GoExperiment)
+	switch attrs.Instrument {
+	case "":
+	case "race", "msan", "asan":
+		sdk.Instrument = attrs.Instrument
+		// The go command selects instrumented files with a build tag of the
+		// same name.
+		Context.BuildTags = append(Context.BuildTags, attrs.Instrument)
+	default:
+		Fatal(&AttrError{"instrument", fmt.Errorf("unknown instrumentation \"%s\", expected race, msan, or asan", attrs.Instrument)})
+	}
+	sdk.DynLink = attrs.DynLink
+	if attrs.Toolchain != "" {
+		if err := SelectToolchain(sdk, attrs.Toolchain); err != nil {
+			Fatal(&AttrError{"toolchain", err})
+		}
+	}
+	NixMessage(NixLevelTalkative, "tool environment: "+strings.Join(sdk.Env(), " "))
 
-	command := os.Args[1]
 	switch command {
+	case "attest":
+		attest()
 	case "compile":
 		compile(sdk)
+	case "gopackages-driver":
+		gopackagesDriver(sdk, &attrs)
+	case "graph":
+		graph()
 	case "link":
 		link(sdk)
+	case "lock":
+		lock()
+	case "metapkg":
+		metapkg()
+	case "module":
+		module()
+	case "module-src":
+		moduleSrc()
+	case "shlib":
+		shlib(sdk)
 	case "stdlib":
 		stdlib(sdk)
+	case "test":
+		test()
+	case "test-build":
+		testBuild()
+	case "test-run":
+		testRun()
+	case "typecheck":
+		typecheck(sdk)
 	default:
-		log.Fatalf("unknown command \"%s\"\n%s", command, usage)
+		fatal(CategoryAttr, fmt.Sprintf("unknown command \"%s\"\n%s", command, usage), nil)
+	}
+
+	if DryRun {
+		if err := SaveDryRunPlan(dryRunOutput()); err != nil {
+			Fatalf("failed to write dry run plan: %v", err)
+		}
+	} else if ActionManifests {
+		if err := SaveActionManifests(derivation.MustOutput("manifests")); err != nil {
+			Fatalf("failed to write action manifests: %v", err)
+		}
+	}
+	if ProfileTools {
+		if err := SaveToolProfiles(profilesOutput()); err != nil {
+			Fatalf("failed to write tool profiles: %v", err)
+		}
+	}
+
+	// Failures exit early, leaving the build directory behind.
+	if !attrs.KeepBuildDir {
+		derivation.CleanBuildDir()
 	}
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Bytes of a hash kept in each part of a build ID, as in cmd/go.
+	buildIDHashSize = 15
+
+	// Bytes at the start of an archive searched for its build ID. The go
+	// command reads the same amount.
+	buildIDReadSize = 32 * 1024
+)
+
+// buildIDPart hashes s into one part of a build ID, encoded like cmd/go
+// encodes its action and content IDs.
+func buildIDPart(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:buildIDHashSize])
+}
+
+// packageBuildID is the build ID the compiler is given for a package, in the
+// form "actionID/contentID". Like cmd/go, the content ID starts out as the
+// action ID, and is replaced by [UpdateBuildID] once the package has been
+// compiled.
+func packageBuildID(actionID string) string {
+	part := buildIDPart(actionID)
+	return part + "/" + part
+}
+
+// binaryBuildID is the build ID the linker is given for a binary, in the form
+// "actionID(binary)/actionID(main.a)/contentID(main.a)/contentID(binary)",
+// from the build ID of the main package.
+func binaryBuildID(actionID, mainID string) (string, error) {
+	parts := strings.Split(mainID, "/")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("main package has build ID %q, not an action and content ID", mainID)
+	}
+
+	part := buildIDPart(actionID)
+	return strings.Join([]string{part, parts[0], parts[1], part}, "/"), nil
+}
+
+// hasBuildIDFlag reports whether args, given to the compiler or linker, set a
+// build ID of their own, which is then kept as it is.
+func hasBuildIDFlag(args []string) bool {
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && name == "buildid" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReadBuildID returns the build ID of a package archive, which the compiler
+// writes in the header of its first member. Unlike "go tool buildid", this
+// also reads the archives written with "-linkobj", which start with the object
+// rather than export data.
+func ReadBuildID(archive string) (string, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, buildIDReadSize))
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(data, []byte(arMagic)) {
+		return "", fmt.Errorf("%s is not a package archive", archive)
+	}
+
+	_, line, ok := bytes.Cut(data, []byte("\nbuild id "))
+	if ok {
+		line, _, ok = bytes.Cut(line, []byte("\n"))
+	}
+	if !ok {
+		return "", fmt.Errorf("%s has no build ID", archive)
+	}
+	id, err := strconv.Unquote(string(line))
+	if err != nil {
+		return "", fmt.Errorf("%s has a malformed build ID: %w", archive, err)
+	}
+
+	return id, nil
+}
+
+// UpdateBuildID replaces the content ID of file, the last part of its build
+// ID id, with the hash of its contents, as cmd/go does after every build. Like
+// cmd/go, every copy of id is zeroed for the hash, so the new ID doesn't
+// depend on the old one.
+func UpdateBuildID(file, id string) error {
+	// A dry run never ran the tool writing file.
+	if DryRun {
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	var matches []int
+	for start := 0; ; {
+		i := bytes.Index(data[start:], []byte(id))
+		if i < 0 {
+			h.Write(data[start:])
+			break
+		}
+		matches = append(matches, start+i)
+		h.Write(data[start : start+i])
+		h.Write(make([]byte, len(id)))
+		start += i + len(id)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("%s does not contain its build ID %s", file, id)
+	}
+
+	contentID := base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:buildIDHashSize])
+	newID := id[:strings.LastIndex(id, "/")+1] + contentID
+	if len(newID) != len(id) {
+		return fmt.Errorf("build ID %s of %s has a content ID of the wrong length", id, file)
+	}
+	for _, i := range matches {
+		copy(data[i:], newID)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, info.Mode())
+}
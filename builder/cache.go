@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"log"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// An ActionCache is a directory of compiled packages, keyed by a hash of
+// everything that went into compiling them. The Nix store already caches
+// builds of identical derivations, but any change to a derivation (like the
+// store path of its sources) rebuilds it. Outside of the sandbox, such as when
+// iterating locally, the cache lets unchanged packages skip the compiler.
+//
+// The cache must be writable from the build, so it only works with the
+// sandbox disabled or the directory in "extra-sandbox-paths".
+type ActionCache struct {
+	Dir string
+
+	Hits   int
+	Misses int
+}
+
+// ActionID hashes the inputs of the compilation. Two compilations with the
+// same ID produce the same outputs.
+func (c *Compilation) ActionID(extraArgs []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "builder %s\n", Version)
+	// Imports are store paths, which change whenever anything they were built
+	// from does.
+	if err := c.hashAction(h, extraArgs, c.Imports); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashAction adds everything the compilation depends on to h, identifying each
+// import by its entry in imports.
+func (c *Compilation) hashAction(h hash.Hash, extraArgs []string, imports map[string]string) error {
+	fmt.Fprintf(h, "sdk %s %s\n", c.SDK.Path, c.SDK.Version)
+	fmt.Fprintf(h, "package %s %s\n", c.ImportPath, c.SDK.CompatVersion)
+	// The path of a main package decides which internal packages it may
+	// import.
+	fmt.Fprintf(h, "mainpath %s\n", c.MainPath)
+	for _, env := range c.SDK.PackageEnv(c.ImportPath) {
+		if name, _, _ := strings.Cut(env, "="); slices.Contains(buildDirEnv, name) {
+			continue
+		}
+		fmt.Fprintf(h, "env %s\n", env)
+	}
+	fmt.Fprintf(h, "instrument %s\n", c.SDK.Instrument)
+	fmt.Fprintf(h, "dynlink %t\n", c.SDK.DynLink)
+	fmt.Fprintf(h, "compiler %s\n", c.SDK.Compiler().Name())
+	fmt.Fprintf(h, "cover %s\n", c.CoverMode)
+	fmt.Fprintf(h, "allowmissingstd %q\n", c.AllowMissingStd)
+	// Tags select which sources are compiled.
+	fmt.Fprintf(h, "buildtags %q\n", Context.BuildTags)
+	fmt.Fprintf(h, "tooltags %q\n", Context.ToolTags)
+	fmt.Fprintf(h, "releasetags %q\n", Context.ReleaseTags)
+	fmt.Fprintf(h, "strict %t\n", StrictDeterminism)
+	fmt.Fprintf(h, "std %t\n", c.Std)
+	for _, arg := range extraArgs {
+		fmt.Fprintf(h, "flag %q\n", arg)
+	}
+	for _, arg := range c.AsmFlags {
+		fmt.Fprintf(h, "asmflag %q\n", arg)
+	}
+
+	fmt.Fprintf(h, "filter %t %q\n", c.Filter.ExcludeTests, c.Filter.OnlyPlatforms)
+	for _, src := range c.Srcs {
+		if c.Filter.Explain(src) != "" {
+			continue
+		}
+		if err := hashFile(h, "src", src); err != nil {
+			return err
+		}
+	}
+	for _, importPath := range SortedKeys(imports) {
+		fmt.Fprintf(h, "import %s %s\n", importPath, imports[importPath])
+	}
+	if c.CgoGenerated != "" {
+		generated, objs, err := readCgoGenerated(c.CgoGenerated)
+		if err != nil {
+			return err
+		}
+		for _, file := range slices.Concat(generated, objs) {
+			if err := hashFile(h, "cgo", file); err != nil {
+				return err
+			}
+		}
+		// pkg-config finds the linker flags of packages in buildInputs.
+		fmt.Fprintf(h, "buildinputs %q\n", derivation.BuildInputs)
+	}
+	// The order of extra objects is kept in the archive.
+	for _, obj := range c.ExtraObjects {
+		if err := hashFile(h, "extraobj", obj); err != nil {
+			return err
+		}
+	}
+	for _, importPath := range SortedKeys(c.ImportMap) {
+		fmt.Fprintf(h, "importmap %s %s\n", importPath, c.ImportMap[importPath])
+	}
+	for _, metaPackage := range MetaPackages {
+		fmt.Fprintf(h, "meta %s\n", metaPackage)
+	}
+	if c.EmbedCfg != nil {
+		for _, pattern := range SortedKeys(c.EmbedCfg.Patterns) {
+			fmt.Fprintf(h, "embed %q %q\n", pattern, c.EmbedCfg.Patterns[pattern])
+		}
+		for _, name := range SortedKeys(c.EmbedCfg.Files) {
+			if err := hashFile(h, "embedfile "+name, c.EmbedCfg.Files[name]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// hashFile adds the name and contents of a file to h.
+func hashFile(h hash.Hash, kind, path string) error {
+	sum, err := IndexSource(path).Hash()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(h, "%s %s %x\n", kind, filepath.Base(path), sum)
+	return nil
+}
+
+// entry returns the directory of the action id.
+func (a *ActionCache) entry(id string) string {
+	return filepath.Join(a.Dir, id[:2], id)
+}
+
+// Get copies the outputs of the action id from the cache to the paths in
+// files, keyed by their names in the cache. It reports whether the action was
+// found. Files which weren't stored with the action are skipped.
+func (a *ActionCache) Get(id string, files map[string]string) (bool, error) {
+	entry := a.entry(id)
+	if _, err := os.Stat(entry); errors.Is(err, fs.ErrNotExist) {
+		a.Misses++
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, name := range SortedKeys(files) {
+		err := copyFile(filepath.Join(entry, name), files[name])
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, fmt.Errorf("failed to read %s from action cache: %w", name, err)
+		}
+	}
+
+	a.Hits++
+	return true, nil
+}
+
+// Put stores the files of the action id in the cache, keyed by name. Files
+// which don't exist are left out. Entries are written to a temporary directory
+// first, so concurrent builds never see a partial entry.
+func (a *ActionCache) Put(id string, files map[string]string) error {
+	entry := a.entry(id)
+	if err := os.MkdirAll(filepath.Dir(entry), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(entry), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, name := range SortedKeys(files) {
+		err := copyFile(files[name], filepath.Join(tmp, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to write %s to action cache: %w", name, err)
+		}
+	}
+
+	// Another build may have stored the same action first, which is fine.
+	if err := os.Rename(tmp, entry); err != nil {
+		if _, statErr := os.Stat(entry); statErr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogStats prints how many actions were found in the cache.
+func (a *ActionCache) LogStats() {
+	log.Printf(
+		"action cache %s: %d hits, %d misses",
+		a.Dir,
+		a.Hits,
+		a.Misses,
+	)
+}
+
+// cacheFiles lists the outputs of the package importPath stored in the action
+// cache.
+func cacheFiles(libDir, exportDir, importPath string) map[string]string {
+	name := filepath.Base(importPath)
+	return map[string]string{
+		"lib.a":          filepath.Join(libDir, name+".a"),
+		"export.x":       filepath.Join(exportDir, name+".x"),
+		"metadata.json":  filepath.Join(exportDir, name+".json"),
+		"build.json":     filepath.Join(libDir, name+".build.json"),
+		"overrides.json": filepath.Join(libDir, name+".overrides.json"),
+		"unused.json":    filepath.Join(libDir, name+".unused.json"),
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"nix/derivation"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The builder doesn't run cgo yet, so files importing "C" are still excluded
+// by the "cgo" build tag, unless cgo was run ahead of time by another
+// derivation and its outputs are given as CgoGenerated. These helpers collect
+// the C toolchain flags a cgo package asks for, in the same way as the go
+// command. Whatever ran cgo already compiled the C sources, so only the linker
+// flags are still needed, which are passed on through the package's archive.
+// See [writeCgoLinkFlags].
+
+// CgoFlags are the flags passed to the C toolchain for a cgo package.
+type CgoFlags struct {
+	CPPFLAGS []string
+	CFLAGS   []string
+	CXXFLAGS []string
+	FFLAGS   []string
+	LDFLAGS  []string
+
+	// Packages from "#cgo pkg-config:" directives, resolved by [PkgConfig].
+	PkgConfig []string
+}
+
+// add appends the arguments of a "#cgo" directive to the flags.
+func (f *CgoFlags) add(verb string, args []string) error {
+	switch verb {
+	case "CPPFLAGS":
+		f.CPPFLAGS = append(f.CPPFLAGS, args...)
+	case "CFLAGS":
+		f.CFLAGS = append(f.CFLAGS, args...)
+	case "CXXFLAGS":
+		f.CXXFLAGS = append(f.CXXFLAGS, args...)
+	case "FFLAGS":
+		f.FFLAGS = append(f.FFLAGS, args...)
+	case "LDFLAGS":
+		f.LDFLAGS = append(f.LDFLAGS, args...)
+	case "pkg-config":
+		for _, pkg := range args {
+			if strings.HasPrefix(pkg, "-") {
+				return fmt.Errorf("invalid pkg-config package name: %s", pkg)
+			}
+		}
+		f.PkgConfig = append(f.PkgConfig, args...)
+	default:
+		return fmt.Errorf("unknown #cgo verb %s", verb)
+	}
+
+	return nil
+}
+
+// matchCgoConstraint reports whether the options of a "#cgo" directive select
+// the current build. Options are separated by spaces and any of them may
+// match. Each is a comma separated list of tags, which must all match.
+func matchCgoConstraint(options []string) bool {
+	if len(options) == 0 {
+		return true
+	}
+
+	for _, option := range options {
+		match := true
+		for _, term := range strings.Split(option, ",") {
+			if negated, ok := strings.CutPrefix(term, "!"); ok {
+				match = match && !matchTag(negated)
+			} else {
+				match = match && matchTag(term)
+			}
+		}
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitQuoted splits s into fields separated by spaces, where a field may be
+// quoted with ' or " and a backslash escapes the next character.
+func splitQuoted(s string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+	escaped, inField := false, false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+			field.WriteRune(r)
+		case r == '\\':
+			escaped, inField = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				field.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inField = r, true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed quote")
+	} else if escaped {
+		return nil, fmt.Errorf("unfinished escaping")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields, nil
+}
+
+// cgoPreamble returns the comment above the `import "C"` of a parsed file, or
+// nil if it doesn't use cgo.
+func cgoPreamble(header *ast.File) *ast.CommentGroup {
+	for _, decl := range header.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ImportSpec)
+			if spec.Path.Value != `"C"` {
+				continue
+			}
+			if spec.Doc == nil && !gen.Lparen.IsValid() {
+				return gen.Doc
+			}
+			return spec.Doc
+		}
+	}
+
+	return nil
+}
+
+// ReadCgoFlags collects the flags from the "#cgo" directives of every Go
+// source importing "C". Directives for other platforms are skipped.
+func ReadCgoFlags(srcs []string) (*CgoFlags, error) {
+	flags := &CgoFlags{}
+	for _, src := range srcs {
+		if filepath.Ext(src) != ".go" {
+			continue
+		}
+		header, err := IndexSource(src).Header()
+		if err != nil {
+			return nil, err
+		}
+		preamble := cgoPreamble(header)
+		if preamble == nil {
+			continue
+		}
+
+		for i, line := range strings.Split(preamble.Text(), "\n") {
+			line = strings.TrimSpace(line)
+			rest, ok := strings.CutPrefix(line, "#cgo")
+			if !ok || rest == "" || (rest[0] != ' ' && rest[0] != '\t') {
+				continue
+			}
+
+			directive, argList, ok := strings.Cut(rest, ":")
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid #cgo line: %s", src, line)
+			}
+			fields := strings.Fields(directive)
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("%s: invalid #cgo line: %s", src, line)
+			}
+			if !matchCgoConstraint(fields[:len(fields)-1]) {
+				continue
+			}
+
+			args, err := splitQuoted(argList)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid #cgo line %d: %w", src, i+1, err)
+			}
+			if err := flags.add(fields[len(fields)-1], args); err != nil {
+				return nil, fmt.Errorf("%s: %w", src, err)
+			}
+		}
+	}
+
+	return flags, nil
+}
+
+// pkgConfigPath returns the search path for pkg-config, from the pkgconfig
+// directories of buildInputs.
+func pkgConfigPath() string {
+	var dirs []string
+	for _, dep := range derivation.BuildInputs {
+		dirs = append(
+			dirs,
+			filepath.Join(dep, "lib", "pkgconfig"),
+			filepath.Join(dep, "share", "pkgconfig"),
+		)
+	}
+
+	return strings.Join(dirs, ":")
+}
+
+// PkgConfig resolves the pkg-config packages of flags, using pkg-config from
+// nativeBuildInputs, and merges the results into the preprocessor and linker
+// flags.
+func PkgConfig(flags *CgoFlags) error {
+	if len(flags.PkgConfig) == 0 {
+		return nil
+	}
+
+	tool, err := FindNativeTool("pkg-config")
+	if err != nil {
+		return err
+	}
+
+	query := func(mode string) ([]string, error) {
+		var out bytes.Buffer
+		cmd := exec.Command(tool, append([]string{mode, "--"}, flags.PkgConfig...)...)
+		cmd.Env = append(NativeEnv(), "PKG_CONFIG_PATH="+pkgConfigPath())
+		cmd.Stdout = &out
+		if err := RunLogged(cmd); err != nil {
+			return nil, fmt.Errorf("pkg-config %s failed: %w", mode, err)
+		}
+
+		return splitQuoted(out.String())
+	}
+
+	cflags, err := query("--cflags")
+	if err != nil {
+		return err
+	}
+	ldflags, err := query("--libs")
+	if err != nil {
+		return err
+	}
+
+	// Like the go command, pkg-config's cflags go to the preprocessor.
+	flags.CPPFLAGS = append(flags.CPPFLAGS, cflags...)
+	flags.LDFLAGS = append(flags.LDFLAGS, ldflags...)
+	return nil
+}
+
+// writeCgoLinkFlags writes the linker flags asked for by the "#cgo" directives
+// of goSrcs, including those of their pkg-config packages, to a source of the
+// package pkgName as "//go:cgo_ldflag" directives. Like those cgo generates,
+// the compiler records them in the archive, and the linker passes them on to
+// the external linker. Returns an empty path if there are none.
+func writeCgoLinkFlags(pkgName string, goSrcs []string) (string, error) {
+	flags, err := ReadCgoFlags(goSrcs)
+	if err != nil {
+		return "", err
+	}
+	if err := PkgConfig(flags); err != nil {
+		return "", err
+	}
+	if len(flags.LDFLAGS) == 0 {
+		return "", nil
+	}
+
+	// The compiler only accepts the directives in files named like cgo's.
+	src := filepath.Join(derivation.BuildDir(), "_cgo_ldflags.go")
+	err = WriteGenerated(src, func(w io.Writer) error {
+		fmt.Fprintf(w, "package %s\n\n", pkgName)
+		for _, flag := range flags.LDFLAGS {
+			fmt.Fprintf(w, "//go:cgo_ldflag %q\n", flag)
+		}
+		return nil
+	})
+
+	return src, err
+}
+
+// readCgoGenerated lists the outputs of running cgo on a package ahead of time,
+// in dir. Its Go files, like "_cgo_gotypes.go" and "<name>.cgo1.go", replace
+// the sources importing "C", and its C objects are packed into the archive.
+// Like the go command, "_cgo_main.o" and "_cgo_.o" are skipped, as cgo only
+// links them to find the dynamic imports written to "_cgo_import.go".
+func readCgoGenerated(dir string) (goSrcs, objs []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+		case filepath.Ext(name) == ".go":
+			goSrcs = append(goSrcs, filepath.Join(dir, name))
+		case name == "_cgo_main.o" || name == "_cgo_.o":
+		case filepath.Ext(name) == ".o":
+			objs = append(objs, filepath.Join(dir, name))
+		}
+	}
+	if len(goSrcs) == 0 {
+		return nil, nil, fmt.Errorf("%s has no Go files generated by cgo", dir)
+	}
+
+	return goSrcs, objs, nil
+}
+
+// replaceCgoSources returns goSrcs with the sources importing "C" replaced by
+// the Go files generated by cgo, failing if cgo wasn't run on any of them.
+func replaceCgoSources(goSrcs, generated []string) ([]string, error) {
+	var replaced []string
+	for _, src := range goSrcs {
+		imports, err := IndexSource(src).Imports()
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(imports, "C") {
+			replaced = append(replaced, src)
+			continue
+		}
+
+		cgo1 := strings.TrimSuffix(filepath.Base(src), ".go") + ".cgo1.go"
+		if !slices.ContainsFunc(generated, func(gen string) bool { return filepath.Base(gen) == cgo1 }) {
+			return nil, fmt.Errorf("cgo output is missing %s, generated from %s", cgo1, src)
+		}
+	}
+	replaced = append(replaced, generated...)
+	slices.Sort(replaced)
+
+	return replaced, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PackageClauseError records when the Go files of a package don't agree on
+// its name, or declare a name which can't be built with its import path.
+type PackageClauseError struct {
+	ImportPath string
+
+	// Files of the package, keyed by the name they declare.
+	Names map[string][]string
+}
+
+func (e PackageClauseError) Error() string {
+	var msg strings.Builder
+	if len(e.Names) > 1 {
+		fmt.Fprintf(&msg, "sources of %s declare different packages:", e.ImportPath)
+	} else {
+		fmt.Fprintf(&msg, "sources of %s declare package main, which must be built with packagePath \"main\":", e.ImportPath)
+	}
+	for _, name := range SortedKeys(e.Names) {
+		fmt.Fprintf(&msg, "\n  package %s", name)
+		for _, src := range e.Names[name] {
+			fmt.Fprintf(&msg, "\n    %s", src)
+		}
+	}
+	fmt.Fprint(&msg, "\n\n  Are the sources or packagePath of the derivation from another package?")
+
+	return msg.String()
+}
+
+// importPathName returns the package name suggested by the last element of
+// importPath, ignoring a major version suffix like "/v2".
+func importPathName(importPath string) string {
+	name := path.Base(importPath)
+	if major, ok := strings.CutPrefix(name, "v"); ok && path.Dir(importPath) != "." {
+		if _, err := strconv.Atoi(major); err == nil {
+			name = path.Base(path.Dir(importPath))
+		}
+	}
+
+	return name
+}
+
+// CheckPackageClauses ensures the Go files selected for the package importPath
+// all declare the same package, and that main packages are built as "main".
+// These mistakes otherwise surface as confusing errors from the compiler or
+// linker. Files which fail to parse are left for the compiler to report.
+//
+// The sources are also expected to come from a directory named after the
+// package. If neither the directory nor the declared package match importPath,
+// a warning is printed, since the sources were likely copied from another
+// package.
+func CheckPackageClauses(importPath string, goSrcs []string) error {
+	names := make(map[string][]string)
+	dirs := make(map[string]struct{})
+	for _, src := range goSrcs {
+		header, err := IndexSource(src).Header()
+		if err != nil {
+			continue
+		}
+		names[header.Name.Name] = append(names[header.Name.Name], src)
+		dirs[filepath.Dir(src)] = struct{}{}
+	}
+
+	if len(names) > 1 {
+		return &PackageClauseError{importPath, names}
+	}
+	if _, ok := names["main"]; ok && importPath != "main" {
+		return &PackageClauseError{importPath, names}
+	}
+
+	expected := importPathName(importPath)
+	for name := range names {
+		if name == expected || name == "main" || len(dirs) != 1 {
+			continue
+		}
+		for dir := range dirs {
+			if base := filepath.Base(dir); base != expected && base == name {
+				log.Printf(
+					"warning: sources of %s are from %s and declare package %s, is packagePath correct?",
+					importPath,
+					dir,
+					name,
+				)
+			}
+		}
+	}
+
+	return nil
+}
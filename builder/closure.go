@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Magic strings starting the Go object files the linker reads, since Go 1.16
+// and 1.20. Both start with the same header.
+var goObjectMagics = []string{"\x00go116ld", "\x00go120ld"}
+
+// linkerImports returns the packages the linker loads for sdk on its own,
+// besides those imported by the linked packages, like the go command adds to
+// binaries. Binaries whose main package is instrumented for coverage also need
+// the coverage runtime.
+func linkerImports(sdk *GoSDK, main *Package) []string {
+	imports := []string{"runtime"}
+	if sdk.Instrument != "" {
+		imports = append(imports, "runtime/"+sdk.Instrument)
+	}
+	if main.CoverMode != "" {
+		imports = append(imports, coverageRuntime)
+	}
+
+	return imports
+}
+
+// linkClosure follows the packages the linker loads from the main archive and
+// implicit packages through the archives of deps, returning every package it
+// loads mapped to the first package found to need it. The linker would only
+// fail on the first package missing from its importcfg, without telling why
+// it's needed, so the closure is checked beforehand. Packages in shlibs are
+// linked from shared libraries, which already hold their dependencies.
+func linkClosure(mainImportPath, mainArchive string, implicit []string, deps, shlibs map[string]string) (map[string]string, error) {
+	needed := make(map[string]string)
+	var queue []string
+	require := func(importPath, parent string) {
+		if _, ok := needed[importPath]; !ok && importPath != mainImportPath {
+			needed[importPath] = parent
+			queue = append(queue, importPath)
+		}
+	}
+
+	imports, err := archiveImports(mainArchive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read imports of %s: %w", mainArchive, err)
+	}
+	for _, importPath := range imports {
+		require(importPath, mainImportPath)
+	}
+	for _, importPath := range implicit {
+		require(importPath, "the linker")
+	}
+
+	for len(queue) > 0 {
+		importPath := queue[0]
+		queue = queue[1:]
+		if _, ok := shlibs[importPath]; ok {
+			continue
+		}
+
+		storePath := deps[importPath]
+		if storePath == "" {
+			err := NewImportError(importPath, needed[importPath], deps)
+			if chain := importChain(needed, importPath); len(chain) > 2 {
+				err.Hints = append(err.Hints, fmt.Sprintf(
+					"It's required transitively: %s.",
+					strings.Join(chain, " -> "),
+				))
+			}
+			return nil, err
+		}
+		archive := fmt.Sprintf("%s/%s.a", storePath, filepath.Base(importPath))
+		imports, err := archiveImports(archive)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf(
+				"package %s has no archive in %s, needed by %s. Was it only type checked?",
+				importPath,
+				storePath,
+				needed[importPath],
+			)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read imports of %s: %w", archive, err)
+		}
+		for _, dep := range imports {
+			require(dep, importPath)
+		}
+	}
+
+	return needed, nil
+}
+
+// importChain returns how importPath is reached from the main package, or
+// the linker, by following needed.
+func importChain(needed map[string]string, importPath string) []string {
+	chain := []string{importPath}
+	for parent, ok := needed[importPath]; ok; parent, ok = needed[parent] {
+		chain = append([]string{parent}, chain...)
+	}
+
+	return chain
+}
+
+// archiveImports returns the packages the linker loads for the Go objects in
+// the archive at path, from the list of imported packages in each object.
+// Objects in formats older than Go 1.16 are skipped.
+func archiveImports(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(file, magic); err != nil || string(magic) != arMagic {
+		return nil, fmt.Errorf("%s is not an archive", path)
+	}
+
+	var imports []string
+	seen := make(map[string]bool)
+	header := make([]byte, arHeaderSize)
+	for offset := int64(len(arMagic)); ; {
+		if n, err := file.ReadAt(header, offset); n == 0 && err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("archive %s has a truncated member header", path)
+		}
+		var size int64
+		if _, err := fmt.Sscan(strings.TrimSpace(string(header[48:58])), &size); err != nil {
+			return nil, fmt.Errorf("archive %s has a member with an invalid size", path)
+		}
+
+		member := io.NewSectionReader(file, offset+arHeaderSize, size)
+		objImports, err := goObjectImports(member)
+		if err != nil {
+			return nil, fmt.Errorf("member %s: %w", strings.TrimSpace(string(header[0:16])), err)
+		}
+		for _, importPath := range objImports {
+			if !seen[importPath] {
+				seen[importPath] = true
+				imports = append(imports, importPath)
+			}
+		}
+
+		// Members are padded to an even length.
+		offset += arHeaderSize + size + size%2
+	}
+
+	return imports, nil
+}
+
+// goObjectImports reads the imported packages of a Go object, which follow
+// its textual header ending in a line of "!". Other members, like the export
+// data or host objects, have none.
+func goObjectImports(member *io.SectionReader) ([]string, error) {
+	r := bufio.NewReader(member)
+	line, err := r.ReadString('\n')
+	if !strings.HasPrefix(line, "go object ") {
+		return nil, nil
+	}
+	start := int64(len(line))
+	for line != "!\n" {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, fmt.Errorf("truncated object header: %w", err)
+		}
+		start += int64(len(line))
+	}
+
+	// The object header is the magic, an 8 byte fingerprint, 4 bytes of
+	// flags, and the offsets of each block, of which the first lists the
+	// imported packages.
+	header := make([]byte, 28)
+	if _, err := member.ReadAt(header, start); err != nil {
+		return nil, fmt.Errorf("truncated object: %w", err)
+	}
+	known := false
+	for _, magic := range goObjectMagics {
+		known = known || string(header[:len(magic)]) == magic
+	}
+	if !known {
+		return nil, nil
+	}
+	blockStart := binary.LittleEndian.Uint32(header[20:])
+	blockEnd := binary.LittleEndian.Uint32(header[24:])
+
+	// Each import is a reference to its path, as a length and offset, and
+	// its 8 byte fingerprint.
+	const importSize = 16
+	if blockEnd < blockStart {
+		return nil, fmt.Errorf("invalid import block")
+	}
+	block := make([]byte, blockEnd-blockStart)
+	if _, err := member.ReadAt(block, start+int64(blockStart)); err != nil {
+		return nil, fmt.Errorf("truncated import block: %w", err)
+	}
+	imports := make([]string, 0, len(block)/importSize)
+	for i := 0; i+importSize <= len(block); i += importSize {
+		length := binary.LittleEndian.Uint32(block[i:])
+		offset := binary.LittleEndian.Uint32(block[i+4:])
+		path := make([]byte, length)
+		if _, err := member.ReadAt(path, start+int64(offset)); err != nil {
+			return nil, fmt.Errorf("truncated import path: %w", err)
+		}
+		imports = append(imports, string(path))
+	}
+
+	return imports, nil
+}
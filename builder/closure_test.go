@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeArchive writes an archive to dir/name.a holding a single Go object,
+// which imports each of imports.
+func writeArchive(t *testing.T, dir, name string, imports ...string) {
+	t.Helper()
+	// The import block directly follows the object header, and the paths it
+	// references follow the block, with offsets relative to the magic.
+	const headerSize, importSize = 28, 16
+	block := make([]byte, 0, len(imports)*importSize)
+	var paths []byte
+	for _, importPath := range imports {
+		block = binary.LittleEndian.AppendUint32(block, uint32(len(importPath)))
+		block = binary.LittleEndian.AppendUint32(block, uint32(headerSize+len(imports)*importSize+len(paths)))
+		block = append(block, make([]byte, 8)...)
+		paths = append(paths, importPath...)
+	}
+	obj := []byte("go object linux amd64 go1.22\n!\n")
+	obj = append(obj, goObjectMagics[1]...)
+	obj = append(obj, make([]byte, 12)...)
+	obj = binary.LittleEndian.AppendUint32(obj, headerSize)
+	obj = binary.LittleEndian.AppendUint32(obj, uint32(headerSize+len(block)))
+	obj = append(obj, block...)
+	obj = append(obj, paths...)
+	if len(obj)%2 != 0 {
+		obj = append(obj, '\n')
+	}
+
+	archive := []byte(arMagic)
+	archive = fmt.Appendf(archive, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", "_go_.o", "0", "0", "0", "644", len(obj))
+	archive = append(archive, obj...)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".a"), archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkCoveredMain(t *testing.T) {
+	root := t.TempDir()
+	deps := map[string]string{
+		"main":             filepath.Join(root, "main"),
+		"runtime":          filepath.Join(root, "runtime"),
+		"internal/abi":     filepath.Join(root, "abi"),
+		"runtime/coverage": filepath.Join(root, "coverage"),
+	}
+	writeArchive(t, deps["main"], "main", "runtime")
+	writeArchive(t, deps["runtime"], "runtime", "internal/abi")
+	writeArchive(t, deps["internal/abi"], "abi")
+	writeArchive(t, deps["runtime/coverage"], "coverage", "runtime")
+
+	mainArchive := filepath.Join(deps["main"], "main.a")
+	covered := &Package{ImportPath: "main", CoverMode: "set"}
+	needed, err := linkClosure("main", mainArchive, linkerImports(&GoSDK{}, covered), deps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent := needed[coverageRuntime]; parent != "the linker" {
+		t.Errorf("covered main package needs %s for %q, want the linker", coverageRuntime, parent)
+	}
+	if parent := needed["internal/abi"]; parent != "runtime" {
+		t.Errorf("covered main package needs internal/abi for %q, want runtime", parent)
+	}
+
+	uncovered := &Package{ImportPath: "main"}
+	needed, err = linkClosure("main", mainArchive, linkerImports(&GoSDK{}, uncovered), deps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := needed[coverageRuntime]; ok {
+		t.Errorf("uncovered main package needs %s", coverageRuntime)
+	}
+
+	// Without the coverage runtime among the deps, linking a covered main
+	// package fails before the linker runs.
+	delete(deps, coverageRuntime)
+	_, err = linkClosure("main", mainArchive, linkerImports(&GoSDK{}, covered), deps, nil)
+	var importErr *ImportError
+	if !errors.As(err, &importErr) {
+		t.Errorf("linking a covered main package without %s = %v, want an ImportError", coverageRuntime, err)
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"cmp"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"maps"
 	"nix/derivation"
 	"os"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
+	"unicode"
 )
 
 type EmbedCfg struct {
@@ -18,111 +24,277 @@ type EmbedCfg struct {
 }
 
 type CompileAttrs struct {
-	PackagePath string
-	Srcs        []string
+	PackagePath string   `nix:"required"`
+	Srcs        []string `nix:"required"`
 	Imports     map[string]string
 	ImportMap   map[string]string
 	EmbedCfg    *EmbedCfg
 
+	// Imports which are meta packages, in addition to "std", and what to do
+	// when they contain a package which was also imported directly.
+	MetaPackages  []string
+	MetaConflicts string
+
+	// Write a report of which sources were included in the build, and why.
+	ConstraintReport bool
+
+	// Drop tests and sources for other platforms from Srcs. See
+	// [SourceFilter].
+	ExcludeTests  bool
+	OnlyPlatforms []string
+
+	// Replacement files for some of Srcs, keyed by the source they replace. An
+	// empty replacement removes the source.
+	Overlay map[string]string
+
 	CompileFlags []string
+	AsmFlags     []string
+
+	// Instrument the package for coverage with this counter mode of the cover
+	// tool: "set", "count", or "atomic".
+	CoverMode string
+
+	// Standard library packages to compile an empty stub of if std doesn't
+	// have them, like when it's older than the SDK, so experimental builds
+	// can go ahead. See [Compilation.compileStdStub].
+	AllowMissingStd []string
+
+	// Output of running cgo on the package ahead of time, by another
+	// derivation. Its Go files replace the sources importing "C", and its
+	// objects are packed into the archive. See [readCgoGenerated].
+	CgoGenerated string
+
+	// Prebuilt objects or archives to pack into the package's archive, like
+	// blobs from a vendor. See [Compilation.ExtraObjects].
+	ExtraObjects []string
+
+	// Import path a main package, compiled as "main", has within its module,
+	// like "example.com/m/cmd/tool". This decides which internal packages it
+	// may import.
+	MainPath string
+
+	// Build the package as part of the standard library, which the runtime and
+	// the packages it uses need to compile. This is detected for sources in the
+	// SDK.
+	Std bool
+
+	// Fail if any of Imports isn't imported by the package, instead of only
+	// warning. Unused imports are always listed in "<name>.unused.json".
+	StrictImports bool
+
+	// Where archives are installed in the lib output. See [OutputLayout].
+	OutputLayout string
+
+	// Directory of a shared action cache to look up the package in before
+	// compiling it. See [ActionCache].
+	ActionCache string
 }
 
-// sortSrcs sorts the Srcs list and splits it into Go files, header files, and
-// assembly files.
-func sortSrcs(srcs []string) (goSrcs, hSrcs, sSrcs []string, err error) {
+// sortSrcs sorts the Srcs list and splits it into Go files, header files,
+// assembly files, and prebuilt objects. Files dropped by filter or not matching
+// Context are skipped, and files which can't be built without cgo are ignored
+// with a warning.
+func sortSrcs(srcs []string, filter *SourceFilter) (goSrcs, hSrcs, sSrcs, sysoSrcs []string, err error) {
 	for _, src := range srcs {
-		match, err := Context.MatchFile(filepath.Dir(src), filepath.Base(src))
+		if filter.Explain(src) != "" {
+			continue
+		}
+
+		match, err := IndexSource(src).Match()
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 
 		if !match {
 			continue
 		}
 
-		switch filepath.Ext(src) {
+		switch ext := filepath.Ext(src); ext {
 		case ".go":
 			goSrcs = append(goSrcs, src)
 		case ".h":
 			hSrcs = append(hSrcs, src)
 		case ".s":
 			sSrcs = append(sSrcs, src)
+		case ".syso":
+			sysoSrcs = append(sysoSrcs, src)
+		case ".c", ".cc", ".cpp", ".cxx", ".hh", ".hpp", ".hxx", ".m", ".f", ".F", ".for", ".f90":
+			// Same as the go command, these are only allowed when using cgo.
+			log.Printf("warning: ignoring %s, %s sources require cgo", src, ext)
+		case ".swig", ".swigcxx":
+			log.Printf("warning: ignoring %s, SWIG bindings require cgo", src)
 		default:
-			log.Fatalf("source %s was neither a .go, .h, or .s file", src)
+			log.Printf("warning: ignoring %s, which is not a Go, header, assembly, or object file", src)
 		}
 	}
 
 	slices.Sort(goSrcs)
 	slices.Sort(hSrcs)
 	slices.Sort(sSrcs)
+	slices.Sort(sysoSrcs)
 
 	return
 }
 
+// realImportPath returns the import path the package has within its module,
+// which differs from ImportPath for main packages.
+func (c *Compilation) realImportPath() string {
+	if c.MainPath != "" {
+		return c.MainPath
+	}
+
+	return c.ImportPath
+}
+
 // compileImportCfg creates the importcfg neccesary for the Go compiler and
 // returns the path to it, as well as a list of imports for writing the metadata
-// later.
+// later. Packages in implicit are imported even if no source imports them.
 func compileImportCfg(
+	importPath string,
+	std bool,
 	srcs []string,
 	deps map[string]string,
 	importMap map[string]string,
+	implicit []string,
+	builtin func(importPath string) bool,
 ) (string, []Import, error) {
-	if err := ResolveMetaPackages(deps, importMap); err != nil {
+	// Meta packages add to the import map, which shouldn't change the
+	// attributes.
+	importMap = maps.Clone(importMap)
+	if importMap == nil {
+		importMap = make(map[string]string)
+	}
+	if err := ResolveMetaPackages(deps, importMap, std); err != nil {
 		return "", nil, err
 	}
 
-	imports, rewrites, err := ScanImports(srcs, deps, importMap)
+	imports, rewrites, err := ScanImports(importPath, std, srcs, deps, importMap, builtin)
 	if err != nil {
 		return "", nil, err
 	}
+	for _, dep := range implicit {
+		imported := slices.ContainsFunc(imports, func(imp Import) bool { return imp.ImportPath == dep })
+		if imported || builtin(dep) {
+			continue
+		}
+		storePath, ok := deps[dep]
+		if !ok {
+			return "", nil, NewImportError(dep, importPath, deps)
+		}
+		imports = append(imports, Import{StorePath: storePath, ImportPath: dep})
+	}
+	SortImports(imports)
 
-	cfgPath := filepath.Join(BuildDir(), "importcfg")
-	cfgFile, err := os.Create(cfgPath)
+	cfgPath := filepath.Join(derivation.BuildDir(), "importcfg")
+	err = WriteGenerated(cfgPath, func(cfgFile io.Writer) error {
+		for _, pkg := range rewrites {
+			fmt.Fprintf(cfgFile, "importmap %s=%s\n", pkg.ImportPath, pkg.StorePath)
+		}
+		for _, pkg := range imports {
+			fmt.Fprintf(
+				cfgFile,
+				"packagefile %s=%s/%s.x\n",
+				pkg.ImportPath,
+				pkg.StorePath,
+				filepath.Base(pkg.ImportPath),
+			)
+		}
+		return nil
+	})
 	if err != nil {
 		return "", nil, err
 	}
-	defer cfgFile.Close()
-
-	for _, pkg := range rewrites {
-		fmt.Fprintf(cfgFile, "importmap %s=%s\n", pkg.ImportPath, pkg.StorePath)
-	}
-	for _, pkg := range imports {
-		fmt.Fprintf(
-			cfgFile,
-			"packagefile %s=%s/%s.x\n",
-			pkg.ImportPath,
-			pkg.StorePath,
-			filepath.Base(pkg.ImportPath),
-		)
-	}
 
 	return cfgPath, imports, nil
 }
 
+// A trimRewrite is a "-trimpath" rewrite, replacing the path prefix From with
+// To in file names recorded by the compiler.
+type trimRewrite struct {
+	From, To string
+}
+
 // packageTrimPath builds a "-trimpath" argument for the Go compiler to
 // remove absolute file paths from the output binary. This is needed for
 // reproducibility.
-func packageTrimPath(srcs []string, importPath, out string) string {
-	var trimPath strings.Builder
-	srcPaths := make(map[string]struct{})
+//
+// Each source directory is rewritten to the import path, or for a directory
+// nested in another, such as generated files in a subdirectory, to the import
+// path joined with the directories between them. Source trees are rewritten
+// the same way, followed by extra. The compiler applies the first rewrite
+// matching a file, so rewrites are ordered longest prefix first. This way,
+// nested directories take precedence over their parents, whatever the order
+// of srcs.
+func packageTrimPath(srcs []string, importPath string, extra ...trimRewrite) string {
+	rewrites := make(map[string]string)
+	for _, tree := range sourceTrees {
+		rewrites[tree.Root] = tree.ImportPath
+	}
 
+	var dirs []string
 	for _, src := range srcs {
-		dir := filepath.Dir(src)
-		if _, ok := srcPaths[dir]; !ok {
-			srcPaths[dir] = struct{}{}
-			fmt.Fprintf(&trimPath, "%s=>%s;", dir, importPath)
+		dirs = append(dirs, filepath.Dir(src))
+	}
+	// Parents are always shorter, so they're rewritten before their children.
+	slices.SortFunc(dirs, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	})
+	for _, dir := range slices.Compact(dirs) {
+		if _, ok := rewrites[dir]; ok {
+			continue
+		}
+		rewrites[dir] = importPath
+		if parent := trimParent(rewrites, dir); parent != "" {
+			rel, _ := filepath.Rel(parent, dir)
+			rewrites[dir] = path.Join(rewrites[parent], filepath.ToSlash(rel))
+		}
+	}
+	for _, rewrite := range extra {
+		if _, ok := rewrites[rewrite.From]; !ok {
+			rewrites[rewrite.From] = rewrite.To
 		}
 	}
 
-	return trimPath.String() + out + "=>"
+	prefixes := slices.SortedFunc(maps.Keys(rewrites), func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(b), len(a)), strings.Compare(a, b))
+	})
+	trimPath := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		trimPath[i] = fmt.Sprintf("%s=>%s", prefix, rewrites[prefix])
+	}
+
+	return strings.Join(trimPath, ";")
+}
+
+// trimParent returns the longest directory in rewrites containing dir, or ""
+// if there isn't one. Sources given as individual store paths all share the
+// store directory, which never counts as a parent, so their directories aren't
+// nested under it.
+func trimParent(rewrites map[string]string, dir string) string {
+	storeDir := os.Getenv("NIX_STORE")
+	if storeDir == "" {
+		storeDir = "/nix/store"
+	}
+
+	parent := ""
+	for prefix := range rewrites {
+		if len(prefix) <= len(parent) || prefix == storeDir {
+			continue
+		}
+		if rel, err := filepath.Rel(prefix, dir); err == nil && rel != "." && filepath.IsLocal(rel) {
+			parent = prefix
+		}
+	}
+
+	return parent
 }
 
 // findIncludes returns a sorted list of include directories for the header
 // sources.
 func findIncludes(sdkInclude string, hSrcs []string) []string {
 	hDirs := map[string]struct{}{
-		BuildDir(): {},
-		sdkInclude: {},
+		derivation.BuildDir(): {},
+		sdkInclude:            {},
 	}
 	for _, src := range hSrcs {
 		dir := filepath.Dir(src)
@@ -136,7 +308,7 @@ func findIncludes(sdkInclude string, hSrcs []string) []string {
 		}
 	}
 
-	return slices.Sorted(maps.Keys(hDirs))
+	return SortedKeys(hDirs)
 }
 
 // symlinkArchHeaders symlinks architecture-specific (ending in _$GOOS or
@@ -161,7 +333,8 @@ func symlinkArchHeaders(hFiles []string) error {
 		}
 
 		if newBase != "" {
-			if err := os.Symlink(path, filepath.Join(BuildDir(), newBase)); err != nil {
+			err := Materialize(path, filepath.Join(derivation.BuildDir(), newBase), MaterializeSymlink)
+			if err != nil {
 				return err
 			}
 		}
@@ -183,13 +356,9 @@ func touchFile(path string) error {
 // appendArchive adds object files to an archive.
 func appendArchive(sdk *GoSDK, archive string, objs ...string) error {
 	cmd := sdk.RunTool("pack", "r", archive)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-
 	cmd.Args = append(cmd.Args, objs...)
 
-	fmt.Fprintln(os.Stderr, cmd)
-	if err := cmd.Run(); err != nil {
+	if err := RunLogged(cmd); err != nil {
 		return fmt.Errorf("failed to pack archive: %w", err)
 	}
 
@@ -210,18 +379,130 @@ func hasForwardDecl(importPath string) bool {
 	}
 }
 
+// isLegacyRuntimePackage reports whether SDKs before Go 1.22 need to be told
+// they are compiling the runtime for a package. The list is taken from
+// src/cmd/internal/objabi/path.go of Go 1.21.
+func isLegacyRuntimePackage(importPath string) bool {
+	switch importPath {
+	case "runtime", "reflect", "syscall", "internal/bytealg":
+		return true
+	default:
+		return strings.HasPrefix(importPath, "runtime/internal")
+	}
+}
+
+// stdFlags returns the flags for compiling and assembling a package of the
+// standard library. Since Go 1.22, the tools work out which packages are part
+// of the runtime from "-std", but older SDKs must be told.
+func (c *Compilation) stdFlags() (compileFlags, asmFlags []string) {
+	if !c.Std {
+		return nil, nil
+	}
+
+	if older, ok := CompareGoVersion(c.SDK.Version, "1.22"); ok && older < 0 {
+		compileFlags = []string{"-std"}
+		if c.ImportPath == "runtime" || strings.HasPrefix(c.ImportPath, "runtime/internal") {
+			compileFlags = append(compileFlags, "-+")
+		}
+		if isLegacyRuntimePackage(c.ImportPath) {
+			asmFlags = []string{"-compiling-runtime"}
+		}
+		return compileFlags, asmFlags
+	}
+
+	return []string{"-std"}, []string{"-std"}
+}
+
+// isSDKSource reports whether every source is in the SDK's source tree, so the
+// package is part of the standard library.
+func isSDKSource(sdk *GoSDK, srcs []string) bool {
+	srcDir := filepath.Join(sdk.Path, "src") + string(filepath.Separator)
+	for _, src := range srcs {
+		if !strings.HasPrefix(src, srcDir) {
+			return false
+		}
+	}
+
+	return len(srcs) > 0
+}
+
 // compileEmbedCfg creates the embedcfg neccesary for the Go compiler and
 // returns the path to it.
 func compileEmbedCfg(cfg *EmbedCfg) (string, error) {
-	cfgPath := filepath.Join(BuildDir(), "embedcfg")
-	cfgFile, err := os.Create(cfgPath)
-	if err != nil {
-		return "", err
+	cfgPath := filepath.Join(derivation.BuildDir(), "embedcfg")
+	return cfgPath, WriteGenerated(cfgPath, func(cfgFile io.Writer) error {
+		encoder := json.NewEncoder(cfgFile)
+		return encoder.Encode(cfg)
+	})
+}
+
+// Normalize returns a copy of the embedcfg which doesn't depend on how it was
+// written, so the same files always give the same config. Names of files are
+// cleaned of "./" and other redundant elements, and the files they name have
+// their symlinks resolved. A pattern listing a name which isn't a file, like a
+// directory or the pattern itself, is expanded to the files it matches as by
+// the go command, and the files of each pattern are sorted.
+func (cfg *EmbedCfg) Normalize() (*EmbedCfg, error) {
+	normalized := &EmbedCfg{
+		Patterns: make(map[string][]string, len(cfg.Patterns)),
+		Files:    make(map[string]string, len(cfg.Files)),
+	}
+
+	for _, name := range SortedKeys(cfg.Files) {
+		clean, err := cleanEmbedName(name)
+		if err != nil {
+			return nil, err
+		}
+		file, err := filepath.EvalSymlinks(cfg.Files[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve embedded file %s: %w", name, err)
+		}
+		if prev, ok := normalized.Files[clean]; ok && prev != file {
+			return nil, fmt.Errorf("embedded file %s is both %s and %s", clean, prev, file)
+		}
+		normalized.Files[clean] = file
+	}
+	names := SortedKeys(normalized.Files)
+
+	for pattern, matched := range cfg.Patterns {
+		_, all := strings.CutPrefix(pattern, "all:")
+		files := make([]string, 0, len(matched))
+		for _, name := range matched {
+			name, nameAll := strings.CutPrefix(name, "all:")
+			clean, err := cleanEmbedName(name)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := normalized.Files[clean]; ok {
+				files = append(files, clean)
+				continue
+			}
+
+			if all || nameAll {
+				clean = "all:" + clean
+			}
+			expanded := matchEmbedPattern(clean, names)
+			if len(expanded) == 0 {
+				return nil, fmt.Errorf("pattern %q matches %s, which matches no embedded files", pattern, clean)
+			}
+			files = append(files, expanded...)
+		}
+		slices.Sort(files)
+		normalized.Patterns[pattern] = slices.Compact(files)
+	}
+
+	return normalized, nil
+}
+
+// cleanEmbedName cleans the name of an embedded file, which must be relative
+// to the package's directory without leaving it.
+func cleanEmbedName(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("embedded file %q is not within the package directory", name)
 	}
-	defer cfgFile.Close()
 
-	encoder := json.NewEncoder(cfgFile)
-	return cfgPath, encoder.Encode(cfg)
+	return clean, nil
 }
 
 // A Compilation represents a call to the Go compiler.
@@ -233,13 +514,63 @@ type Compilation struct {
 	ImportMap  map[string]string
 	EmbedCfg   *EmbedCfg
 
+	// Extra flags passed to every invocation of the assembler.
+	AsmFlags []string
+
+	// Whether the package is part of the standard library.
+	Std bool
+
+	// Sources dropped before matching build constraints.
+	Filter SourceFilter
+
+	// Counter mode to instrument the package for coverage with, if any. See
+	// [Compilation.instrumentCoverage].
+	CoverMode string
+
+	// Directory of the package's pregenerated cgo output, if any.
+	CgoGenerated string
+
+	// Standard library packages which are stubbed if missing.
+	AllowMissingStd []string
+
+	// Objects packed into the archive last, in this order, after those
+	// assembled from sources and the prebuilt .syso sources. Like .syso
+	// sources, these are host objects or archives of them, which the linker
+	// loads along with the package.
+	ExtraObjects []string
+
+	// Import path of a main package within its module. See
+	// [Compilation.realImportPath].
+	MainPath string
+
+	// Hash identifying the compile action, from which the package's build ID
+	// is derived. Defaults to [Compilation.ActionID], so packages restored
+	// from an action cache have the same build ID as when they were compiled.
+	ActionHash string
+
+	obj          string
+	exportData   string
+	compileFlags []string
+
+	// Sources selected by build constraints, before any are generated, and
+	// the extra objects.
+	sources []string
+
+	// Go sources selected by build constraints, before cgo or the cover tool
+	// replace them with their generated output.
+	selectedGoSrcs []string
+
 	goSrcs    []string
 	hSrcs     []string
 	sSrcs     []string
+	sysoSrcs  []string
 	includes  []string
 	importCfg string
 	imports   []Import
 	trimPath  string
+
+	coverCfg   string
+	coverFixup *coverFixupConfig
 }
 
 // Deps resolves a list of all packages directly imported by the compiled
@@ -262,67 +593,194 @@ func (c *Compilation) Deps() ([]string, []string, error) {
 		if err != nil {
 			return nil, nil, err
 		}
+		if err := CheckCompatible(&pkg, c.SDK); err != nil {
+			return nil, nil, err
+		}
 		for _, subDep := range pkg.Deps {
 			deps[subDep] = struct{}{}
 		}
 	}
 
 	// imports should already be sorted by FindImports.
-	return imports, slices.Sorted(maps.Keys(deps)), nil
+	return imports, SortedKeys(deps), nil
 }
 
-// CompilePackage invokes the Go compiler to execute the Compilation.
+// CompilePackage invokes the compiler of the SDK's toolchain to execute the
+// Compilation. If obj is empty, only exportData is written, which is enough
+// to type check packages importing it, and assembly sources are only scanned
+// for their symbols.
 func (c *Compilation) CompilePackage(
 	obj string,
 	exportData string,
 	extraArgs []string,
 ) error {
+	c.obj, c.exportData, c.compileFlags = obj, exportData, extraArgs
+
 	var err error
-	c.goSrcs, c.hSrcs, c.sSrcs, err = sortSrcs(c.Srcs)
+	c.goSrcs, c.hSrcs, c.sSrcs, c.sysoSrcs, err = sortSrcs(c.Srcs, &c.Filter)
 	if err != nil {
 		return fmt.Errorf("failed to enumerate source files: %w", err)
 	}
+	c.sources = slices.Concat(c.goSrcs, c.hSrcs, c.sSrcs, c.sysoSrcs, c.ExtraObjects)
+	c.selectedGoSrcs = c.goSrcs
+	if c.CgoGenerated != "" {
+		generated, objs, err := readCgoGenerated(c.CgoGenerated)
+		if err == nil {
+			c.goSrcs, err = replaceCgoSources(c.goSrcs, generated)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read cgo output: %w", err)
+		}
+		c.sysoSrcs = append(c.sysoSrcs, objs...)
+		if err := c.addCgoLinkFlags(); err != nil {
+			return fmt.Errorf("failed to collect cgo linker flags: %w", err)
+		}
+	}
+	if err := CheckPackageClauses(c.ImportPath, c.goSrcs); err != nil {
+		return err
+	}
+	stub := len(c.goSrcs) == 0
+	if stub {
+		src, err := c.writeStub()
+		if err != nil {
+			return fmt.Errorf("failed to generate stub source: %w", err)
+		}
+		c.goSrcs = []string{src}
+	} else if c.CoverMode != "" {
+		if err := c.instrumentCoverage(); err != nil {
+			return fmt.Errorf("failed to instrument package for coverage: %w", err)
+		}
+	}
 
-	c.importCfg, c.imports, err = compileImportCfg(
-		c.goSrcs,
-		c.Imports,
-		c.ImportMap,
-	)
+	// The types generated by cgo import runtime/cgo, which is otherwise
+	// ignored.
+	var implicit []string
+	if c.CgoGenerated != "" {
+		implicit = append(implicit, "runtime/cgo")
+	}
+	// Like the go command, the main package of an instrumented binary
+	// imports the coverage runtime its init function calls.
+	if c.CoverMode != "" && c.ImportPath == "main" {
+		implicit = append(implicit, coverageRuntime)
+	}
+
+	// Resolving meta packages removes std from the imports.
+	stdPath := c.Imports["std"]
+	var importErr *ImportError
+	for {
+		c.importCfg, c.imports, err = compileImportCfg(
+			c.realImportPath(),
+			c.Std,
+			c.goSrcs,
+			c.Imports,
+			c.ImportMap,
+			implicit,
+			c.SDK.Compiler().Builtin,
+		)
+		if !errors.As(err, &importErr) || !isStdPath(importErr.Import) ||
+			!slices.Contains(c.AllowMissingStd, importErr.Import) || c.Imports[importErr.Import] != "" {
+			break
+		}
+
+		log.Printf("warning: %s is missing from std, compiling against an empty stub of it", importErr.Import)
+		stub, err := c.compileStdStub(importErr.Import)
+		if err != nil {
+			return err
+		}
+		if c.Imports == nil {
+			c.Imports = make(map[string]string)
+		}
+		c.Imports[importErr.Import] = stub
+	}
+	if errors.As(err, &importErr) && stdPath != "" {
+		if stdErr := CheckStdManifest(stdPath, c.SDK, importErr.Import); stdErr != nil {
+			err = stdErr
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to generate compiler importcfg: %w", err)
 	}
 
-	c.trimPath = packageTrimPath(c.Srcs, c.ImportPath, filepath.Dir(obj))
-	if len(c.sSrcs) > 0 {
-		c.trimPath = c.trimPath + fmt.Sprintf(";%s=>", BuildDir())
+	outDir := filepath.Dir(exportData)
+	if obj != "" {
+		outDir = filepath.Dir(obj)
+	}
+	rewrites := []trimRewrite{{outDir, ""}}
+	if len(c.sSrcs) > 0 || stub || c.coverCfg != "" {
+		rewrites = append(rewrites, trimRewrite{derivation.BuildDir(), ""})
+	}
+	if c.CgoGenerated != "" {
+		rewrites = append(rewrites, trimRewrite{c.CgoGenerated, c.ImportPath})
+	}
+	if StrictDeterminism {
+		// Headers included from the SDK otherwise leak its store path, which
+		// differs between builds of the same Go version.
+		rewrites = append(rewrites, trimRewrite{c.SDK.Path, "GOROOT"})
 	}
+	c.trimPath = packageTrimPath(c.Srcs, c.ImportPath, rewrites...)
+
+	if c.ActionHash == "" {
+		if c.ActionHash, err = c.ActionID(extraArgs); err != nil {
+			return fmt.Errorf("failed to hash compile action: %w", err)
+		}
+	}
+
+	return c.SDK.Compiler().Compile(c, extraArgs)
+}
 
-	cmd := c.SDK.RunTool("compile", extraArgs...)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	cmd.Env = []string{"CGO_ENABLED=0"}
+// Compile invokes the compile tool of the SDK, then assembles the assembly
+// sources and packs their objects into the archive.
+func (gcToolchain) Compile(c *Compilation, extraArgs []string) error {
+	obj, exportData := c.obj, c.exportData
+	var err error
+
+	stdCompileFlags, _ := c.stdFlags()
+	cmd := c.SDK.RunTool("compile", append(stdCompileFlags, extraArgs...)...)
+	cmd.Env = c.SDK.PackageEnv(c.ImportPath)
+	if c.SDK.Instrument != "" {
+		cmd.Args = append(cmd.Args, "-"+c.SDK.Instrument)
+	}
+	if c.SDK.DynLink {
+		// Like the go command, packages of shared libraries are compiled to
+		// also link against other libraries, or they reference each other by
+		// index, which the linker can't resolve across libraries.
+		cmd.Args = append(cmd.Args, "-dynlink", "-linkshared")
+	}
+	if c.coverCfg != "" {
+		cmd.Args = append(cmd.Args, "-coveragecfg="+c.coverCfg)
+	}
 
+	cmd.Args = append(cmd.Args, "-o", exportData)
+	if obj != "" {
+		cmd.Args = append(cmd.Args, "-linkobj", obj)
+	}
 	cmd.Args = append(
 		cmd.Args,
-		"-o", exportData,
-		"-linkobj", obj,
 		"-trimpath", c.trimPath,
 		"-p", c.ImportPath,
 		"-lang", c.SDK.CompatVersion,
 	)
+	// A build ID from extraArgs is kept, rather than replaced by its content
+	// ID.
+	customBuildID := hasBuildIDFlag(extraArgs)
+	if !customBuildID {
+		cmd.Args = append(cmd.Args, "-buildid", packageBuildID(c.ActionHash))
+	}
 
+	var symabis, asmHeader, embedCfg string
 	if len(c.sSrcs) > 0 {
+		SetPhase("asm")
 		c.includes = findIncludes(c.SDK.Include(), c.hSrcs)
-		asmHeader := filepath.Join(BuildDir(), "go_asm.h")
+		asmHeader = filepath.Join(derivation.BuildDir(), "go_asm.h")
 		if err := touchFile(asmHeader); err != nil {
 			return err
 		}
 		if err := symlinkArchHeaders(c.hSrcs); err != nil {
 			return err
 		}
-		symabis, err := c.AssembleSources(
+		symabis, err = c.AssembleSources(
 			c.sSrcs,
-			filepath.Join(BuildDir(), "symabis"),
+			filepath.Join(derivation.BuildDir(), "symabis"),
 			[]string{"-gensymabis"},
 		)
 		if err != nil {
@@ -333,21 +791,23 @@ func (c *Compilation) CompilePackage(
 			"-symabis", symabis,
 			"-asmhdr", asmHeader,
 		)
-	} else if !hasForwardDecl(c.ImportPath) {
+	} else if !hasForwardDecl(c.ImportPath) && c.CgoGenerated == "" {
+		// Without cgo's objects, C functions would look like missing bodies.
 		cmd.Args = append(cmd.Args, "-complete")
 	}
 
 	if c.EmbedCfg != nil {
-		embedCfg, err := compileEmbedCfg(c.EmbedCfg)
+		embedCfg, err = compileEmbedCfg(c.EmbedCfg)
 		if err != nil {
 			return fmt.Errorf("failed to generate compiler embedcfg: %w", err)
 		}
 		cmd.Args = append(cmd.Args, "-embedcfg", embedCfg)
 	}
 
+	cmd.Args = append(cmd.Args, ProfileFlags("compile", c.ImportPath)...)
 	cmd.Args = append(
 		cmd.Args,
-		"-c", fmt.Sprint(BuildParallelism()),
+		"-c", fmt.Sprint(derivation.BuildParallelism()),
 		"-nolocalimports",
 		"-importcfg", c.importCfg,
 		"-pack",
@@ -355,17 +815,32 @@ func (c *Compilation) CompilePackage(
 	)
 	cmd.Args = append(cmd.Args, c.goSrcs...)
 
-	fmt.Fprintln(os.Stderr, cmd)
-	if err := cmd.Run(); err != nil {
+	inputs := slices.Concat(c.goSrcs, []string{c.importCfg, symabis, embedCfg, c.coverCfg})
+	if c.EmbedCfg != nil {
+		inputs = append(inputs, slices.Sorted(maps.Values(c.EmbedCfg.Files))...)
+	}
+	if err := RecordAction(cmd, inputs, []string{exportData, obj, asmHeader}); err != nil {
+		return err
+	}
+
+	SetPhase("compile")
+	if err := RunLogged(cmd); err != nil {
 		return fmt.Errorf("failed to compile binary: %w", err)
 	}
+	if obj == "" {
+		if customBuildID {
+			return nil
+		}
+		return UpdateBuildID(exportData, packageBuildID(c.ActionHash))
+	}
 
 	var sObjs []string
-	for _, src := range c.sSrcs {
+	for i, src := range c.sSrcs {
+		SetPhaseProgress("asm", i+1, len(c.sSrcs))
 		base, _ := strings.CutSuffix(filepath.Base(src), ".s")
 		obj, err := c.AssembleSources(
 			[]string{src},
-			filepath.Join(BuildDir(), fmt.Sprintf("%s.o", base)),
+			filepath.Join(derivation.BuildDir(), fmt.Sprintf("%s.o", base)),
 			[]string{},
 		)
 		if err != nil {
@@ -373,14 +848,98 @@ func (c *Compilation) CompilePackage(
 		}
 		sObjs = append(sObjs, obj)
 	}
+	// Like the go command, prebuilt objects are packed with no processing.
+	sObjs = append(sObjs, c.sysoSrcs...)
+	extraObjs, err := c.extraObjectMembers()
+	if err != nil {
+		return err
+	}
+	sObjs = append(sObjs, extraObjs...)
 
 	if sObjs != nil {
-		return appendArchive(c.SDK, obj, sObjs...)
+		if err := appendArchive(c.SDK, obj, sObjs...); err != nil {
+			return err
+		}
+	}
+
+	if customBuildID {
+		return nil
+	}
+	for _, file := range []string{exportData, obj} {
+		if err := UpdateBuildID(file, packageBuildID(c.ActionHash)); err != nil {
+			return fmt.Errorf("failed to update build ID: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// addCgoLinkFlags adds a source with the linker flags of the package's "#cgo"
+// directives to its Go sources. See [writeCgoLinkFlags].
+func (c *Compilation) addCgoLinkFlags() error {
+	if len(c.selectedGoSrcs) == 0 {
+		return nil
+	}
+
+	header, err := IndexSource(c.selectedGoSrcs[0]).Header()
+	if err != nil {
+		return err
+	}
+	src, err := writeCgoLinkFlags(header.Name.Name, c.selectedGoSrcs)
+	if err != nil || src == "" {
+		return err
+	}
+	c.goSrcs = append(c.goSrcs, src)
+
+	return nil
+}
+
+// stubPackageName guesses the name of a package with no Go files selected for
+// the build. Files excluded by build constraints still declare it, but some
+// may be programs run by "go generate", so the last element of the import
+// path is preferred if any of them declares it, like the go command assumes.
+func stubPackageName(srcs []string, importPath string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, importPathName(importPath))
+
+	var declared []string
+	for _, src := range srcs {
+		if filepath.Ext(src) != ".go" || strings.HasSuffix(src, "_test.go") {
+			continue
+		}
+		if header, err := IndexSource(src).Header(); err == nil {
+			declared = append(declared, header.Name.Name)
+		}
+	}
+	if len(declared) > 0 && !slices.Contains(declared, name) {
+		return declared[0]
+	}
+
+	return name
+}
+
+// writeStub writes a Go file declaring only the package, so packages of just
+// assembly, or whose Go files are all excluded by build constraints, still
+// get an archive and export data. The go command refuses to build these, but
+// Nix builds every package in the import graph, whether or not the platform
+// uses it.
+func (c *Compilation) writeStub() (string, error) {
+	name := stubPackageName(c.Srcs, c.ImportPath)
+	if len(c.sSrcs) == 0 && len(c.sysoSrcs) == 0 {
+		log.Printf("warning: no files of %s are selected for the build, writing an empty package", c.ImportPath)
+	}
+
+	stub := filepath.Join(derivation.BuildDir(), "_stub.go")
+	return stub, WriteGenerated(stub, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "package %s\n", name)
+		return err
+	})
+}
+
 // AssembleSources assembles .s source file into an object for packing into the
 // package archive.
 func (c *Compilation) AssembleSources(
@@ -388,12 +947,25 @@ func (c *Compilation) AssembleSources(
 	out string,
 	extraArgs []string,
 ) (string, error) {
-	cmd := c.SDK.RunTool("asm", extraArgs...)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	cmd.Env = []string{"CGO_ENABLED=0"}
+	return c.SDK.Compiler().Assemble(c, srcs, out, extraArgs)
+}
+
+// Assemble invokes the asm tool of the SDK.
+func (gcToolchain) Assemble(
+	c *Compilation,
+	srcs []string,
+	out string,
+	extraArgs []string,
+) (string, error) {
+	_, stdAsmFlags := c.stdFlags()
+	args := slices.Concat(stdAsmFlags, c.AsmFlags, extraArgs)
+	cmd := c.SDK.RunTool("asm", args...)
+	cmd.Env = c.SDK.PackageEnv(c.ImportPath)
 
 	cmd.Args = append(cmd.Args, "-p", c.ImportPath, "-trimpath", c.trimPath)
+	if c.SDK.DynLink {
+		cmd.Args = append(cmd.Args, "-dynlink")
+	}
 	for _, dir := range c.includes {
 		cmd.Args = append(cmd.Args, "-I", dir)
 	}
@@ -401,58 +973,442 @@ func (c *Compilation) AssembleSources(
 		cmd.Args,
 		"-D", fmt.Sprintf("GOOS_%s", Context.GOOS),
 		"-D", fmt.Sprintf("GOARCH_%s", Context.GOARCH),
-		"-o", out,
 	)
+	for _, define := range c.SDK.AsmDefines() {
+		cmd.Args = append(cmd.Args, "-D", define)
+	}
+	cmd.Args = append(cmd.Args, "-o", out)
 	cmd.Args = append(cmd.Args, srcs...)
 
-	fmt.Fprintln(os.Stderr, cmd)
-	if err := cmd.Run(); err != nil {
+	if err := RecordAction(cmd, slices.Concat(srcs, c.hSrcs), []string{out}); err != nil {
+		return "", err
+	}
+	if err := RunLogged(cmd); err != nil {
 		return "", fmt.Errorf("failed to assemble sources: %w", err)
 	}
 
 	return out, nil
 }
 
+// prepareCompilation applies the attributes shared by every mode of compiling
+// a package, returning the compilation of it.
+func prepareCompilation(sdk *GoSDK, attrs *CompileAttrs) *Compilation {
+	MetaPackages = append(MetaPackages, attrs.MetaPackages...)
+	policy, err := ParseConflictPolicy(attrs.MetaConflicts)
+	if err != nil {
+		Fatal(&AttrError{"metaConflicts", err})
+	}
+	MetaConflicts = policy
+
+	srcs, err := ApplyOverlay(attrs.Srcs, attrs.Overlay, attrs.PackagePath)
+	if err != nil {
+		Fatalf("failed to apply overlay: %v", err)
+	}
+	MapDiagnosticPaths(attrs.PackagePath, srcs)
+
+	filter := SourceFilter{ExcludeTests: attrs.ExcludeTests, OnlyPlatforms: attrs.OnlyPlatforms}
+	if err := filter.Check(); err != nil {
+		Fatal(&AttrError{"onlyPlatforms", err})
+	}
+	if attrs.MainPath != "" && attrs.PackagePath != "main" {
+		Fatal(&AttrError{"mainPath", fmt.Errorf("only main packages have one, but packagePath is \"%s\"", attrs.PackagePath)})
+	}
+
+	if err := checkCoverMode(attrs.CoverMode); err != nil {
+		Fatal(&AttrError{"coverMode", err})
+	}
+	if attrs.CgoGenerated != "" {
+		// Sources are selected as if cgo were enabled, so fallbacks for its
+		// absence are skipped.
+		Context.CgoEnabled = true
+	}
+
+	if err := checkExtraObjects(attrs.ExtraObjects); err != nil {
+		Fatal(&AttrError{"extraObjects", err})
+	}
+
+	embedCfg := attrs.EmbedCfg
+	if embedCfg != nil {
+		if embedCfg, err = embedCfg.Normalize(); err != nil {
+			Fatal(&AttrError{"embedCfg", err})
+		}
+	}
+
+	return &Compilation{
+		SDK:             sdk,
+		ImportPath:      attrs.PackagePath,
+		Srcs:            srcs,
+		Imports:         attrs.Imports,
+		ImportMap:       attrs.ImportMap,
+		EmbedCfg:        embedCfg,
+		AsmFlags:        attrs.AsmFlags,
+		Std:             attrs.Std || isSDKSource(sdk, attrs.Srcs),
+		Filter:          filter,
+		CoverMode:       attrs.CoverMode,
+		CgoGenerated:    attrs.CgoGenerated,
+		AllowMissingStd: attrs.AllowMissingStd,
+		ExtraObjects:    attrs.ExtraObjects,
+		MainPath:        attrs.MainPath,
+	}
+}
+
+// extraObjectName returns the name of the archive member an object is packed
+// as. The pack tool names members after their files, but the linker skips any
+// not named ".o" or ".syso", so ".o" is appended to other names.
+func extraObjectName(obj string) string {
+	name := filepath.Base(obj)
+	if ext := filepath.Ext(name); ext != ".o" && ext != ".syso" {
+		name += ".o"
+	}
+
+	return name
+}
+
+// extraObjectMembers returns the paths to pack the extra objects from, in
+// order. The linker only loads objects packed directly into the archive, so
+// archives are unpacked, and objects which need to be renamed are linked into
+// the build directory.
+func (c *Compilation) extraObjectMembers() ([]string, error) {
+	dir := filepath.Join(derivation.BuildDir(), "extra")
+	var members []string
+	for _, obj := range c.ExtraObjects {
+		extracted, err := extractArchive(obj, dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack extra object %s: %w", obj, err)
+		}
+		if extracted == nil {
+			extracted = []string{obj}
+		}
+
+		for _, file := range extracted {
+			name := extraObjectName(file)
+			if name != filepath.Base(file) {
+				member := filepath.Join(dir, name)
+				if err := Materialize(file, member, MaterializeSymlink); err != nil {
+					return nil, fmt.Errorf("failed to link extra object %s: %w", obj, err)
+				}
+				file = member
+			}
+			members = append(members, file)
+		}
+	}
+
+	return members, nil
+}
+
+// checkExtraObjects ensures every extra object is a file packed under a name
+// unique among them, so the members of the archive can be told apart. Packages
+// compiled by the Go compiler are rejected, since the linker only accepts one
+// compiled object per package.
+func checkExtraObjects(objs []string) error {
+	names := make(map[string]string, len(objs))
+	for _, obj := range objs {
+		info, err := os.Stat(obj)
+		if err != nil {
+			return err
+		} else if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a file", obj)
+		}
+		if compiled, err := isCompiledPackage(obj); err != nil {
+			return err
+		} else if compiled {
+			return fmt.Errorf("%s is a package compiled by the Go compiler, which must be imported instead", obj)
+		}
+
+		name := extraObjectName(obj)
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("%s and %s have the same name", other, obj)
+		}
+		names[name] = obj
+	}
+
+	return nil
+}
+
+// Metadata describes the compiled package. This must be called after the
+// package has already been compiled.
+func (c *Compilation) Metadata() (*Package, error) {
+	imports, deps, err := c.Deps()
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect dependencies: %w", err)
+	}
+
+	pkg := &Package{
+		SchemaVersion: SchemaVersion,
+		ImportPath:    c.ImportPath,
+		Imports:       imports,
+		Deps:          deps,
+		GOOS:          Context.GOOS,
+		GOARCH:        Context.GOARCH,
+		BuildTags:     slices.Sorted(slices.Values(Context.BuildTags)),
+		ArchFeatures:  c.SDK.ArchFeatures,
+		Experiments:   c.SDK.Experiments,
+		GoVersion:     c.SDK.Version,
+		DynLink:       c.SDK.DynLink,
+	}
+	if compiler := c.SDK.Compiler().Name(); compiler != "gc" {
+		pkg.Compiler = compiler
+	}
+	if pkg.ExportSHA256, err = fileDigest(c.exportData); err != nil {
+		return nil, fmt.Errorf("failed to hash export data: %w", err)
+	}
+	// Generated sources have directives of their own, like cgo's linkname of
+	// runtime.cgocall, which the package's code never wrote.
+	if pkg.LinkDirectives, err = linkDirectives(c.selectedGoSrcs); err != nil {
+		return nil, fmt.Errorf("failed to scan for linkname directives: %w", err)
+	}
+	godebug, err := godebugDirectives(c.ImportPath, c.selectedGoSrcs)
+	if err != nil {
+		return nil, err
+	}
+	if len(godebug) > 0 {
+		pkg.Godebug = godebug
+	}
+	if c.coverFixup != nil {
+		pkg.CoverMode = c.coverFixup.CounterMode
+		pkg.CoverMetaHash = c.coverFixup.MetaHash
+	}
+
+	return pkg, nil
+}
+
+// BuildRecord describes how the package with the metadata pkg was compiled,
+// for the lib output. This must be called after the package has already been
+// compiled.
+func (c *Compilation) BuildRecord(pkg *Package) (*BuildRecord, error) {
+	record := BuildRecord{Metadata: *pkg, CompileFlags: c.compileFlags}
+	var err error
+	if record.ArchiveSHA256, err = fileDigest(c.obj); err != nil {
+		return nil, fmt.Errorf("failed to hash archive: %w", err)
+	}
+	if record.SourceSHA256, err = c.sourceDigests(); err != nil {
+		return nil, fmt.Errorf("failed to hash sources: %w", err)
+	}
+	if record.ImportSHA256, err = c.importDigests(); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// sourceDigests returns the digests of the compiled sources keyed by file name.
+func (c *Compilation) sourceDigests() (map[string]string, error) {
+	if len(c.sources) == 0 {
+		return nil, nil
+	}
+
+	digests := make(map[string]string, len(c.sources))
+	for _, src := range c.sources {
+		digest, err := fileDigest(src)
+		if err != nil {
+			return nil, err
+		}
+		digests[filepath.Base(src)] = digest
+	}
+
+	return digests, nil
+}
+
+// importDigests returns the export data digests of the imports, keyed by
+// import path. Imports from builders which didn't record them are left out.
+func (c *Compilation) importDigests() (map[string]string, error) {
+	if len(c.imports) == 0 {
+		return nil, nil
+	}
+
+	digests := make(map[string]string, len(c.imports))
+	for _, dep := range c.imports {
+		pkg, err := LoadMetadata[Package](dep.StorePath, dep.ImportPath)
+		if err != nil {
+			return nil, err
+		}
+		if pkg.ExportSHA256 != "" {
+			digests[dep.ImportPath] = pkg.ExportSHA256
+		}
+	}
+
+	return digests, nil
+}
+
+// fileDigest returns the hex SHA-256 of a file, or an empty string if path is.
+func fileDigest(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	sum, err := IndexSource(path).Hash()
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum), nil
+}
+
+// reportUnusedImports warns about imports the package never used, or fails
+// if strict.
+func reportUnusedImports(importPath string, unused []string, strict bool) {
+	if len(unused) == 0 {
+		return
+	}
+
+	unusedErr := &UnusedImportsError{importPath, unused}
+	if strict {
+		Fatal(unusedErr)
+	}
+	log.Printf("warning: %v", unusedErr)
+}
+
 func compile(sdk *GoSDK) {
 	attrs := derivation.GetAttrs[CompileAttrs]()
+	if DryRun && attrs.CoverMode != "" {
+		// The imports, and so the importcfg, come from the instrumented
+		// sources.
+		Fatal(&AttrError{"coverMode", errors.New("a dry run can't plan compiling sources the cover tool hasn't generated")})
+	}
+	compilation := prepareCompilation(sdk, &attrs)
+	layout, err := ParseOutputLayout(attrs.OutputLayout)
+	if err != nil {
+		Fatal(&AttrError{"outputLayout", err})
+	}
+
+	libDir := derivation.MustOutput("lib")
+	exportDir := derivation.MustOutput("export")
+
+	name := filepath.Base(attrs.PackagePath)
+
+	var cache *ActionCache
+	var actionID string
+	if attrs.ActionCache != "" && Version == "devel" {
+		// Entries are keyed by the version of the builder which wrote them,
+		// which an unstamped builder doesn't know.
+		log.Print("warning: ignoring actionCache, since this builder wasn't stamped with a version")
+	} else if attrs.ActionCache != "" && !DryRun {
+		cache = &ActionCache{Dir: attrs.ActionCache}
+		if actionID, err = compilation.ActionID(attrs.CompileFlags); err != nil {
+			Fatalf("failed to hash compile action: %v", err)
+		}
+	}
+	hit := false
+	if cache != nil {
+		hit, err = cache.Get(actionID, cacheFiles(libDir, exportDir, attrs.PackagePath))
+		if err != nil {
+			Fatal(err)
+		}
+		cache.LogStats()
+	}
+
+	// Resolving meta packages removes them from Imports.
+	declared := maps.Clone(attrs.Imports)
+	var unused []string
+	if hit {
+		if unused, err = LoadUnusedImports(libDir, attrs.PackagePath); err != nil {
+			Fatalf("failed to read unused imports: %v", err)
+		}
+	} else {
+		err = compilation.CompilePackage(
+			filepath.Join(libDir, name+".a"),
+			filepath.Join(exportDir, name+".x"),
+			attrs.CompileFlags,
+		)
+		if err != nil {
+			Fatal(err)
+		}
+		if DryRun {
+			return
+		}
+
+		if unused, err = FindUnusedImports(declared, compilation.imports); err != nil {
+			Fatalf("failed to find unused imports: %v", err)
+		}
+		if err := SaveUnusedImports(libDir, attrs.PackagePath, unused); err != nil {
+			Fatalf("failed to generate unused imports report: %v", err)
+		}
+	}
+	reportUnusedImports(attrs.PackagePath, unused, attrs.StrictImports)
+
+	if StrictDeterminism {
+		forbidden := []string{sdk.Path, derivation.BuildDir()}
+		for _, archive := range []string{
+			filepath.Join(libDir, name+".a"),
+			filepath.Join(exportDir, name+".x"),
+		} {
+			if err := AuditArchive(archive, forbidden); err != nil {
+				Fatal(err)
+			}
+		}
+	}
+
+	err = layout.Install(libDir, filepath.Join(libDir, name+".a"), attrs.PackagePath, sdk.Instrument)
+	if err != nil {
+		Fatalf("failed to install archive in %s layout: %v", layout, err)
+	}
 
-	libDir, err := OutputPath("lib")
+	if attrs.ConstraintReport {
+		err := SaveSelectionReport(libDir, attrs.PackagePath, compilation.Srcs, &compilation.Filter)
+		if err != nil {
+			Fatalf("failed to generate build constraint report: %v", err)
+		}
+	}
+
+	// Everything else was restored from the cache.
+	if hit {
+		return
+	}
+
+	if err := SaveOverrideReport(libDir, attrs.PackagePath); err != nil {
+		Fatalf("failed to generate meta package override report: %v", err)
+	}
+
+	pkg, err := compilation.Metadata()
 	if err != nil {
-		log.Fatal(err)
+		Fatal(err)
 	}
-	exportDir, err := OutputPath("export")
+	if err := SaveMetadata(exportDir, pkg); err != nil {
+		Fatalf("failed to generate package metadata: %v", err)
+	}
+	record, err := compilation.BuildRecord(pkg)
 	if err != nil {
-		log.Fatal(err)
+		Fatal(err)
+	}
+	if err := SaveBuildRecord(libDir, attrs.PackagePath, record); err != nil {
+		Fatalf("failed to generate build record: %v", err)
 	}
 
+	if cache != nil {
+		files := cacheFiles(libDir, exportDir, attrs.PackagePath)
+		if err := cache.Put(actionID, files); err != nil {
+			log.Printf("warning: failed to store package in action cache: %v", err)
+		}
+	}
+}
+
+// typecheck compiles only the export data of a package, into the export
+// output. Packages importing it can be type checked the same way, so checking
+// that code compiles skips assembling and packing archives nobody links.
+func typecheck(sdk *GoSDK) {
+	attrs := derivation.GetAttrs[CompileAttrs]()
+	compilation := prepareCompilation(sdk, &attrs)
+
+	exportDir := derivation.MustOutput("export")
 	name := filepath.Base(attrs.PackagePath)
-	compilation := &Compilation{
-		SDK:        sdk,
-		ImportPath: attrs.PackagePath,
-		Srcs:       attrs.Srcs,
-		Imports:    attrs.Imports,
-		ImportMap:  attrs.ImportMap,
-		EmbedCfg:   attrs.EmbedCfg,
-	}
-	err = compilation.CompilePackage(
-		filepath.Join(libDir, name+".a"),
-		filepath.Join(exportDir, name+".x"),
-		attrs.CompileFlags,
-	)
+
+	// Resolving meta packages removes them from Imports.
+	declared := maps.Clone(attrs.Imports)
+	err := compilation.CompilePackage("", filepath.Join(exportDir, name+".x"), attrs.CompileFlags)
 	if err != nil {
-		log.Fatal(err)
+		Fatal(err)
 	}
 
-	imports, deps, err := compilation.Deps()
+	unused, err := FindUnusedImports(declared, compilation.imports)
 	if err != nil {
-		log.Fatalf("failed to collect dependencies: %v", err)
+		Fatalf("failed to find unused imports: %v", err)
 	}
-	pkg := &Package{
-		ImportPath: attrs.PackagePath,
-		Imports:    imports,
-		Deps:       deps,
+	reportUnusedImports(attrs.PackagePath, unused, attrs.StrictImports)
+
+	pkg, err := compilation.Metadata()
+	if err != nil {
+		Fatal(err)
 	}
 	if err := SaveMetadata(exportDir, pkg); err != nil {
-		log.Fatalf("failed to generate package metadata: %v", err)
+		Fatalf("failed to generate package metadata: %v", err)
 	}
 }
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"nix/derivation"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// useTempOutputs points the lib and export outputs and the build directory at
+// a temporary directory for the rest of the test.
+func useTempOutputs(t *testing.T) {
+	restore, err := derivation.UseDirs(t.TempDir(), "lib", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(restore)
+}
+
+func TestCompileImportCfg(t *testing.T) {
+	useTempOutputs(t)
+
+	src := filepath.Join(t.TempDir(), "a.go")
+	code := `package a
+
+import (
+	"example.com/dep"
+	"fmt"
+	"old"
+	"unsafe"
+)
+`
+	if err := os.WriteFile(src, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deps := map[string]string{
+		"example.com/dep": "/nix/store/dep",
+		"example.com/new": "/nix/store/new",
+		"fmt":             "/nix/store/fmt",
+		"runtime":         "/nix/store/runtime",
+	}
+	importMap := map[string]string{"old": "example.com/new"}
+	builtin := func(importPath string) bool { return importPath == "unsafe" }
+
+	cfgPath, imports, err := compileImportCfg(
+		"example.com/a",
+		false,
+		[]string{src},
+		deps,
+		importMap,
+		[]string{"runtime", "fmt", "unsafe"},
+		builtin,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dir := filepath.Dir(cfgPath); dir != derivation.BuildDir() {
+		t.Errorf("importcfg written to %s, want the build directory %s", dir, derivation.BuildDir())
+	}
+	cfg, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `importmap old=example.com/new
+packagefile example.com/dep=/nix/store/dep/dep.x
+packagefile example.com/new=/nix/store/new/new.x
+packagefile fmt=/nix/store/fmt/fmt.x
+packagefile runtime=/nix/store/runtime/runtime.x
+`
+	if string(cfg) != want {
+		t.Errorf("importcfg =\n%s\nwant\n%s", cfg, want)
+	}
+
+	var paths []string
+	for _, imp := range imports {
+		paths = append(paths, imp.ImportPath)
+	}
+	if want := []string{"example.com/dep", "example.com/new", "fmt", "runtime"}; !slices.Equal(paths, want) {
+		t.Errorf("imports = %q, want %q", paths, want)
+	}
+	if len(importMap) != 1 {
+		t.Errorf("compileImportCfg changed the import map to %v", importMap)
+	}
+}
+
+func TestCompileImportCfgMissing(t *testing.T) {
+	useTempOutputs(t)
+
+	deps := map[string]string{"fmt": "/nix/store/fmt"}
+	builtin := func(string) bool { return false }
+	_, _, err := compileImportCfg("example.com/a", false, nil, deps, nil, []string{"runtime"}, builtin)
+	if err == nil {
+		t.Error("compileImportCfg with a missing implicit import succeeded")
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	useTempOutputs(t)
+	libDir := derivation.MustOutput("lib")
+	exportDir := derivation.MustOutput("export")
+
+	pkg := Package{
+		SchemaVersion: SchemaVersion,
+		ImportPath:    "example.com/a",
+		Imports:       []string{"fmt"},
+		Deps:          []string{"errors", "fmt"},
+		GOOS:          "linux",
+		GOARCH:        "arm64",
+		BuildTags:     []string{"netgo"},
+		GoVersion:     "1.23.5",
+		ExportSHA256:  "0123",
+	}
+	if err := SaveMetadata(exportDir, pkg); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMetadata[Package](exportDir, pkg.ImportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, pkg) {
+		t.Errorf("loaded metadata %+v, want %+v", loaded, pkg)
+	}
+
+	record := &BuildRecord{
+		Metadata:      pkg,
+		ArchiveSHA256: "4567",
+		SourceSHA256:  map[string]string{"a.go": "89ab"},
+		CompileFlags:  []string{"-p", "example.com/a"},
+		ImportSHA256:  map[string]string{"fmt": "cdef"},
+	}
+	if err := SaveBuildRecord(libDir, pkg.ImportPath, record); err != nil {
+		t.Fatal(err)
+	}
+	loadedRecord, err := LoadBuildRecord(libDir, pkg.ImportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loadedRecord, record) {
+		t.Errorf("loaded build record %+v, want %+v", loadedRecord, record)
+	}
+}
+
+func TestPackageTrimPath(t *testing.T) {
+	t.Setenv("NIX_STORE", "/nix/store")
+
+	tests := []struct {
+		name  string
+		srcs  []string
+		trees []*SourceTree
+		extra []trimRewrite
+		want  string
+	}{
+		{
+			name: "one directory",
+			srcs: []string{"/src/a.go", "/src/b.go"},
+			want: "/src=>example.com/a",
+		},
+		{
+			name: "nested directory",
+			srcs: []string{"/src/gen/b.go", "/src/a.go"},
+			want: "/src/gen=>example.com/a/gen;/src=>example.com/a",
+		},
+		{
+			name: "deeply nested directories",
+			srcs: []string{"/src/x/y/c.go", "/src/a.go", "/src/x/b.go"},
+			want: "/src/x/y=>example.com/a/x/y;/src/x=>example.com/a/x;/src=>example.com/a",
+		},
+		{
+			name: "overlapping names aren't nested",
+			srcs: []string{"/src/a.go", "/src-gen/b.go"},
+			want: "/src-gen=>example.com/a;/src=>example.com/a",
+		},
+		{
+			name: "roots of the same length",
+			srcs: []string{"/b/a.go", "/a/b.go"},
+			want: "/a=>example.com/a;/b=>example.com/a",
+		},
+		{
+			name: "store directory isn't a parent",
+			srcs: []string{"/nix/store/aaa-a.go", "/nix/store/bbb-gen/b.go"},
+			want: "/nix/store/bbb-gen=>example.com/a;/nix/store=>example.com/a",
+		},
+		{
+			name:  "nested in a source tree",
+			srcs:  []string{"/build/tree/sub/a.go"},
+			trees: []*SourceTree{{Root: "/build/tree", ImportPath: "example.com/t"}},
+			want:  "/build/tree/sub=>example.com/t/sub;/build/tree=>example.com/t",
+		},
+		{
+			name:  "source tree takes its own import path",
+			srcs:  []string{"/build/tree/a.go"},
+			trees: []*SourceTree{{Root: "/build/tree", ImportPath: "example.com/t"}},
+			want:  "/build/tree=>example.com/t",
+		},
+		{
+			name:  "extra rewrites come after longer ones",
+			srcs:  []string{"/src/a.go"},
+			extra: []trimRewrite{{"/build", ""}},
+			want:  "/build=>;/src=>example.com/a",
+		},
+		{
+			name:  "extra rewrites don't replace sources",
+			srcs:  []string{"/build/a.go"},
+			extra: []trimRewrite{{"/build", ""}},
+			want:  "/build=>example.com/a",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sourceTrees = test.trees
+			defer func() { sourceTrees = nil }()
+
+			got := packageTrimPath(test.srcs, "example.com/a", test.extra...)
+			if got != test.want {
+				t.Errorf("packageTrimPath(%q) = %q, want %q", test.srcs, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrimParent(t *testing.T) {
+	t.Setenv("NIX_STORE", "/nix/store")
+	rewrites := map[string]string{
+		"/src":       "example.com/a",
+		"/src/x":     "example.com/a/x",
+		"/nix/store": "example.com/a",
+	}
+
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{"/src/x/y", "/src/x"},
+		{"/src/x", "/src"},
+		{"/src/y", "/src"},
+		{"/src", ""},
+		{"/src-gen", ""},
+		{"/src/x-gen", "/src"},
+		{"/nix/store/aaa-gen", ""},
+		{"/other", ""},
+	}
+	for _, test := range tests {
+		if got := trimParent(rewrites, test.dir); got != test.want {
+			t.Errorf("trimParent(%q) = %q, want %q", test.dir, got, test.want)
+		}
+	}
+}
+
+func TestCleanEmbedName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"./a.txt", "a.txt", true},
+		{"static//a.txt", "static/a.txt", true},
+		{"static/../a.txt", "a.txt", true},
+		{"..a.txt", "..a.txt", true},
+		{".", "", false},
+		{"static/..", "", false},
+		{"..", "", false},
+		{"../a.txt", "", false},
+		{"static/../../a.txt", "", false},
+		{"/a.txt", "", false},
+	}
+	for _, test := range tests {
+		got, err := cleanEmbedName(test.name)
+		if ok := err == nil; ok != test.ok || got != test.want {
+			t.Errorf("cleanEmbedName(%q) = %q, %v; want %q, ok %t", test.name, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestEmbedCfgNormalize(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a, b, hidden := file("a"), file("b"), file("hidden")
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(a, link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  EmbedCfg
+		want *EmbedCfg
+	}{
+		{
+			name: "names are cleaned",
+			cfg: EmbedCfg{
+				Patterns: map[string][]string{"./a.txt": {"./a.txt"}},
+				Files:    map[string]string{"./a.txt": a},
+			},
+			want: &EmbedCfg{
+				Patterns: map[string][]string{"./a.txt": {"a.txt"}},
+				Files:    map[string]string{"a.txt": a},
+			},
+		},
+		{
+			name: "symlinks are resolved",
+			cfg: EmbedCfg{
+				Patterns: map[string][]string{"a.txt": {"a.txt"}},
+				Files:    map[string]string{"a.txt": link},
+			},
+			want: &EmbedCfg{
+				Patterns: map[string][]string{"a.txt": {"a.txt"}},
+				Files:    map[string]string{"a.txt": a},
+			},
+		},
+		{
+			name: "duplicate names of the same file are merged",
+			cfg: EmbedCfg{
+				Patterns: map[string][]string{"*.txt": {"a.txt", "./a.txt"}},
+				Files:    map[string]string{"a.txt": a, "./a.txt": link},
+			},
+			want: &EmbedCfg{
+				Patterns: map[string][]string{"*.txt": {"a.txt"}},
+				Files:    map[string]string{"a.txt": a},
+			},
+		},
+		{
+			name: "directories are expanded and sorted",
+			cfg: EmbedCfg{
+				Patterns: map[string][]string{"static": {"static"}},
+				Files: map[string]string{
+					"static/b.txt":      b,
+					"static/a.txt":      a,
+					"static/.hidden":    hidden,
+					"static/_sub/x.txt": hidden,
+				},
+			},
+			want: &EmbedCfg{
+				Patterns: map[string][]string{"static": {"static/a.txt", "static/b.txt"}},
+				Files: map[string]string{
+					"static/a.txt":      a,
+					"static/b.txt":      b,
+					"static/.hidden":    hidden,
+					"static/_sub/x.txt": hidden,
+				},
+			},
+		},
+		{
+			name: "all: keeps hidden files",
+			cfg: EmbedCfg{
+				Patterns: map[string][]string{"all:static": {"static"}},
+				Files: map[string]string{
+					"static/a.txt":   a,
+					"static/.hidden": hidden,
+				},
+			},
+			want: &EmbedCfg{
+				Patterns: map[string][]string{"all:static": {"static/.hidden", "static/a.txt"}},
+				Files: map[string]string{
+					"static/a.txt":   a,
+					"static/.hidden": hidden,
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.cfg.Normalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Normalize() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name string
+		cfg  EmbedCfg
+	}{
+		{
+			name: "parent directory",
+			cfg:  EmbedCfg{Files: map[string]string{"../a.txt": a}},
+		},
+		{
+			name: "escaping name",
+			cfg:  EmbedCfg{Files: map[string]string{"static/../../a.txt": a}},
+		},
+		{
+			name: "absolute path",
+			cfg:  EmbedCfg{Files: map[string]string{"/a.txt": a}},
+		},
+		{
+			name: "duplicate names of different files",
+			cfg:  EmbedCfg{Files: map[string]string{"a.txt": a, "./a.txt": b}},
+		},
+		{
+			name: "escaping pattern",
+			cfg: EmbedCfg{
+				Patterns: map[string][]string{"a.txt": {"../a.txt"}},
+				Files:    map[string]string{"a.txt": a},
+			},
+		},
+		{
+			name: "pattern matching nothing",
+			cfg: EmbedCfg{
+				Patterns: map[string][]string{"static": {"static"}},
+				Files:    map[string]string{"a.txt": a},
+			},
+		},
+		{
+			name: "missing file",
+			cfg:  EmbedCfg{Files: map[string]string{"a.txt": filepath.Join(dir, "missing")}},
+		},
+	}
+	for _, test := range invalid {
+		if _, err := test.cfg.Normalize(); err == nil {
+			t.Errorf("%s: Normalize() succeeded, want an error", test.name)
+		}
+	}
+}
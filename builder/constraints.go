@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go/build/constraint"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var (
+	// Taken from src/go/build/syslist.go
+	knownOS = []string{
+		"aix", "android", "darwin", "dragonfly", "freebsd", "hurd", "illumos",
+		"ios", "js", "linux", "nacl", "netbsd", "openbsd", "plan9", "solaris",
+		"wasip1", "windows", "zos",
+	}
+	unixOS = []string{
+		"aix", "android", "darwin", "dragonfly", "freebsd", "hurd", "illumos",
+		"ios", "linux", "netbsd", "openbsd", "solaris",
+	}
+	knownArch = []string{
+		"386", "amd64", "amd64p32", "arm", "armbe", "arm64", "arm64be", "loong64",
+		"mips", "mipsle", "mips64", "mips64le", "mips64p32", "mips64p32le", "ppc",
+		"ppc64", "ppc64le", "riscv", "riscv64", "s390", "s390x", "sparc",
+		"sparc64", "wasm",
+	}
+)
+
+// A FileSelection records whether a source file was included in the build and
+// why.
+type FileSelection struct {
+	Path     string
+	Included bool
+	Reason   string `json:",omitempty"`
+}
+
+// matchTag reports whether a build tag is satisfied by Context. This follows
+// the rules of go/build, which doesn't export them.
+func matchTag(tag string) bool {
+	switch {
+	case tag == Context.GOOS || tag == Context.GOARCH || tag == Context.Compiler:
+		return true
+	case tag == "cgo":
+		return Context.CgoEnabled
+	case tag == "unix":
+		return slices.Contains(unixOS, Context.GOOS)
+	case tag == "linux" && Context.GOOS == "android":
+		return true
+	case tag == "solaris" && Context.GOOS == "illumos":
+		return true
+	case tag == "darwin" && Context.GOOS == "ios":
+		return true
+	}
+
+	return slices.Contains(Context.BuildTags, tag) ||
+		slices.Contains(Context.ToolTags, tag) ||
+		slices.Contains(Context.ReleaseTags, tag)
+}
+
+// experimentToolTags applies GOEXPERIMENT experiments to the tool tags of a
+// build as the go command would. Each experiment X adds "goexperiment.X", while
+// "noX" disables X, removing its tag even if X is on by default. Experiments
+// apply in order, so the last mention of each wins.
+func experimentToolTags(tags, experiments []string) []string {
+	enabled := make(map[string]bool)
+	for _, experiment := range experiments {
+		name, disabled := strings.CutPrefix(experiment, "no")
+		enabled[name] = !disabled
+	}
+
+	tags = slices.DeleteFunc(slices.Clone(tags), func(tag string) bool {
+		name, ok := strings.CutPrefix(tag, "goexperiment.")
+		_, listed := enabled[name]
+		return ok && listed
+	})
+	for _, name := range SortedKeys(enabled) {
+		if enabled[name] {
+			tags = append(tags, "goexperiment."+name)
+		}
+	}
+
+	return tags
+}
+
+// fileNameSuffix returns the _GOOS and _GOARCH constraints of a file name,
+// either of which may be empty.
+func fileNameSuffix(name string) (goos, goarch string) {
+	name, _, _ = strings.Cut(name, ".")
+	name = strings.TrimSuffix(name, "_test")
+
+	// The first element of the name is never a constraint.
+	_, name, ok := strings.Cut(name, "_")
+	if !ok {
+		return "", ""
+	}
+	parts := strings.Split(name, "_")
+
+	n := len(parts)
+	switch {
+	case n >= 2 && slices.Contains(knownOS, parts[n-2]) && slices.Contains(knownArch, parts[n-1]):
+		return parts[n-2], parts[n-1]
+	case slices.Contains(knownOS, parts[n-1]):
+		return parts[n-1], ""
+	case slices.Contains(knownArch, parts[n-1]):
+		return "", parts[n-1]
+	}
+
+	return "", ""
+}
+
+// explainFileName returns why the _GOOS or _GOARCH suffix of a file name
+// excludes it, or an empty string if it doesn't.
+func explainFileName(name string) string {
+	goos, goarch := fileNameSuffix(name)
+	switch {
+	case goos != "" && goarch != "":
+		if !matchTag(goos) || !matchTag(goarch) {
+			return fmt.Sprintf("file name suffix _%s_%s", goos, goarch)
+		}
+	case goos != "" && !matchTag(goos):
+		return fmt.Sprintf("file name suffix _%s", goos)
+	case goarch != "" && !matchTag(goarch):
+		return fmt.Sprintf("file name suffix _%s", goarch)
+	}
+
+	return ""
+}
+
+// A SourceFilter drops sources before they're matched against Context, so a
+// whole source tree can be given as Srcs. Only file names are checked, so the
+// same sources are always dropped, whatever they contain.
+type SourceFilter struct {
+	// Drop _test.go files.
+	ExcludeTests bool
+
+	// Platforms the sources are meant for, like "linux/amd64". Files whose
+	// _GOOS or _GOARCH suffix matches none of them are dropped. Every platform
+	// is kept if empty.
+	OnlyPlatforms []string
+}
+
+// parsePlatform splits a platform like "linux/amd64" into GOOS and GOARCH.
+func parsePlatform(platform string) (goos, goarch string, err error) {
+	goos, goarch, ok := strings.Cut(platform, "/")
+	if !ok || !slices.Contains(knownOS, goos) || !slices.Contains(knownArch, goarch) {
+		return "", "", fmt.Errorf("unknown platform \"%s\", expected GOOS/GOARCH", platform)
+	}
+
+	return goos, goarch, nil
+}
+
+// Check fails if the filter is invalid, or excludes the platform of Context.
+func (f *SourceFilter) Check() error {
+	target := Context.GOOS + "/" + Context.GOARCH
+	for _, platform := range f.OnlyPlatforms {
+		if _, _, err := parsePlatform(platform); err != nil {
+			return err
+		}
+	}
+	if len(f.OnlyPlatforms) > 0 && !slices.Contains(f.OnlyPlatforms, target) {
+		return fmt.Errorf("building for %s, which is not one of %s", target, strings.Join(f.OnlyPlatforms, ", "))
+	}
+
+	return nil
+}
+
+// matchOS reports whether a _GOOS file name suffix is built for goos, which
+// also includes the platforms implying another, like android implying linux.
+func matchOS(tag, goos string) bool {
+	return tag == goos ||
+		tag == "linux" && goos == "android" ||
+		tag == "solaris" && goos == "illumos" ||
+		tag == "darwin" && goos == "ios"
+}
+
+// Explain returns why the filter drops src, or an empty string if it doesn't.
+func (f *SourceFilter) Explain(src string) string {
+	name := filepath.Base(src)
+	if f.ExcludeTests && strings.HasSuffix(name, "_test.go") {
+		return "test file"
+	}
+
+	goos, goarch := fileNameSuffix(name)
+	if len(f.OnlyPlatforms) == 0 || goos == "" && goarch == "" {
+		return ""
+	}
+	for _, platform := range f.OnlyPlatforms {
+		// Checked by [SourceFilter.Check].
+		platformOS, platformArch, _ := parsePlatform(platform)
+		if (goos == "" || matchOS(goos, platformOS)) && (goarch == "" || goarch == platformArch) {
+			return ""
+		}
+	}
+
+	return "not built for any of onlyPlatforms"
+}
+
+// readConstraints parses the build constraints at the top of a source file.
+func readConstraints(in io.Reader) ([]constraint.Expr, error) {
+	var exprs []constraint.Expr
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			// Constraints must come before any code, including the package
+			// clause.
+			break
+		}
+
+		if constraint.IsGoBuild(line) || constraint.IsPlusBuild(line) {
+			expr, err := constraint.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, expr)
+		}
+	}
+
+	return exprs, scanner.Err()
+}
+
+// explainConstraints returns which build constraint of a file excludes it, or
+// an empty string if none do.
+func explainConstraints(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	exprs, err := readConstraints(file)
+	if err != nil {
+		return "", err
+	}
+	for _, expr := range exprs {
+		if !expr.Eval(matchTag) {
+			return fmt.Sprintf("build constraint \"%s\"", expr), nil
+		}
+	}
+
+	return "", nil
+}
+
+// ExplainSelection records why filter or Context.MatchFile included or excluded
+// each of srcs.
+func ExplainSelection(srcs []string, filter *SourceFilter) ([]FileSelection, error) {
+	selections := make([]FileSelection, 0, len(srcs))
+	for _, src := range srcs {
+		name := filepath.Base(src)
+		selection := FileSelection{Path: src}
+		if reason := filter.Explain(src); reason != "" {
+			selection.Reason = reason
+			selections = append(selections, selection)
+			continue
+		}
+
+		match, err := IndexSource(src).Match()
+		if err != nil {
+			return nil, err
+		}
+		selection.Included = match
+
+		if !match {
+			switch {
+			case strings.HasPrefix(name, "_") || strings.HasPrefix(name, "."):
+				selection.Reason = "file name starts with _ or ."
+			default:
+				selection.Reason = explainFileName(name)
+			}
+			if selection.Reason == "" {
+				selection.Reason, err = explainConstraints(src)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if selection.Reason == "" && filepath.Ext(src) == ".go" {
+				imports, err := IndexSource(src).Imports()
+				if err != nil {
+					return nil, err
+				}
+				if slices.Contains(imports, "C") {
+					selection.Reason = "uses cgo, which is disabled"
+				}
+			}
+			if selection.Reason == "" {
+				selection.Reason = "unknown"
+			}
+		}
+
+		selections = append(selections, selection)
+	}
+
+	return selections, nil
+}
+
+// SaveSelectionReport writes a report of which sources were included in the
+// build of a package to dir.
+func SaveSelectionReport(dir, importPath string, srcs []string, filter *SourceFilter) error {
+	selections, err := ExplainSelection(srcs, filter)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, filepath.Base(importPath)+".constraints.json")
+	return WriteGenerated(path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(selections)
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExperimentToolTags(t *testing.T) {
+	defaults := []string{"goexperiment.aliastypeparams", "goexperiment.swissmap"}
+
+	tests := []struct {
+		name        string
+		experiments []string
+		want        []string
+	}{
+		{"none", nil, defaults},
+		{
+			"enable",
+			[]string{"rangefunc"},
+			[]string{"goexperiment.aliastypeparams", "goexperiment.swissmap", "goexperiment.rangefunc"},
+		},
+		{
+			"enable a default",
+			[]string{"swissmap"},
+			[]string{"goexperiment.aliastypeparams", "goexperiment.swissmap"},
+		},
+		{
+			"disable a default",
+			[]string{"noswissmap"},
+			[]string{"goexperiment.aliastypeparams"},
+		},
+		{
+			"disable one not enabled",
+			[]string{"norangefunc"},
+			defaults,
+		},
+		{
+			"last mention wins",
+			[]string{"norangefunc", "rangefunc", "swissmap", "noswissmap"},
+			[]string{"goexperiment.aliastypeparams", "goexperiment.rangefunc"},
+		},
+	}
+	for _, test := range tests {
+		got := experimentToolTags(defaults, test.experiments)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: experimentToolTags(%q) = %q, want %q", test.name, test.experiments, got, test.want)
+		}
+	}
+}
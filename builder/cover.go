@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// coverageRuntime is the package which writes out the coverage data of an
+// instrumented binary. The compiler calls into it from the init function of
+// the main package, and the go command links it into every instrumented
+// binary. Since Go 1.23 it wraps internal/coverage/cfile, which it imports, so
+// it's the same package for every version of the cover tool's format.
+const coverageRuntime = "runtime/coverage"
+
+// checkCoverMode checks a counter mode of the cover tool, where an empty mode
+// leaves the package uninstrumented.
+func checkCoverMode(mode string) error {
+	switch mode {
+	case "", "set", "count", "atomic":
+		return nil
+	default:
+		return fmt.Errorf("unknown coverage mode \"%s\", expected set, count, or atomic", mode)
+	}
+}
+
+// coverPkgConfig is the package configuration read by the cover tool, like
+// the go command writes for "go build -cover".
+type coverPkgConfig struct {
+	OutConfig   string
+	PkgPath     string
+	PkgName     string
+	Granularity string
+	ModulePath  string
+	Local       bool
+}
+
+// coverFixupConfig is the part of the configuration written by the cover tool
+// for the compiler which is recorded in the package metadata.
+type coverFixupConfig struct {
+	MetaHash    string
+	CounterMode string
+}
+
+// instrumentCoverage runs the cover tool on the Go sources of the package,
+// replacing them with instrumented copies and a file declaring the counters
+// and coverage metadata, which the compiler registers with the runtime.
+// Tests aren't instrumented, like with the go command.
+func (c *Compilation) instrumentCoverage() error {
+	header, err := IndexSource(c.goSrcs[0]).Header()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(derivation.BuildDir(), "cover")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	pkgCfg := filepath.Join(dir, "pkgcfg.json")
+	outCfg := filepath.Join(dir, "coveragecfg")
+	err = WriteGenerated(pkgCfg, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(coverPkgConfig{
+			OutConfig:   outCfg,
+			PkgPath:     c.ImportPath,
+			PkgName:     header.Name.Name,
+			Granularity: "perblock",
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var srcs, instrumented []string
+	outputs := []string{filepath.Join(dir, "covervars.go")}
+	for i, src := range c.goSrcs {
+		if strings.HasSuffix(src, "_test.go") {
+			instrumented = append(instrumented, src)
+			continue
+		}
+		base := strings.TrimSuffix(filepath.Base(src), ".go")
+		out := filepath.Join(dir, fmt.Sprintf("%s.%d.cover.go", base, i))
+		srcs = append(srcs, src)
+		outputs = append(outputs, out)
+		instrumented = append(instrumented, out)
+	}
+	if len(srcs) == 0 {
+		return nil
+	}
+	outList := filepath.Join(dir, "outfiles")
+	err = WriteGenerated(outList, func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(outputs, "\n")+"\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Counter variables are named after the package, like the go command
+	// does, so they're the same whichever builder instrumented it.
+	sum := sha256.Sum256([]byte(c.ImportPath))
+	cmd := c.SDK.RunTool(
+		"cover",
+		"-pkgcfg", pkgCfg,
+		"-mode", c.CoverMode,
+		"-var", fmt.Sprintf("goCover_%x_", sum[:6]),
+		"-outfilelist", outList,
+	)
+	cmd.Args = append(cmd.Args, srcs...)
+	cmd.Env = c.SDK.PackageEnv(c.ImportPath)
+	if err := RecordAction(cmd, slices.Concat(srcs, []string{pkgCfg, outList}), slices.Concat(outputs, []string{outCfg})); err != nil {
+		return err
+	}
+	SetPhase("cover")
+	if err := RunLogged(cmd); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(outCfg)
+	if err != nil {
+		return err
+	}
+	c.coverFixup = &coverFixupConfig{}
+	if err := json.Unmarshal(data, c.coverFixup); err != nil {
+		return fmt.Errorf("failed to read coverage config: %w", err)
+	}
+	c.coverCfg = outCfg
+	c.goSrcs = slices.Concat(outputs[:1], instrumented)
+
+	return nil
+}
+
+// CoverModeError records packages linked into a binary which were
+// instrumented for coverage with different counter modes, or instrumented
+// packages linked into a main package which wasn't. Only an instrumented main
+// package registers the coverage of the binary with the runtime, and the
+// runtime expects a single counter mode.
+type CoverModeError struct {
+	// Instrumented packages keyed by their counter mode, and the main package
+	// under "" if it wasn't instrumented.
+	Modes map[string][]string
+}
+
+func (e CoverModeError) Error() string {
+	var modes strings.Builder
+	for _, mode := range SortedKeys(e.Modes) {
+		name := mode
+		if name == "" {
+			name = "none"
+		}
+		fmt.Fprintf(&modes, "\n    %s: %s", name, strings.Join(e.Modes[mode], ", "))
+	}
+
+	return fmt.Sprintf(
+		"packages linked into the binary are instrumented for coverage differently:%s\n\n  Build the main package and every instrumented package with the same coverMode.",
+		modes.String(),
+	)
+}
+
+// checkCoverage fails unless every package instrumented for coverage which is
+// linked with main, found from the metadata of exports, has the same counter
+// mode as main. Packages which weren't instrumented are linked as they are,
+// like the standard library.
+func checkCoverage(main *Package, exports map[string]string) error {
+	modes := map[string][]string{main.CoverMode: {main.ImportPath}}
+	for _, importPath := range main.Deps {
+		storePath := exports[importPath]
+		if storePath == "" {
+			continue
+		}
+		dep, err := LoadMetadata[Package](storePath, importPath)
+		if err != nil {
+			return err
+		}
+		if dep.CoverMode != "" {
+			modes[dep.CoverMode] = append(modes[dep.CoverMode], importPath)
+		}
+	}
+
+	if len(modes) > 1 {
+		return &CoverModeError{modes}
+	}
+
+	return nil
+}
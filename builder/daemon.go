@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"nix/derivation"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// A Job is a single run of the builder sent to the daemon, as if it were run
+// with Args and the attributes Attrs.
+type Job struct {
+	// Arguments after the name of the builder, like ["compile"].
+	Args []string
+
+	// The derivation attributes, as written by Nix for __structuredAttrs.
+	Attrs json.RawMessage
+
+	// Environment variables set for the job only, like $NIX_BUILD_TOP.
+	Env map[string]string
+}
+
+// A JobResult is the outcome of a [Job].
+type JobResult struct {
+	// The exit status the builder would have had, and its error summary if it
+	// failed.
+	ExitCode int
+	Error    *ErrorSummary `json:",omitempty"`
+
+	// Everything the job logged and its tools printed to stderr.
+	Output string
+}
+
+// A jobExit ends a job of the daemon early, in place of exiting the builder.
+type jobExit struct {
+	summary *ErrorSummary
+}
+
+// Daemon runs builder jobs within one long-running process, so SDKs and
+// packed metadata are loaded once instead of by every job. It's served over
+// JSON-RPC (version 1.0) as the "Daemon" service, with the method "Run".
+//
+// The builder keeps the state of a build in package variables, so jobs are run
+// one at a time, and that state is reset before each.
+type Daemon struct {
+	mu sync.Mutex
+
+	// State of the builder before the first job, restored for every job.
+	context      build.Context
+	metaPackages []string
+	buildDirPath string
+	path         string
+	hasPath      bool
+}
+
+// NewDaemon prepares a daemon from the current state of the builder.
+func NewDaemon() *Daemon {
+	context := Context
+	context.BuildTags = slices.Clone(Context.BuildTags)
+	context.ToolTags = slices.Clone(Context.ToolTags)
+	context.ReleaseTags = slices.Clone(Context.ReleaseTags)
+
+	path, hasPath := os.LookupEnv("PATH")
+
+	return &Daemon{
+		context:      context,
+		metaPackages: slices.Clone(MetaPackages),
+		buildDirPath: derivation.BuildDirPath,
+		path:         path,
+		hasPath:      hasPath,
+	}
+}
+
+// reset restores the state a job could have changed, and sets the arguments of
+// job. Metadata loaded from packs is kept, since store paths never change.
+// Sources may be outside the store, so they're indexed again.
+func (d *Daemon) reset(job *Job) {
+	// Whether the daemon itself was started with "--dry-run" doesn't matter,
+	// only whether the job was.
+	os.Args, DryRun = dryRunArg(append([]string{os.Args[0]}, job.Args...))
+	Command = ""
+	if len(os.Args) > 1 {
+		Command = os.Args[1]
+	}
+
+	Context = d.context
+	Context.BuildTags = slices.Clone(d.context.BuildTags)
+	Context.ToolTags = slices.Clone(d.context.ToolTags)
+	Context.ReleaseTags = slices.Clone(d.context.ReleaseTags)
+	MetaPackages = slices.Clone(d.metaPackages)
+	MetaConflicts = ConflictOverride
+	MetaOverrides = nil
+	ToolTimeout = 0
+	diagnosticPaths = nil
+	diagnosticSources = nil
+	sourceTrees = nil
+	sourceIndex = make(map[string]*SourceFile)
+	actionManifests = []ActionManifest{}
+	toolProfiles = []ToolProfile{}
+	derivation.BuildDirPath = d.buildDirPath
+	derivation.ForgetBuildDir()
+	NixLog = os.Getenv("NIX_BUILD_TOP") != ""
+
+	// Jobs with nativeBuildInputs replace $PATH for their tools, which the
+	// next job mustn't inherit. The environment of the job takes precedence.
+	if path, ok := job.Env["PATH"]; ok {
+		os.Setenv("PATH", path)
+	} else if d.hasPath {
+		os.Setenv("PATH", d.path)
+	} else {
+		os.Unsetenv("PATH")
+	}
+}
+
+// Run runs a job, reporting its failure in result rather than as an error.
+func (d *Daemon) Run(job *Job, result *JobResult) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name, value := range job.Env {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	d.reset(job)
+
+	output, err := os.CreateTemp("", "builder-job")
+	if err != nil {
+		return fmt.Errorf("failed to capture job output: %w", err)
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	stderr := os.Stderr
+	os.Stderr = output
+	log.SetOutput(output)
+	defer func() {
+		os.Stderr = stderr
+		log.SetOutput(stderr)
+	}()
+
+	result.Error = runJob(func() {
+		if err := derivation.LoadJson(job.Attrs); err != nil {
+			fatalAttrs(fmt.Errorf("failed to read job attributes: %w", err))
+		}
+		// Like from main, doctor loads the attributes itself.
+		if Command == "doctor" {
+			doctor()
+			return
+		}
+		run()
+	})
+	if result.Error != nil {
+		result.ExitCode = result.Error.ExitCode
+	}
+
+	if _, err := output.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read job output: %w", err)
+	}
+	data, err := io.ReadAll(output)
+	if err != nil {
+		return fmt.Errorf("failed to read job output: %w", err)
+	}
+	result.Output = string(data)
+
+	return nil
+}
+
+// runJob runs a job of the daemon, returning the error summary if it failed.
+func runJob(job func()) (summary *ErrorSummary) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if exit, ok := r.(jobExit); ok {
+			summary = exit.summary
+			return
+		}
+
+		err := &InternalError{r, debug.Stack()}
+		log.Print(err)
+		summary = NewErrorSummary(CategoryInternal, err.Error(), err)
+		summary.Write()
+	}()
+
+	job()
+	return nil
+}
+
+// daemon serves builder jobs on the unix socket given as its argument until
+// interrupted.
+func daemon() {
+	if len(os.Args) < 3 {
+		fatal(CategoryAttr, fmt.Sprintf("daemon needs a socket path\n%s", usage), nil)
+	}
+	socket := os.Args[2]
+
+	server := rpc.NewServer()
+	if err := server.Register(NewDaemon()); err != nil {
+		Fatalf("failed to start daemon: %v", err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		Fatalf("failed to start daemon: %v", err)
+	}
+	defer os.Remove(socket)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	// Failures of a job only end the job.
+	exit = func(summary *ErrorSummary) {
+		panic(jobExit{summary})
+	}
+
+	log.Printf("serving jobs on %s", socket)
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			exit = exitBuilder
+			Fatalf("failed to accept connection: %v", err)
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
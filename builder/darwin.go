@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// darwinHeaderPadFlag has the external linker leave as much room as possible
+// for load commands, so install_name_tool can rewrite library paths of the
+// binary later. The internal linker always reserves a page for them.
+const darwinHeaderPadFlag = "-Wl,-headerpad_max_install_names"
+
+// CodesignAttrs configures signing of darwin binaries after linking.
+type CodesignAttrs struct {
+	// Identity to sign with. Defaults to "-", an ad-hoc signature.
+	Identity string
+
+	// Path to an entitlements plist to embed in the signature.
+	Entitlements string
+}
+
+// codesignCommand creates the command signing binary, preferring rcodesign if
+// it is in nativeBuildInputs since it doesn't rely on the host keychain.
+func codesignCommand(binary string, attrs *CodesignAttrs) (*exec.Cmd, error) {
+	identity := attrs.Identity
+	if identity == "" {
+		identity = "-"
+	}
+
+	if rcodesign, err := FindNativeTool("rcodesign"); err == nil && identity == "-" {
+		cmd := exec.Command(rcodesign, "sign")
+		if attrs.Entitlements != "" {
+			cmd.Args = append(cmd.Args, "--entitlements-xml-path", attrs.Entitlements)
+		}
+		cmd.Args = append(cmd.Args, binary)
+		return cmd, nil
+	}
+
+	codesign, err := FindNativeTool("codesign")
+	if err != nil {
+		return nil, fmt.Errorf("neither rcodesign nor codesign could be used: %w", err)
+	}
+	cmd := exec.Command(
+		codesign,
+		"--force",
+		"--sign", identity,
+		// Secure timestamps come from a server and would make the output
+		// unreproducible.
+		"--timestamp=none",
+	)
+	if attrs.Entitlements != "" {
+		cmd.Args = append(cmd.Args, "--entitlements", attrs.Entitlements)
+	}
+	cmd.Args = append(cmd.Args, binary)
+	return cmd, nil
+}
+
+// signDarwinBinary signs a linked binary in place.
+func signDarwinBinary(binary string, attrs *CodesignAttrs) error {
+	if Context.GOOS != "darwin" && Context.GOOS != "ios" {
+		return fmt.Errorf(
+			"binaries can only be code signed when targeting darwin, not %s",
+			Context.GOOS,
+		)
+	}
+
+	cmd, err := codesignCommand(binary, attrs)
+	if err != nil {
+		return err
+	}
+	cmd.Env = NativeEnv()
+	if err := RunLogged(cmd); err != nil {
+		return fmt.Errorf("failed to sign binary: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"nix/derivation"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A DeadcodePackage describes what the linker kept of a package.
+type DeadcodePackage struct {
+	ImportPath string
+
+	// Number of symbols of the package kept in the binary, and the functions
+	// which were discarded.
+	Reachable int
+	Discarded []string `json:",omitempty"`
+
+	// The shortest chain of references from an entry point of the binary to the
+	// package, explaining why it was kept.
+	ReachedBy []string `json:",omitempty"`
+}
+
+// A DeadcodeReport lists every package linked into a binary. Packages with no
+// reachable symbols were discarded entirely.
+type DeadcodeReport struct {
+	Packages []DeadcodePackage
+}
+
+// Suffixes of symbols the compiler generates to describe functions, like
+// stack maps. The linker reports these as reachable from the runtime, which
+// would hide what actually kept their function.
+var auxSymbolSuffixes = []string{
+	".arginfo0",
+	".arginfo1",
+	".argliveinfo",
+	".args_stackmap",
+	".opendefer",
+	".stkobj",
+	".wrapinfo",
+}
+
+// symbolPackage returns the import path of the package defining the linker
+// symbol sym, or "" for symbols generated by the compiler or linker.
+func symbolPackage(sym string) string {
+	sym = strings.TrimPrefix(sym, "type:")
+	sym = strings.TrimLeft(sym, "*[]")
+	if strings.HasPrefix(sym, "go:") {
+		return ""
+	}
+	for _, suffix := range auxSymbolSuffixes {
+		if strings.HasSuffix(sym, suffix) {
+			return ""
+		}
+	}
+
+	head := sym
+	if end := strings.IndexAny(sym, "[("); end >= 0 {
+		head = sym[:end]
+	}
+	slash := strings.LastIndex(head, "/")
+	dot := strings.Index(head[slash+1:], ".")
+	if dot < 0 {
+		return ""
+	}
+
+	return head[:slash+1+dot]
+}
+
+// parseDumpDep reads the reachability graph printed by "link -dumpdep". Each
+// line is a reference from one symbol to another, where references from "_"
+// are the entry points of the binary.
+func parseDumpDep(r io.Reader) (map[string][]string, error) {
+	edges := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		from, to, ok := strings.Cut(scanner.Text(), " -> ")
+		if !ok {
+			return nil, fmt.Errorf("unexpected line in linker dependency dump: %s", scanner.Text())
+		}
+		edges[from] = append(edges[from], to)
+	}
+
+	return edges, scanner.Err()
+}
+
+// definedFunctions lists the functions defined by an archive, using the SDK's
+// nm. Newer SDKs don't ship nm prebuilt, so it's run through "go tool", which
+// builds it if needed.
+func definedFunctions(sdk *GoSDK, archive string) ([]string, error) {
+	var out bytes.Buffer
+	cmd := sdk.RunGo("tool", "nm", archive)
+	cmd.Env = append(
+		sdk.Env(),
+		fmt.Sprintf("GOCACHE=%s", filepath.Join(derivation.BuildDir(), "go-cache")),
+		fmt.Sprintf("GOROOT=%s", sdk.Path),
+	)
+	cmd.Stdout = &out
+	if err := RunLogged(cmd); err != nil {
+		return nil, fmt.Errorf("failed to list symbols of %s: %w", archive, err)
+	}
+
+	var funcs []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		// Lines are an address, a type, and a name which may contain spaces.
+		fields := strings.SplitN(strings.TrimLeft(line, " "), " ", 3)
+		if len(fields) == 3 && fields[1] == "T" {
+			funcs = append(funcs, fields[2])
+		}
+	}
+
+	return funcs, nil
+}
+
+// NewDeadcodeReport compares the symbols reachable in the linker's dependency
+// dump with the functions defined in archives, keyed by import path.
+func NewDeadcodeReport(sdk *GoSDK, dump io.Reader, archives map[string]string) (*DeadcodeReport, error) {
+	edges, err := parseDumpDep(dump)
+	if err != nil {
+		return nil, err
+	}
+
+	// A breadth first search from the entry points finds the shortest path to
+	// every symbol. The first symbol reached in each package explains why it
+	// was kept.
+	parents := map[string]string{"_": ""}
+	reachable := make(map[string]int)
+	firstReached := make(map[string]string)
+	queue := []string{"_"}
+	for len(queue) > 0 {
+		sym := queue[0]
+		queue = queue[1:]
+		if pkg := symbolPackage(sym); pkg != "" {
+			if reachable[pkg] == 0 {
+				firstReached[pkg] = sym
+			}
+			reachable[pkg]++
+		}
+
+		for _, to := range edges[sym] {
+			if _, ok := parents[to]; !ok {
+				parents[to] = sym
+				queue = append(queue, to)
+			}
+		}
+	}
+
+	report := &DeadcodeReport{}
+	for _, importPath := range SortedKeys(archives) {
+		funcs, err := definedFunctions(sdk, archives[importPath])
+		if err != nil {
+			return nil, err
+		}
+
+		pkg := DeadcodePackage{ImportPath: importPath, Reachable: reachable[importPath]}
+		for _, fn := range funcs {
+			// Archives also hold instantiations of generic functions from
+			// other packages.
+			if symbolPackage(fn) != importPath {
+				continue
+			}
+			if _, ok := parents[fn]; !ok {
+				pkg.Discarded = append(pkg.Discarded, fn)
+			}
+		}
+		slices.Sort(pkg.Discarded)
+		for sym := firstReached[importPath]; sym != "" && sym != "_"; sym = parents[sym] {
+			pkg.ReachedBy = append(pkg.ReachedBy, sym)
+		}
+		slices.Reverse(pkg.ReachedBy)
+
+		report.Packages = append(report.Packages, pkg)
+	}
+
+	return report, nil
+}
+
+// SaveDeadcodeReport writes the report to "deadcode.json" in dir.
+func SaveDeadcodeReport(dir string, report *DeadcodeReport) error {
+	return WriteGenerated(filepath.Join(dir, "deadcode.json"), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	})
+}
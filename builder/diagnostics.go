@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Rules for classifying lines of tool output, applied in order. The first
+	// matching rule decides the level of a line.
+	DiagnosticFilters []DiagnosticFilter
+
+	// Fail the build if a tool prints anything classified as a warning.
+	WarningsAsErrors bool
+
+	// Directory to show sources under in diagnostics, in place of their store
+	// paths. See [MapDiagnosticPaths].
+	DiagnosticPathPrefix string
+
+	// Highlight diagnostics with ANSI escape codes.
+	DiagnosticColor bool
+
+	// Rewrites of trimmed source paths in tool output.
+	diagnosticPaths *strings.Replacer
+
+	// Readable sources, keyed by every path tools report them by.
+	diagnosticSources map[string]string
+
+	// Matches a diagnostic like "x.go:12:5: message", with an optional column.
+	diagnosticPattern = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?: (.*)$`)
+)
+
+// ANSI escape codes used when DiagnosticColor is set.
+const (
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorCyan  = "\x1b[36m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// A DiagnosticLevel is the severity of a line of tool output.
+type DiagnosticLevel int
+
+const (
+	// Drop the line entirely.
+	LevelIgnore DiagnosticLevel = iota
+	// Print the line, but never treat it as a warning.
+	LevelInfo
+	// Print the line. This is the level of any line not matched by a filter.
+	LevelWarn
+	// Print the line and fail the build, even if the tool succeeded.
+	LevelError
+)
+
+// ParseDiagnosticLevel converts the name of a level to a DiagnosticLevel.
+func ParseDiagnosticLevel(name string) (DiagnosticLevel, error) {
+	switch name {
+	case "ignore":
+		return LevelIgnore, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown diagnostic level \"%s\"", name)
+	}
+}
+
+// A DiagnosticFilter assigns a level to lines of tool output matching Pattern.
+type DiagnosticFilter struct {
+	Pattern *regexp.Regexp
+	Level   DiagnosticLevel
+}
+
+// DiagnosticFilterAttrs are the derivation attributes describing a
+// DiagnosticFilter.
+type DiagnosticFilterAttrs struct {
+	Pattern string
+	Level   string
+}
+
+// SetDiagnosticFilters compiles the filters described by attrs and installs
+// them for every following tool invocation.
+func SetDiagnosticFilters(attrs []DiagnosticFilterAttrs) error {
+	filters := make([]DiagnosticFilter, 0, len(attrs))
+	for _, attr := range attrs {
+		pattern, err := regexp.Compile(attr.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid diagnostic filter: %w", err)
+		}
+		level, err := ParseDiagnosticLevel(attr.Level)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, DiagnosticFilter{pattern, level})
+	}
+
+	DiagnosticFilters = filters
+	return nil
+}
+
+// DiagnosticError records when a tool printed output that should fail the
+// build.
+type DiagnosticError struct {
+	Line string
+}
+
+func (e DiagnosticError) Error() string {
+	return fmt.Sprintf("tool reported a diagnostic treated as an error: %s", e.Line)
+}
+
+// A diagnostic is a message about a position in a source file, along with the
+// indented lines continuing it.
+type diagnostic struct {
+	file      string
+	line, col int
+	message   string
+	text      string
+	extra     []string
+}
+
+// A DiagnosticWriter classifies each line written to it with the
+// DiagnosticFilters, forwarding anything not ignored to an underlying writer.
+//
+// Diagnostics about known sources are held until the writer is closed, then
+// written grouped by file and sorted by position, without duplicates, each
+// followed by the line of source it points to. Parallel compiler backends
+// otherwise interleave them. Other output written after the first diagnostic
+// follows them.
+type DiagnosticWriter struct {
+	out     io.Writer
+	partial []byte
+	err     error
+
+	diagnostics []*diagnostic
+	trailing    [][]byte
+}
+
+// NewDiagnosticWriter creates a DiagnosticWriter forwarding to out.
+func NewDiagnosticWriter(out io.Writer) *DiagnosticWriter {
+	return &DiagnosticWriter{out: out}
+}
+
+func (w *DiagnosticWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if err := w.writeLine(w.partial[:i+1]); err != nil {
+			return 0, err
+		}
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *DiagnosticWriter) writeLine(line []byte) error {
+	level := LevelWarn
+	text := string(bytes.TrimRight(line, "\n"))
+	for _, filter := range DiagnosticFilters {
+		if filter.Pattern.MatchString(text) {
+			level = filter.Level
+			break
+		}
+	}
+
+	if w.err == nil && (level == LevelError || level == LevelWarn && WarningsAsErrors) {
+		w.err = &DiagnosticError{text}
+	}
+	if level == LevelIgnore {
+		return nil
+	}
+
+	if strings.HasPrefix(text, "\t") && len(w.diagnostics) > 0 && len(w.trailing) == 0 {
+		last := w.diagnostics[len(w.diagnostics)-1]
+		last.extra = append(last.extra, text)
+		return nil
+	}
+	if d := parseDiagnostic(text); d != nil {
+		w.diagnostics = append(w.diagnostics, d)
+		w.trailing = nil
+		return nil
+	}
+
+	if diagnosticPaths != nil {
+		line = []byte(diagnosticPaths.Replace(string(line)))
+	}
+	if len(w.diagnostics) > 0 {
+		w.trailing = append(w.trailing, line)
+		return nil
+	}
+	_, err := w.out.Write(line)
+	return err
+}
+
+// parseDiagnostic parses a line of tool output as a diagnostic about one of the
+// sources mapped by [MapDiagnosticPaths], or returns nil.
+func parseDiagnostic(text string) *diagnostic {
+	match := diagnosticPattern.FindStringSubmatch(text)
+	if match == nil {
+		return nil
+	}
+	if _, ok := diagnosticSources[match[1]]; !ok {
+		return nil
+	}
+
+	d := &diagnostic{file: match[1], message: match[4], text: text}
+	d.line, _ = strconv.Atoi(match[2])
+	d.col, _ = strconv.Atoi(match[3])
+	return d
+}
+
+// sourceLine returns the 1-based line n of file, if it can be read.
+func sourceLine(sources map[string][]string, file string, n int) (string, bool) {
+	lines, ok := sources[file]
+	if !ok {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		sources[file] = lines
+	}
+	if n < 1 || n > len(lines) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(lines[n-1], "\r"), true
+}
+
+// writeDiagnostics writes every held diagnostic, grouped by file in the order
+// each was first reported.
+func (w *DiagnosticWriter) writeDiagnostics() error {
+	files := make(map[string]int)
+	for _, d := range w.diagnostics {
+		if _, ok := files[d.file]; !ok {
+			files[d.file] = len(files)
+		}
+	}
+	slices.SortStableFunc(w.diagnostics, func(a, b *diagnostic) int {
+		if c := cmp.Compare(files[a.file], files[b.file]); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.line, b.line); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.col, b.col)
+	})
+
+	var out bytes.Buffer
+	sources := make(map[string][]string)
+	seen := make(map[string]struct{})
+	for _, d := range w.diagnostics {
+		key := strings.Join(append([]string{d.text}, d.extra...), "\n")
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		text := d.text
+		if diagnosticPaths != nil {
+			text = diagnosticPaths.Replace(text)
+		}
+		if DiagnosticColor {
+			pos := strings.TrimSuffix(text, ": "+d.message)
+			text = colorBold + pos + ":" + colorReset + " " + colorRed + d.message + colorReset
+		}
+		fmt.Fprintln(&out, text)
+		for _, extra := range d.extra {
+			fmt.Fprintln(&out, extra)
+		}
+
+		src, ok := sourceLine(sources, diagnosticSources[d.file], d.line)
+		if !ok {
+			continue
+		}
+		gutter := fmt.Sprintf("%6d | ", d.line)
+		blank := strings.Repeat(" ", len(gutter)-2) + "| "
+		if DiagnosticColor {
+			gutter = colorCyan + gutter + colorReset
+			blank = colorCyan + blank + colorReset
+		}
+		fmt.Fprintf(&out, "%s%s\n", gutter, src)
+		if d.col > 0 && d.col <= len(src)+1 {
+			// Tabs are kept so the caret lines up with the source.
+			indent := strings.Map(func(r rune) rune {
+				if r == '\t' {
+					return r
+				}
+				return ' '
+			}, src[:d.col-1])
+			caret := "^"
+			if DiagnosticColor {
+				caret = colorGreen + caret + colorReset
+			}
+			fmt.Fprintf(&out, "%s%s%s\n", blank, indent, caret)
+		}
+	}
+	for _, line := range w.trailing {
+		out.Write(line)
+	}
+
+	w.diagnostics = nil
+	w.trailing = nil
+	_, err := w.out.Write(out.Bytes())
+	return err
+}
+
+// Close flushes any unterminated line and reports whether any output should
+// fail the build.
+func (w *DiagnosticWriter) Close() error {
+	if len(w.partial) > 0 {
+		if err := w.writeLine(append(w.partial, '\n')); err != nil {
+			return err
+		}
+		w.partial = nil
+	}
+	if len(w.diagnostics) > 0 {
+		if err := w.writeDiagnostics(); err != nil {
+			return err
+		}
+	}
+
+	return w.err
+}
+
+// RunLogged prints cmd and runs it with [RunCommand], passing its output
+// through the diagnostic filters. Output from tools is always written to
+// stderr.
+func RunLogged(cmd *exec.Cmd) error {
+	diagnostics := NewDiagnosticWriter(os.Stderr)
+	if cmd.Stdout == nil {
+		cmd.Stdout = diagnostics
+	}
+	cmd.Stderr = diagnostics
+
+	fmt.Fprintln(os.Stderr, cmd)
+	if DryRun {
+		return nil
+	}
+	err := RunCommand(cmd)
+	if closeErr := diagnostics.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// MapDiagnosticPaths rewrites the positions tools report for the sources of
+// the package importPath. Sources materialized in the build directory are gone
+// after the build, and anything read back from an object only knows a source by
+// its import path and file name after "-trimpath", so diagnostics would
+// otherwise point to files which don't exist. Both are rewritten to the
+// source's store path, or to the same import path and file name under
+// DiagnosticPathPrefix if it is set.
+func MapDiagnosticPaths(importPath string, srcs []string) {
+	paths := make(map[string]string, 2*len(srcs))
+	diagnosticSources = make(map[string]string, 2*len(srcs))
+	for _, src := range srcs {
+		diagnosticSources[src] = src
+		diagnosticSources[importPath+"/"+filepath.Base(src)] = src
+		shown := src
+		if DiagnosticPathPrefix != "" {
+			shown = filepath.Join(DiagnosticPathPrefix, importPath, filepath.Base(src))
+		} else if target, err := os.Readlink(src); err == nil && filepath.IsAbs(target) {
+			shown = target
+		}
+		paths[src+":"] = shown + ":"
+		paths[importPath+"/"+filepath.Base(src)+":"] = shown + ":"
+	}
+
+	// Longer paths go first, so a full path is never rewritten as if it were
+	// a trimmed path it ends with.
+	trimmed := SortedKeys(paths)
+	slices.SortStableFunc(trimmed, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	oldnew := make([]string, 0, 2*len(trimmed))
+	for _, path := range trimmed {
+		oldnew = append(oldnew, path, paths[path])
+	}
+
+	diagnosticPaths = strings.NewReplacer(oldnew...)
+}
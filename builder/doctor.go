@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// A DoctorCheck is the result of one check of the build environment.
+type DoctorCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// doctorReport collects the results of every check.
+type doctorReport struct {
+	Checks []DoctorCheck
+}
+
+func (r *doctorReport) pass(name, detail string, args ...any) {
+	r.Checks = append(r.Checks, DoctorCheck{name, true, fmt.Sprintf(detail, args...)})
+}
+
+func (r *doctorReport) fail(name, detail string, args ...any) {
+	r.Checks = append(r.Checks, DoctorCheck{name, false, fmt.Sprintf(detail, args...)})
+}
+
+// checkAttrs validates the structured attributes file passed by Nix, given the
+// error decoding them, if any.
+func (r *doctorReport) checkAttrs(decodeErr error) {
+	path := os.Getenv("NIX_ATTRS_JSON_FILE")
+	if decodeErr != nil {
+		r.fail("attrs", "%v", decodeErr)
+		return
+	}
+	var attrs map[string]any
+	if err := json.Unmarshal(derivation.AttrJson, &attrs); err != nil {
+		r.fail("attrs", "%s is not a JSON object: %v", path, err)
+		return
+	}
+
+	r.pass("attrs", "%s (%d attributes)", path, len(attrs))
+}
+
+// checkSDK validates the layout of the Go SDK, including the tools for the host
+// platform.
+func (r *doctorReport) checkSDK(attrs *Attrs) {
+	if attrs.SDK == "" && attrs.SDKs == nil {
+		r.fail("sdk", "\"sdk\" was not set in the derivation attributes")
+		return
+	}
+	// A go.mod which fails to load only loses its say in choosing an SDK, and
+	// the build itself reports it.
+	var modFile *ModFile
+	if attrs.GoMod != "" {
+		modFile, _ = LoadModFile(attrs.GoMod)
+	}
+	path, err := attrs.SelectSDK(modFile)
+	if err != nil {
+		r.fail("sdk", "%v", err)
+		return
+	}
+	sdk, err := LoadSDK(path, attrs.GoCompatVersion)
+	if err != nil {
+		r.fail("sdk", "%s: %v", path, err)
+		return
+	}
+	r.pass("sdk", "%s (go%s, compatible with %s)", sdk.Path, sdk.Version, sdk.CompatVersion)
+
+	for _, tool := range []string{"asm", "compile", "link", "pack"} {
+		path := filepath.Join(sdk.Path, "pkg", "tool", HostPlatform, tool)
+		if isExecutable(path) {
+			r.pass("tool "+tool, "%s", path)
+		} else {
+			r.fail("tool "+tool, "%s is missing or not executable", path)
+		}
+	}
+
+	if info, err := os.Stat(sdk.Include()); err == nil && info.IsDir() {
+		r.pass("include", "%s", sdk.Include())
+	} else {
+		r.fail("include", "%s is missing", sdk.Include())
+	}
+}
+
+// checkTempDir ensures temporary files can be created.
+func (r *doctorReport) checkTempDir() {
+	file, err := os.CreateTemp(os.TempDir(), "doctor")
+	if err != nil {
+		r.fail("tmpdir", "%s is not writable: %v", os.TempDir(), err)
+		return
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	r.pass("tmpdir", "%s", os.TempDir())
+}
+
+// checkOutputs ensures every output can be created.
+func (r *doctorReport) checkOutputs() {
+	if len(derivation.Outputs) == 0 {
+		r.fail("outputs", "the derivation declares no outputs")
+		return
+	}
+
+	for _, name := range SortedKeys(derivation.Outputs) {
+		path := derivation.Outputs[name]
+		if _, err := os.Lstat(path); err == nil {
+			r.fail("output "+name, "%s already exists", path)
+		} else if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			r.fail("output "+name, "parent of %s does not exist", path)
+		} else {
+			r.pass("output "+name, "%s", path)
+		}
+	}
+}
+
+// checkParallelism ensures NIX_BUILD_CORES can be parsed.
+func (r *doctorReport) checkParallelism() {
+	cores := os.Getenv("NIX_BUILD_CORES")
+	if cores == "" {
+		r.pass("parallelism", "NIX_BUILD_CORES is unset, using 1")
+	} else if _, err := strconv.ParseInt(cores, 10, 32); err != nil {
+		r.fail("parallelism", "failed to parse NIX_BUILD_CORES: %v", err)
+	} else {
+		r.pass("parallelism", "%d", derivation.BuildParallelism())
+	}
+}
+
+// Write prints the report in a human-readable format.
+func (r *doctorReport) Write(w io.Writer) {
+	for _, check := range r.Checks {
+		status := "ok"
+		if !check.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%-4s  %-14s  %s\n", status, check.Name, check.Detail)
+	}
+}
+
+// doctor checks that the build environment is usable by the builder and prints
+// a report. Unlike every other command, it doesn't stop at the first problem.
+// If the derivation has an "out" output, a JSON report is also written there.
+func doctor() {
+	var report doctorReport
+	// Attributes which fail to load are reported like any other problem,
+	// rather than stopping the checks.
+	attrs, err := derivation.LoadAttrs[Attrs]()
+	report.checkAttrs(err)
+	if err == nil {
+		report.checkSDK(&attrs)
+	}
+	report.checkTempDir()
+	report.checkOutputs()
+	report.checkParallelism()
+
+	report.Write(os.Stderr)
+
+	if out := derivation.Outputs["out"]; out != "" {
+		if err := os.Mkdir(out, 0755); err != nil {
+			Fatalf("failed to create output directory: %v", err)
+		}
+		err := WriteGenerated(filepath.Join(out, "doctor.json"), func(w io.Writer) error {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(&report)
+		})
+		if err != nil {
+			Fatalf("failed to write report: %v", err)
+		}
+	}
+
+	for _, check := range report.Checks {
+		if !check.OK {
+			Fatal("the build environment has problems, see above")
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"slices"
+)
+
+var (
+	// Command prefix running binaries built for another platform, such as
+	// qemu-user. Only used for binaries which can't run on the builder.
+	Emulator []string
+)
+
+// EmulatorError records when a binary built for another platform must run
+// during the build, but there is no emulator to run it with.
+type EmulatorError struct {
+	Binary string
+	GOOS   string
+	GOARCH string
+}
+
+func (e EmulatorError) Error() string {
+	return fmt.Sprintf(
+		"%s was built for %s/%s, which can't run on %s/%s\n\n  Run it under an emulator like qemu-user with \"emulator\".",
+		e.Binary,
+		e.GOOS,
+		e.GOARCH,
+		runtime.GOOS,
+		runtime.GOARCH,
+	)
+}
+
+// TargetCommand prepares to run binary, built for goos and goarch, with args.
+// Binaries for other platforms than the builder's run under Emulator.
+func TargetCommand(goos, goarch, binary string, args ...string) (*exec.Cmd, error) {
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return exec.Command(binary, args...), nil
+	}
+	if len(Emulator) == 0 {
+		return nil, &EmulatorError{binary, goos, goarch}
+	}
+
+	return exec.Command(Emulator[0], slices.Concat(Emulator[1:], []string{binary}, args)...), nil
+}
+
+// BinaryPlatform reads the GOOS and GOARCH an executable was linked for from
+// its headers, so a binary can be run the right way whatever SDK installed it.
+// ELF binaries are taken to be for Linux unless they name another OS ABI.
+func BinaryPlatform(path string) (goos, goarch string, err error) {
+	if file, err := elf.Open(path); err == nil {
+		defer file.Close()
+		return elfPlatform(file)
+	}
+	if file, err := macho.Open(path); err == nil {
+		defer file.Close()
+		switch file.Cpu {
+		case macho.CpuAmd64:
+			return "darwin", "amd64", nil
+		case macho.CpuArm64:
+			return "darwin", "arm64", nil
+		}
+		return "", "", fmt.Errorf("%s is for an unknown Mach-O CPU %v", path, file.Cpu)
+	}
+	if file, err := pe.Open(path); err == nil {
+		defer file.Close()
+		switch file.Machine {
+		case pe.IMAGE_FILE_MACHINE_AMD64:
+			return "windows", "amd64", nil
+		case pe.IMAGE_FILE_MACHINE_I386:
+			return "windows", "386", nil
+		case pe.IMAGE_FILE_MACHINE_ARM64:
+			return "windows", "arm64", nil
+		}
+		return "", "", fmt.Errorf("%s is for an unknown PE machine %#x", path, file.Machine)
+	}
+
+	return "", "", fmt.Errorf("%s is not an ELF, Mach-O, or PE executable", path)
+}
+
+// elfPlatform finds the GOOS and GOARCH of an ELF executable.
+func elfPlatform(file *elf.File) (goos, goarch string, err error) {
+	switch file.OSABI {
+	case elf.ELFOSABI_FREEBSD:
+		goos = "freebsd"
+	case elf.ELFOSABI_NETBSD:
+		goos = "netbsd"
+	case elf.ELFOSABI_OPENBSD:
+		goos = "openbsd"
+	default:
+		goos = "linux"
+	}
+
+	is64 := file.Class == elf.ELFCLASS64
+	little := file.ByteOrder == binary.LittleEndian
+	switch {
+	case file.Machine == elf.EM_X86_64:
+		goarch = "amd64"
+	case file.Machine == elf.EM_386:
+		goarch = "386"
+	case file.Machine == elf.EM_AARCH64:
+		goarch = "arm64"
+	case file.Machine == elf.EM_ARM:
+		goarch = "arm"
+	case file.Machine == elf.EM_RISCV && is64:
+		goarch = "riscv64"
+	case file.Machine == elf.EM_LOONGARCH:
+		goarch = "loong64"
+	case file.Machine == elf.EM_S390:
+		goarch = "s390x"
+	case file.Machine == elf.EM_PPC64 && little:
+		goarch = "ppc64le"
+	case file.Machine == elf.EM_PPC64:
+		goarch = "ppc64"
+	case file.Machine == elf.EM_MIPS && is64 && little:
+		goarch = "mips64le"
+	case file.Machine == elf.EM_MIPS && is64:
+		goarch = "mips64"
+	case file.Machine == elf.EM_MIPS && little:
+		goarch = "mipsle"
+	case file.Machine == elf.EM_MIPS:
+		goarch = "mips"
+	default:
+		return "", "", fmt.Errorf("unknown ELF machine %v", file.Machine)
+	}
+
+	return goos, goarch, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestBinaryPlatform(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goos, goarch, err := BinaryPlatform(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goos != runtime.GOOS || goarch != runtime.GOARCH {
+		t.Errorf("BinaryPlatform(test binary) = %s/%s, want %s/%s", goos, goarch, runtime.GOOS, runtime.GOARCH)
+	}
+
+	script := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := BinaryPlatform(script); err == nil {
+		t.Error("BinaryPlatform of a script succeeded, want an error")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"nix/derivation"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+)
+
+// An ErrorCategory groups failures by what needs to be fixed, so tooling
+// wrapping the builder can triage them. Each category exits with its own code.
+type ErrorCategory int
+
+const (
+	// Anything which wasn't classified more precisely.
+	CategoryUnknown ErrorCategory = iota
+
+	// Missing or invalid derivation attributes, including inputs which don't
+	// fit together, like imports built for another platform.
+	CategoryAttr
+
+	// Problems with the sources being built, like a go.mod which can't be
+	// parsed or warnings treated as errors.
+	CategorySource
+
+	// A tool failed, ran too long, or produced output the builder rejected.
+	// Compiler errors are reported by the compiler failing.
+	CategoryTool
+
+	// A bug in the builder.
+	CategoryInternal
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case CategoryAttr:
+		return "attr"
+	case CategorySource:
+		return "source"
+	case CategoryTool:
+		return "tool"
+	case CategoryInternal:
+		return "internal"
+	default:
+		return "unknown"
+	}
+}
+
+// ExitCode returns the exit status of the builder for an error of the
+// category.
+func (c ErrorCategory) ExitCode() int {
+	return 1 + int(c)
+}
+
+// An AttrError records an invalid value of a derivation attribute.
+type AttrError struct {
+	Attr string
+	Err  error
+}
+
+func (e AttrError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Attr, e.Err)
+}
+
+func (e AttrError) Unwrap() error {
+	return e.Err
+}
+
+// A ToolError records a tool exiting with a failure. Callers already say what
+// was being run, so only the exit status is reported.
+type ToolError struct {
+	Tool string
+	Err  *exec.ExitError
+}
+
+func (e ToolError) Error() string {
+	return e.Err.Error()
+}
+
+func (e ToolError) Unwrap() error {
+	return e.Err
+}
+
+// An InternalError records a panic in the builder.
+type InternalError struct {
+	Value any
+	Stack []byte
+}
+
+func (e InternalError) Error() string {
+	return fmt.Sprintf(
+		"internal error: %v\n\n  This is a bug in the builder, please report it.\n\n%s",
+		e.Value,
+		e.Stack,
+	)
+}
+
+// An ErrorSummary describes why the builder failed, for tooling wrapping it.
+type ErrorSummary struct {
+	Category string
+	ExitCode int
+	Command  string `json:",omitempty"`
+	Message  string
+
+	// The tool which failed and its exit status, for tool errors.
+	Tool         string `json:",omitempty"`
+	ToolExitCode int    `json:",omitempty"`
+}
+
+var (
+	// The subcommand being run, for error summaries.
+	Command string
+
+	// Exits the builder after a failure, with the exit code of its summary. The
+	// daemon replaces it to only end the current job.
+	exit = exitBuilder
+)
+
+// CategorizeError decides which category err belongs to, by the types of
+// errors it wraps.
+func CategorizeError(err error) ErrorCategory {
+	var (
+		attrErr        *AttrError
+		attrsErr       *derivation.AttrsError
+		importErr      *ImportError
+		conflictErr    *MetaConflictError
+		duplicateErr   *DuplicatePackageError
+		vendoredErr    *VendoredCopyError
+		unusedErr      *UnusedImportsError
+		featureErr     *FeatureError
+		experimentErr  *ExperimentError
+		targetErr      *TargetError
+		toolchainErr   *ToolchainError
+		compilerErr    *CompilerError
+		dynLinkErr     *DynLinkError
+		importCycleErr *ImportCycleError
+		coverModeErr   *CoverModeError
+		linknameErr    *LinknameError
+		schemaErr      *SchemaError
+		sdkErr         *SDKSelectionError
+		stdVersionErr  *StdVersionError
+		emulatorErr    *EmulatorError
+		clauseErr      *PackageClauseError
+		modFileErr     *modFileError
+		goVersionErr   *GoVersionError
+		moduleHashErr  *ModuleHashError
+		diagnosticErr  *DiagnosticError
+		visibilityErr  *VisibilityError
+		cycleErr       *ModuleCycleError
+		toolErr        *ToolError
+		timeoutErr     *ToolTimeoutError
+		interruptedErr *InterruptedError
+		staticErr      *StaticError
+		archiveErr     *ArchiveError
+		determinismErr *DeterminismError
+		internalErr    *InternalError
+	)
+	switch {
+	case err == nil:
+		return CategoryUnknown
+	case errors.As(err, &internalErr):
+		return CategoryInternal
+	case errors.As(err, &attrErr), errors.As(err, &attrsErr), errors.Is(err, derivation.ErrNoAttrs),
+		errors.As(err, &importErr), errors.As(err, &conflictErr), errors.As(err, &unusedErr),
+		errors.As(err, &featureErr), errors.As(err, &experimentErr), errors.As(err, &targetErr),
+		errors.As(err, &stdVersionErr), errors.As(err, &emulatorErr), errors.As(err, &clauseErr),
+		errors.As(err, &duplicateErr), errors.As(err, &vendoredErr), errors.As(err, &toolchainErr),
+		errors.As(err, &sdkErr), errors.As(err, &importCycleErr), errors.As(err, &compilerErr),
+		errors.As(err, &schemaErr), errors.As(err, &coverModeErr),
+		errors.As(err, &linknameErr), errors.As(err, &dynLinkErr):
+		return CategoryAttr
+	case errors.As(err, &modFileErr), errors.As(err, &goVersionErr), errors.As(err, &moduleHashErr),
+		errors.As(err, &diagnosticErr), errors.As(err, &visibilityErr), errors.As(err, &cycleErr):
+		return CategorySource
+	case errors.As(err, &toolErr), errors.As(err, &timeoutErr), errors.As(err, &interruptedErr),
+		errors.As(err, &staticErr), errors.As(err, &archiveErr), errors.As(err, &determinismErr):
+		return CategoryTool
+	default:
+		return CategoryUnknown
+	}
+}
+
+// NewErrorSummary summarizes a failure in category with the message msg,
+// caused by err.
+func NewErrorSummary(category ErrorCategory, msg string, err error) *ErrorSummary {
+	summary := &ErrorSummary{
+		Category: category.String(),
+		ExitCode: category.ExitCode(),
+		Command:  Command,
+		Message:  msg,
+	}
+
+	var toolErr *ToolError
+	var timeoutErr *ToolTimeoutError
+	var interruptedErr *InterruptedError
+	switch {
+	case errors.As(err, &toolErr):
+		summary.Tool, summary.ToolExitCode = toolErr.Tool, toolErr.Err.ExitCode()
+	case errors.As(err, &timeoutErr):
+		summary.Tool = timeoutErr.Tool
+	case errors.As(err, &interruptedErr):
+		summary.Tool = interruptedErr.Tool
+	}
+
+	return summary
+}
+
+// Write reports the summary as a final "@builder-error" line on stderr. Within
+// a build, it's also written to "builder-error.json" in $NIX_BUILD_TOP, which
+// is kept by "nix build --keep-failed".
+func (s *ErrorSummary) Write() {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "@builder-error %s\n", data)
+
+	if top := os.Getenv("NIX_BUILD_TOP"); top != "" {
+		_ = os.WriteFile(filepath.Join(top, "builder-error.json"), append(data, '\n'), 0666)
+	}
+}
+
+// firstError returns the first argument which is an error.
+func firstError(v []any) error {
+	for _, arg := range v {
+		if err, ok := arg.(error); ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exitBuilder exits with the exit code of summary.
+func exitBuilder(summary *ErrorSummary) {
+	os.Exit(summary.ExitCode)
+}
+
+// fatal logs msg, writes the error summary, and exits with the exit code of
+// category.
+func fatal(category ErrorCategory, msg string, err error) {
+	log.Print(msg)
+	summary := NewErrorSummary(category, msg, err)
+	summary.Write()
+	exit(summary)
+}
+
+// Fatal is like log.Fatal, but exits with the code for the category of the
+// first error in v and writes an error summary.
+func Fatal(v ...any) {
+	err := firstError(v)
+	fatal(CategorizeError(err), fmt.Sprint(v...), err)
+}
+
+// Fatalf is like log.Fatalf, but exits with the code for the category of the
+// first error in v and writes an error summary.
+func Fatalf(format string, v ...any) {
+	err := firstError(v)
+	fatal(CategorizeError(err), fmt.Sprintf(format, v...), err)
+}
+
+// recoverInternal turns a panic into an internal error. It must be deferred.
+func recoverInternal() {
+	if r := recover(); r != nil {
+		Fatal(&InternalError{r, debug.Stack()})
+	}
+}
+
+// fatalAttrs reports failures loading the derivation attributes. Anything not
+// categorized otherwise is a problem with the attributes.
+func fatalAttrs(err error) {
+	category := CategorizeError(err)
+	if category == CategoryUnknown {
+		category = CategoryAttr
+	}
+	fatal(category, err.Error(), err)
+}
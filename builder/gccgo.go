@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// gccgoToolchain compiles and links packages with gccgo, the Go frontend of
+// GCC, which needs gccgo, objcopy, and ar in nativeBuildInputs. Export data is
+// still written to "<name>.x", so the outputs of each package keep their
+// layout, but it holds the ".go_export" section of the object instead, which
+// gccgo imports like a ".gox" file. The standard library is gccgo's own
+// libgo, so std packages are never imported from other derivations, and the
+// flags in compileFlags and linkFlags are given to gccgo as they are.
+type gccgoToolchain struct {
+	gccgo, objcopy, ar string
+}
+
+func newGccgoToolchain(sdk *GoSDK) (Toolchain, error) {
+	var g gccgoToolchain
+	for _, tool := range []struct {
+		name string
+		path *string
+	}{
+		{"gccgo", &g.gccgo},
+		{"objcopy", &g.objcopy},
+		{"ar", &g.ar},
+	} {
+		path, err := FindNativeTool(tool.name)
+		if err != nil {
+			return nil, err
+		}
+		*tool.path = path
+	}
+
+	return &g, nil
+}
+
+func (g *gccgoToolchain) Name() string {
+	return "gccgo"
+}
+
+func (g *gccgoToolchain) Builtin(importPath string) bool {
+	return isStdPath(importPath)
+}
+
+// unsupported checks c can be compiled by gccgo, which has none of the gc
+// toolchain's instrumentation.
+func (g *gccgoToolchain) unsupported(c *Compilation) error {
+	switch {
+	case c.Std:
+		return &AttrError{"toolchain", fmt.Errorf("package %s is part of the standard library, which gccgo provides as libgo", c.ImportPath)}
+	case c.SDK.Instrument != "":
+		return &AttrError{"instrument", fmt.Errorf("gccgo doesn't support %s instrumentation", c.SDK.Instrument)}
+	case c.SDK.DynLink:
+		return &AttrError{"dynLink", errors.New("gccgo doesn't support dynLink")}
+	case c.CoverMode != "":
+		return &AttrError{"coverMode", errors.New("gccgo doesn't support coverage instrumentation")}
+	}
+
+	return nil
+}
+
+// Compile compiles the Go sources of c to an object with gccgo, copies its
+// export data out of it, then packs it into the archive along with the
+// objects of the other sources.
+func (g *gccgoToolchain) Compile(c *Compilation, extraArgs []string) error {
+	if err := g.unsupported(c); err != nil {
+		return err
+	}
+
+	goObj := filepath.Join(derivation.BuildDir(), "_go_.o")
+	cmd := c.SDK.RunNativeTool(g.gccgo, "-c", "-g", "-O2", "-fgo-importcfg="+c.importCfg)
+	cmd.Env = c.SDK.PackageEnv(c.ImportPath)
+	// Like the go command, only the main package is compiled without a
+	// package path, so its symbols are those libgo's entry point calls.
+	header, err := IndexSource(c.goSrcs[0]).Header()
+	if err != nil {
+		return err
+	}
+	if header.Name.Name != "main" {
+		cmd.Args = append(cmd.Args, "-fgo-pkgpath="+c.ImportPath)
+	}
+	for _, rewrite := range strings.Split(c.trimPath, ";") {
+		from, to, _ := strings.Cut(rewrite, "=>")
+		cmd.Args = append(cmd.Args, fmt.Sprintf("-fdebug-prefix-map=%s=%s", from, to))
+	}
+
+	var embedCfg string
+	if c.EmbedCfg != nil {
+		if embedCfg, err = compileEmbedCfg(c.EmbedCfg); err != nil {
+			return fmt.Errorf("failed to generate compiler embedcfg: %w", err)
+		}
+		cmd.Args = append(cmd.Args, "-fgo-embedcfg="+embedCfg)
+	}
+	cmd.Args = append(cmd.Args, extraArgs...)
+	cmd.Args = append(cmd.Args, "-o", goObj)
+	cmd.Args = append(cmd.Args, c.goSrcs...)
+
+	if err := RecordAction(cmd, slices.Concat(c.goSrcs, []string{c.importCfg, embedCfg}), []string{goObj}); err != nil {
+		return err
+	}
+	SetPhase("compile")
+	if err := RunLogged(cmd); err != nil {
+		return fmt.Errorf("failed to compile package: %w", err)
+	}
+
+	cmd = c.SDK.RunNativeTool(g.objcopy, "-j", ".go_export", goObj, c.exportData)
+	cmd.Env = c.SDK.PackageEnv(c.ImportPath)
+	if err := RecordAction(cmd, []string{goObj}, []string{c.exportData}); err != nil {
+		return err
+	}
+	if err := RunLogged(cmd); err != nil {
+		return fmt.Errorf("failed to extract export data: %w", err)
+	}
+	if c.obj == "" {
+		return nil
+	}
+
+	objs := []string{goObj}
+	c.includes = findIncludes(c.SDK.Include(), c.hSrcs)
+	for i, src := range c.sSrcs {
+		SetPhaseProgress("asm", i+1, len(c.sSrcs))
+		base, _ := strings.CutSuffix(filepath.Base(src), ".s")
+		obj, err := g.Assemble(c, []string{src}, filepath.Join(derivation.BuildDir(), base+".o"), nil)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, obj)
+	}
+	objs = append(objs, c.sysoSrcs...)
+	extraObjs, err := c.extraObjectMembers()
+	if err != nil {
+		return err
+	}
+	objs = append(objs, extraObjs...)
+
+	// Archives are written with a symbol table, which the system linker needs
+	// to search them, and without timestamps, so they're reproducible.
+	cmd = c.SDK.RunNativeTool(g.ar, "rcsD", c.obj)
+	cmd.Args = append(cmd.Args, objs...)
+	cmd.Env = c.SDK.PackageEnv(c.ImportPath)
+	if err := RecordAction(cmd, objs, []string{c.obj}); err != nil {
+		return err
+	}
+	if err := RunLogged(cmd); err != nil {
+		return fmt.Errorf("failed to pack archive: %w", err)
+	}
+
+	return nil
+}
+
+// Assemble assembles srcs with gccgo, which only understands the assembly of
+// the target, not the gc toolchain's.
+func (g *gccgoToolchain) Assemble(
+	c *Compilation,
+	srcs []string,
+	out string,
+	extraArgs []string,
+) (string, error) {
+	cmd := c.SDK.RunNativeTool(g.gccgo, "-xassembler-with-cpp", "-c")
+	cmd.Env = c.SDK.PackageEnv(c.ImportPath)
+	for _, dir := range c.includes {
+		cmd.Args = append(cmd.Args, "-I", dir)
+	}
+	cmd.Args = append(
+		cmd.Args,
+		"-D", fmt.Sprintf("GOOS_%s", Context.GOOS),
+		"-D", fmt.Sprintf("GOARCH_%s", Context.GOARCH),
+	)
+	cmd.Args = append(cmd.Args, c.AsmFlags...)
+	cmd.Args = append(cmd.Args, extraArgs...)
+	cmd.Args = append(cmd.Args, "-o", out)
+	cmd.Args = append(cmd.Args, srcs...)
+
+	if err := RecordAction(cmd, slices.Concat(srcs, c.hSrcs), []string{out}); err != nil {
+		return "", err
+	}
+	if err := RunLogged(cmd); err != nil {
+		return "", fmt.Errorf("failed to assemble sources: %w", err)
+	}
+
+	return out, nil
+}
+
+// Link links the archive of the main package and those of its deps with
+// gccgo. Archives are grouped, since they aren't ordered by their imports,
+// and the system linker only pulls in the members the binary needs.
+func (g *gccgoToolchain) Link(l *Linkage, out string, extraArgs []string) error {
+	switch {
+	case len(l.Shlibs) > 0:
+		return &AttrError{"shlibs", errors.New("gccgo doesn't support linking against shlibs")}
+	case len(l.WindowsResources) > 0:
+		return &AttrError{"windowsResources", errors.New("gccgo doesn't support windowsResources")}
+	case l.Godebug != "":
+		return &AttrError{"defaultGodebug", errors.New("gccgo doesn't support defaultGodebug or //go:debug directives")}
+	case l.DumpDeps != nil:
+		return &AttrError{"deadcodeReport", errors.New("gccgo doesn't support deadcodeReport")}
+	}
+
+	if err := ResolveMetaPackages(l.Deps, nil, false); err != nil {
+		return err
+	}
+	archives := []string{fmt.Sprintf("%s/%s.a", l.Deps[l.Main.ImportPath], filepath.Base(l.Main.ImportPath))}
+	for _, importPath := range l.Main.Deps {
+		if g.Builtin(importPath) {
+			continue
+		}
+		storePath := l.Deps[importPath]
+		if storePath == "" {
+			return NewImportError(importPath, l.Main.ImportPath, l.Deps)
+		}
+		archive := fmt.Sprintf("%s/%s.a", storePath, filepath.Base(importPath))
+		if _, err := os.Stat(archive); err != nil {
+			return fmt.Errorf("package %s has no archive in %s. Was it only type checked?", importPath, storePath)
+		}
+		archives = append(archives, archive)
+	}
+
+	cmd := l.SDK.RunNativeTool(g.gccgo, extraArgs...)
+	cmd.Env = l.SDK.PackageEnv(l.Main.ImportPath)
+	cmd.Args = append(cmd.Args, "-o", out, "-Wl,--start-group")
+	cmd.Args = append(cmd.Args, archives...)
+	cmd.Args = append(cmd.Args, "-Wl,--end-group")
+
+	if err := RecordAction(cmd, archives, []string{out}); err != nil {
+		return err
+	}
+	SetPhase("link")
+	if err := RunLogged(cmd); err != nil {
+		return fmt.Errorf("failed to link binary: %w", err)
+	}
+
+	if l.Codesign != nil {
+		if err := signDarwinBinary(out, l.Codesign); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
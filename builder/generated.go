@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+)
+
+var (
+	// Generate every file twice and fail if the outputs differ. See
+	// [WriteGenerated] for what this can't catch.
+	AuditDeterminism bool
+)
+
+// DeterminismError records when generating a file twice produced different
+// contents.
+type DeterminismError struct {
+	Path   string
+	Offset int
+}
+
+func (e DeterminismError) Error() string {
+	return fmt.Sprintf(
+		"generated file %s is not deterministic, runs differ at byte %d",
+		e.Path,
+		e.Offset,
+	)
+}
+
+// SortedKeys returns the keys of a map in sorted order. Anything which ends up
+// in a generated file or the logs should iterate maps through this.
+func SortedKeys[M ~map[K]V, K cmp.Ordered, V any](m M) []K {
+	return slices.Sorted(maps.Keys(m))
+}
+
+// WriteGenerated creates the file at path with the output of generate. When
+// AuditDeterminism is set, generate is run a second time and the build fails if
+// it produced different bytes, catching things like map iteration order leaking
+// into the output.
+//
+// Both runs happen in the same process, one after the other, so the audit only
+// catches nondeterminism within generate. Anything fixed before it runs, like
+// the environment, the time, the order of inputs it was given, or state it
+// reads that an earlier run left behind, is the same both times. Comparing the
+// outputs of separate builds, as "nix build --rebuild" does, catches those.
+func WriteGenerated(path string, generate func(w io.Writer) error) error {
+	var out bytes.Buffer
+	if err := generate(&out); err != nil {
+		return err
+	}
+
+	if AuditDeterminism {
+		var check bytes.Buffer
+		if err := generate(&check); err != nil {
+			return err
+		}
+		if a, b := out.Bytes(), check.Bytes(); !bytes.Equal(a, b) {
+			offset := 0
+			for offset < min(len(a), len(b)) && a[offset] == b[offset] {
+				offset++
+			}
+			return &DeterminismError{path, offset}
+		}
+	}
+
+	return os.WriteFile(path, out.Bytes(), 0666)
+}
@@ -0,0 +1,487 @@
+// Package gometa defines the metadata the builder writes alongside compiled
+// packages, so other tools can read and produce it without going through the
+// builder.
+package gometa
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// SchemaVersion is the version of the metadata described here. It's raised
+// whenever metadata changes in a way older readers would misread, so metadata
+// from older builders can be migrated, and newer metadata rejected.
+const SchemaVersion = 1
+
+// Interface PackageLike represents the metadata of either a package or meta
+// package. This generalizes loading and saving .json descriptions to the store.
+type PackageLike[P any] interface {
+	StorePath(string) string
+	FromImport(string) P
+
+	// Migrate upgrades metadata read from the store to SchemaVersion.
+	Migrate() (P, error)
+}
+
+// SchemaError records when metadata was written with a newer schema than
+// SchemaVersion, which can't be read correctly.
+type SchemaError struct {
+	ImportPath string
+	Version    int
+}
+
+func (e SchemaError) Error() string {
+	return fmt.Sprintf(
+		"metadata of %s has schema version %d, but this builder only reads up to version %d\n\n  It was written by a newer builder. Build everything with the same builder.",
+		e.ImportPath,
+		e.Version,
+		SchemaVersion,
+	)
+}
+
+// migrate upgrades the schema version of the metadata of importPath in place.
+func migrate(importPath string, version *int) error {
+	if *version > SchemaVersion {
+		return &SchemaError{importPath, *version}
+	}
+
+	// Version 0 is metadata from before it was versioned. Everything added
+	// since, like the target platform and digests, is optional and empty when
+	// unknown, so it needs no changes.
+	*version = SchemaVersion
+	return nil
+}
+
+// A Package is the metadata of a single compiled package.
+type Package struct {
+	SchemaVersion int
+
+	ImportPath string `json:"-"`
+	Imports    []string
+	Deps       []string
+
+	// Target platform of the package, and any build tags which selected its
+	// files beyond those implied by the platform and Go version.
+	GOOS      string   `json:",omitempty"`
+	GOARCH    string   `json:",omitempty"`
+	BuildTags []string `json:",omitempty"`
+
+	ArchFeatures map[string]string `json:",omitempty"`
+	Experiments  []string          `json:",omitempty"`
+
+	// Version of the Go SDK which compiled the package, like "1.22.5". Export
+	// data is only understood by the same compiler.
+	GoVersion string `json:",omitempty"`
+
+	// Toolchain which compiled the package, like "gccgo", if not the gc
+	// toolchain of the Go SDK.
+	Compiler string `json:",omitempty"`
+
+	// Hex SHA-256 digest of the export data, so caches fetching it from
+	// elsewhere can check it. The digest of the archive is in the package's
+	// [BuildRecord] instead.
+	ExportSHA256 string `json:",omitempty"`
+
+	// Counter mode of a package instrumented for coverage, like "set", and
+	// the hash of the coverage metadata the cover tool generated for it. Both
+	// are empty for packages which weren't instrumented.
+	CoverMode     string `json:",omitempty"`
+	CoverMetaHash string `json:",omitempty"`
+
+	// The "//go:linkname" and "//go:cgo_import_dynamic" directives of the
+	// package, without their slashes, like "go:linkname now time.now". These
+	// reach into the internals of other packages, like the runtime.
+	LinkDirectives []string `json:",omitempty"`
+
+	// GODEBUG settings of a main package's "//go:debug" directives, which the
+	// binary linked from it defaults to.
+	Godebug map[string]string `json:",omitempty"`
+
+	// Whether the package was compiled with "-dynlink", so it can be linked
+	// into a shared library, or into a binary linked against one.
+	DynLink bool `json:",omitempty"`
+}
+
+func (p Package) StorePath(dir string) string {
+	return filepath.Join(dir, filepath.Base(p.ImportPath)+".json")
+}
+func (p Package) FromImport(path string) Package {
+	return Package{ImportPath: path}
+}
+func (p Package) Migrate() (Package, error) {
+	err := migrate(p.ImportPath, &p.SchemaVersion)
+	return p, err
+}
+
+// A BuildRecord describes how a package was compiled beyond what's in its
+// metadata. It's written next to the archive in the lib output, since
+// anything in the export output which changes with the package's code, rather
+// than its export data, would rebuild every package importing it.
+type BuildRecord struct {
+	// Metadata of the package, repeated so two builds can be compared from
+	// their records alone.
+	Metadata Package
+
+	// Hex SHA-256 digest of the archive.
+	ArchiveSHA256 string `json:",omitempty"`
+
+	// Hex SHA-256 digests of the sources compiled into the package, keyed by
+	// file name, the flags given to the compiler besides those the builder
+	// always adds, and the export data digests of the imports, keyed by
+	// import path. These tell why a package was rebuilt. See [Diff].
+	SourceSHA256 map[string]string `json:",omitempty"`
+	CompileFlags []string          `json:",omitempty"`
+	ImportSHA256 map[string]string `json:",omitempty"`
+}
+
+// An Import is a package along with the store path holding it.
+type Import struct {
+	StorePath  string
+	ImportPath string
+}
+
+// SortImports sorts a slice of imports lexicographically by import path.
+func SortImports(imports []Import) {
+	slices.SortFunc(imports, func(a, b Import) int {
+		return strings.Compare(a.ImportPath, b.ImportPath)
+	})
+}
+
+// A MetaPackage is the metadata of a set of packages which can be imported
+// together under a single import path, like "std".
+type MetaPackage struct {
+	SchemaVersion int
+
+	ImportPath  string `json:"-"`
+	SubPackages []Import
+	ImportMap   map[string]string `json:",omitempty"`
+}
+
+func (p MetaPackage) StorePath(dir string) string {
+	return filepath.Join(dir, filepath.Base(p.ImportPath)+".json")
+}
+func (p MetaPackage) FromImport(path string) MetaPackage {
+	return MetaPackage{ImportPath: path}
+}
+func (p MetaPackage) Migrate() (MetaPackage, error) {
+	err := migrate(p.ImportPath, &p.SchemaVersion)
+	return p, err
+}
+
+// A SharedLibrary is the metadata of a shared library of packages, built with
+// "-buildmode=shared", which binaries link against with "-linkshared".
+type SharedLibrary struct {
+	SchemaVersion int
+
+	// File name of the library in the lib directory, like "libstd.so".
+	Library string
+
+	// Sorted import paths of the packages linked into the library.
+	Packages []string
+}
+
+func (l SharedLibrary) Migrate() (SharedLibrary, error) {
+	err := migrate(l.Library, &l.SchemaVersion)
+	return l, err
+}
+
+// FilterInternalPackages returns true if a package named importPath is an
+// internal package that should be filtered from the output.
+func FilterInternalPackages(importPath string) bool {
+	switch importPath {
+	case "runtime/cgo", "unsafe":
+		return true
+	default:
+		return false
+	}
+}
+
+// FeatureError records when a package was built for a different
+// micro-architecture feature level than the current build.
+type FeatureError struct {
+	ImportPath string
+	Feature    string
+	Built      string
+	Want       string
+}
+
+func (e FeatureError) Error() string {
+	level := func(value string) string {
+		if value == "" {
+			return "<default>"
+		}
+		return value
+	}
+
+	return fmt.Sprintf(
+		"package %s was built with %s=%s, but this build uses %s=%s",
+		e.ImportPath,
+		e.Feature,
+		level(e.Built),
+		e.Feature,
+		level(e.Want),
+	)
+}
+
+// CheckArchFeatures ensures a package was built with the same micro-architecture
+// feature levels as features. Archives built for different feature levels can
+// technically be linked together, but the result may not run on the intended
+// hardware.
+func CheckArchFeatures(pkg *Package, features map[string]string) error {
+	names := slices.Collect(maps.Keys(features))
+	names = append(names, slices.Collect(maps.Keys(pkg.ArchFeatures))...)
+	slices.Sort(names)
+
+	for _, name := range slices.Compact(names) {
+		if pkg.ArchFeatures[name] != features[name] {
+			return &FeatureError{
+				ImportPath: pkg.ImportPath,
+				Feature:    name,
+				Built:      pkg.ArchFeatures[name],
+				Want:       features[name],
+			}
+		}
+	}
+
+	return nil
+}
+
+// ExperimentError records when a package was built with a different set of
+// toolchain experiments than the current build.
+type ExperimentError struct {
+	ImportPath string
+	Built      []string
+	Want       []string
+}
+
+func (e ExperimentError) Error() string {
+	experiments := func(names []string) string {
+		if len(names) == 0 {
+			return "<none>"
+		}
+		return strings.Join(names, ",")
+	}
+
+	return fmt.Sprintf(
+		"package %s was built with GOEXPERIMENT=%s, but this build uses GOEXPERIMENT=%s",
+		e.ImportPath,
+		experiments(e.Built),
+		experiments(e.Want),
+	)
+}
+
+// CheckExperiments ensures a package was built with the same toolchain
+// experiments as experiments, which must be sorted.
+func CheckExperiments(pkg *Package, experiments []string) error {
+	if !slices.Equal(pkg.Experiments, experiments) {
+		return &ExperimentError{pkg.ImportPath, pkg.Experiments, experiments}
+	}
+
+	return nil
+}
+
+// ToolchainError records when a package was compiled by a different version of
+// Go than the current build.
+type ToolchainError struct {
+	ImportPath string
+	Built      string
+	Want       string
+}
+
+func (e ToolchainError) Error() string {
+	return fmt.Sprintf(
+		"package %s was compiled by go%s, but this build uses go%s",
+		e.ImportPath,
+		e.Built,
+		e.Want,
+	)
+}
+
+// CheckGoVersion ensures a package was compiled by the Go SDK of version
+// version. Packages from before the version was recorded are assumed to match.
+func CheckGoVersion(pkg *Package, version string) error {
+	if pkg.GoVersion != "" && pkg.GoVersion != version {
+		return &ToolchainError{pkg.ImportPath, pkg.GoVersion, version}
+	}
+
+	return nil
+}
+
+// CompilerError records when a package was compiled by a different toolchain
+// than the current build, like gccgo instead of gc.
+type CompilerError struct {
+	ImportPath string
+	Built      string
+	Want       string
+}
+
+func (e CompilerError) Error() string {
+	return fmt.Sprintf(
+		"package %s was compiled by %s, but this build uses %s",
+		e.ImportPath,
+		e.Built,
+		e.Want,
+	)
+}
+
+// CheckCompiler ensures a package was compiled by the toolchain compiler,
+// where "gc" is also recorded as no compiler at all. The objects and export
+// data of each toolchain are only understood by itself.
+func CheckCompiler(pkg *Package, compiler string) error {
+	built := pkg.Compiler
+	if built == "" {
+		built = "gc"
+	}
+	if built != compiler {
+		return &CompilerError{pkg.ImportPath, built, compiler}
+	}
+
+	return nil
+}
+
+// TargetError records when a package was built for a different platform than
+// the current build.
+type TargetError struct {
+	ImportPath string
+	Built      string
+	Want       string
+}
+
+func (e TargetError) Error() string {
+	return fmt.Sprintf(
+		"package %s was built for %s, but this build targets %s",
+		e.ImportPath,
+		e.Built,
+		e.Want,
+	)
+}
+
+// CheckTarget ensures a package was built for the platform goos/goarch. Older
+// metadata doesn't record a platform, so those packages are always accepted.
+func CheckTarget(pkg *Package, goos, goarch string) error {
+	if pkg.GOOS == "" && pkg.GOARCH == "" {
+		return nil
+	}
+	if pkg.GOOS != goos || pkg.GOARCH != goarch {
+		return &TargetError{
+			ImportPath: pkg.ImportPath,
+			Built:      pkg.GOOS + "/" + pkg.GOARCH,
+			Want:       goos + "/" + goarch,
+		}
+	}
+
+	return nil
+}
+
+// DynLinkError records when a package was compiled for a different linking
+// mode than the current build, either as a static archive or with "-dynlink"
+// for shared libraries.
+type DynLinkError struct {
+	ImportPath string
+	Built      bool
+}
+
+func (e DynLinkError) Error() string {
+	if e.Built {
+		return fmt.Sprintf(
+			"package %s was compiled with -dynlink for shared libraries, but this build links statically",
+			e.ImportPath,
+		)
+	}
+	return fmt.Sprintf(
+		"package %s wasn't compiled with -dynlink, but this build links with shared libraries",
+		e.ImportPath,
+	)
+}
+
+// CheckDynLink ensures a package was compiled with "-dynlink" exactly when
+// dynlink is set. Code compiled for shared libraries reaches global data
+// differently, so the two can't be mixed.
+func CheckDynLink(pkg *Package, dynlink bool) error {
+	if pkg.DynLink != dynlink {
+		return &DynLinkError{pkg.ImportPath, pkg.DynLink}
+	}
+
+	return nil
+}
+
+// Diff lists what changed between the old and new build of a package, like
+// "source a.go changed", starting with its sources, compile flags, and
+// imports, followed by the settings it was built with, from their build
+// records.
+func Diff(oldRecord, newRecord *BuildRecord) []string {
+	old, new := &oldRecord.Metadata, &newRecord.Metadata
+	changes := diffKeys("source", oldRecord.SourceSHA256, newRecord.SourceSHA256)
+	for _, name := range slices.Sorted(maps.Keys(newRecord.SourceSHA256)) {
+		if digest, ok := oldRecord.SourceSHA256[name]; ok && digest != newRecord.SourceSHA256[name] {
+			changes = append(changes, fmt.Sprintf("source %s changed", name))
+		}
+	}
+	if !slices.Equal(oldRecord.CompileFlags, newRecord.CompileFlags) {
+		changes = append(changes, fmt.Sprintf("compile flags changed from %q to %q", oldRecord.CompileFlags, newRecord.CompileFlags))
+	}
+
+	changes = append(changes, diffSets("import", old.Imports, new.Imports)...)
+	for _, importPath := range slices.Sorted(maps.Keys(newRecord.ImportSHA256)) {
+		if digest, ok := oldRecord.ImportSHA256[importPath]; ok && digest != newRecord.ImportSHA256[importPath] {
+			changes = append(changes, fmt.Sprintf("export data of import %s changed", importPath))
+		}
+	}
+	changes = append(changes, diffSets("dependency", old.Deps, new.Deps)...)
+
+	for _, setting := range []struct {
+		name     string
+		old, new string
+	}{
+		{"GOOS", old.GOOS, new.GOOS},
+		{"GOARCH", old.GOARCH, new.GOARCH},
+		{"Go version", old.GoVersion, new.GoVersion},
+		{"compiler", old.Compiler, new.Compiler},
+		{"build tags", strings.Join(old.BuildTags, ","), strings.Join(new.BuildTags, ",")},
+		{"experiments", strings.Join(old.Experiments, ","), strings.Join(new.Experiments, ",")},
+		{"arch features", formatFeatures(old.ArchFeatures), formatFeatures(new.ArchFeatures)},
+		{"cover mode", old.CoverMode, new.CoverMode},
+		{"dynlink", fmt.Sprint(old.DynLink), fmt.Sprint(new.DynLink)},
+	} {
+		if setting.old != setting.new {
+			changes = append(changes, fmt.Sprintf("%s changed from %q to %q", setting.name, setting.old, setting.new))
+		}
+	}
+
+	return changes
+}
+
+// diffKeys lists the keys of kind added to or removed from old in new.
+func diffKeys(kind string, old, new map[string]string) []string {
+	return diffSets(kind, slices.Collect(maps.Keys(old)), slices.Collect(maps.Keys(new)))
+}
+
+// diffSets lists the elements of kind added to or removed from old in new.
+func diffSets(kind string, old, new []string) []string {
+	var changes []string
+	for _, name := range slices.Sorted(slices.Values(new)) {
+		if !slices.Contains(old, name) {
+			changes = append(changes, fmt.Sprintf("%s %s added", kind, name))
+		}
+	}
+	for _, name := range slices.Sorted(slices.Values(old)) {
+		if !slices.Contains(new, name) {
+			changes = append(changes, fmt.Sprintf("%s %s removed", kind, name))
+		}
+	}
+
+	return changes
+}
+
+// formatFeatures formats feature levels like GOAMD64=v3, sorted by name.
+func formatFeatures(features map[string]string) string {
+	pairs := make([]string, 0, len(features))
+	for _, name := range slices.Sorted(maps.Keys(features)) {
+		pairs = append(pairs, name+"="+features[name])
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type GoPackagesDriverAttrs struct {
+	// Every package the driver can answer for, keyed by import path.
+	Packages map[string]DriverPackageAttrs `nix:"required"`
+
+	// Export output of the std meta package. Packages of the standard library
+	// are read from the SDK.
+	Std string
+
+	// Store path of the source tree the packages were built from. Sources under
+	// it are reported under the driver's working directory instead, which
+	// go/packages sets to the workspace folder, so editors open the files being
+	// edited rather than their copy in the store.
+	SourceRoot string
+}
+
+// DriverPackageAttrs describes a compiled package to the driver.
+type DriverPackageAttrs struct {
+	Srcs      []string
+	Export    string
+	ImportMap map[string]string
+}
+
+// A driverRequest is the query go/packages writes to the driver's stdin. Only
+// what the driver uses is kept.
+type driverRequest struct {
+	Tests bool
+}
+
+// A driverError is a package error, in the form go/packages expects.
+type driverError struct {
+	Pos  string
+	Msg  string
+	Kind int
+}
+
+// Kinds of driverError, from go/packages.
+const (
+	driverListError = 1
+)
+
+// A driverPackage is a package in a driverResponse. Imports are keyed by the
+// import path used in the source, and map to the ID of the imported package.
+type driverPackage struct {
+	ID              string
+	Name            string            `json:",omitempty"`
+	PkgPath         string            `json:",omitempty"`
+	Errors          []driverError     `json:",omitempty"`
+	GoFiles         []string          `json:",omitempty"`
+	CompiledGoFiles []string          `json:",omitempty"`
+	OtherFiles      []string          `json:",omitempty"`
+	ExportFile      string            `json:",omitempty"`
+	Imports         map[string]string `json:",omitempty"`
+}
+
+// A driverResponse is the answer written to the driver's stdout.
+type driverResponse struct {
+	NotHandled bool
+	Compiler   string
+	Arch       string
+	Roots      []string `json:",omitempty"`
+	Packages   []*driverPackage
+	GoVersion  int
+}
+
+// A PackagesDriver answers go/packages queries from the metadata of packages
+// already built by Nix.
+type PackagesDriver struct {
+	SDK   *GoSDK
+	Attrs *GoPackagesDriverAttrs
+
+	// Directory sources under SourceRoot are reported in.
+	WorkDir string
+
+	// Packages of the standard library, keyed by import path, and how std
+	// rewrites its imports of vendored packages.
+	stdPackages  map[string]string
+	stdImportMap map[string]string
+
+	loaded map[string]*driverPackage
+	order  []string
+}
+
+// NewPackagesDriver creates a driver answering for the packages in attrs.
+func NewPackagesDriver(sdk *GoSDK, attrs *GoPackagesDriverAttrs, workDir string) (*PackagesDriver, error) {
+	d := &PackagesDriver{
+		SDK:         sdk,
+		Attrs:       attrs,
+		WorkDir:     workDir,
+		stdPackages: make(map[string]string),
+		loaded:      make(map[string]*driverPackage),
+	}
+
+	if attrs.Std != "" {
+		std, err := loadMetaPackage(attrs.Std, "std")
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range std.SubPackages {
+			d.stdPackages[pkg.ImportPath] = pkg.StorePath
+		}
+		d.stdImportMap = std.ImportMap
+	}
+
+	return d, nil
+}
+
+// localPath maps a source to where the editor sees it.
+func (d *PackagesDriver) localPath(src string) string {
+	if d.Attrs.SourceRoot == "" {
+		return src
+	}
+	rel, ok := strings.CutPrefix(src, d.Attrs.SourceRoot+"/")
+	if !ok {
+		return src
+	}
+
+	return filepath.Join(d.WorkDir, rel)
+}
+
+// stdSrcs lists the sources of a standard library package in the SDK which
+// are selected for the build.
+func (d *PackagesDriver) stdSrcs(importPath string) ([]string, error) {
+	dir := filepath.Join(d.SDK.Path, "src", filepath.FromSlash(importPath))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var srcs []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		srcs = append(srcs, filepath.Join(dir, name))
+	}
+
+	return srcs, nil
+}
+
+// stdVendored reports whether the standard library vendors the package
+// importPath. Without the std meta package's import map, this is how the
+// standard library's imports of vendored packages are resolved.
+func (d *PackagesDriver) stdVendored(importPath string) bool {
+	info, err := os.Stat(filepath.Join(d.SDK.Path, "src", "vendor", filepath.FromSlash(importPath)))
+	return err == nil && info.IsDir()
+}
+
+// Load resolves the package importPath and everything it imports, returning
+// its ID. Problems are recorded as errors of the package, like the go command
+// does, so the editor can still use everything else.
+func (d *PackagesDriver) Load(importPath string) string {
+	if _, ok := d.loaded[importPath]; ok {
+		return importPath
+	}
+	pkg := &driverPackage{ID: importPath, PkgPath: importPath}
+	d.loaded[importPath] = pkg
+	d.order = append(d.order, importPath)
+
+	addError := func(err error) {
+		pkg.Errors = append(pkg.Errors, driverError{Pos: "-", Msg: err.Error(), Kind: driverListError})
+	}
+
+	var srcs []string
+	importMap := d.stdImportMap
+	attrs, ok := d.Attrs.Packages[importPath]
+	isStd := !ok
+	if ok {
+		for _, src := range attrs.Srcs {
+			srcs = append(srcs, d.localPath(src))
+		}
+		if attrs.Export != "" {
+			pkg.ExportFile = filepath.Join(attrs.Export, filepath.Base(importPath)+".x")
+		}
+		importMap = attrs.ImportMap
+	} else {
+		var err error
+		if srcs, err = d.stdSrcs(importPath); err != nil {
+			addError(fmt.Errorf("package %s is not built by Nix or part of the standard library", importPath))
+			return importPath
+		}
+		if storePath, ok := d.stdPackages[importPath]; ok {
+			pkg.ExportFile = filepath.Join(storePath, filepath.Base(importPath)+".x")
+		}
+	}
+
+	imports := make(map[string]struct{})
+	for _, src := range srcs {
+		match, err := IndexSource(src).Match()
+		if err != nil {
+			addError(err)
+			continue
+		}
+		if !match {
+			continue
+		}
+		if filepath.Ext(src) != ".go" {
+			pkg.OtherFiles = append(pkg.OtherFiles, src)
+			continue
+		}
+		pkg.GoFiles = append(pkg.GoFiles, src)
+
+		header, err := IndexSource(src).Header()
+		if err != nil {
+			addError(err)
+			continue
+		}
+		if pkg.Name == "" {
+			pkg.Name = header.Name.Name
+		}
+		fileImports, err := IndexSource(src).Imports()
+		if err != nil {
+			addError(err)
+			continue
+		}
+		for _, imp := range fileImports {
+			imports[imp] = struct{}{}
+		}
+	}
+	pkg.CompiledGoFiles = pkg.GoFiles
+
+	for _, imp := range SortedKeys(imports) {
+		// cgo isn't supported, so there is nothing to resolve "C" to.
+		if imp == "C" {
+			continue
+		}
+		resolved := imp
+		if mapped, ok := importMap[imp]; ok {
+			resolved = mapped
+		} else if isStd && d.stdVendored(imp) {
+			resolved = "vendor/" + imp
+		}
+		if pkg.Imports == nil {
+			pkg.Imports = make(map[string]string)
+		}
+		pkg.Imports[imp] = d.Load(resolved)
+	}
+
+	return importPath
+}
+
+// packageDir returns the directory of a package's sources, as the editor sees
+// them.
+func (d *PackagesDriver) packageDir(importPath string) string {
+	for _, src := range d.Attrs.Packages[importPath].Srcs {
+		if filepath.Ext(src) == ".go" {
+			return filepath.Dir(d.localPath(src))
+		}
+	}
+
+	return ""
+}
+
+// Match returns the import paths of the packages matching a pattern. Patterns
+// are import paths, directories relative to the working directory, either of
+// which may end in "/..." to include everything below them, "file=<path>" for
+// the package containing a file, "std", or "builtin".
+func (d *PackagesDriver) Match(pattern string) []string {
+	if file, ok := strings.CutPrefix(pattern, "file="); ok {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(d.WorkDir, file)
+		}
+		var matches []string
+		for _, importPath := range SortedKeys(d.Attrs.Packages) {
+			for _, src := range d.Attrs.Packages[importPath].Srcs {
+				if d.localPath(src) == file {
+					matches = append(matches, importPath)
+					break
+				}
+			}
+		}
+		stdDir := filepath.Join(d.SDK.Path, "src") + string(filepath.Separator)
+		if rel, ok := strings.CutPrefix(filepath.Dir(file), stdDir); len(matches) == 0 && ok {
+			matches = append(matches, filepath.ToSlash(rel))
+		}
+		return matches
+	}
+
+	switch pattern {
+	case "builtin":
+		return []string{"builtin"}
+	case "std":
+		return SortedKeys(d.stdPackages)
+	}
+
+	prefix, recursive := strings.CutSuffix(pattern, "/...")
+	if pattern == "..." {
+		prefix, recursive = "", true
+	}
+	if prefix == "." || strings.HasPrefix(prefix, "./") || strings.HasPrefix(prefix, "../") ||
+		filepath.IsAbs(prefix) {
+		dir := prefix
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(d.WorkDir, dir)
+		}
+		var matches []string
+		for _, importPath := range SortedKeys(d.Attrs.Packages) {
+			pkgDir := d.packageDir(importPath)
+			if pkgDir == dir || (recursive && strings.HasPrefix(pkgDir, dir+string(filepath.Separator))) {
+				matches = append(matches, importPath)
+			}
+		}
+		return matches
+	}
+
+	if !recursive {
+		return []string{pattern}
+	}
+	var matches []string
+	for _, importPath := range SortedKeys(d.Attrs.Packages) {
+		if prefix == "" || importPath == prefix || strings.HasPrefix(importPath, prefix+"/") {
+			matches = append(matches, importPath)
+		}
+	}
+	return matches
+}
+
+// Respond answers a query for patterns. Test variants of packages aren't
+// built by Nix, so requests for tests get the packages alone.
+func (d *PackagesDriver) Respond(patterns []string) *driverResponse {
+	response := &driverResponse{Compiler: "gc", Arch: Context.GOARCH}
+	if version, ok := parseGoVersion(d.SDK.Version); ok {
+		response.GoVersion = version.minor
+	}
+
+	for _, pattern := range patterns {
+		for _, importPath := range d.Match(pattern) {
+			if id := d.Load(importPath); !slices.Contains(response.Roots, id) {
+				response.Roots = append(response.Roots, id)
+			}
+		}
+	}
+	for _, importPath := range d.order {
+		response.Packages = append(response.Packages, d.loaded[importPath])
+	}
+
+	return response
+}
+
+// installPackagesDriver writes the driver's configuration and a script for
+// GOPACKAGESDRIVER calling the builder with it.
+func installPackagesDriver(attrs *Attrs, driverAttrs *GoPackagesDriverAttrs) {
+	outDir := derivation.MustOutput("out")
+	builder, err := os.Executable()
+	if err != nil {
+		Fatalf("failed to find the builder: %v", err)
+	}
+
+	config := filepath.Join(outDir, "driver.json")
+	err = WriteGenerated(config, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(struct {
+			*Attrs
+			*GoPackagesDriverAttrs
+		}{attrs, driverAttrs})
+	})
+	if err != nil {
+		Fatalf("failed to write driver configuration: %v", err)
+	}
+
+	binDir, err := derivation.EnsureDir(outDir, "bin")
+	if err != nil {
+		Fatal(err)
+	}
+	script := filepath.Join(binDir, "gopackagesdriver")
+	err = WriteGenerated(script, func(w io.Writer) error {
+		_, err := fmt.Fprintf(
+			w,
+			"#!/bin/sh\nexec '%s' --attrs-file '%s' gopackages-driver \"$@\"\n",
+			builder,
+			config,
+		)
+		return err
+	})
+	if err == nil {
+		err = os.Chmod(script, 0755)
+	}
+	if err != nil {
+		Fatalf("failed to write driver script: %v", err)
+	}
+}
+
+// gopackagesDriver implements the GOPACKAGESDRIVER protocol of go/packages,
+// so gopls and other tools can load packages built by Nix. Inside a derivation,
+// "--install" writes a script for GOPACKAGESDRIVER instead.
+func gopackagesDriver(sdk *GoSDK, attrs *Attrs) {
+	driverAttrs := derivation.GetAttrs[GoPackagesDriverAttrs]()
+	if len(os.Args) > 2 && os.Args[2] == "--install" {
+		installPackagesDriver(attrs, &driverAttrs)
+		return
+	}
+
+	var request driverRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&request); err != nil && err != io.EOF {
+		Fatalf("failed to read driver request: %v", err)
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		Fatal(err)
+	}
+
+	driver, err := NewPackagesDriver(sdk, &driverAttrs, workDir)
+	if err != nil {
+		Fatalf("failed to load standard library: %v", err)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(driver.Respond(os.Args[2:])); err != nil {
+		Fatal(err)
+	}
+}
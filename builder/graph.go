@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"nix/derivation"
+	"path/filepath"
+	"strconv"
+)
+
+type GraphAttrs struct {
+	PackagePath string `nix:"required"`
+	Main        string `nix:"required"`
+	Deps        map[string]string
+
+	// Either "dot" (the default) or "json".
+	Format string
+}
+
+// A GraphNode is a package in an import graph, with the packages it imports
+// directly.
+type GraphNode struct {
+	ImportPath string
+	StorePath  string
+	Imports    []string `json:",omitempty"`
+}
+
+// An ImportGraph is the transitive import graph of a package. Packages are
+// sorted by import path.
+type ImportGraph struct {
+	Root     string
+	Packages []GraphNode
+}
+
+// LoadImportGraph walks the metadata of a package and everything it imports.
+// deps maps import paths to the store paths holding their metadata.
+func LoadImportGraph(
+	root string,
+	storePath string,
+	deps map[string]string,
+) (*ImportGraph, error) {
+	if err := ResolveMetaPackages(deps, nil, false); err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]GraphNode)
+	var visit func(importPath, storePath, parent string) error
+	visit = func(importPath, storePath, parent string) error {
+		if _, ok := nodes[importPath]; ok {
+			return nil
+		}
+		if storePath == "" {
+			return NewImportError(importPath, parent, deps)
+		}
+
+		pkg, err := LoadMetadata[Package](storePath, importPath)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", importPath, err)
+		}
+		nodes[importPath] = GraphNode{importPath, storePath, pkg.Imports}
+
+		for _, dep := range pkg.Imports {
+			if err := visit(dep, deps[dep], importPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(root, storePath, root); err != nil {
+		return nil, err
+	}
+
+	graph := &ImportGraph{Root: root, Packages: make([]GraphNode, 0, len(nodes))}
+	for _, importPath := range SortedKeys(nodes) {
+		graph.Packages = append(graph.Packages, nodes[importPath])
+	}
+	return graph, nil
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language.
+func (g *ImportGraph) WriteDOT(w io.Writer) error {
+	fmt.Fprintln(w, "digraph imports {")
+	fmt.Fprintf(w, "\t%s [shape=box];\n", strconv.Quote(g.Root))
+	for _, node := range g.Packages {
+		for _, dep := range node.Imports {
+			fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(node.ImportPath), strconv.Quote(dep))
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// WriteJSON writes the graph as JSON.
+func (g *ImportGraph) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(g)
+}
+
+// graph writes the transitive import graph of a package, so it can be
+// visualized to find what is pulling in a dependency.
+func graph() {
+	attrs := derivation.GetAttrs[GraphAttrs]()
+
+	outDir := derivation.MustOutput("out")
+
+	importGraph, err := LoadImportGraph(attrs.PackagePath, attrs.Main, attrs.Deps)
+	if err != nil {
+		Fatalf("failed to load import graph: %v", err)
+	}
+
+	var write func(io.Writer) error
+	switch attrs.Format {
+	case "", "dot":
+		write = importGraph.WriteDOT
+		attrs.Format = "dot"
+	case "json":
+		write = importGraph.WriteJSON
+	default:
+		Fatalf("unknown graph format \"%s\"", attrs.Format)
+	}
+
+	err = WriteGenerated(filepath.Join(outDir, "graph."+attrs.Format), write)
+	if err != nil {
+		Fatalf("failed to write import graph: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// An OutputLayout selects where compiled archives are installed in the lib
+// output, in addition to "<name>.a" at its root.
+type OutputLayout string
+
+const (
+	// Only install the archive at the root of the output.
+	LayoutDefault OutputLayout = ""
+
+	// Also link the archive into "pkg/$GOOS_$GOARCH/<import path>.a", where the
+	// go command installed archives in GOPATH mode. Tools expecting GOPATH
+	// conventions can then use the output as a GOPATH.
+	LayoutGopath OutputLayout = "gopath"
+)
+
+// ParseOutputLayout checks the layout named by the outputLayout attribute.
+func ParseOutputLayout(name string) (OutputLayout, error) {
+	switch layout := OutputLayout(name); layout {
+	case LayoutDefault, LayoutGopath:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("unknown output layout \"%s\", expected \"gopath\"", name)
+	}
+}
+
+// GopathPkgDir returns the directory of archives in a GOPATH for the current
+// platform. Like the go command, instrumented builds get their own directory.
+func GopathPkgDir(instrument string) string {
+	dir := Context.GOOS + "_" + Context.GOARCH
+	if instrument != "" {
+		dir += "_" + instrument
+	}
+
+	return filepath.Join("pkg", dir)
+}
+
+// Install places archive in the layout under dir. Archives are linked relative
+// to dir, so the output can be moved.
+func (l OutputLayout) Install(dir, archive, importPath, instrument string) error {
+	if l != LayoutGopath {
+		return nil
+	}
+
+	dst := filepath.Join(dir, GopathPkgDir(instrument), filepath.FromSlash(importPath)+".a")
+	target, err := filepath.Rel(filepath.Dir(dst), archive)
+	if err != nil {
+		return err
+	}
+
+	return Materialize(target, dst, MaterializeSymlink)
+}
@@ -1,60 +1,628 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"nix/derivation"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 )
 
 type LinkAttrs struct {
-	PackagePath string
-	Main        string
-	Name        string
+	PackagePath string `nix:"required"`
+	Main        string `nix:"required"`
+	Name        string `nix:"required"`
 	Deps        map[string]string
 
+	// Export outputs of Deps, keyed the same way. Their metadata is checked
+	// for import cycles, and packages instrumented for coverage differently,
+	// before linking. See [checkImportCycles] and [checkCoverage].
+	Exports map[string]string
+
+	// Resource scripts (.rc) to compile and embed in Windows binaries.
+	WindowsResources []string
+
+	// Sign darwin binaries after linking.
+	Codesign *CodesignAttrs
+
+	// Commands to run with the linked binary, installing what they print.
+	PostLink []PostLinkHook
+
+	// Write a report of which packages and functions were discarded by the
+	// linker to the "deadcode" output.
+	DeadcodeReport bool
+
+	// Fail unless the binary is statically linked.
+	Static bool
+
+	// Transformations of the linked binary, such as stripping or compressing
+	// it, applied before it's installed.
+	PostProcess []PostProcessStep
+
+	// What to do when a linked package is provided both directly and by a
+	// meta package, or by two meta packages. See [ConflictPolicy].
+	MetaConflicts string
+
+	// GODEBUG settings the binary defaults to, unless the "//go:debug"
+	// directives of the main package set them too. The environment still
+	// overrides them at runtime.
+	DefaultGodebug map[string]string
+
+	// Fail if a package is linked both from its module and as the standard
+	// library's vendored copy. See [VendoredCopyError].
+	CheckVendoredStd bool
+
+	// Fail if any linked package outside the standard library, besides those
+	// in AllowLinknames, has "//go:linkname" or "//go:cgo_import_dynamic"
+	// directives. This needs Exports. See [checkLinkDirectives].
+	StrictLinknames bool
+	AllowLinknames  []string
+
+	// Outputs of "shlib" derivations to link the binary against, instead of
+	// linking their packages in. This needs dynLink.
+	Shlibs []string
+
+	// Debug information and symbols kept in the binary. See [debugLinkFlags].
+	DwarfEnabled  *bool
+	CompressDwarf *bool
+	StripSymbols  bool
+
+	// ELF interpreter and runtime library search path of the binary, so it
+	// finds its shared libraries on NixOS without patching. See
+	// [runtimeLinkFlags].
+	DynamicLinker string
+	RPath         []string
+
+	// Presets for common needs of a target platform, so its raw linker flags
+	// don't have to be known. See [platformLinkFlags].
+	WindowsGUI      bool
+	DarwinHeaderPad bool
+
 	LinkFlags []string
 }
 
+// debugLinkFlags translates the DWARF and symbol table attributes to linker
+// flags. Unset attributes keep the linker's defaults, so the flags are only
+// added when needed and never change with the SDK. These are listed before
+// LinkFlags, so explicit flags still take precedence.
+func debugLinkFlags(attrs *LinkAttrs) []string {
+	var flags []string
+	if attrs.StripSymbols {
+		flags = append(flags, "-s")
+	}
+	switch {
+	case attrs.DwarfEnabled == nil:
+	case !*attrs.DwarfEnabled:
+		flags = append(flags, "-w")
+	case attrs.StripSymbols:
+		// "-s" also drops DWARF, unless it's kept explicitly.
+		flags = append(flags, "-w=0")
+	}
+	if attrs.CompressDwarf != nil && !*attrs.CompressDwarf {
+		flags = append(flags, "-compressdwarf=false")
+	}
+
+	return flags
+}
+
+// runtimeLinkFlags translates DynamicLinker and RPath to the linker's "-I" and
+// "-r" flags, which it passes on to the external linker as well. Every path
+// must be absolute, since the binary could be run from anywhere.
+func runtimeLinkFlags(attrs *LinkAttrs) ([]string, error) {
+	var flags []string
+	if attrs.DynamicLinker != "" {
+		if attrs.Static {
+			return nil, &AttrError{"dynamicLinker", fmt.Errorf("static binaries have no dynamic linker")}
+		}
+		if !filepath.IsAbs(attrs.DynamicLinker) {
+			return nil, &AttrError{"dynamicLinker", fmt.Errorf("%s is not an absolute path", attrs.DynamicLinker)}
+		}
+		flags = append(flags, "-I", attrs.DynamicLinker)
+	}
+
+	if len(attrs.RPath) > 0 {
+		for _, dir := range attrs.RPath {
+			if !filepath.IsAbs(dir) || strings.Contains(dir, ":") {
+				return nil, &AttrError{"rpath", fmt.Errorf("%q is not an absolute path without \":\"", dir)}
+			}
+		}
+		flags = append(flags, "-r", strings.Join(attrs.RPath, ":"))
+	}
+
+	return flags, nil
+}
+
+// platformLinkFlags translates the presets of LinkAttrs to linker flags for
+// the target platform, failing if a preset doesn't apply to it. Flags for the
+// external linker are only added if args selects external linking.
+func platformLinkFlags(attrs *LinkAttrs, args []string) ([]string, error) {
+	if attrs.WindowsGUI {
+		if Context.GOOS != "windows" {
+			return nil, &AttrError{"windowsGUI", fmt.Errorf("GUI binaries can only be linked when targeting windows, not %s", Context.GOOS)}
+		}
+		args = append(slices.Clone(args), windowsGUILinkFlags...)
+	}
+
+	if attrs.DarwinHeaderPad {
+		if Context.GOOS != "darwin" && Context.GOOS != "ios" {
+			return nil, &AttrError{"darwinHeaderPad", fmt.Errorf("header padding only applies when targeting darwin, not %s", Context.GOOS)}
+		}
+		args = addExternalLinkFlag(args, darwinHeaderPadFlag)
+	}
+
+	return args, nil
+}
+
+// checkLinkPresets fails if an attribute translated to flags of Go's linker is
+// set while another toolchain links the binary, which would take them for
+// flags of its own, like gccgo reading "-r" as a relocatable partial link.
+func checkLinkPresets(attrs *LinkAttrs, toolchain string) error {
+	if toolchain == "gc" {
+		return nil
+	}
+
+	for _, preset := range []struct {
+		name string
+		set  bool
+	}{
+		{"stripSymbols", attrs.StripSymbols},
+		{"dwarfEnabled", attrs.DwarfEnabled != nil},
+		{"compressDwarf", attrs.CompressDwarf != nil},
+		{"dynamicLinker", attrs.DynamicLinker != ""},
+		{"rpath", len(attrs.RPath) > 0},
+		{"windowsGUI", attrs.WindowsGUI},
+		{"darwinHeaderPad", attrs.DarwinHeaderPad},
+		{"static", attrs.Static},
+	} {
+		if preset.set {
+			return &AttrError{preset.name, fmt.Errorf(
+				"it only applies to Go's linker, not the %s toolchain. Pass the flags it needs in linkFlags instead",
+				toolchain,
+			)}
+		}
+	}
+
+	return nil
+}
+
+// addExternalLinkFlag adds flag to "-extldflags" in args if they select
+// external linking, keeping any external linker flags already given. Like the
+// linker, only the last "-extldflags" counts, whether its value is the next
+// argument or follows "=".
+func addExternalLinkFlag(args []string, flag string) []string {
+	external := false
+	extldflags := -1
+	prefix := ""
+	for i := 0; i < len(args); i++ {
+		switch arg := strings.TrimPrefix(args[i], "-"); {
+		case arg == "-linkmode=external" || arg == "linkmode=external":
+			external = true
+		case (arg == "-linkmode" || arg == "linkmode") && i+1 < len(args):
+			external = args[i+1] == "external"
+			i++
+		case arg == "-extldflags" || arg == "extldflags":
+			extldflags, prefix = i+1, ""
+			i++
+		case strings.HasPrefix(arg, "-extldflags=") || strings.HasPrefix(arg, "extldflags="):
+			name, _, _ := strings.Cut(args[i], "=")
+			extldflags, prefix = i, name+"="
+		}
+	}
+	if !external {
+		return args
+	}
+
+	args = slices.Clone(args)
+	if extldflags < 0 {
+		return append(args, "-extldflags", flag)
+	}
+	if extldflags < len(args) {
+		value := strings.TrimPrefix(args[extldflags], prefix)
+		switch {
+		case slices.Contains(strings.Fields(value), flag):
+		case strings.TrimSpace(value) == "":
+			args[extldflags] = prefix + flag
+		default:
+			args[extldflags] = prefix + value + " " + flag
+		}
+	}
+
+	return args
+}
+
+// FormatGodebug formats GODEBUG settings as the linker expects them in
+// runtime.godebugDefault.
+func FormatGodebug(settings map[string]string) (string, error) {
+	pairs := make([]string, 0, len(settings))
+	for _, key := range SortedKeys(settings) {
+		value := settings[key]
+		if err := checkGodebug(key, value); err != nil {
+			return "", err
+		}
+		pairs = append(pairs, key+"="+value)
+	}
+
+	return strings.Join(pairs, ","), nil
+}
+
+// checkGodebug fails unless key=value can be a GODEBUG setting.
+func checkGodebug(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "=, \t") || strings.ContainsAny(value, "=, \t") {
+		return fmt.Errorf("invalid GODEBUG setting %q=%q", key, value)
+	}
+
+	return nil
+}
+
+// godebugDirectives collects the settings of the "//go:debug" directives in
+// goSrcs, failing if two set the same key differently. Only main packages
+// and their tests may have them, as with the go command.
+func godebugDirectives(importPath string, goSrcs []string) (map[string]string, error) {
+	settings := make(map[string]string)
+	for _, src := range goSrcs {
+		found, err := IndexSource(src).GodebugDirectives()
+		if err != nil {
+			return nil, err
+		}
+		if len(found) > 0 && importPath != "main" && !strings.HasSuffix(src, "_test.go") {
+			return nil, fmt.Errorf("%s: //go:debug directives only apply to main packages", src)
+		}
+
+		for _, setting := range found {
+			key, value, ok := strings.Cut(setting, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid //go:debug directive %q, expected key=value", src, setting)
+			}
+			if err := checkGodebug(key, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", src, err)
+			}
+			if prev, ok := settings[key]; ok && prev != value {
+				return nil, fmt.Errorf("%s: //go:debug %s=%s conflicts with %s=%s", src, key, value, key, prev)
+			}
+			settings[key] = value
+		}
+	}
+
+	return settings, nil
+}
+
+// mergeGodebug returns the defaults with the settings of directives, which
+// take precedence, applied over them.
+func mergeGodebug(defaults, directives map[string]string) map[string]string {
+	settings := maps.Clone(defaults)
+	if settings == nil {
+		settings = make(map[string]string, len(directives))
+	}
+	maps.Copy(settings, directives)
+
+	return settings
+}
+
+// A PostLinkHook runs the linked binary with Args and installs its output in
+// the conventional location for Type, like nixpkgs' installShellCompletion and
+// installManPage.
+type PostLinkHook struct {
+	Args []string
+
+	// Either "bash", "fish", or "zsh" for shell completions, or "man" for a
+	// manual page.
+	Type string
+
+	// Name of the installed file. Completions default to the name of the
+	// binary. Manual pages must be named with their section, like "tool.1".
+	Name string
+
+	// Derivation output to install into. Defaults to "out".
+	Output string
+}
+
+// installPath returns where the output of the hook is installed, relative to
+// the derivation output, for the binary name.
+func (h *PostLinkHook) installPath(name string) (string, error) {
+	if h.Name != "" {
+		name = h.Name
+	}
+
+	switch h.Type {
+	case "bash":
+		return filepath.Join("share", "bash-completion", "completions", name), nil
+	case "fish":
+		return filepath.Join("share", "fish", "vendor_completions.d", name+".fish"), nil
+	case "zsh":
+		return filepath.Join("share", "zsh", "site-functions", "_"+name), nil
+	case "man":
+		ext := filepath.Ext(h.Name)
+		if len(ext) < 2 {
+			return "", fmt.Errorf("manual page %s is missing a section", h.Name)
+		}
+		return filepath.Join("share", "man", "man"+ext[1:2], h.Name), nil
+	default:
+		return "", fmt.Errorf("unknown post-link hook type \"%s\"", h.Type)
+	}
+}
+
+// runPostLinkHooks runs each hook with the linked binary, installing their
+// output into the derivation outputs. outDirs holds outputs which were already
+// created, and is updated with any the hooks create.
+func runPostLinkHooks(binary string, hooks []PostLinkHook, outDirs map[string]string) error {
+	for i, hook := range hooks {
+		SetPhaseProgress("postLink", i+1, len(hooks))
+		output := hook.Output
+		if output == "" {
+			output = "out"
+		}
+		rel, err := hook.installPath(filepath.Base(binary))
+		if err != nil {
+			return err
+		}
+
+		dir, ok := outDirs[output]
+		if !ok {
+			if dir, err = derivation.OutputPath(output); err != nil {
+				return err
+			}
+			outDirs[output] = dir
+		}
+
+		var out bytes.Buffer
+		cmd, err := TargetCommand(Context.GOOS, Context.GOARCH, binary, hook.Args...)
+		if err != nil {
+			return err
+		}
+		// Binaries shouldn't see anything from the builder's environment.
+		cmd.Env = NativeEnv()
+		cmd.Dir = derivation.BuildDir()
+		cmd.Stdout = &out
+		if err := RunLogged(cmd); err != nil {
+			return fmt.Errorf("post-link hook failed: %w", err)
+		}
+
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+			return fmt.Errorf("failed to install post-link hook output: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DuplicatePackageError records when packages linked into a binary were
+// provided by more than one store path. Packages compiled against one copy
+// can't be linked with the other, which the linker would only report as
+// mismatched fingerprints or duplicate symbols.
+type DuplicatePackageError struct {
+	Duplicates []MetaOverride
+}
+
+func (e DuplicatePackageError) Error() string {
+	var msg strings.Builder
+	for i, duplicate := range e.Duplicates {
+		if i > 0 {
+			msg.WriteString("\n\n")
+		}
+		fmt.Fprintf(
+			&msg,
+			"package %s is provided by more than one store path:\n    %s (from %s)\n    %s (from %s)",
+			duplicate.ImportPath,
+			duplicate.StorePath,
+			depAttr(duplicate.ImportPath, duplicate.Provider),
+			duplicate.Shadowed,
+			depAttr(duplicate.ImportPath, duplicate.MetaPackage),
+		)
+	}
+	msg.WriteString("\n\n  Remove all but one copy of each from the dependencies, so everything is built against the same one.")
+
+	return msg.String()
+}
+
+// depAttr describes the attribute which provided the package importPath,
+// either directly or through the meta package provider.
+func depAttr(importPath, provider string) string {
+	if provider == "" {
+		return fmt.Sprintf("deps.%q", importPath)
+	}
+	return fmt.Sprintf("meta package deps.%q", provider)
+}
+
+// checkDuplicatePackages applies policy to the packages linked into main which
+// were shadowed by one of overrides, so they were provided by more than one
+// store path. With ConflictOverride, the linker is left to sort them out.
+func checkDuplicatePackages(main *Package, overrides []MetaOverride, policy ConflictPolicy) error {
+	var duplicates []MetaOverride
+	for _, override := range overrides {
+		if override.ImportPath == main.ImportPath || slices.Contains(main.Deps, override.ImportPath) {
+			duplicates = append(duplicates, override)
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	err := &DuplicatePackageError{duplicates}
+	switch policy {
+	case ConflictError:
+		return err
+	case ConflictWarn:
+		log.Printf("warning: %v", err)
+	}
+	return nil
+}
+
+// VendoredCopyError records when a binary links a package both from its module
+// and as the copy vendored into the standard library. This is allowed, but the
+// two copies don't share any state or types, and may be different versions.
+type VendoredCopyError struct {
+	Packages []string
+}
+
+func (e VendoredCopyError) Error() string {
+	var msg strings.Builder
+	for i, importPath := range e.Packages {
+		if i > 0 {
+			msg.WriteString("\n")
+		}
+		fmt.Fprintf(&msg, "package %s is linked both from its module and as std's vendored copy vendor/%s", importPath, importPath)
+	}
+
+	return msg.String()
+}
+
+// checkVendoredCopies fails if main links any package of std's vendored
+// modules along with the module's own copy of it.
+func checkVendoredCopies(main *Package) error {
+	linked := append([]string{main.ImportPath}, main.Deps...)
+
+	var copies []string
+	for _, importPath := range linked {
+		vendored, ok := strings.CutPrefix(importPath, "vendor/")
+		if ok && slices.Contains(linked, vendored) {
+			copies = append(copies, vendored)
+		}
+	}
+	if len(copies) > 0 {
+		slices.Sort(copies)
+		return &VendoredCopyError{copies}
+	}
+
+	return nil
+}
+
+// ImportCycleError records packages linked into a binary which import each
+// other. Go doesn't allow this, so the dependencies were wired up wrong, like
+// by an importMap pointing a package at a copy built against another.
+type ImportCycleError struct {
+	// The packages of the cycle, in import order, starting and ending with
+	// the same package.
+	Cycle []string
+}
+
+func (e ImportCycleError) Error() string {
+	return fmt.Sprintf(
+		"import cycle between linked packages:\n    %s\n\n  Check the imports and importMap of these packages for one pointing at the wrong copy of a package.",
+		strings.Join(e.Cycle, "\n    imports "),
+	)
+}
+
+// resolveExports returns the export outputs of the packages linked, with meta
+// packages resolved to the packages they contain.
+func resolveExports(exports map[string]string) (map[string]string, error) {
+	exports = maps.Clone(exports)
+	resolved := len(MetaOverrides)
+	err := ResolveMetaPackages(exports, nil, false)
+	// Overrides are reported for the libraries linked, not their exports.
+	MetaOverrides = MetaOverrides[:resolved]
+
+	return exports, err
+}
+
+// checkImportCycles fails if any package imported by main, directly or not,
+// imports itself, following the Imports in the metadata of exports. Packages
+// missing from exports are skipped, and reported when linking instead.
+func checkImportCycles(main *Package, exports map[string]string) error {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(pkg *Package) error
+	visit = func(pkg *Package) error {
+		state[pkg.ImportPath] = visiting
+		stack = append(stack, pkg.ImportPath)
+		for _, importPath := range pkg.Imports {
+			switch state[importPath] {
+			case visiting:
+				start := slices.Index(stack, importPath)
+				return &ImportCycleError{append(slices.Clone(stack[start:]), importPath)}
+			case visited:
+				continue
+			}
+
+			storePath := exports[importPath]
+			if storePath == "" {
+				continue
+			}
+			dep, err := LoadMetadata[Package](storePath, importPath)
+			if err != nil {
+				return err
+			}
+			if err := visit(&dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[pkg.ImportPath] = visited
+
+		return nil
+	}
+
+	return visit(main)
+}
+
 // linkImportCfg creates the importcfg neccesary for the Go linker and returns
-// the path to it, as well as the resolved main package.
+// the path to it, as well as the resolved main package. It lists every package
+// the linker loads, besides the main package, which must all be in deps. See
+// [linkClosure]. Packages in shlibs, keyed by import path, are linked from
+// those shared libraries.
 func linkImportCfg(
 	main *Package,
 	mainPath string,
 	deps map[string]string,
+	shlibs map[string]string,
+	implicit []string,
 ) (string, error) {
-	if err := ResolveMetaPackages(deps, nil); err != nil {
+	// The policy is only applied to packages which are linked, and names the
+	// attributes which provided them.
+	resolved := len(MetaOverrides)
+	if err := resolveMetaPackages(deps, nil, false, ConflictOverride); err != nil {
+		return "", err
+	}
+	if err := checkDuplicatePackages(main, MetaOverrides[resolved:], MetaConflicts); err != nil {
 		return "", err
 	}
 
-	imports := make([]Import, 0, len(main.Deps)+1)
-	for _, importPath := range main.Deps {
+	mainArchive := fmt.Sprintf("%s/%s.a", mainPath, filepath.Base(main.ImportPath))
+	needed, err := linkClosure(main.ImportPath, mainArchive, implicit, deps, shlibs)
+	if err != nil {
+		return "", err
+	}
+	imports := make([]Import, 0, len(needed)+1)
+	for _, importPath := range SortedKeys(needed) {
 		if storePath := deps[importPath]; storePath != "" {
-			imports = append(imports, Import{storePath, importPath})
-		} else {
-			return "", &ImportError{importPath, main.ImportPath}
+			imports = append(imports, Import{StorePath: storePath, ImportPath: importPath})
 		}
 	}
-	imports = append(imports, Import{mainPath, "command-line-arguments"})
+	imports = append(imports, Import{StorePath: mainPath, ImportPath: "command-line-arguments"})
 	SortImports(imports)
 
-	cfgPath := filepath.Join(BuildDir(), "importcfg.link")
-	cfgFile, err := os.Create(cfgPath)
+	cfgPath := filepath.Join(derivation.BuildDir(), "importcfg.link")
+	err = WriteGenerated(cfgPath, func(cfgFile io.Writer) error {
+		for _, pkg := range imports {
+			fmt.Fprintf(
+				cfgFile,
+				"packagefile %s=%s/%s.a\n",
+				pkg.ImportPath,
+				pkg.StorePath,
+				filepath.Base(pkg.ImportPath),
+			)
+		}
+		for _, importPath := range SortedKeys(shlibs) {
+			fmt.Fprintf(cfgFile, "packageshlib %s=%s\n", importPath, shlibs[importPath])
+		}
+		return nil
+	})
 	if err != nil {
 		return "", err
 	}
-	defer cfgFile.Close()
-
-	for _, pkg := range imports {
-		fmt.Fprintf(
-			cfgFile,
-			"packagefile %s=%s/%s.a\n",
-			pkg.ImportPath,
-			pkg.StorePath,
-			filepath.Base(pkg.ImportPath),
-		)
-	}
 
 	return cfgPath, nil
 }
@@ -65,43 +633,141 @@ type Linkage struct {
 	Main Package
 	Deps map[string]string
 
+	WindowsResources []string
+	Codesign         *CodesignAttrs
+
+	// Default GODEBUG settings, as formatted by [FormatGodebug].
+	Godebug string
+
+	// Receives the linker's reachability graph of symbols, as from "-dumpdep".
+	DumpDeps io.Writer
+
+	// Shared libraries of packages the binary links against, keyed by the
+	// import paths of the packages. See [sharedLibraryPackages].
+	Shlibs map[string]string
+
+	// Hash identifying the link, from which the binary's build ID is derived.
+	// Defaults to the path the binary is linked to.
+	ActionHash string
+
 	importCfg string
 }
 
-// LinkPackage invokes the Go linker to execute the Linkage.
+// archives lists the archive of every package linked into the binary, keyed by
+// import path. This must be called after the package has already been linked.
+func (l *Linkage) archives() map[string]string {
+	archives := make(map[string]string, len(l.Main.Deps)+1)
+	for _, importPath := range append(slices.Clone(l.Main.Deps), l.Main.ImportPath) {
+		archives[importPath] = fmt.Sprintf("%s/%s.a", l.Deps[importPath], filepath.Base(importPath))
+	}
+
+	return archives
+}
+
+// LinkPackage invokes the linker of the SDK's toolchain to execute the
+// Linkage.
 func (l *Linkage) LinkPackage(out string, extraArgs []string) error {
 	storePath := l.Deps[l.Main.ImportPath]
 	if storePath == "" {
-		return &ImportError{l.Main.ImportPath, l.Main.ImportPath}
+		return NewImportError(l.Main.ImportPath, l.Main.ImportPath, l.Deps)
 	}
+	if err := CheckCompatible(&l.Main, l.SDK); err != nil {
+		return err
+	}
+
+	return l.SDK.Compiler().Link(l, out, extraArgs)
+}
+
+// Link invokes the link tool of the SDK.
+func (gcToolchain) Link(l *Linkage, out string, extraArgs []string) error {
+	storePath := l.Deps[l.Main.ImportPath]
 
 	var err error
-	l.importCfg, err = linkImportCfg(&l.Main, storePath, l.Deps)
+	l.importCfg, err = linkImportCfg(&l.Main, storePath, l.Deps, l.Shlibs, linkerImports(l.SDK, &l.Main))
 	if err != nil {
 		return fmt.Errorf("failed to generate linker importcfg: %w", err)
 	}
 
-	cmd := l.SDK.RunTool("link", extraArgs...)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	cmd.Env = []string{
-		"CGO_ENABLED=0",
-		// Make sure GOROOT is unset.
-		"GOROOT=",
+	mainArchive := fmt.Sprintf("%s/%s.a", storePath, filepath.Base(l.Main.ImportPath))
+	if len(l.WindowsResources) > 0 {
+		mainArchive, err = embedWindowsResources(l.SDK, mainArchive, l.WindowsResources)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A build ID from extraArgs is kept, rather than replaced by its content
+	// ID.
+	customBuildID := hasBuildIDFlag(extraArgs)
+	var buildID string
+	var defaultArgs []string
+	if !customBuildID {
+		mainID, err := ReadBuildID(mainArchive)
+		if err != nil {
+			return fmt.Errorf("failed to read build ID: %w", err)
+		}
+		actionHash := l.ActionHash
+		if actionHash == "" {
+			actionHash = out
+		}
+		if buildID, err = binaryBuildID(actionHash, mainID); err != nil {
+			return fmt.Errorf("%w, it may be from an older builder", err)
+		}
+		defaultArgs = append(defaultArgs, "-buildid="+buildID)
 	}
 
+	// Listed before extraArgs, so an explicit "-X" still takes precedence.
+	if l.Godebug != "" {
+		defaultArgs = append(defaultArgs, "-X=runtime.godebugDefault="+l.Godebug)
+	}
+	cmd := l.SDK.RunTool("link", append(defaultArgs, extraArgs...)...)
+	// Make sure GOROOT is unset.
+	cmd.Env = append(l.SDK.PackageEnv(l.Main.ImportPath), "GOROOT=")
+	if l.SDK.Instrument != "" {
+		cmd.Args = append(cmd.Args, "-"+l.SDK.Instrument)
+	}
+
+	if len(l.Shlibs) > 0 {
+		// The linker can't generate DWARF for types defined in shared
+		// libraries, so the go command always drops it too.
+		cmd.Args = append(cmd.Args, "-linkshared", "-w")
+	}
+
+	if l.DumpDeps != nil {
+		cmd.Args = append(cmd.Args, "-dumpdep")
+		cmd.Stdout = l.DumpDeps
+	}
+
+	cmd.Args = append(cmd.Args, ProfileFlags("link", filepath.Base(out))...)
 	cmd.Args = append(
 		cmd.Args,
 		"-o", out,
 		"-importcfg", l.importCfg,
 		"-buildmode", "exe",
-		fmt.Sprintf("%s/%s.a", storePath, filepath.Base(l.Main.ImportPath)),
+		mainArchive,
 	)
 
-	fmt.Fprintln(os.Stderr, cmd)
-	if err := cmd.Run(); err != nil {
+	if err := RecordAction(cmd, []string{l.importCfg, mainArchive}, []string{out}); err != nil {
+		return err
+	}
+
+	SetPhase("link")
+	if err := RunLogged(cmd); err != nil {
 		return fmt.Errorf("failed to link binary: %w", err)
 	}
+	// Rewriting the build ID would invalidate the signature the linker gives
+	// Mach-O binaries, which cmd/go re-signs but this doesn't.
+	if !customBuildID && Context.GOOS != "darwin" && Context.GOOS != "ios" {
+		if err := UpdateBuildID(out, buildID); err != nil {
+			return fmt.Errorf("failed to update build ID: %w", err)
+		}
+	}
+
+	if l.Codesign != nil {
+		if err := signDarwinBinary(out, l.Codesign); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -109,27 +775,145 @@ func (l *Linkage) LinkPackage(out string, extraArgs []string) error {
 func link(sdk *GoSDK) {
 	attrs := derivation.GetAttrs[LinkAttrs]()
 
-	outDir, err := OutputPath("out")
-	if err != nil {
-		log.Fatal(err)
-	}
+	outDir := derivation.MustOutput("out")
 	binDir := filepath.Join(outDir, "bin")
 	if err := os.Mkdir(binDir, 0755); err != nil {
-		log.Fatalf("failed to create bin directory: %v", err)
+		Fatalf("failed to create bin directory: %v", err)
 	}
 
 	main, err := LoadMetadata[Package](attrs.Main, attrs.PackagePath)
 	if err != nil {
-		log.Fatalf("failed to load main module: %v", err)
+		Fatalf("failed to load main module: %v", err)
+	}
+	if MetaConflicts, err = ParseConflictPolicy(attrs.MetaConflicts); err != nil {
+		Fatal(&AttrError{"metaConflicts", err})
+	}
+
+	godebug, err := FormatGodebug(mergeGodebug(attrs.DefaultGodebug, main.Godebug))
+	if err != nil {
+		Fatal(&AttrError{"defaultGodebug", err})
+	}
+	if attrs.CheckVendoredStd {
+		if err := checkVendoredCopies(&main); err != nil {
+			Fatal(err)
+		}
+	}
+	if attrs.StrictLinknames && attrs.Exports == nil {
+		Fatal(&AttrError{"strictLinknames", errors.New("needs the exports of deps to check their metadata")})
+	}
+	if attrs.Exports != nil {
+		exports, err := resolveExports(attrs.Exports)
+		if err != nil {
+			Fatal(err)
+		}
+		if err := checkImportCycles(&main, exports); err != nil {
+			Fatal(err)
+		}
+		if err := checkCoverage(&main, exports); err != nil {
+			Fatal(err)
+		}
+		if attrs.StrictLinknames {
+			var std []string
+			if storePath := attrs.Exports["std"]; storePath != "" {
+				meta, err := loadMetaPackage(storePath, "std")
+				if err != nil {
+					Fatal(err)
+				}
+				for _, pkg := range meta.SubPackages {
+					std = append(std, pkg.ImportPath)
+				}
+			}
+			if err := checkLinkDirectives(&main, exports, std, attrs.AllowLinknames); err != nil {
+				Fatal(err)
+			}
+		}
+	}
+
+	if len(attrs.Shlibs) > 0 && !sdk.DynLink {
+		Fatal(&AttrError{"shlibs", errors.New("linking against shared libraries needs dynLink")})
+	}
+	shlibs, err := sharedLibraryPackages(attrs.Shlibs)
+	if err != nil {
+		Fatal(&AttrError{"shlibs", err})
 	}
 
 	linkage := &Linkage{
-		SDK:  sdk,
-		Main: main,
-		Deps: attrs.Deps,
+		SDK:              sdk,
+		Main:             main,
+		Deps:             attrs.Deps,
+		WindowsResources: attrs.WindowsResources,
+		Codesign:         attrs.Codesign,
+		Godebug:          godebug,
+		Shlibs:           shlibs,
+		ActionHash:       outDir,
 	}
-	err = linkage.LinkPackage(filepath.Join(binDir, attrs.Name), attrs.LinkFlags)
+	var dump bytes.Buffer
+	if attrs.DeadcodeReport {
+		linkage.DumpDeps = &dump
+	}
+	if err := checkLinkPresets(&attrs, sdk.Compiler().Name()); err != nil {
+		Fatal(err)
+	}
+	runtimeFlags, err := runtimeLinkFlags(&attrs)
+	if err != nil {
+		Fatal(err)
+	}
+	linkFlags, err := platformLinkFlags(&attrs, slices.Concat(debugLinkFlags(&attrs), runtimeFlags, attrs.LinkFlags))
 	if err != nil {
-		log.Fatal(err)
+		Fatal(err)
+	}
+	if attrs.Static {
+		linkFlags = staticLinkFlags(linkFlags)
+	}
+	binary := filepath.Join(binDir, attrs.Name)
+	linked := binary
+	if len(attrs.PostProcess) > 0 {
+		// Signatures wouldn't survive post-processing, so the binary is only
+		// signed after.
+		linkage.Codesign = nil
+		linked = filepath.Join(derivation.BuildDir(), "bin", attrs.Name)
+		if _, err := derivation.EnsureDir(filepath.Dir(linked)); err != nil {
+			Fatal(err)
+		}
+	}
+	if err := linkage.LinkPackage(linked, linkFlags); err != nil {
+		Fatal(err)
+	}
+	if DryRun {
+		return
+	}
+	if len(attrs.PostProcess) > 0 {
+		processed, err := PostProcess(linked, attrs.PostProcess)
+		if err != nil {
+			Fatal(err)
+		}
+		if attrs.Codesign != nil {
+			if err := signDarwinBinary(processed, attrs.Codesign); err != nil {
+				Fatal(err)
+			}
+		}
+		if err := InstallBinary(processed, binary); err != nil {
+			Fatalf("failed to install binary: %v", err)
+		}
+	}
+	if attrs.Static {
+		if err := CheckStatic(binary); err != nil {
+			Fatal(err)
+		}
+	}
+
+	if attrs.DeadcodeReport {
+		report, err := NewDeadcodeReport(sdk, &dump, linkage.archives())
+		if err != nil {
+			Fatalf("failed to generate deadcode report: %v", err)
+		}
+		if err := SaveDeadcodeReport(derivation.MustOutput("deadcode"), report); err != nil {
+			Fatalf("failed to generate deadcode report: %v", err)
+		}
+	}
+
+	outDirs := map[string]string{"out": outDir}
+	if err := runPostLinkHooks(binary, attrs.PostLink, outDirs); err != nil {
+		Fatal(err)
 	}
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAddExternalLinkFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "internal linking",
+			args: []string{"-s"},
+			want: []string{"-s"},
+		},
+		{
+			name: "no extldflags",
+			args: []string{"-linkmode=external"},
+			want: []string{"-linkmode=external", "-extldflags", "-static"},
+		},
+		{
+			name: "linkmode as separate argument",
+			args: []string{"-linkmode", "external"},
+			want: []string{"-linkmode", "external", "-extldflags", "-static"},
+		},
+		{
+			name: "separate extldflags",
+			args: []string{"-linkmode=external", "-extldflags", "-lm"},
+			want: []string{"-linkmode=external", "-extldflags", "-lm -static"},
+		},
+		{
+			name: "extldflags with equals",
+			args: []string{"-linkmode=external", "-extldflags=-lm -lz"},
+			want: []string{"-linkmode=external", "-extldflags=-lm -lz -static"},
+		},
+		{
+			name: "double dash extldflags with equals",
+			args: []string{"--extldflags=-lm", "--linkmode=external"},
+			want: []string{"--extldflags=-lm -static", "--linkmode=external"},
+		},
+		{
+			name: "empty extldflags with equals",
+			args: []string{"-linkmode=external", "-extldflags="},
+			want: []string{"-linkmode=external", "-extldflags=-static"},
+		},
+		{
+			name: "flag already given",
+			args: []string{"-linkmode=external", "-extldflags=-static -lm"},
+			want: []string{"-linkmode=external", "-extldflags=-static -lm"},
+		},
+		{
+			name: "last extldflags counts",
+			args: []string{"-extldflags", "-lm", "-linkmode=external", "-extldflags=-lz"},
+			want: []string{"-extldflags", "-lm", "-linkmode=external", "-extldflags=-lz -static"},
+		},
+	}
+	for _, test := range tests {
+		args := slices.Clone(test.args)
+		got := addExternalLinkFlag(args, "-static")
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: addExternalLinkFlag(%q) = %q, want %q", test.name, test.args, got, test.want)
+		}
+		if !slices.Equal(args, test.args) {
+			t.Errorf("%s: addExternalLinkFlag changed its arguments to %q", test.name, args)
+		}
+	}
+}
+
+func TestGodebugDirectives(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, code string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	main := write("main.go", `// Command main sets GODEBUG defaults.
+
+//go:debug http2client=0
+//go:debug panicnil=1
+package main
+
+//go:debug ignored=1
+`)
+	other := write("other.go", "//go:debug http2client=0\n\npackage main\n")
+	conflict := write("conflict.go", "//go:debug http2client=1\n\npackage main\n")
+	invalid := write("invalid.go", "//go:debug http2client\n\npackage main\n")
+	library := write("library.go", "//go:debug panicnil=1\n\npackage lib\n")
+	libraryTest := write("library_test.go", "//go:debug panicnil=1\n\npackage lib\n")
+
+	got, err := godebugDirectives("main", []string{main, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"http2client": "0", "panicnil": "1"}; !maps.Equal(got, want) {
+		t.Errorf("godebugDirectives = %v, want %v", got, want)
+	}
+	if _, err := godebugDirectives("lib", []string{libraryTest}); err != nil {
+		t.Errorf("godebugDirectives of a test file = %v, want nil", err)
+	}
+
+	for _, srcs := range [][]string{{main, conflict}, {invalid}} {
+		if _, err := godebugDirectives("main", srcs); err == nil {
+			t.Errorf("godebugDirectives(%q) succeeded, want an error", srcs)
+		}
+	}
+	if _, err := godebugDirectives("example.com/lib", []string{library}); err == nil {
+		t.Error("godebugDirectives of a library succeeded, want an error")
+	}
+}
+
+func TestMergeGodebug(t *testing.T) {
+	defaults := map[string]string{"http2client": "0", "x509negativeserial": "1"}
+	directives := map[string]string{"http2client": "1", "panicnil": "1"}
+
+	got, err := FormatGodebug(mergeGodebug(defaults, directives))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http2client=1,panicnil=1,x509negativeserial=1"; got != want {
+		t.Errorf("merged GODEBUG = %q, want %q", got, want)
+	}
+	if defaults["http2client"] != "0" {
+		t.Error("mergeGodebug changed the defaults")
+	}
+	if got, err := FormatGodebug(mergeGodebug(nil, nil)); err != nil || got != "" {
+		t.Errorf("merged GODEBUG without settings = %q, %v; want nothing", got, err)
+	}
+	if _, err := FormatGodebug(map[string]string{"a": "1,b=2"}); err == nil {
+		t.Error("FormatGodebug of a value with a comma succeeded, want an error")
+	}
+}
+
+func TestCheckDuplicatePackages(t *testing.T) {
+	main := &Package{ImportPath: "main", Deps: []string{"fmt", "example.com/dep"}}
+	overrides := []MetaOverride{
+		{ImportPath: "fmt", MetaPackage: "std", StorePath: "/nix/store/fmt", Shadowed: "/nix/store/std"},
+		{ImportPath: "unlinked", MetaPackage: "std", StorePath: "/nix/store/a", Shadowed: "/nix/store/std"},
+	}
+
+	var duplicateErr *DuplicatePackageError
+	err := checkDuplicatePackages(main, overrides, ConflictError)
+	if !errors.As(err, &duplicateErr) {
+		t.Fatalf("checkDuplicatePackages with ConflictError = %v, want a DuplicatePackageError", err)
+	}
+	if len(duplicateErr.Duplicates) != 1 || duplicateErr.Duplicates[0].ImportPath != "fmt" {
+		t.Errorf("duplicates = %v, want only fmt", duplicateErr.Duplicates)
+	}
+
+	for _, policy := range []ConflictPolicy{ConflictOverride, ConflictWarn} {
+		if err := checkDuplicatePackages(main, overrides, policy); err != nil {
+			t.Errorf("checkDuplicatePackages with policy %d = %v, want nil", policy, err)
+		}
+	}
+	if err := checkDuplicatePackages(main, overrides[1:], ConflictError); err != nil {
+		t.Errorf("checkDuplicatePackages of an unlinked package = %v, want nil", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// linkDirectives returns the sorted link directives of every Go source of a
+// package. See [SourceFile.LinkDirectives].
+func linkDirectives(goSrcs []string) ([]string, error) {
+	var directives []string
+	for _, src := range goSrcs {
+		found, err := IndexSource(src).LinkDirectives()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, found...)
+	}
+	slices.Sort(directives)
+
+	return slices.Compact(directives), nil
+}
+
+// LinknameError records packages linked into a binary which use link
+// directives without being allowed to.
+type LinknameError struct {
+	// Directives of each package, keyed by import path.
+	Packages map[string][]string
+}
+
+func (e LinknameError) Error() string {
+	var packages strings.Builder
+	for _, importPath := range SortedKeys(e.Packages) {
+		fmt.Fprintf(&packages, "\n    %s:", importPath)
+		for _, directive := range e.Packages[importPath] {
+			fmt.Fprintf(&packages, "\n        //%s", directive)
+		}
+	}
+
+	return fmt.Sprintf(
+		"packages linked into the binary use linkname directives:%s\n\n  Add them to allowLinknames once they're reviewed.",
+		packages.String(),
+	)
+}
+
+// checkLinkDirectives fails if any package linked with main, found from the
+// metadata of exports, has link directives but isn't in allowed. The standard
+// library implements the runtime with them, so packages of std are allowed.
+func checkLinkDirectives(main *Package, exports map[string]string, std []string, allowed []string) error {
+	denied := make(map[string][]string)
+	for _, importPath := range append([]string{main.ImportPath}, main.Deps...) {
+		if slices.Contains(allowed, importPath) || slices.Contains(std, importPath) {
+			continue
+		}
+
+		pkg := main
+		if importPath != main.ImportPath {
+			storePath := exports[importPath]
+			if storePath == "" {
+				continue
+			}
+			dep, err := LoadMetadata[Package](storePath, importPath)
+			if err != nil {
+				return err
+			}
+			pkg = &dep
+		}
+		if len(pkg.LinkDirectives) > 0 {
+			denied[importPath] = pkg.LinkDirectives
+		}
+	}
+
+	if len(denied) > 0 {
+		return &LinknameError{denied}
+	}
+
+	return nil
+}
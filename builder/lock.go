@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"nix/derivation"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type LockAttrs struct {
+	// Root of the source tree, containing a go.work or go.mod.
+	Src string `nix:"required"`
+}
+
+// A LockedModule is a module in the build graph of a workspace. Local modules
+// have a Dir relative to the root of the source tree, while all others have a
+// Version to be fetched.
+type LockedModule struct {
+	Path    string
+	Version string      `json:",omitempty"`
+	Dir     string      `json:",omitempty"`
+	Replace *ModVersion `json:",omitempty"`
+}
+
+// A LockedPackage is a package of a local module. ImportMap rewrites imports of
+// modules replaced by a module with a different path.
+type LockedPackage struct {
+	ImportPath string
+	Module     string
+	Dir        string
+	Srcs       []string
+	Imports    []string          `json:",omitempty"`
+	ImportMap  map[string]string `json:",omitempty"`
+
+	// Whether the package is a command, which is compiled as "main".
+	Main bool `json:",omitempty"`
+}
+
+// A Lock describes every module and local package of a workspace, so Nix can
+// produce a build plan for it.
+type Lock struct {
+	Modules  []LockedModule
+	Packages []LockedPackage
+}
+
+// A Workspace is a set of local modules, either from a go.work file or a single
+// go.mod, and the modules they require.
+type Workspace struct {
+	Root string
+
+	// Directories of local modules relative to Root, keyed by module path.
+	Local map[string]string
+
+	// Selected versions of every other module, keyed by module path.
+	Require map[string]string
+
+	// Non-local replacements, keyed by the replaced module. Replacements of
+	// every version of a module have no version in their key.
+	Replace map[ModVersion]ModVersion
+
+	// Module versions which must never be selected.
+	Exclude map[ModVersion]struct{}
+
+	// Requirements of local modules which were dropped because Exclude lists
+	// them, in the order they were found. The go command would select the next
+	// version instead, which the lock can't, so the module may be missing.
+	Excluded []ModVersion
+
+	// Parsed go.mod files of the local modules, keyed by module path.
+	ModFiles map[string]*ModFile
+}
+
+// localDir resolves a directory referenced by a go.mod or go.work in dir,
+// relative to the root of the workspace.
+func (w *Workspace) localDir(dir, target string) (string, error) {
+	rel := filepath.Clean(filepath.Join(dir, filepath.FromSlash(target)))
+	if filepath.IsAbs(target) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("local module %s is outside of the source tree", target)
+	}
+
+	return rel, nil
+}
+
+// addModule loads the go.mod in dir as a local module of the workspace. If
+// modPath is empty, the path declared by the go.mod is used.
+func (w *Workspace) addModule(dir, modPath string) error {
+	modFile, err := LoadModFile(filepath.Join(w.Root, dir, "go.mod"))
+	if err != nil {
+		return err
+	}
+	if modFile.Module == "" {
+		return fmt.Errorf("%s/go.mod has no module directive", dir)
+	}
+	if modPath == "" {
+		modPath = modFile.Module
+	}
+
+	w.Local[modPath] = dir
+	w.ModFiles[modPath] = modFile
+	return nil
+}
+
+// addReplaces applies replace directives from a file in dir, unless a module
+// was already replaced. Local replacements become local modules.
+func (w *Workspace) addReplaces(dir string, replaces []Replace) error {
+	for _, r := range replaces {
+		if !r.IsLocal() {
+			if _, ok := w.Replace[r.Old]; !ok {
+				w.Replace[r.Old] = r.New
+			}
+			continue
+		}
+
+		local, err := w.localDir(dir, r.New.Path)
+		if err != nil {
+			return err
+		}
+		// The replacement may declare a different module path than the one it
+		// replaces, but it is only ever imported as the replaced module.
+		if _, ok := w.Local[r.Old.Path]; !ok {
+			if err := w.addModule(local, r.Old.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadWorkspace reads the go.work or go.mod at the root of a source tree and
+// resolves the modules it depends on.
+func LoadWorkspace(root string) (*Workspace, error) {
+	w := &Workspace{
+		Root:     root,
+		Local:    make(map[string]string),
+		Require:  make(map[string]string),
+		Replace:  make(map[ModVersion]ModVersion),
+		Exclude:  make(map[ModVersion]struct{}),
+		ModFiles: make(map[string]*ModFile),
+	}
+
+	dirs := []string{"."}
+	var workReplaces []Replace
+	workFile, err := LoadModFile(filepath.Join(root, "go.work"))
+	if err == nil {
+		dirs = dirs[:0]
+		for _, use := range workFile.Use {
+			dir, err := w.localDir(".", use)
+			if err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, dir)
+		}
+		workReplaces = workFile.Replace
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if err := w.addModule(dir, ""); err != nil {
+			return nil, err
+		}
+	}
+	// Replacements in go.work override those of individual modules, so they are
+	// applied first.
+	if err := w.addReplaces(".", workReplaces); err != nil {
+		return nil, err
+	}
+	for _, modPath := range SortedKeys(w.ModFiles) {
+		if err := w.addReplaces(w.Local[modPath], w.ModFiles[modPath].Replace); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every local module is a main module, so all of their excludes apply.
+	for _, modFile := range w.ModFiles {
+		for _, exclude := range modFile.Exclude {
+			w.Exclude[exclude] = struct{}{}
+		}
+	}
+
+	// Since go 1.17, go.mod lists every module needed to build the module's
+	// packages, so the newest version required by any local module is what
+	// minimal version selection would pick.
+	for _, modPath := range SortedKeys(w.ModFiles) {
+		for _, req := range w.ModFiles[modPath].Require {
+			if _, ok := w.Local[req.Path]; ok {
+				continue
+			}
+			if _, ok := w.Exclude[req]; ok {
+				if !slices.Contains(w.Excluded, req) {
+					w.Excluded = append(w.Excluded, req)
+				}
+				continue
+			}
+			if current, ok := w.Require[req.Path]; !ok || CompareSemver(req.Version, current) > 0 {
+				w.Require[req.Path] = req.Version
+			}
+		}
+	}
+
+	return w, nil
+}
+
+// Modules lists every module of the workspace.
+func (w *Workspace) Modules() []LockedModule {
+	modules := make([]LockedModule, 0, len(w.Local)+len(w.Require))
+	for _, modPath := range SortedKeys(w.Local) {
+		modules = append(modules, LockedModule{Path: modPath, Dir: filepath.ToSlash(w.Local[modPath])})
+	}
+	for _, modPath := range SortedKeys(w.Require) {
+		mod := LockedModule{Path: modPath, Version: w.Require[modPath]}
+		if r, ok := w.Replacement(modPath); ok {
+			mod.Replace = &r
+		}
+		modules = append(modules, mod)
+	}
+
+	slices.SortFunc(modules, func(a, b LockedModule) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return modules
+}
+
+// Replacement returns the replacement of the selected version of a module, if
+// it was replaced by another (non-local) module.
+func (w *Workspace) Replacement(modPath string) (ModVersion, bool) {
+	version := w.Require[modPath]
+	if r, ok := w.Replace[ModVersion{modPath, version}]; ok {
+		return r, true
+	}
+	r, ok := w.Replace[ModVersion{Path: modPath}]
+	return r, ok
+}
+
+// inModule reports whether importPath is a package of the module modPath.
+func inModule(importPath, modPath string) bool {
+	return importPath == modPath || strings.HasPrefix(importPath, modPath+"/")
+}
+
+// splitMajorVersion splits a module path ending in a major version suffix,
+// like "example.com/x/v2", into the path before the suffix and the suffix.
+// Only versions from v2 have a suffix.
+func splitMajorVersion(modPath string) (prefix, major string, ok bool) {
+	prefix, major = path.Dir(modPath), path.Base(modPath)
+	digits, ok := strings.CutPrefix(major, "v")
+	if !ok || prefix == "." || digits == "" || digits[0] == '0' {
+		return modPath, "", false
+	}
+	if n, err := strconv.Atoi(digits); err != nil || n < 2 {
+		return modPath, "", false
+	}
+
+	return prefix, major, true
+}
+
+// compatImport rewrites importPath to a package of a local module with a major
+// version suffix, if importPath names the same package without the suffix.
+// Like the go command's "minimal module compatibility" outside of module mode,
+// this lets code written before a module added its suffix build against it.
+func (w *Workspace) compatImport(importPath string) (string, bool) {
+	var matched, rewritten string
+	for modPath := range w.Local {
+		prefix, _, ok := splitMajorVersion(modPath)
+		if !ok || !inModule(importPath, prefix) || len(prefix) <= len(matched) {
+			continue
+		}
+		// Another major version of the module, which isn't local.
+		rest := strings.TrimPrefix(importPath[len(prefix):], "/")
+		if _, _, ok := splitMajorVersion("_/" + strings.SplitN(rest, "/", 2)[0]); ok {
+			continue
+		}
+
+		matched = prefix
+		rewritten = modPath + importPath[len(prefix):]
+	}
+
+	return rewritten, matched != ""
+}
+
+// ImportMap derives importMap entries for imports of modules which were
+// replaced by a module with a different path. Packages of the replacement are
+// built with their own import path, so imports of the original must be
+// rewritten to find them. Imports of a local module without its major version
+// suffix are rewritten too. See [Workspace.compatImport].
+func (w *Workspace) ImportMap(imports []string) map[string]string {
+	importMap := make(map[string]string)
+	for _, importPath := range imports {
+		// The module providing a package is the longest matching module path.
+		var modPath string
+		for candidate := range w.Require {
+			if inModule(importPath, candidate) && len(candidate) > len(modPath) {
+				modPath = candidate
+			}
+		}
+		local := false
+		for candidate := range w.Local {
+			if inModule(importPath, candidate) && len(candidate) > len(modPath) {
+				modPath, local = candidate, true
+			}
+		}
+		if local {
+			continue
+		}
+		if modPath == "" {
+			if rewritten, ok := w.compatImport(importPath); ok {
+				importMap[importPath] = rewritten
+			}
+			continue
+		}
+
+		r, ok := w.Replacement(modPath)
+		if !ok || r.Path == modPath {
+			continue
+		}
+		importMap[importPath] = r.Path + importPath[len(modPath):]
+	}
+
+	if len(importMap) == 0 {
+		return nil
+	}
+	return importMap
+}
+
+// checkImportComment warns if the import comment of the package importPath of
+// the module modPath names another package. Comments naming the package
+// without the module's major version suffix are expected, since those imports
+// are rewritten by [Workspace.ImportMap].
+func checkImportComment(importPath, modPath string, goSrcs []string) error {
+	for _, src := range goSrcs {
+		comment, err := IndexSource(src).ImportComment()
+		if err != nil {
+			return err
+		}
+		if comment == "" || comment == importPath {
+			continue
+		}
+		if prefix, _, ok := splitMajorVersion(modPath); ok && comment == prefix+importPath[len(modPath):] {
+			continue
+		}
+
+		log.Printf(
+			"warning: %s has the import comment %q, but its module provides it as %s",
+			src,
+			comment,
+			importPath,
+		)
+		break
+	}
+
+	return nil
+}
+
+// scanPackage lists the sources and imports of the package in dir.
+func scanPackage(dir string) (srcs, imports []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[string]struct{})
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+
+		switch filepath.Ext(name) {
+		case ".go":
+			fileImports, err := IndexSource(filepath.Join(dir, name)).Imports()
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, importPath := range fileImports {
+				if !FilterInternalPackages(importPath) {
+					found[importPath] = struct{}{}
+				}
+			}
+		case ".h", ".s", ".syso":
+		default:
+			continue
+		}
+		srcs = append(srcs, name)
+	}
+
+	return srcs, SortedKeys(found), nil
+}
+
+// Packages lists every package of the local modules of the workspace.
+func (w *Workspace) Packages() ([]LockedPackage, error) {
+	var pkgs []LockedPackage
+	for _, modPath := range SortedKeys(w.Local) {
+		modDir := filepath.Join(w.Root, w.Local[modPath])
+
+		err := filepath.WalkDir(modDir, func(dir string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.IsDir() {
+				return err
+			}
+
+			rel, err := filepath.Rel(modDir, dir)
+			if err != nil {
+				return err
+			}
+			if rel != "." {
+				// Matches the directories ignored by "go list ./...".
+				name := entry.Name()
+				if name == "testdata" || name == "vendor" ||
+					strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+					return filepath.SkipDir
+				}
+				// Nested modules are separate.
+				if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+
+			srcs, imports, err := scanPackage(dir)
+			if err != nil {
+				return err
+			}
+			if !slices.ContainsFunc(srcs, func(src string) bool { return filepath.Ext(src) == ".go" }) {
+				return nil
+			}
+
+			pkgDir, err := filepath.Rel(w.Root, dir)
+			if err != nil {
+				return err
+			}
+			importPath := path.Join(modPath, filepath.ToSlash(rel))
+			var goSrcs []string
+			for _, src := range srcs {
+				if filepath.Ext(src) == ".go" {
+					goSrcs = append(goSrcs, filepath.Join(dir, src))
+				}
+			}
+			if err := checkImportComment(importPath, modPath, goSrcs); err != nil {
+				return err
+			}
+			command := slices.ContainsFunc(goSrcs, func(src string) bool {
+				header, err := IndexSource(src).Header()
+				return err == nil && header.Name.Name == "main"
+			})
+
+			pkgs = append(pkgs, LockedPackage{
+				ImportPath: importPath,
+				Module:     modPath,
+				Dir:        filepath.ToSlash(pkgDir),
+				Srcs:       srcs,
+				Imports:    imports,
+				ImportMap:  w.ImportMap(imports),
+				Main:       command,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan module %s: %w", modPath, err)
+		}
+	}
+
+	slices.SortFunc(pkgs, func(a, b LockedPackage) int {
+		return strings.Compare(a.ImportPath, b.ImportPath)
+	})
+	return pkgs, nil
+}
+
+// lock generates a lock file describing every module of a workspace and the
+// packages of its local modules, along with a Nix expression building those
+// packages. See [Lock.WriteNix].
+func lock() {
+	attrs := derivation.GetAttrs[LockAttrs]()
+
+	outDir := derivation.MustOutput("out")
+
+	workspace, err := LoadWorkspace(attrs.Src)
+	if err != nil {
+		Fatalf("failed to load workspace: %v", err)
+	}
+	for _, excluded := range workspace.Excluded {
+		log.Printf("warning: dropped requirement of %s, which is excluded", excluded)
+	}
+	pkgs, err := workspace.Packages()
+	if err != nil {
+		Fatal(err)
+	}
+
+	lockFile := Lock{Modules: workspace.Modules(), Packages: pkgs}
+	err = WriteGenerated(filepath.Join(outDir, "lock.json"), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(&lockFile)
+	})
+	if err != nil {
+		Fatalf("failed to write lock file: %v", err)
+	}
+	if err := WriteGenerated(filepath.Join(outDir, "default.nix"), lockFile.WriteNix); err != nil {
+		Fatalf("failed to write Nix expression: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadWorkspaceExcluded(t *testing.T) {
+	root := t.TempDir()
+	modFile := `module example.com/m
+
+go 1.22
+
+require (
+	example.com/a v1.0.0
+	example.com/b v1.2.0
+)
+
+exclude example.com/b v1.2.0
+`
+	if err := os.WriteFile(filepath.Join(root, "go.mod"), []byte(modFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	workspace, err := LoadWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := workspace.Require["example.com/b"]; ok {
+		t.Errorf("excluded example.com/b was required")
+	}
+	if want := []ModVersion{{"example.com/b", "v1.2.0"}}; !slices.Equal(workspace.Excluded, want) {
+		t.Errorf("Excluded = %v, want %v", workspace.Excluded, want)
+	}
+	if got := workspace.Require["example.com/a"]; got != "v1.0.0" {
+		t.Errorf("example.com/a required at %q, want v1.0.0", got)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"nix/derivation"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var (
+	// Whether to record every invocation of compile, asm, and link, written by
+	// [SaveActionManifests].
+	ActionManifests bool
+
+	// Whether tools are only recorded and printed instead of run, as with
+	// "--dry-run". Nothing is written to the outputs besides the plan saved
+	// by [SaveDryRunPlan].
+	DryRun bool
+
+	// Every tool invocation recorded by [RecordAction], in order.
+	actionManifests = []ActionManifest{}
+)
+
+// An ActionManifest records exactly how a tool was run, so tools auditing the
+// build can replay or compare it, like a "compile_commands.json" entry.
+type ActionManifest struct {
+	Tool string
+	Dir  string `json:",omitempty"`
+	Args []string
+	Env  []string
+
+	// Files read and written by the tool. Inputs generated in the build
+	// directory, such as importcfg files, are gone after the build, so their
+	// contents are kept in Generated, keyed by path.
+	Inputs    []string
+	Outputs   []string
+	Generated map[string]string `json:",omitempty"`
+}
+
+// RecordAction records the invocation of cmd, which reads inputs and writes
+// outputs, if ActionManifests is set. Any importcfg among the inputs adds the
+// package files it lists. This must be called before cmd runs.
+func RecordAction(cmd *exec.Cmd, inputs, outputs []string) error {
+	if !ActionManifests && !DryRun {
+		return nil
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	manifest := ActionManifest{
+		Tool:    filepath.Base(cmd.Path),
+		Dir:     cmd.Dir,
+		Args:    slices.Clone(cmd.Args),
+		Env:     slices.Clone(env),
+		Outputs: slices.DeleteFunc(slices.Clone(outputs), func(output string) bool { return output == "" }),
+	}
+
+	buildDir := derivation.BuildDir()
+	for _, input := range inputs {
+		if input == "" {
+			continue
+		}
+		manifest.Inputs = append(manifest.Inputs, input)
+		if rel, err := filepath.Rel(buildDir, input); err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return fmt.Errorf("failed to record %s action: %w", manifest.Tool, err)
+		}
+		if manifest.Generated == nil {
+			manifest.Generated = make(map[string]string)
+		}
+		manifest.Generated[input] = string(data)
+
+		if strings.HasPrefix(filepath.Base(input), "importcfg") {
+			manifest.Inputs = append(manifest.Inputs, importCfgFiles(string(data))...)
+		}
+	}
+
+	actionManifests = append(actionManifests, manifest)
+	return nil
+}
+
+// importCfgFiles returns the package files listed by an importcfg.
+func importCfgFiles(importCfg string) []string {
+	var files []string
+	scanner := bufio.NewScanner(strings.NewReader(importCfg))
+	for scanner.Scan() {
+		spec, ok := strings.CutPrefix(scanner.Text(), "packagefile ")
+		if !ok {
+			continue
+		}
+		if _, file, ok := strings.Cut(spec, "="); ok {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// SaveActionManifests writes every recorded action to "actions.json" in dir.
+func SaveActionManifests(dir string) error {
+	return WriteGenerated(filepath.Join(dir, "actions.json"), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(actionManifests)
+	})
+}
+
+// SaveDryRunPlan writes every action recorded by a dry run to "dry-run.json"
+// in dir. These are the exact invocations the build would run, with the
+// contents of the importcfg and embedcfg files generated for them.
+func SaveDryRunPlan(dir string) error {
+	return WriteGenerated(filepath.Join(dir, "dry-run.json"), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(actionManifests)
+	})
+}
+
+// dryRunOutput returns the output a dry run writes its plan to, "out", or
+// "lib" for compilations, which have no "out".
+func dryRunOutput() string {
+	dir := derivation.Outputs["out"]
+	if dir == "" {
+		dir = derivation.Outputs["lib"]
+	}
+	if _, err := derivation.EnsureDir(dir); err != nil {
+		Fatal(err)
+	}
+
+	return dir
+}
+
+// LoadActionManifests reads the manifests written by [SaveActionManifests].
+func LoadActionManifests(dir string) ([]ActionManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "actions.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []ActionManifest
+	return manifests, json.Unmarshal(data, &manifests)
+}
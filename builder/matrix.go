@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"nix/derivation"
+	"os"
+	"slices"
+	"strings"
+)
+
+type MatrixAttrs struct {
+	// Platforms to build for, like "linux/amd64".
+	Platforms []string `nix:"required"`
+
+	// Attributes set for only one platform, keyed by platform, replacing those
+	// shared by every platform. Packages are compiled for a single platform,
+	// so this usually sets the imports of "compile", or the main package and
+	// deps of "link".
+	PlatformAttrs map[string]map[string]json.RawMessage
+}
+
+// Attributes of "matrix" which aren't passed on to the build for each
+// platform.
+var matrixOnlyAttrs = []string{"platforms", "platformAttrs"}
+
+// matrixOutputSuffix returns the suffix of the outputs of a matrix derivation
+// which were built for goos/goarch, like "-linux-amd64".
+func matrixOutputSuffix(goos, goarch string) string {
+	return "-" + goos + "-" + goarch
+}
+
+// matrixJobAttrs returns the attributes building for platform, given the
+// shared attributes and outputs of the matrix. Each output with the suffix of
+// the platform becomes the output of the same name without it, so "out" of
+// "link" is written to "out-linux-amd64".
+func matrixJobAttrs(
+	shared map[string]json.RawMessage,
+	matrixOutputs map[string]string,
+	attrs *MatrixAttrs,
+	platform, suffix string,
+) ([]byte, error) {
+	job := make(map[string]json.RawMessage, len(shared))
+	for name, value := range shared {
+		job[name] = value
+	}
+	for name, value := range attrs.PlatformAttrs[platform] {
+		job[name] = value
+	}
+
+	outputs := make(map[string]string)
+	for name, path := range matrixOutputs {
+		if name, ok := strings.CutSuffix(name, suffix); ok {
+			outputs[name] = path
+		}
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("derivation has no outputs for %s, like \"out%s\"", platform, suffix)
+	}
+	data, err := json.Marshal(outputs)
+	if err != nil {
+		return nil, err
+	}
+	job["outputs"] = data
+
+	return json.Marshal(job)
+}
+
+// matrix runs "compile" or "link" once for every platform of the derivation,
+// writing each to its platform's outputs. Unlike a derivation per platform,
+// sources are only read and parsed once, and the SDK only loaded once. The
+// builder keeps the state of a build in package variables, so it's reset
+// between platforms like the jobs of a daemon.
+func matrix() {
+	if len(os.Args) < 3 {
+		fatal(CategoryAttr, fmt.Sprintf("matrix needs a command, compile or link\n%s", usage), nil)
+	}
+	command := os.Args[2]
+	if command != "compile" && command != "link" {
+		fatal(CategoryAttr, fmt.Sprintf("matrix can't run \"%s\", only compile or link\n%s", command, usage), nil)
+	}
+
+	attrs := derivation.GetAttrs[MatrixAttrs]()
+	if len(attrs.Platforms) == 0 {
+		Fatal(&AttrError{"platforms", errors.New("no platforms to build for")})
+	}
+	for _, platform := range attrs.Platforms {
+		if _, _, err := parsePlatform(platform); err != nil {
+			Fatal(&AttrError{"platforms", err})
+		}
+	}
+	for platform := range attrs.PlatformAttrs {
+		if !slices.Contains(attrs.Platforms, platform) {
+			Fatal(&AttrError{"platformAttrs", fmt.Errorf("platform \"%s\" isn't one of platforms", platform)})
+		}
+	}
+
+	shared := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(derivation.AttrJson, &shared); err != nil {
+		Fatalf("failed to read attributes: %v", err)
+	}
+	for _, name := range matrixOnlyAttrs {
+		delete(shared, name)
+	}
+
+	// Each platform replaces the outputs with its own.
+	matrixOutputs := derivation.Outputs
+	state := NewDaemon()
+	job := &Job{Args: []string{command}}
+	for i, platform := range attrs.Platforms {
+		goos, goarch, _ := parsePlatform(platform)
+		data, err := matrixJobAttrs(shared, matrixOutputs, &attrs, platform, matrixOutputSuffix(goos, goarch))
+		if err != nil {
+			Fatal(&AttrError{"outputs", err})
+		}
+
+		// What was learned about sources is kept, besides whether they match
+		// the platform.
+		sources := sourceIndex
+		state.reset(job)
+		for _, file := range sources {
+			file.matched = nil
+		}
+		sourceIndex = sources
+		Context.GOOS, Context.GOARCH = goos, goarch
+
+		if err := derivation.LoadJson(data); err != nil {
+			fatalAttrs(fmt.Errorf("failed to read attributes for %s: %w", platform, err))
+		}
+		SetPhaseProgress("matrix", i+1, len(attrs.Platforms))
+		log.Printf("building %s", platform)
+		os.Args = []string{os.Args[0], command}
+		run()
+	}
+}
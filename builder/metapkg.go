@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"nix/derivation"
+)
+
+// PackageOutputs are the store paths of a compiled package.
+type PackageOutputs struct {
+	Export string
+	Lib    string
+}
+
+type MetaPackageAttrs struct {
+	PackagePath string                    `nix:"required"`
+	Packages    map[string]PackageOutputs `nix:"required"`
+	ImportMap   map[string]string
+
+	// Also write the meta package as a pack, including the metadata of every
+	// subpackage.
+	PackMetadata bool
+}
+
+// SaveMetaPackage writes the metadata of a meta package aggregating packages to
+// the lib and export outputs.
+func SaveMetaPackage(
+	importPath string,
+	packages map[string]PackageOutputs,
+	importMap map[string]string,
+	pack bool,
+) error {
+	libDir, err := derivation.OutputPath("lib")
+	if err != nil {
+		return err
+	}
+	exportDir, err := derivation.OutputPath("export")
+	if err != nil {
+		return err
+	}
+
+	return WriteMetaPackage(libDir, exportDir, importPath, packages, importMap, pack)
+}
+
+// WriteMetaPackage is like [SaveMetaPackage], but writes to existing lib and
+// export directories.
+func WriteMetaPackage(
+	libDir string,
+	exportDir string,
+	importPath string,
+	packages map[string]PackageOutputs,
+	importMap map[string]string,
+	pack bool,
+) error {
+	subLibs := make([]Import, 0, len(packages))
+	subExports := make([]Import, 0, len(packages))
+	for _, subPath := range SortedKeys(packages) {
+		storePaths := packages[subPath]
+		subLibs = append(subLibs, Import{StorePath: storePaths.Lib, ImportPath: subPath})
+		subExports = append(subExports, Import{StorePath: storePaths.Export, ImportPath: subPath})
+	}
+
+	lib := MetaPackage{
+		SchemaVersion: SchemaVersion,
+		ImportPath:    importPath,
+		SubPackages:   subLibs,
+	}
+	if err := SaveMetadata(libDir, lib); err != nil {
+		return fmt.Errorf("failed to generate package libs: %w", err)
+	}
+	export := MetaPackage{
+		SchemaVersion: SchemaVersion,
+		ImportPath:    importPath,
+		SubPackages:   subExports,
+		ImportMap:     importMap,
+	}
+	if err := SaveMetadata(exportDir, export); err != nil {
+		return fmt.Errorf("failed to generate package exports: %w", err)
+	}
+
+	if pack {
+		if err := SavePack(libDir, lib, false); err != nil {
+			return fmt.Errorf("failed to pack package libs: %w", err)
+		}
+		if err := SavePack(exportDir, export, true); err != nil {
+			return fmt.Errorf("failed to pack package exports: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// metapkg creates a user-defined meta package depending on a set of already
+// compiled packages. Like "std", it can be used as a single import in place of
+// all of them.
+func metapkg() {
+	attrs := derivation.GetAttrs[MetaPackageAttrs]()
+
+	if attrs.PackagePath == "" {
+		Fatal("meta package is missing a packagePath")
+	}
+	err := SaveMetaPackage(
+		attrs.PackagePath,
+		attrs.Packages,
+		attrs.ImportMap,
+		attrs.PackMetadata,
+	)
+	if err != nil {
+		Fatalf("failed to generate meta package %s: %v", attrs.PackagePath, err)
+	}
+}
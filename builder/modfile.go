@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A ModVersion is a module path with an optional version.
+type ModVersion struct {
+	Path    string
+	Version string `json:",omitempty"`
+}
+
+func (m ModVersion) String() string {
+	if m.Version == "" {
+		return m.Path
+	}
+	return m.Path + "@" + m.Version
+}
+
+// A Replace is a replace directive. If New has no version, it is a directory on
+// the local filesystem.
+type Replace struct {
+	Old ModVersion
+	New ModVersion
+}
+
+// IsLocal reports whether the replacement is a local directory.
+func (r Replace) IsLocal() bool {
+	return r.New.Version == ""
+}
+
+// A ModFile is the contents of a go.mod or go.work file. Only the directives the
+// builder uses are kept.
+type ModFile struct {
+	Module    string
+	Go        string
+	Toolchain string
+	Require   []ModVersion
+	Replace   []Replace
+	Exclude   []ModVersion
+
+	// Module directories of a go.work file.
+	Use []string
+}
+
+// modFileError records a syntax error in a go.mod or go.work file.
+type modFileError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e modFileError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// modFields splits a line of a go.mod file into fields, removing comments and
+// unquoting any quoted strings. Like the go command, a comment starts at any
+// "//" outside of a quoted string.
+func modFields(line string) ([]string, error) {
+	var fields []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if strings.HasPrefix(line, "//") {
+			break
+		}
+
+		if line[0] == '"' || line[0] == '`' {
+			end := quotedEnd(line)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			field, err := strconv.Unquote(line[:end])
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			line = line[end:]
+			continue
+		}
+
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		if comment := strings.Index(line[:end], "//"); comment >= 0 {
+			end = comment
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+
+	return fields, nil
+}
+
+// quotedEnd returns the index just past the string quoted at the start of
+// line, or -1 if it isn't terminated. Quotes escaped within an interpreted
+// string don't end it.
+func quotedEnd(line string) int {
+	quote := line[0]
+	for i := 1; i < len(line); i++ {
+		switch {
+		case line[i] == quote:
+			return i + 1
+		case line[i] == '\\' && quote == '"':
+			i++
+		}
+	}
+
+	return -1
+}
+
+// parseDirective adds the directive verb with arguments args to f.
+func (f *ModFile) parseDirective(verb string, args []string) error {
+	switch verb {
+	case "module":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: module module/path")
+		}
+		f.Module = args[0]
+	case "go":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: go 1.23")
+		}
+		f.Go = args[0]
+	case "toolchain":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: toolchain go1.23.0")
+		}
+		f.Toolchain = args[0]
+	case "require", "exclude":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s module/path v1.2.3", verb)
+		}
+		mod := ModVersion{args[0], args[1]}
+		if verb == "require" {
+			f.Require = append(f.Require, mod)
+		} else {
+			f.Exclude = append(f.Exclude, mod)
+		}
+	case "replace":
+		arrow := -1
+		for i, arg := range args {
+			if arg == "=>" {
+				arrow = i
+			}
+		}
+		if arrow < 1 || arrow > 2 || len(args)-arrow-1 < 1 || len(args)-arrow-1 > 2 {
+			return fmt.Errorf("usage: replace module/path [v1.2.3] => other/module v1.4.5 or local/directory")
+		}
+		var r Replace
+		r.Old.Path = args[0]
+		if arrow == 2 {
+			r.Old.Version = args[1]
+		}
+		r.New.Path = args[arrow+1]
+		if len(args) == arrow+3 {
+			r.New.Version = args[arrow+2]
+		}
+		f.Replace = append(f.Replace, r)
+	case "use":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: use local/directory")
+		}
+		f.Use = append(f.Use, args[0])
+	default:
+		// Everything else (retract, godebug, tool, ...) doesn't affect builds.
+	}
+
+	return nil
+}
+
+// ParseModFile parses the contents of a go.mod or go.work file. name is only
+// used for error messages.
+func ParseModFile(name string, data []byte) (*ModFile, error) {
+	f := &ModFile{}
+
+	var block string
+	for i, line := range strings.Split(string(data), "\n") {
+		fields, err := modFields(line)
+		if err != nil {
+			return nil, &modFileError{name, i + 1, err.Error()}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		verb, args := block, fields
+		switch {
+		case block != "" && fields[0] == ")":
+			block = ""
+			continue
+		case block == "" && len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+			continue
+		case block == "":
+			verb, args = fields[0], fields[1:]
+		}
+
+		if err := f.parseDirective(verb, args); err != nil {
+			return nil, &modFileError{name, i + 1, err.Error()}
+		}
+	}
+	if block != "" {
+		return nil, &modFileError{name, 0, fmt.Sprintf("unterminated %s block", block)}
+	}
+
+	return f, nil
+}
+
+// LoadModFile reads and parses a go.mod or go.work file.
+func LoadModFile(path string) (*ModFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseModFile(filepath.Base(path), data)
+}
+
+// CompareSemver compares two semantic versions, as used for module versions
+// (e.g. "v1.2.3-pre"). Build metadata is ignored.
+func CompareSemver(a, b string) int {
+	splitVersion := func(v string) ([]string, string) {
+		v = strings.TrimPrefix(v, "v")
+		v, _, _ = strings.Cut(v, "+")
+		v, pre, _ := strings.Cut(v, "-")
+		return strings.Split(v, "."), pre
+	}
+	compareField := func(x, y string) int {
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		switch {
+		case xErr == nil && yErr == nil:
+			return xn - yn
+		case xErr == nil:
+			return -1
+		case yErr == nil:
+			return 1
+		default:
+			return strings.Compare(x, y)
+		}
+	}
+
+	aCore, aPre := splitVersion(a)
+	bCore, bPre := splitVersion(b)
+	for i := 0; i < max(len(aCore), len(bCore)); i++ {
+		x, y := "0", "0"
+		if i < len(aCore) {
+			x = aCore[i]
+		}
+		if i < len(bCore) {
+			y = bCore[i]
+		}
+		if c := compareField(x, y); c != 0 {
+			return c
+		}
+	}
+
+	// A version without a prerelease is newer than one with.
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	aFields, bFields := strings.Split(aPre, "."), strings.Split(bPre, ".")
+	for i := 0; i < min(len(aFields), len(bFields)); i++ {
+		if c := compareField(aFields[i], bFields[i]); c != 0 {
+			return c
+		}
+	}
+	return len(aFields) - len(bFields)
+}
+
+// A goVersion is a parsed Go version, like "1.21", "1.21rc1", or "1.21.3".
+type goVersion struct {
+	major, minor, patch int
+
+	// How far along the release of major.minor the version is: a bare language
+	// version ("1.21") comes before its betas, release candidates, and finally
+	// its releases ("1.21.0").
+	stage int
+	pre   int
+}
+
+const (
+	goStageLanguage = iota
+	goStageBeta
+	goStageRC
+	goStageRelease
+)
+
+// parseGoVersion parses a Go version, with or without a "go" prefix.
+func parseGoVersion(v string) (goVersion, bool) {
+	var version goVersion
+	fields := strings.Split(strings.TrimPrefix(v, "go"), ".")
+	if len(fields) > 3 {
+		return version, false
+	}
+
+	var err error
+	if version.major, err = strconv.Atoi(fields[0]); err != nil {
+		return version, false
+	}
+	if len(fields) == 1 {
+		return version, true
+	}
+
+	minor := fields[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		if len(fields) == 3 {
+			return version, false
+		}
+		pre := minor[i:]
+		minor = minor[:i]
+		if rc, ok := strings.CutPrefix(pre, "rc"); ok {
+			version.stage, pre = goStageRC, rc
+		} else if beta, ok := strings.CutPrefix(pre, "beta"); ok {
+			version.stage, pre = goStageBeta, beta
+		} else {
+			return version, false
+		}
+		if version.pre, err = strconv.Atoi(pre); err != nil {
+			return version, false
+		}
+	}
+	if version.minor, err = strconv.Atoi(minor); err != nil {
+		return version, false
+	}
+
+	if len(fields) == 3 {
+		version.stage = goStageRelease
+		if version.patch, err = strconv.Atoi(fields[2]); err != nil {
+			return version, false
+		}
+	}
+
+	return version, true
+}
+
+// CompareGoVersion compares two Go versions, as used by the go and toolchain
+// directives. ok is false if either isn't a valid version.
+func CompareGoVersion(a, b string) (c int, ok bool) {
+	x, xOk := parseGoVersion(a)
+	y, yOk := parseGoVersion(b)
+	if !xOk || !yOk {
+		return 0, false
+	}
+
+	for _, d := range []int{
+		x.major - y.major,
+		x.minor - y.minor,
+		x.stage - y.stage,
+		x.pre - y.pre,
+		x.patch - y.patch,
+	} {
+		if d != 0 {
+			return d, true
+		}
+	}
+	return 0, true
+}
+
+// GoVersionError records when a module needs a newer Go than the SDK.
+type GoVersionError struct {
+	Module  string
+	Go      string
+	Version string
+}
+
+func (e GoVersionError) Error() string {
+	return fmt.Sprintf(
+		"module %s requires go >= %s, but the sdk is go%s\n\n  Use a newer sdk, or lower the go directive of the module's go.mod.",
+		e.Module,
+		e.Go,
+		e.Version,
+	)
+}
+
+// CheckGoVersion fails if the go directive requires a newer version of Go than
+// sdkVersion. A newer toolchain directive only warns, since it names the
+// preferred toolchain rather than the oldest one which works. SDKs with
+// unrecognized versions, like development builds, are assumed to be new enough.
+func (f *ModFile) CheckGoVersion(sdkVersion string) error {
+	if f.Go != "" {
+		if c, ok := CompareGoVersion(f.Go, sdkVersion); ok && c > 0 {
+			return &GoVersionError{f.Module, f.Go, sdkVersion}
+		}
+	}
+	if f.Toolchain != "" && f.Toolchain != "default" {
+		if c, ok := CompareGoVersion(f.Toolchain, sdkVersion); ok && c > 0 {
+			log.Printf("warning: module %s prefers toolchain %s, but the sdk is go%s", f.Module, f.Toolchain, sdkVersion)
+		}
+	}
+
+	return nil
+}
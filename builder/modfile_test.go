@@ -0,0 +1,39 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestModFields(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"// comment", nil},
+		{"module example.com/m", []string{"module", "example.com/m"}},
+		{"require example.com/a v1.0.0 // indirect", []string{"require", "example.com/a", "v1.0.0"}},
+		{"example.com/a v1.0.0// indirect", []string{"example.com/a", "v1.0.0"}},
+		{"\texample.com/a\tv1.0.0", []string{"example.com/a", "v1.0.0"}},
+		{`module "example.com/m"`, []string{"module", "example.com/m"}},
+		{`replace "example.com/a" => "./a//b" // local`, []string{"replace", "example.com/a", "=>", "./a//b"}},
+		{"replace x => `./a // b`", []string{"replace", "x", "=>", "./a // b"}},
+		{`module "a\"//b"`, []string{"module", `a"//b`}},
+		{`module "a" "b"`, []string{"module", "a", "b"}},
+	}
+	for _, test := range tests {
+		got, err := modFields(test.line)
+		if err != nil {
+			t.Errorf("modFields(%q) = %v", test.line, err)
+		} else if !slices.Equal(got, test.want) {
+			t.Errorf("modFields(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	for _, line := range []string{`module "example.com/m`, "module `m", `module "a\"`} {
+		if _, err := modFields(line); err == nil {
+			t.Errorf("modFields(%q) succeeded, want an error", line)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"nix/derivation"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type ModuleSrcAttrs struct {
+	// Module path and version, as in go.sum.
+	ModulePath string `nix:"required"`
+	Version    string `nix:"required"`
+
+	// Either a module zip, as served by a module proxy, or a directory holding
+	// the module's source, such as a VCS checkout.
+	Src string `nix:"required"`
+
+	// The "h1:" hash of the module from go.sum. The source is checked against
+	// it before any patches are applied.
+	Hash string
+
+	// Patches applied to the module with "patch -p1", using patch from
+	// nativeBuildInputs.
+	Patches []string
+}
+
+// Directories of version control metadata, which are never part of a module.
+var vcsDirs = []string{".bzr", ".git", ".hg", ".svn"}
+
+// ModuleHashError records when the source of a module doesn't match the hash
+// in go.sum.
+type ModuleHashError struct {
+	Module string
+	Hash   string
+	Want   string
+}
+
+func (e ModuleHashError) Error() string {
+	return fmt.Sprintf(
+		"module %s has hash %s, but go.sum expects %s",
+		e.Module,
+		e.Hash,
+		e.Want,
+	)
+}
+
+// extractModuleZip extracts the files of a module zip into dir. Every file in
+// the zip must be under the "<module>@<version>/" prefix.
+func extractModuleZip(src, prefix, dir string) error {
+	archive, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		name, ok := strings.CutPrefix(file.Name, prefix)
+		if !ok || !filepath.IsLocal(name) {
+			return fmt.Errorf("module zip contains unexpected file %s", file.Name)
+		}
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		err := func() error {
+			in, err := file.Open()
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			return writeModuleFile(in, filepath.Join(dir, name), file.Mode())
+		}()
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", file.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// copyModuleTree copies the files of the module rooted at src into dir,
+// leaving out version control metadata and nested modules, like the go command
+// does when creating a module zip.
+func copyModuleTree(src, dir string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if slices.Contains(vcsDirs, entry.Name()) {
+				return filepath.SkipDir
+			}
+			if rel != "." {
+				if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			log.Printf("warning: skipping %s, which is not a regular file", rel)
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		return writeModuleFile(in, filepath.Join(dir, rel), info.Mode())
+	})
+}
+
+// writeModuleFile writes the contents of in to path. Only the executable bit
+// of mode is kept.
+func writeModuleFile(in io.Reader, path string, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	perm := fs.FileMode(0644)
+	if mode&0111 != 0 {
+		perm = 0755
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// HashModule computes the "h1:" hash of the module source in dir, as found in
+// go.sum. This is a SHA-256 of a summary listing the SHA-256 of every file,
+// named under prefix and sorted by name.
+func HashModule(dir, prefix string) (string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, prefix+filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	slices.Sort(files)
+
+	summary := sha256.New()
+	for _, file := range files {
+		if strings.Contains(file, "\n") {
+			return "", fmt.Errorf("file name %q contains a newline", file)
+		}
+		sum, err := IndexSource(filepath.Join(dir, strings.TrimPrefix(file, prefix))).Hash()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(summary, "%x  %s\n", sum, file)
+	}
+
+	return "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil)), nil
+}
+
+// moduleSrc unpacks the source of a single module into a normalized store path,
+// which packages of the module can use as their sources.
+func moduleSrc() {
+	attrs := derivation.GetAttrs[ModuleSrcAttrs]()
+	module := attrs.ModulePath + "@" + attrs.Version
+	outDir := derivation.MustOutput("out")
+
+	info, err := os.Stat(attrs.Src)
+	if err != nil {
+		Fatalf("failed to read module source: %v", err)
+	}
+	if info.IsDir() {
+		err = copyModuleTree(attrs.Src, outDir)
+	} else {
+		err = extractModuleZip(attrs.Src, module+"/", outDir)
+	}
+	if err != nil {
+		Fatalf("failed to unpack %s: %v", module, err)
+	}
+
+	hash, err := HashModule(outDir, module+"/")
+	if err != nil {
+		Fatalf("failed to hash %s: %v", module, err)
+	}
+	if attrs.Hash == "" {
+		log.Printf("warning: no hash given for %s, which has hash %s", module, hash)
+	} else if hash != attrs.Hash {
+		Fatal(&ModuleHashError{module, hash, attrs.Hash})
+	}
+
+	if len(attrs.Patches) > 0 {
+		tool, err := FindNativeTool("patch")
+		if err != nil {
+			Fatal(err)
+		}
+		for _, patch := range attrs.Patches {
+			cmd := exec.Command(tool, "-p1", "--batch", "-d", outDir, "-i", patch)
+			cmd.Env = NativeEnv()
+			if err := RunLogged(cmd); err != nil {
+				Fatalf("failed to apply %s to %s: %v", patch, module, err)
+			}
+		}
+	}
+}
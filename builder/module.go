@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nix/derivation"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A ModulePackage is one package of a module built by "builder module", like
+// an entry of a lock file's packages.
+type ModulePackage struct {
+	Srcs []string
+
+	// Import paths imported by the package, before applying ImportMap. Those
+	// of other packages in the module are compiled first.
+	Imports   []string
+	ImportMap map[string]string
+	EmbedCfg  *EmbedCfg
+}
+
+type ModuleAttrs struct {
+	// Import path of the module. Its packages are collected into a meta
+	// package of the same name.
+	PackagePath string `nix:"required"`
+
+	// Packages of the module, keyed by import path.
+	Packages map[string]ModulePackage `nix:"required"`
+
+	// Libraries from outside the module, like the imports of "compile". Each
+	// package is only given those it imports, besides meta packages.
+	Imports      map[string]string
+	MetaPackages []string
+
+	// Also write the meta package as a pack, including the metadata of every
+	// package in the module.
+	PackMetadata bool
+}
+
+// Attributes of "module" which aren't passed on to the compilation of each
+// package. Everything else is shared by them.
+var moduleOnlyAttrs = []string{"packages", "packMetadata"}
+
+// A ModuleCycleError records packages of a module which import each other, so
+// none of them can be compiled first.
+type ModuleCycleError struct {
+	Packages []string
+}
+
+func (e ModuleCycleError) Error() string {
+	return fmt.Sprintf("import cycle between the packages %s", strings.Join(e.Packages, ", "))
+}
+
+// moduleDeps returns the packages of the module each package imports, after
+// applying its ImportMap.
+func moduleDeps(pkgs map[string]ModulePackage) map[string][]string {
+	deps := make(map[string][]string, len(pkgs))
+	for importPath, pkg := range pkgs {
+		deps[importPath] = []string{}
+		for _, dep := range pkg.Imports {
+			if mapped, ok := pkg.ImportMap[dep]; ok {
+				dep = mapped
+			}
+			if _, ok := pkgs[dep]; ok && !slices.Contains(deps[importPath], dep) {
+				deps[importPath] = append(deps[importPath], dep)
+			}
+		}
+	}
+
+	return deps
+}
+
+// ScheduleModule calls compile for every package in deps, keyed by import
+// path, running up to jobs at once. A package is only compiled once every
+// package it depends on has been. After the first failure, nothing new is
+// started, and its error is returned once running compilations finish.
+func ScheduleModule(deps map[string][]string, jobs int, compile func(importPath string) error) error {
+	waiting := make(map[string]int, len(deps))
+	dependents := make(map[string][]string, len(deps))
+	var ready []string
+	for _, importPath := range SortedKeys(deps) {
+		waiting[importPath] = len(deps[importPath])
+		for _, dep := range deps[importPath] {
+			dependents[dep] = append(dependents[dep], importPath)
+		}
+		if waiting[importPath] == 0 {
+			ready = append(ready, importPath)
+		}
+	}
+
+	type result struct {
+		importPath string
+		err        error
+	}
+	results := make(chan result)
+	running, done := 0, 0
+	var firstErr error
+	for {
+		for firstErr == nil && len(ready) > 0 && running < jobs {
+			importPath := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				results <- result{importPath, compile(importPath)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		done++
+		SetPhaseProgress("module", done, len(deps))
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		for _, dependent := range dependents[r.importPath] {
+			if waiting[dependent]--; waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+		slices.Sort(ready)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if done < len(deps) {
+		var cycle []string
+		for _, importPath := range SortedKeys(waiting) {
+			if waiting[importPath] > 0 {
+				cycle = append(cycle, importPath)
+			}
+		}
+		return &ModuleCycleError{cycle}
+	}
+
+	return nil
+}
+
+// A moduleBuild compiles the packages of a module, each by running the
+// builder's "compile" in its own process. The builder keeps the state of a
+// compilation in package variables, so they can't share one.
+type moduleBuild struct {
+	attrs   *ModuleAttrs
+	builder string
+	outputs PackageOutputs
+
+	// Attributes of the module derivation, passed on to each compilation.
+	shared map[string]json.RawMessage
+
+	// Index of each package in sorted order, naming its staging directory.
+	index map[string]int
+
+	// Serializes the output of compilations, which is only written once each
+	// finishes so it isn't interleaved, and adding their action manifests and
+	// profiles.
+	mu sync.Mutex
+}
+
+// packageOutputs returns where the package importPath is installed, under
+// "<import path>/" of the module's outputs.
+func (b *moduleBuild) packageOutputs(importPath string) PackageOutputs {
+	dir := filepath.FromSlash(importPath)
+	return PackageOutputs{
+		Lib:    filepath.Join(b.outputs.Lib, dir),
+		Export: filepath.Join(b.outputs.Export, dir),
+	}
+}
+
+// packageAttrs returns the attributes compiling the package importPath into
+// the outputs in stage, with a build directory of its own.
+func (b *moduleBuild) packageAttrs(importPath, stage string) ([]byte, error) {
+	pkg := b.attrs.Packages[importPath]
+
+	imports := make(map[string]string)
+	for name, path := range b.attrs.Imports {
+		if name == "std" || slices.Contains(b.attrs.MetaPackages, name) {
+			imports[name] = path
+		}
+	}
+	for _, dep := range pkg.Imports {
+		if mapped, ok := pkg.ImportMap[dep]; ok {
+			dep = mapped
+		}
+		if _, ok := b.attrs.Packages[dep]; ok {
+			imports[dep] = b.packageOutputs(dep).Export
+		} else if path, ok := b.attrs.Imports[dep]; ok {
+			imports[dep] = path
+		}
+	}
+
+	attrs := make(map[string]any, len(b.shared)+7)
+	for name, value := range b.shared {
+		attrs[name] = value
+	}
+	attrs["packagePath"] = importPath
+	attrs["srcs"] = pkg.Srcs
+	attrs["imports"] = imports
+	attrs["importMap"] = pkg.ImportMap
+	attrs["embedCfg"] = pkg.EmbedCfg
+	// Within Nix, the build directory is kept in the stage. Outside of it, each
+	// compile gets a temporary one.
+	if top := os.Getenv("NIX_BUILD_TOP"); top != "" {
+		buildDir, err := filepath.Rel(top, filepath.Join(stage, "build"))
+		if err != nil {
+			return nil, err
+		}
+		attrs["buildDir"] = buildDir
+	}
+	outputs := map[string]string{
+		"lib":    filepath.Join(stage, "lib"),
+		"export": filepath.Join(stage, "export"),
+	}
+	if ActionManifests {
+		outputs["manifests"] = filepath.Join(stage, "manifests")
+	}
+	if ProfileTools {
+		outputs["profiles"] = filepath.Join(stage, "profiles")
+	}
+	attrs["outputs"] = outputs
+
+	return json.Marshal(attrs)
+}
+
+// compile compiles the package importPath in a new process, staging its
+// outputs in the build directory before moving them into place.
+func (b *moduleBuild) compile(importPath string) error {
+	stage := filepath.Join(derivation.BuildDir(), "module", strconv.Itoa(b.index[importPath]))
+	if err := os.MkdirAll(stage, 0755); err != nil {
+		return err
+	}
+	data, err := b.packageAttrs(importPath, stage)
+	if err != nil {
+		return fmt.Errorf("failed to write attributes of %s: %w", importPath, err)
+	}
+	attrsFile := filepath.Join(stage, "attrs.json")
+	if err := os.WriteFile(attrsFile, data, 0644); err != nil {
+		return err
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(b.builder, "--attrs-file", attrsFile, "compile")
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = cmd.Run()
+
+	b.mu.Lock()
+	io.Copy(os.Stderr, &output)
+	b.mu.Unlock()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("failed to compile %s: %w", importPath, &ToolError{"builder compile", exitErr})
+	} else if err != nil {
+		return fmt.Errorf("failed to compile %s: %w", importPath, err)
+	}
+
+	outputs := b.packageOutputs(importPath)
+	for from, to := range map[string]string{
+		filepath.Join(stage, "lib"):    outputs.Lib,
+		filepath.Join(stage, "export"): outputs.Export,
+	} {
+		if err := moveDirContents(from, to); err != nil {
+			return fmt.Errorf("failed to install %s: %w", importPath, err)
+		}
+	}
+
+	if ActionManifests {
+		manifests, err := LoadActionManifests(filepath.Join(stage, "manifests"))
+		if err != nil {
+			return fmt.Errorf("failed to read action manifests of %s: %w", importPath, err)
+		}
+		b.mu.Lock()
+		actionManifests = append(actionManifests, manifests...)
+		b.mu.Unlock()
+	}
+	if ProfileTools {
+		dir := filepath.Join(stage, "profiles")
+		profiles, err := LoadToolProfiles(dir)
+		if err == nil {
+			err = os.Remove(filepath.Join(dir, "tools.json"))
+		}
+		if err == nil {
+			err = moveDirContents(dir, profilesOutput())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to collect profiles of %s: %w", importPath, err)
+		}
+		b.mu.Lock()
+		toolProfiles = append(toolProfiles, profiles...)
+		b.mu.Unlock()
+	}
+
+	return nil
+}
+
+// moveDirContents moves everything in the directory from into the directory
+// to, creating it if needed.
+func moveDirContents(from, to string) error {
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// module compiles every package of a module within a single derivation,
+// running as many compilations at once as Nix allows cores. Each package is
+// written to "<import path>/" in the lib and export outputs, which also hold a
+// meta package of the whole module. This suits small modules, where a
+// derivation for every package costs more than it saves.
+func module() {
+	attrs := derivation.GetAttrs[ModuleAttrs]()
+
+	builder, err := os.Executable()
+	if err != nil {
+		Fatalf("failed to find the builder: %v", err)
+	}
+	shared := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(derivation.AttrJson, &shared); err != nil {
+		Fatalf("failed to read attributes: %v", err)
+	}
+	for _, name := range moduleOnlyAttrs {
+		delete(shared, name)
+	}
+
+	build := &moduleBuild{
+		attrs:   &attrs,
+		builder: builder,
+		outputs: PackageOutputs{
+			Lib:    derivation.MustOutput("lib"),
+			Export: derivation.MustOutput("export"),
+		},
+		shared: shared,
+		index:  make(map[string]int, len(attrs.Packages)),
+	}
+	for i, importPath := range SortedKeys(attrs.Packages) {
+		build.index[importPath] = i
+	}
+	err = ScheduleModule(moduleDeps(attrs.Packages), derivation.BuildParallelism(), build.compile)
+	if err != nil {
+		Fatal(err)
+	}
+
+	packages := make(map[string]PackageOutputs, len(attrs.Packages))
+	importMap := make(map[string]string)
+	for importPath, pkg := range attrs.Packages {
+		packages[importPath] = build.packageOutputs(importPath)
+		for from, to := range pkg.ImportMap {
+			importMap[from] = to
+		}
+	}
+	err = WriteMetaPackage(build.outputs.Lib, build.outputs.Export, attrs.PackagePath, packages, importMap, attrs.PackMetadata)
+	if err != nil {
+		Fatalf("failed to generate meta package %s: %v", attrs.PackagePath, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+)
+
+// NativeEnv returns the environment every tool the builder runs starts from.
+// Nothing is inherited from the builder's own environment besides $PATH of the
+// nativeBuildInputs, so a tool finds the same programs [FindNativeTool] does,
+// as do the programs it runs in turn, like the C compiler run by cgo or the
+// external linker, and a toolexec wrapper. $HOME and $TMPDIR are the build
+// directory, the only place tools may write to besides the outputs.
+func NativeEnv() []string {
+	var env []string
+	for _, name := range buildDirEnv {
+		env = append(env, name+"="+derivation.BuildDir())
+	}
+	if path := derivation.Path(); path != "" {
+		env = append(env, "PATH="+path)
+	}
+
+	return env
+}
+
+// FindNativeTool searches the bin directories of nativeBuildInputs, and the
+// inputs they propagate, for an executable named name. Cross toolchains usually prefix their tools with the
+// target triple (e.g. "x86_64-w64-mingw32-windres"), so those are also
+// accepted if no exact match is found.
+func FindNativeTool(name string) (string, error) {
+	var prefixed string
+	for _, dep := range derivation.NativeInputs() {
+		bin := filepath.Join(dep, "bin")
+		if path := filepath.Join(bin, name); isExecutable(path) {
+			return path, nil
+		}
+
+		if prefixed == "" {
+			matches, _ := filepath.Glob(filepath.Join(bin, "*-"+name))
+			for _, match := range matches {
+				if isExecutable(match) {
+					prefixed = match
+					break
+				}
+			}
+		}
+	}
+
+	if prefixed != "" {
+		return prefixed, nil
+	}
+	return "", fmt.Errorf("%s was not found in nativeBuildInputs", name)
+}
+
+// isExecutable reports whether path is a regular file that can be executed.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// nixString quotes s as a Nix string literal.
+func nixString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '$':
+			// Only "${" starts an interpolation, but escaping every "$" is
+			// simpler and still valid.
+			b.WriteString("\\$")
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// WriteNix writes the packages of the lock as a Nix expression, so a workspace
+// can be built without writing a derivation for each of its packages. The
+// expression is a function taking the source tree `src`, `buildGoLibrary`, and
+// `deps`, the libraries of non-local modules keyed by import path. It returns
+// a library for every local package, keyed by import path.
+//
+// Imports are resolved after applying the package's ImportMap. Imports of the
+// standard library are left out, since buildGoLibrary provides it. Commands
+// are compiled as "main", with their import path as mainPath.
+func (l *Lock) WriteNix(w io.Writer) error {
+	local := make(map[string]struct{}, len(l.Packages))
+	for _, pkg := range l.Packages {
+		local[pkg.ImportPath] = struct{}{}
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "# Generated by gopkg2nix-incremental from lock.json. Do not edit.")
+	fmt.Fprintln(b, "{")
+	fmt.Fprintln(b, "  src,")
+	fmt.Fprintln(b, "  buildGoLibrary,")
+	fmt.Fprintln(b, "  deps ? { },")
+	fmt.Fprintln(b, "}:")
+	fmt.Fprintln(b, "let")
+	fmt.Fprintln(b, "  packages = {")
+	for _, pkg := range l.Packages {
+		fmt.Fprintf(b, "    %s = buildGoLibrary {\n", nixString(pkg.ImportPath))
+		if pkg.Main {
+			fmt.Fprintln(b, "      packagePath = \"main\";")
+			fmt.Fprintf(b, "      mainPath = %s;\n", nixString(pkg.ImportPath))
+		} else {
+			fmt.Fprintf(b, "      packagePath = %s;\n", nixString(pkg.ImportPath))
+		}
+
+		fmt.Fprintln(b, "      srcs = [")
+		for _, src := range pkg.Srcs {
+			fmt.Fprintf(b, "        (src + %s)\n", nixString("/"+path.Join(pkg.Dir, src)))
+		}
+		fmt.Fprintln(b, "      ];")
+
+		var imports []string
+		for _, importPath := range pkg.Imports {
+			if mapped, ok := pkg.ImportMap[importPath]; ok {
+				importPath = mapped
+			}
+			if _, ok := local[importPath]; ok {
+				imports = append(imports, "packages."+nixString(importPath))
+			} else if !isStdPath(importPath) {
+				imports = append(imports, "deps."+nixString(importPath))
+			}
+		}
+		if len(imports) > 0 {
+			fmt.Fprintln(b, "      imports = [")
+			for _, dep := range imports {
+				fmt.Fprintf(b, "        %s\n", dep)
+			}
+			fmt.Fprintln(b, "      ];")
+		}
+
+		if len(pkg.ImportMap) > 0 {
+			fmt.Fprintln(b, "      importMap = {")
+			for _, importPath := range SortedKeys(pkg.ImportMap) {
+				fmt.Fprintf(b, "        %s = %s;\n", nixString(importPath), nixString(pkg.ImportMap[importPath]))
+			}
+			fmt.Fprintln(b, "      };")
+		}
+		fmt.Fprintln(b, "    };")
+	}
+	fmt.Fprintln(b, "  };")
+	fmt.Fprintln(b, "in")
+	fmt.Fprintln(b, "packages")
+
+	return b.Flush()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteNixCommand(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":              "module example.com/m\n\ngo 1.22\n",
+		"cmd/tool/main.go":    "package main\n\nimport \"example.com/m/internal/x\"\n\nfunc main() { x.Run() }\n",
+		"internal/x/x.go":     "package x\n\nfunc Run() {}\n",
+		"internal/x/x_doc.go": "// Package x is internal.\npackage x\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	workspace, err := LoadWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := workspace.Packages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is written as JSON and read back before generating Nix.
+	data, err := json.Marshal(&Lock{Packages: pkgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock Lock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		t.Fatal(err)
+	}
+
+	var expr strings.Builder
+	if err := lock.WriteNix(&expr); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"example.com/m/cmd/tool" = buildGoLibrary {
+      packagePath = "main";
+      mainPath = "example.com/m/cmd/tool";`,
+		`packages."example.com/m/internal/x"`,
+		`"example.com/m/internal/x" = buildGoLibrary {
+      packagePath = "example.com/m/internal/x";`,
+	} {
+		if !strings.Contains(expr.String(), want) {
+			t.Errorf("expression is missing %q:\n%s", want, expr.String())
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+var (
+	// Report progress to Nix with "@nix" lines, like the phases of stdenv.
+	// Nix reads these from the build log instead of printing them, so they're
+	// only written within a build.
+	NixLog = os.Getenv("NIX_BUILD_TOP") != ""
+)
+
+// writeNixLog writes an "@nix" control line to stderr for Nix to interpret.
+func writeNixLog(msg map[string]any) {
+	if !NixLog {
+		return
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(os.Stderr, "@nix %s\n", line)
+}
+
+// Verbosity of a message in the Nix log shown with "-v". Messages above the
+// level Nix runs with are left out.
+const NixLevelTalkative = 4
+
+// NixMessage logs msg to Nix at level, without printing it to stderr. This
+// records details which are only sometimes useful, like "-v" does for Nix's own
+// messages.
+func NixMessage(level int, msg string) {
+	writeNixLog(map[string]any{"action": "msg", "level": level, "msg": msg})
+}
+
+// SetPhase tells Nix the builder started the phase, which is shown by
+// "--log-format internal-json" consumers like nix-output-monitor.
+func SetPhase(phase string) {
+	writeNixLog(map[string]any{"action": "setPhase", "phase": phase})
+}
+
+// SetPhaseProgress is like SetPhase for step done of total in a phase with
+// multiple steps. Nix ignores any activities started by a builder, so the
+// progress can only be shown in the name of the phase.
+func SetPhaseProgress(phase string, done, total int) {
+	if total > 1 {
+		phase = fmt.Sprintf("%s (%d/%d)", phase, done, total)
+	}
+	SetPhase(phase)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A metadata pack is a single file holding a meta package and, optionally, the
+// metadata of each of its subpackages. It starts with a JSON index, followed by
+// a newline and the metadata of every subpackage concatenated together. Offsets
+// in the index are relative to the end of that newline.
+//
+// Large meta packages like "std" are resolved by every compilation in the
+// graph. Reading a pack only decodes the index, and the metadata of the few
+// subpackages actually imported can then be read without opening hundreds of
+// separate files.
+
+var (
+	// Sections of loaded packs holding the metadata of a package, keyed by the
+	// store path of the package.
+	packedMetadata = make(map[string]*io.SectionReader)
+)
+
+// A PackEntry is the location of a subpackage's metadata in a pack. Entries
+// without metadata have a Length of 0.
+type PackEntry struct {
+	Import
+	Offset int64 `json:",omitempty"`
+	Length int64 `json:",omitempty"`
+}
+
+type packIndex struct {
+	SchemaVersion int
+
+	Entries   []PackEntry
+	ImportMap map[string]string `json:",omitempty"`
+}
+
+// packPath returns the path to the pack of a meta package in a store path.
+func packPath(dir, importPath string) string {
+	return filepath.Join(dir, filepath.Base(importPath)+".pack")
+}
+
+// SavePack writes a pack for a meta package to a store path. If withMetadata
+// is set, the metadata of each subpackage is copied from its own store path
+// into the pack.
+func SavePack(dir string, meta MetaPackage, withMetadata bool) error {
+	index := packIndex{
+		SchemaVersion: meta.SchemaVersion,
+		Entries:       make([]PackEntry, 0, len(meta.SubPackages)),
+		ImportMap:     meta.ImportMap,
+	}
+	var blobs [][]byte
+
+	var offset int64
+	for _, subPkg := range meta.SubPackages {
+		entry := PackEntry{Import: subPkg}
+		if withMetadata {
+			data, err := os.ReadFile(Package{ImportPath: subPkg.ImportPath}.StorePath(subPkg.StorePath))
+			if err != nil {
+				return fmt.Errorf("failed to pack %s: %w", subPkg.ImportPath, err)
+			}
+			entry.Offset, entry.Length = offset, int64(len(data))
+			offset += entry.Length
+			blobs = append(blobs, data)
+		}
+		index.Entries = append(index.Entries, entry)
+	}
+
+	return WriteGenerated(packPath(dir, meta.ImportPath), func(file io.Writer) error {
+		// Encode always terminates the index with a newline.
+		encoder := json.NewEncoder(file)
+		if err := encoder.Encode(&index); err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if _, err := file.Write(blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadPack reads the index of a meta package's pack, if the store path has
+// one, and registers the metadata of its subpackages for [LoadMetadata]. The
+// pack is left open for the rest of the build.
+func loadPack(dir, importPath string) (MetaPackage, bool, error) {
+	meta := MetaPackage{ImportPath: importPath}
+
+	file, err := os.Open(packPath(dir, importPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, false, nil
+	} else if err != nil {
+		return meta, false, fmt.Errorf("failed to read meta package pack: %w", err)
+	}
+
+	var index packIndex
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&index); err != nil {
+		file.Close()
+		return meta, false, fmt.Errorf("failed to read %s pack index: %w", importPath, err)
+	}
+	if meta.SchemaVersion = index.SchemaVersion; meta.SchemaVersion > SchemaVersion {
+		file.Close()
+		return meta, false, &SchemaError{ImportPath: importPath, Version: meta.SchemaVersion}
+	}
+	// Skip the newline after the index.
+	start := decoder.InputOffset() + 1
+
+	meta.SubPackages = make([]Import, 0, len(index.Entries))
+	meta.ImportMap = index.ImportMap
+	for _, entry := range index.Entries {
+		meta.SubPackages = append(meta.SubPackages, entry.Import)
+		if entry.Length > 0 {
+			packedMetadata[entry.StorePath] = io.NewSectionReader(
+				file,
+				start+entry.Offset,
+				entry.Length,
+			)
+		}
+	}
+
+	meta, err = meta.Migrate()
+	return meta, true, err
+}
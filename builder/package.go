@@ -1,128 +1,314 @@
 package main
 
 import (
+	"cmd/builder/gometa"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"go/parser"
-	"go/token"
+	"io"
+	"io/fs"
+	"log"
 	"maps"
 	"os"
 	"path/filepath"
 	"slices"
-	"strconv"
 	"strings"
 )
 
 var (
 	// MetaPackages are special import paths which represent a commonly used set of
-	// packages.
+	// packages. Builds may declare more of their own.
 	MetaPackages = []string{"std"}
+
+	// What to do when a meta package contains a package which was already
+	// provided.
+	MetaConflicts = ConflictOverride
+
+	// Every package of a meta package which was shadowed while resolving
+	// imports.
+	MetaOverrides []MetaOverride
+)
+
+// A ConflictPolicy decides what happens when a package is provided both
+// directly and by a meta package.
+type ConflictPolicy int
+
+const (
+	// Silently use the package provided directly.
+	ConflictOverride ConflictPolicy = iota
+	// Use the package provided directly, but log a warning.
+	ConflictWarn
+	// Fail the build.
+	ConflictError
 )
 
+// ParseConflictPolicy converts the name of a policy to a ConflictPolicy.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch name {
+	case "", "override":
+		return ConflictOverride, nil
+	case "warn":
+		return ConflictWarn, nil
+	case "error":
+		return ConflictError, nil
+	default:
+		return 0, fmt.Errorf("unknown meta package conflict policy \"%s\"", name)
+	}
+}
+
+// A MetaOverride records a package of a meta package which was shadowed by a
+// package with the same import path from somewhere else.
+type MetaOverride struct {
+	ImportPath  string
+	MetaPackage string
+
+	// Store path of the package which was used, and the one from the meta
+	// package which was ignored.
+	StorePath string
+	Shadowed  string
+
+	// The meta package which provided the package used, if it wasn't
+	// provided directly.
+	Provider string `json:",omitempty"`
+}
+
+// MetaConflictError records when a meta package contains a package which was
+// already provided, and conflicts aren't allowed.
+type MetaConflictError struct {
+	MetaOverride
+}
+
+func (e MetaConflictError) Error() string {
+	return fmt.Sprintf(
+		"package %s from meta package %s conflicts with %s, which was already provided",
+		e.ImportPath,
+		e.MetaPackage,
+		e.StorePath,
+	)
+}
+
 // ImportError records when an input could not be found in the current
 // imports.
 type ImportError struct {
 	Import string
 	Parent string
+
+	// Likely fixes for the missing import. See [NewImportError].
+	Hints       []string
+	Suggestions []string
 }
 
 func (e ImportError) Error() string {
-	return fmt.Sprintf(
+	var msg strings.Builder
+	fmt.Fprintf(
+		&msg,
 		"package %s not found in the provided imports, needed by %s",
 		e.Import,
 		e.Parent,
 	)
+
+	for _, hint := range e.Hints {
+		fmt.Fprintf(&msg, "\n\n  %s", hint)
+	}
+	if len(e.Suggestions) > 0 {
+		fmt.Fprint(&msg, "\n\n  Similar packages were provided:")
+		for _, suggestion := range e.Suggestions {
+			fmt.Fprintf(&msg, "\n    %s", suggestion)
+		}
+	}
+
+	return msg.String()
 }
 
-// FilterInternalPackages returns true if a package named importPath is an
-// internal package that should be filtered from the output.
-func FilterInternalPackages(importPath string) bool {
-	switch importPath {
-	case "runtime/cgo", "unsafe":
-		return true
-	default:
-		return false
+// VisibilityError records when a package imports an internal package from
+// outside of the tree rooted at the internal directory's parent, which the go
+// command doesn't allow.
+type VisibilityError struct {
+	Import   string
+	Importer string
+	Source   string
+}
+
+func (e VisibilityError) Error() string {
+	msg := fmt.Sprintf(
+		"use of internal package %s not allowed in %s, imported by %s",
+		e.Import,
+		e.Importer,
+		e.Source,
+	)
+	if e.Importer == "main" {
+		msg += "\n\n  Is mainPath set to the import path of the command in its module?"
 	}
+
+	return msg
 }
 
-// Interface PackageLike represents the metadata of either a package or meta
-// package. This generalizes loading and saving .json descriptions to the store.
-type PackageLike[P any] interface {
-	StorePath(string) string
-	FromImport(string) P
+// internalParent returns the path of the tree which may import importPath, if
+// it's an internal package. Only the last internal element counts, since it's
+// the most restrictive. Internal packages of the standard library have an empty
+// parent.
+func internalParent(importPath string) (string, bool) {
+	switch {
+	case strings.HasSuffix(importPath, "/internal"):
+		return strings.TrimSuffix(importPath, "/internal"), true
+	case strings.Contains(importPath, "/internal/"):
+		return importPath[:strings.LastIndex(importPath, "/internal/")], true
+	case importPath == "internal", strings.HasPrefix(importPath, "internal/"):
+		return "", true
+	}
+
+	return "", false
 }
 
-// SaveMetadata writes the metadata for a package-like object to a store path.
-func SaveMetadata[T PackageLike[T]](dir string, data PackageLike[T]) error {
-	file, err := os.Create(data.StorePath(dir))
-	if err != nil {
+// CheckVisibility fails if the package importer may not import importPath,
+// found in src, by the go command's rules for internal packages. Only packages
+// of the standard library, as reported by std, may import its internal
+// packages.
+func CheckVisibility(importer string, std bool, importPath, src string) error {
+	parent, ok := internalParent(importPath)
+	if !ok {
+		return nil
+	}
+
+	var allowed bool
+	if parent == "" {
+		allowed = std
+	} else {
+		allowed = importer == parent || strings.HasPrefix(importer, parent+"/")
+	}
+	if !allowed {
+		return &VisibilityError{importPath, importer, src}
+	}
+
+	return nil
+}
+
+// Metadata types shared with other tools. See [gometa].
+type (
+	Package         = gometa.Package
+	MetaPackage     = gometa.MetaPackage
+	BuildRecord     = gometa.BuildRecord
+	Import          = gometa.Import
+	FeatureError    = gometa.FeatureError
+	ExperimentError = gometa.ExperimentError
+	TargetError     = gometa.TargetError
+	ToolchainError  = gometa.ToolchainError
+	CompilerError   = gometa.CompilerError
+	SchemaError     = gometa.SchemaError
+	DynLinkError    = gometa.DynLinkError
+	SharedLibrary   = gometa.SharedLibrary
+)
+
+// SchemaVersion is the version of the metadata the builder writes.
+const SchemaVersion = gometa.SchemaVersion
+
+var (
+	SortImports            = gometa.SortImports
+	CheckArchFeatures      = gometa.CheckArchFeatures
+	FilterInternalPackages = gometa.FilterInternalPackages
+)
+
+// CheckCompatible ensures a package was built with the same toolchain
+// configuration as sdk, so it can safely be imported or linked.
+func CheckCompatible(pkg *Package, sdk *GoSDK) error {
+	if err := gometa.CheckTarget(pkg, Context.GOOS, Context.GOARCH); err != nil {
 		return err
 	}
-	defer file.Close()
+	if err := gometa.CheckArchFeatures(pkg, sdk.ArchFeatures); err != nil {
+		return err
+	}
+
+	if err := gometa.CheckExperiments(pkg, sdk.Experiments); err != nil {
+		return err
+	}
+	if err := gometa.CheckDynLink(pkg, sdk.DynLink); err != nil {
+		return err
+	}
+	if err := gometa.CheckCompiler(pkg, sdk.Compiler().Name()); err != nil {
+		return err
+	}
+
+	return gometa.CheckGoVersion(pkg, sdk.Version)
+}
 
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(data)
+// SaveMetadata writes the metadata for a package-like object to a store path.
+func SaveMetadata[T gometa.PackageLike[T]](dir string, data gometa.PackageLike[T]) error {
+	return WriteGenerated(data.StorePath(dir), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		return encoder.Encode(data)
+	})
 }
 
 // LoadMetadata loads the metadata for a single package-like object from a store
 // path.
-func LoadMetadata[T PackageLike[T]](dir string, importPath string) (T, error) {
+func LoadMetadata[T gometa.PackageLike[T]](dir string, importPath string) (T, error) {
 	var pkg T
 	pkg = pkg.FromImport(importPath)
 
-	file, err := os.Open(filepath.Join(dir, filepath.Base(importPath)+".json"))
-	if err != nil {
-		return pkg, fmt.Errorf("failed to read package metadata: %w", err)
+	// Prefer metadata from an already loaded pack.
+	var decoder *json.Decoder
+	if section, ok := packedMetadata[dir]; ok {
+		decoder = json.NewDecoder(io.NewSectionReader(section, 0, section.Size()))
+	} else {
+		file, err := os.Open(filepath.Join(dir, filepath.Base(importPath)+".json"))
+		if err != nil {
+			return pkg, fmt.Errorf("failed to read package metadata: %w", err)
+		}
+		defer file.Close()
+		decoder = json.NewDecoder(file)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	return pkg, decoder.Decode(&pkg)
-}
-
-type Package struct {
-	ImportPath string `json:"-"`
-	Imports    []string
-	Deps       []string
+	if err := decoder.Decode(&pkg); err != nil {
+		return pkg, err
+	}
+	return pkg.Migrate()
 }
 
-func (p Package) StorePath(dir string) string {
-	return filepath.Join(dir, filepath.Base(p.ImportPath)+".json")
-}
-func (p Package) FromImport(path string) Package {
-	return Package{ImportPath: path}
-}
+// loadMetaPackage reads a meta package from its store path, using the pack if
+// one was written.
+func loadMetaPackage(storePath, importPath string) (MetaPackage, error) {
+	pkg, ok, err := loadPack(storePath, importPath)
+	if err != nil || ok {
+		return pkg, err
+	}
 
-type Import struct {
-	StorePath  string
-	ImportPath string
-}
+	name := filepath.Base(importPath)
+	file, err := os.Open(filepath.Join(storePath, name+".json"))
+	if err != nil {
+		return pkg, fmt.Errorf("failed to read meta package: %w", err)
+	}
+	defer file.Close()
 
-// SortImports sorts a slice of imports lexicographically by import path.
-func SortImports(imports []Import) {
-	slices.SortFunc(imports, func(a, b Import) int {
-		return strings.Compare(a.ImportPath, b.ImportPath)
-	})
-}
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&pkg); err != nil {
+		return pkg, fmt.Errorf("failed to read %s: %w", importPath, err)
+	}
 
-type MetaPackage struct {
-	ImportPath  string `json:"-"`
-	SubPackages []Import
-	ImportMap   map[string]string `json:",omitempty"`
+	return pkg.Migrate()
 }
 
-func (p MetaPackage) StorePath(dir string) string {
-	return filepath.Join(dir, filepath.Base(p.ImportPath)+".json")
-}
-func (p MetaPackage) FromImport(path string) MetaPackage {
-	return MetaPackage{ImportPath: path}
+// ResolveMetaPackages replaces known meta packages with their subpackages, and
+// adds their import maps to importMap. Imports of the standard library's
+// vendored packages are only mapped for std packages, as the go command only
+// uses them within std. Packages also provided directly are handled by the
+// MetaConflicts policy.
+func ResolveMetaPackages(
+	pkgs map[string]string,
+	importMap map[string]string,
+	std bool,
+) error {
+	return resolveMetaPackages(pkgs, importMap, std, MetaConflicts)
 }
 
-// ResolveMetaPackages replaces known meta packages with their subpackages.
-func ResolveMetaPackages(
+// resolveMetaPackages is [ResolveMetaPackages], handling packages also
+// provided directly by policy.
+func resolveMetaPackages(
 	pkgs map[string]string,
 	importMap map[string]string,
+	std bool,
+	policy ConflictPolicy,
 ) error {
+	providers := make(map[string]string)
 	for _, importPath := range MetaPackages {
 		if storePath := pkgs[importPath]; storePath != "" {
 			// Only allocate a new map if a meta package is actually found.
@@ -131,28 +317,48 @@ func ResolveMetaPackages(
 			}
 			delete(pkgs, importPath)
 
-			name := filepath.Base(importPath)
-			file, err := os.Open(filepath.Join(storePath, name+".json"))
+			pkg, err := loadMetaPackage(storePath, importPath)
 			if err != nil {
-				return fmt.Errorf("failed to read meta package: %w", err)
-			}
-			defer file.Close()
-
-			var pkg MetaPackage
-			decoder := json.NewDecoder(file)
-			if err := decoder.Decode(&pkg); err != nil {
-				return fmt.Errorf("failed to read %s: %w", importPath, err)
+				return err
 			}
 
 			for _, subPkg := range pkg.SubPackages {
 				// If a package already exists, it was declared manually by the user. It
 				// should override the declaration in the meta package.
-				if _, ok := pkgs[subPkg.ImportPath]; !ok {
+				existing, ok := pkgs[subPkg.ImportPath]
+				if !ok {
 					pkgs[subPkg.ImportPath] = subPkg.StorePath
+					providers[subPkg.ImportPath] = importPath
+					continue
+				} else if existing == subPkg.StorePath {
+					continue
 				}
+
+				override := MetaOverride{
+					ImportPath:  subPkg.ImportPath,
+					MetaPackage: importPath,
+					StorePath:   existing,
+					Shadowed:    subPkg.StorePath,
+					Provider:    providers[subPkg.ImportPath],
+				}
+				switch policy {
+				case ConflictError:
+					return &MetaConflictError{override}
+				case ConflictWarn:
+					log.Printf(
+						"warning: package %s overrides the one from meta package %s",
+						subPkg.ImportPath,
+						importPath,
+					)
+				}
+				MetaOverrides = append(MetaOverrides, override)
 			}
 			if importMap != nil {
-				maps.Copy(importMap, pkg.ImportMap)
+				for from, to := range pkg.ImportMap {
+					if std || !isVendoredStdPath(to) {
+						importMap[from] = to
+					}
+				}
 			}
 		}
 	}
@@ -160,50 +366,26 @@ func ResolveMetaPackages(
 	return nil
 }
 
-// listFileImports parses a .go file and returns a list of all package paths
-// imported by the file.
-func listFileImports(path string) ([]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	fset := token.NewFileSet()
-	parsed, err := parser.ParseFile(fset, path, file, parser.ImportsOnly)
-	if err != nil {
-		return nil, err
-	}
-
-	var imports []string
-	for _, pkg := range parsed.Imports {
-		unquoted, err := strconv.Unquote(pkg.Path.Value)
-		if err != nil {
-			err = fmt.Errorf("parse input at %s: %v", fset.Position(pkg.Pos()), err)
-			return nil, err
-		}
-
-		imports = append(imports, unquoted)
-	}
-
-	return imports, nil
-}
-
 // ScanImports searches through a list of files and resolves each import to
 // its export data. If any imports were rewritten by the import map, an import
 // for the original import path pointing to the rewritten path is added to
-// the second list of imports. Both returned lists are already sorted.
+// the second list of imports. Both returned lists are already sorted. Imports
+// of internal packages importer may not use fail. See [CheckVisibility].
+// Imports builtin reports as provided by the toolchain itself are skipped.
 func ScanImports(
+	importer string,
+	std bool,
 	srcs []string,
 	pkgs map[string]string,
 	importMap map[string]string,
+	builtin func(importPath string) bool,
 ) ([]Import, []Import, error) {
 	imports := make([]Import, 0)
 	rewrites := make([]Import, 0)
 
 	found := make(map[string]struct{})
 	for _, path := range srcs {
-		fileImports, err := listFileImports(path)
+		fileImports, err := IndexSource(path).Imports()
 		if err != nil {
 			return nil, nil, err
 		}
@@ -214,18 +396,21 @@ func ScanImports(
 			}
 
 			found[importPath] = struct{}{}
-			if FilterInternalPackages(importPath) {
+			if FilterInternalPackages(importPath) || builtin(importPath) {
 				continue
 			}
 
 			if truePath := importMap[importPath]; truePath != "" {
-				rewrites = append(rewrites, Import{truePath, importPath})
+				rewrites = append(rewrites, Import{StorePath: truePath, ImportPath: importPath})
 				importPath = truePath
 			}
+			if err := CheckVisibility(importer, std, importPath, path); err != nil {
+				return nil, nil, err
+			}
 			if storePath, ok := pkgs[importPath]; ok {
-				imports = append(imports, Import{storePath, importPath})
+				imports = append(imports, Import{StorePath: storePath, ImportPath: importPath})
 			} else {
-				return nil, nil, &ImportError{Import: importPath, Parent: path}
+				return nil, nil, NewImportError(importPath, path, pkgs)
 			}
 		}
 	}
@@ -235,3 +420,135 @@ func ScanImports(
 
 	return imports, rewrites, nil
 }
+
+// SaveOverrideReport writes every override of a meta package's packages to
+// "<name>.overrides.json" in dir, if there were any.
+func SaveOverrideReport(dir, importPath string) error {
+	if len(MetaOverrides) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(dir, filepath.Base(importPath)+".overrides.json")
+	return WriteGenerated(path, func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(MetaOverrides)
+	})
+}
+
+// UnusedImportsError records when entries of the imports attribute weren't
+// imported by the package, and unused imports aren't allowed.
+type UnusedImportsError struct {
+	ImportPath string
+	Unused     []string
+}
+
+func (e UnusedImportsError) Error() string {
+	return fmt.Sprintf(
+		"package %s does not import %s\n\n  Unused packages can be removed from the imports of the derivation.",
+		e.ImportPath,
+		strings.Join(e.Unused, ", "),
+	)
+}
+
+// FindUnusedImports compares the declared imports of a package with the ones
+// it actually used. A meta package is used if any of its packages were. std is
+// provided to every package, so it is never reported.
+func FindUnusedImports(declared map[string]string, used []Import) ([]string, error) {
+	usedPaths := make(map[string]string, len(used))
+	for _, dep := range used {
+		usedPaths[dep.ImportPath] = dep.StorePath
+	}
+
+	var unused []string
+	for _, importPath := range SortedKeys(declared) {
+		if importPath == "std" {
+			continue
+		}
+		storePath := declared[importPath]
+		if usedPaths[importPath] == storePath {
+			continue
+		}
+
+		if slices.Contains(MetaPackages, importPath) {
+			meta, err := loadMetaPackage(storePath, importPath)
+			if err != nil {
+				return nil, err
+			}
+			if slices.ContainsFunc(meta.SubPackages, func(sub Import) bool {
+				return usedPaths[sub.ImportPath] == sub.StorePath
+			}) {
+				continue
+			}
+		}
+		unused = append(unused, importPath)
+	}
+
+	return unused, nil
+}
+
+// unusedImportsPath returns where the unused imports of a package are
+// reported.
+func unusedImportsPath(dir, importPath string) string {
+	return filepath.Join(dir, filepath.Base(importPath)+".unused.json")
+}
+
+// SaveUnusedImports writes the unused imports of a package to
+// "<name>.unused.json" in dir, if there were any.
+func SaveUnusedImports(dir, importPath string, unused []string) error {
+	if len(unused) == 0 {
+		return nil
+	}
+
+	return WriteGenerated(unusedImportsPath(dir, importPath), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(unused)
+	})
+}
+
+// LoadUnusedImports reads the unused imports saved by [SaveUnusedImports].
+func LoadUnusedImports(dir, importPath string) ([]string, error) {
+	data, err := os.ReadFile(unusedImportsPath(dir, importPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var unused []string
+	return unused, json.Unmarshal(data, &unused)
+}
+
+// buildRecordPath returns where the build record of a package is written.
+func buildRecordPath(dir, importPath string) string {
+	return filepath.Join(dir, filepath.Base(importPath)+".build.json")
+}
+
+// SaveBuildRecord writes the build record of a package to "<name>.build.json"
+// in dir.
+func SaveBuildRecord(dir, importPath string, record *BuildRecord) error {
+	return WriteGenerated(buildRecordPath(dir, importPath), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(record)
+	})
+}
+
+// LoadBuildRecord reads the build record saved by [SaveBuildRecord]. Packages
+// from older builders, or which were only type checked, have an empty one.
+func LoadBuildRecord(dir, importPath string) (*BuildRecord, error) {
+	record := &BuildRecord{Metadata: Package{ImportPath: importPath}}
+	data, err := os.ReadFile(buildRecordPath(dir, importPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return record, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	record.Metadata, err = record.Metadata.Migrate()
+	return record, err
+}
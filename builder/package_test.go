@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckVisibility(t *testing.T) {
+	tests := []struct {
+		name       string
+		importer   string
+		std        bool
+		importPath string
+		allowed    bool
+	}{
+		{"command imports its module's internal package", "example.com/m/cmd/tool", false, "example.com/m/internal/x", true},
+		{"command imports a nested internal package", "example.com/m/cmd/tool", false, "example.com/m/cmd/internal/x", true},
+		{"command imports a sibling's internal package", "example.com/m/cmd/tool", false, "example.com/m/pkg/internal/x", false},
+		{"main without mainPath imports an internal package", "main", false, "example.com/m/internal/x", false},
+		{"main imports std internal package", "main", false, "internal/abi", false},
+		{"module without a dot imports std internal package", "tool/cmd", false, "internal/abi", false},
+		{"std imports std internal package", "runtime", true, "internal/abi", true},
+		{"std imports vendored internal package", "crypto/tls", true, "vendor/golang.org/x/crypto/internal/poly1305", false},
+		{"other module imports internal package", "example.org/n", false, "example.com/m/internal/x", false},
+		{"package imports public package", "example.org/n", false, "example.com/m/x", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckVisibility(test.importer, test.std, test.importPath, "a.go")
+			var visibilityErr *VisibilityError
+			if test.allowed && err != nil {
+				t.Errorf("CheckVisibility(%q, %q) = %v, want nil", test.importer, test.importPath, err)
+			} else if !test.allowed && !errors.As(err, &visibilityErr) {
+				t.Errorf("CheckVisibility(%q, %q) = %v, want a VisibilityError", test.importer, test.importPath, err)
+			}
+		})
+	}
+}
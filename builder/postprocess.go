@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A PostProcessStep transforms a linked binary with a tool from
+// nativeBuildInputs, such as strip, upx, or objcopy.
+type PostProcessStep struct {
+	Tool string
+
+	// Arguments to the tool, where "@in@" and "@out@" are replaced by the
+	// binary and where to write the transformed binary. If neither is used,
+	// the binary is appended and the tool must modify it in place.
+	Args []string
+}
+
+// PostProcess runs each step on binary in order, returning the path of the
+// final binary. Every step works on a copy of the binary in the build
+// directory, so binary must already be there.
+func PostProcess(binary string, steps []PostProcessStep) (string, error) {
+	for i, step := range steps {
+		tool, err := FindNativeTool(step.Tool)
+		if err != nil {
+			return "", fmt.Errorf("failed to find post-processing tool: %w", err)
+		}
+
+		out := fmt.Sprintf("%s.%d", binary, i+1)
+		usesPaths := false
+		args := make([]string, 0, len(step.Args)+1)
+		for _, arg := range step.Args {
+			replaced := strings.NewReplacer("@in@", binary, "@out@", out).Replace(arg)
+			usesPaths = usesPaths || replaced != arg
+			args = append(args, replaced)
+		}
+		if !usesPaths {
+			args = append(args, binary)
+			out = binary
+		}
+
+		SetPhaseProgress("postProcess", i+1, len(steps))
+		cmd := exec.Command(tool, args...)
+		cmd.Env = NativeEnv()
+		if err := RunLogged(cmd); err != nil {
+			return "", fmt.Errorf("post-processing with %s failed: %w", step.Tool, err)
+		}
+		if _, err := os.Stat(out); err != nil {
+			return "", fmt.Errorf("post-processing with %s did not write %s: %w", step.Tool, out, err)
+		}
+		binary = out
+	}
+
+	return binary, nil
+}
+
+// InstallBinary copies binary to dst atomically, so dst is either missing or
+// complete, even if the build is interrupted.
+func InstallBinary(binary, dst string) error {
+	in, err := os.Open(binary)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
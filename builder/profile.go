@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"nix/derivation"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// Whether to profile compile and link, and record the resource usage of
+	// every tool, written by [SaveToolProfiles].
+	ProfileTools bool
+
+	// Every tool run recorded by [RecordToolProfile], in order.
+	toolProfiles = []ToolProfile{}
+)
+
+// A ToolProfile records how long a tool ran and the most memory it used, to
+// find which packages are slow to build.
+type ToolProfile struct {
+	Tool string
+	Args []string
+
+	// Wall clock time in nanoseconds, and peak resident set size in bytes.
+	Wall   time.Duration
+	MaxRSS int64
+}
+
+// profilesOutput returns the "profiles" output, creating it on first use, since
+// it's written to by every compile and link.
+func profilesOutput() string {
+	dir, ok := derivation.Outputs["profiles"]
+	if !ok {
+		return derivation.MustOutput("profiles")
+	}
+	if _, err := derivation.EnsureDir(dir); err != nil {
+		Fatal(err)
+	}
+
+	return dir
+}
+
+// ProfileFlags returns the flags making tool, either compile or link, write
+// CPU and memory profiles of building name to the "profiles" output, if
+// ProfileTools is set.
+func ProfileFlags(tool, name string) []string {
+	if !ProfileTools {
+		return nil
+	}
+
+	base := filepath.Join(profilesOutput(), strings.ReplaceAll(name, "/", "-")+"."+tool)
+	return []string{"-cpuprofile", base + ".cpu.pprof", "-memprofile", base + ".mem.pprof"}
+}
+
+// RecordToolProfile records the resource usage of cmd, which ran for wall, if
+// ProfileTools is set. This must be called after cmd exits.
+func RecordToolProfile(cmd *exec.Cmd, wall time.Duration) {
+	if !ProfileTools || cmd.ProcessState == nil {
+		return
+	}
+
+	profile := ToolProfile{
+		Tool: filepath.Base(cmd.Path),
+		Args: slices.Clone(cmd.Args),
+		Wall: wall,
+	}
+	if usage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		// Linux reports kilobytes, and darwin bytes.
+		profile.MaxRSS = int64(usage.Maxrss)
+		if runtime.GOOS != "darwin" {
+			profile.MaxRSS *= 1024
+		}
+	}
+	log.Printf("%s ran for %s, using at most %d MiB", profile.Tool, wall.Round(time.Millisecond), profile.MaxRSS>>20)
+
+	toolProfiles = append(toolProfiles, profile)
+}
+
+// SaveToolProfiles writes every recorded tool run to "tools.json" in dir.
+func SaveToolProfiles(dir string) error {
+	return WriteGenerated(filepath.Join(dir, "tools.json"), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(toolProfiles)
+	})
+}
+
+// LoadToolProfiles reads the tool runs written by [SaveToolProfiles].
+func LoadToolProfiles(dir string) ([]ToolProfile, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "tools.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []ToolProfile
+	return profiles, json.Unmarshal(data, &profiles)
+}
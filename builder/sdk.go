@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 )
 
 var (
 	// The current host platform. This is "$GOOS_$GOARCH".
 	HostPlatform = fmt.Sprintf("%s_%s", Context.GOOS, Context.GOARCH)
+
+	// SDKs loaded by [CachedSDK], keyed by path and compatible version.
+	loadedSDKs = make(map[[2]string]*GoSDK)
+
+	// Variables of the tool environment pointing into the build directory.
+	// Their value differs between builds, but never changes the output.
+	buildDirEnv = []string{"HOME", "TMPDIR"}
 )
 
 // GoSDK holds information about a specific instance of the Go SDK.
@@ -22,6 +33,43 @@ type GoSDK struct {
 
 	// User-requested version to maintain compatibility with.
 	CompatVersion string
+
+	// Micro-architecture feature levels (e.g. GOAMD64=v3), keyed by the name of
+	// the environment variable that sets them.
+	ArchFeatures map[string]string
+
+	// Sorted list of enabled toolchain experiments.
+	Experiments []string
+
+	// Command every tool is run through, like "go build -toolexec". The tool's
+	// path and arguments are appended to it.
+	Toolexec []string
+
+	// Instrumentation compiled into every package, either "race", "msan", or
+	// "asan". Empty if disabled.
+	Instrument string
+
+	// Whether every package is compiled with "-dynlink", for linking into or
+	// against shared libraries.
+	DynLink bool
+
+	// Environment variables set for every tool, replacing those of the
+	// baseline from [GoSDK.Env].
+	ToolEnv map[string]string
+
+	// Compiler backend which compiles and links packages instead of the
+	// compile, asm, and link tools of the SDK. See [GoSDK.Compiler].
+	Toolchain Toolchain
+}
+
+// Compiler returns the toolchain which compiles and links packages for sdk,
+// the gc toolchain of the SDK itself unless another was selected.
+func (sdk *GoSDK) Compiler() Toolchain {
+	if sdk.Toolchain == nil {
+		return gcToolchain{}
+	}
+
+	return sdk.Toolchain
 }
 
 // ShortVersion returns the "major.minor" of the SDK, without the patch number.
@@ -34,6 +82,23 @@ func (sdk *GoSDK) ShortVersion() string {
 	return sdk.Version[0:dot]
 }
 
+// ReleaseTags returns the release tags satisfied by CompatVersion, "go1.1"
+// through its minor version, so files for newer versions of Go aren't selected.
+func (sdk *GoSDK) ReleaseTags() ([]string, error) {
+	minor, ok := strings.CutPrefix(sdk.CompatVersion, "go1.")
+	minor, _, _ = strings.Cut(minor, ".")
+	n, err := strconv.Atoi(minor)
+	if !ok || err != nil {
+		return nil, fmt.Errorf("invalid Go version \"%s\"", sdk.CompatVersion)
+	}
+
+	tags := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		tags = append(tags, fmt.Sprintf("go1.%d", i))
+	}
+	return tags, nil
+}
+
 // Include returns the "pkg/include" directory of the SDK.
 func (sdk *GoSDK) Include() string {
 	return filepath.Join(sdk.Path, "pkg", "include")
@@ -56,10 +121,247 @@ func LoadSDK(path, compat string) (*GoSDK, error) {
 	return &sdk, nil
 }
 
-// RunTool creates a new exec.Cmd for calling a given tool in the Go SDK.
+// CachedSDK is like [LoadSDK], but reuses an SDK loaded earlier by the same
+// process, like by an earlier job of the daemon. Each call returns a copy, so
+// it can be configured for the build without affecting others.
+func CachedSDK(path, compat string) (*GoSDK, error) {
+	key := [2]string{path, compat}
+	if _, ok := loadedSDKs[key]; !ok {
+		sdk, err := LoadSDK(path, compat)
+		if err != nil {
+			return nil, err
+		}
+		loadedSDKs[key] = sdk
+	}
+
+	sdk := *loadedSDKs[key]
+	return &sdk, nil
+}
+
+// SDKSelectionError records when none of the SDKs given to choose from
+// satisfy the version of Go needed.
+type SDKSelectionError struct {
+	Want      string
+	Available []string
+}
+
+func (e SDKSelectionError) Error() string {
+	return fmt.Sprintf(
+		"no sdk satisfies go %s, the sdks are for go %s",
+		e.Want,
+		strings.Join(e.Available, ", "),
+	)
+}
+
+// SelectSDK chooses the path of an SDK from sdks, keyed by the version of Go
+// they contain, like "1.22.5". An explicit version selects the newest SDK of
+// that version, so "1.22" selects the newest 1.22 release. Otherwise the
+// oldest SDK satisfying modFile is selected, preferring its toolchain directive
+// over its go directive, like the go command switching toolchains. With
+// neither, the newest SDK is selected.
+func SelectSDK(sdks map[string]string, version string, modFile *ModFile) (string, error) {
+	versions := SortedKeys(sdks)
+	for _, v := range versions {
+		if _, ok := parseGoVersion(v); !ok {
+			return "", &AttrError{"sdks", fmt.Errorf("invalid Go version \"%s\"", v)}
+		}
+	}
+	slices.SortFunc(versions, func(a, b string) int {
+		c, _ := CompareGoVersion(a, b)
+		return c
+	})
+	if len(versions) == 0 {
+		return "", &AttrError{"sdks", errors.New("no sdks to choose from")}
+	}
+
+	if version != "" {
+		want := strings.TrimPrefix(version, "go")
+		for _, v := range slices.Backward(versions) {
+			if trimmed := strings.TrimPrefix(v, "go"); trimmed == want || strings.HasPrefix(trimmed, want+".") {
+				return sdks[v], nil
+			}
+		}
+		return "", &SDKSelectionError{want, versions}
+	}
+	if modFile == nil {
+		return sdks[versions[len(versions)-1]], nil
+	}
+
+	// The toolchain directive is only a preference, so fall back on the go
+	// directive when no SDK is new enough for it.
+	toolchain := modFile.Toolchain
+	if toolchain == "default" {
+		toolchain = ""
+	}
+	for _, want := range []string{toolchain, modFile.Go} {
+		if want == "" {
+			continue
+		}
+		for _, v := range versions {
+			if c, ok := CompareGoVersion(v, want); ok && c >= 0 {
+				return sdks[v], nil
+			}
+		}
+	}
+	if modFile.Go != "" {
+		return "", &SDKSelectionError{modFile.Go, versions}
+	}
+
+	return sdks[versions[len(versions)-1]], nil
+}
+
+// Env returns the environment tools in the SDK should be called with, which
+// extends [NativeEnv] with the target platform and toolchain settings.
+// ToolEnv is applied last.
+func (sdk *GoSDK) Env() []string {
+	// Tools default to the platform they were built for, which may not be the
+	// platform packages are selected for.
+	env := []string{
+		"CGO_ENABLED=0",
+		"GOOS=" + Context.GOOS,
+		"GOARCH=" + Context.GOARCH,
+	}
+	env = append(env, NativeEnv()...)
+	for _, name := range SortedKeys(sdk.ArchFeatures) {
+		env = append(env, fmt.Sprintf("%s=%s", name, sdk.ArchFeatures[name]))
+	}
+	if len(sdk.Experiments) > 0 {
+		env = append(env, "GOEXPERIMENT="+strings.Join(sdk.Experiments, ","))
+	}
+	for _, name := range SortedKeys(sdk.ToolEnv) {
+		env = setEnv(env, name, sdk.ToolEnv[name])
+	}
+
+	return env
+}
+
+// setEnv sets name to value in env, replacing any earlier value.
+func setEnv(env []string, name, value string) []string {
+	env = slices.DeleteFunc(env, func(v string) bool {
+		return strings.HasPrefix(v, name+"=")
+	})
+	return append(env, name+"="+value)
+}
+
+// archFeatureDefaults are the feature levels the toolchain assumes when the
+// variable isn't set, as in cmd/internal/buildcfg.
+var archFeatureDefaults = map[string]string{
+	"GO386":     "sse2",
+	"GOAMD64":   "v1",
+	"GOARM":     "7",
+	"GOARM64":   "v8.0",
+	"GOMIPS":    "hardfloat",
+	"GOMIPS64":  "hardfloat",
+	"GOPPC64":   "power8",
+	"GORISCV64": "rva20u64",
+}
+
+// archFeature returns the feature level set by the variable name, or the
+// toolchain's default.
+func (sdk *GoSDK) archFeature(name string) string {
+	if value, ok := sdk.ArchFeatures[name]; ok {
+		return value
+	}
+	return archFeatureDefaults[name]
+}
+
+// AsmDefines returns the macros "go build" defines for the assembler from the
+// micro-architecture feature levels of the target, so assembly gated on them
+// (like GOAMD64_v3) is selected the same way.
+func (sdk *GoSDK) AsmDefines() []string {
+	switch Context.GOARCH {
+	case "386":
+		return []string{"GO386_" + sdk.archFeature("GO386")}
+	case "amd64":
+		return []string{"GOAMD64_" + sdk.archFeature("GOAMD64")}
+	case "mips", "mipsle":
+		return []string{"GOMIPS_" + sdk.archFeature("GOMIPS")}
+	case "mips64", "mips64le":
+		return []string{"GOMIPS64_" + sdk.archFeature("GOMIPS64")}
+	case "riscv64":
+		return []string{"GORISCV64_" + sdk.archFeature("GORISCV64")}
+	case "ppc64", "ppc64le":
+		// Each level implies the ones before it.
+		var defines []string
+		switch sdk.archFeature("GOPPC64") {
+		case "power10":
+			defines = append(defines, "GOPPC64_power10")
+			fallthrough
+		case "power9":
+			defines = append(defines, "GOPPC64_power9")
+			fallthrough
+		default:
+			defines = append(defines, "GOPPC64_power8")
+		}
+		return defines
+	case "arm":
+		var defines []string
+		switch goarm := sdk.archFeature("GOARM"); {
+		case strings.Contains(goarm, "7"):
+			defines = append(defines, "GOARM_7")
+			fallthrough
+		case strings.Contains(goarm, "6"):
+			defines = append(defines, "GOARM_6")
+			fallthrough
+		default:
+			defines = append(defines, "GOARM_5")
+		}
+		return defines
+	case "arm64":
+		if arm64HasLSE(sdk.archFeature("GOARM64")) {
+			return []string{"GOARM64_LSE"}
+		}
+	}
+
+	return nil
+}
+
+// arm64HasLSE reports whether a GOARM64 level, like "v8.1" or "v8.0,lse",
+// includes the large system extensions. They're part of every version since
+// v8.1.
+func arm64HasLSE(goarm64 string) bool {
+	version, options, _ := strings.Cut(goarm64, ",")
+	if slices.Contains(strings.Split(options, ","), "lse") {
+		return true
+	}
+
+	major, minor, ok := strings.Cut(strings.TrimPrefix(version, "v"), ".")
+	if !ok {
+		return false
+	}
+	switch major {
+	case "8":
+		n, err := strconv.Atoi(minor)
+		return err == nil && n >= 1
+	case "9":
+		return true
+	}
+	return false
+}
+
+// PackageEnv returns the environment for a tool acting on a specific package.
+func (sdk *GoSDK) PackageEnv(importPath string) []string {
+	env := sdk.Env()
+	if len(sdk.Toolexec) > 0 {
+		env = append(env, "TOOLEXEC_IMPORTPATH="+importPath)
+	}
+
+	return env
+}
+
+// RunTool creates a new exec.Cmd for calling a given tool in the Go SDK. If a
+// toolexec wrapper is set, the command calls the wrapper instead.
 func (sdk *GoSDK) RunTool(tool string, args ...string) *exec.Cmd {
-	toolBin := filepath.Join(sdk.Path, "pkg", "tool", HostPlatform, tool)
+	return sdk.RunNativeTool(filepath.Join(sdk.Path, "pkg", "tool", HostPlatform, tool), args...)
+}
 
+// RunNativeTool is like [GoSDK.RunTool], but calls the tool at toolBin, like
+// one of another toolchain found by [FindNativeTool].
+func (sdk *GoSDK) RunNativeTool(toolBin string, args ...string) *exec.Cmd {
+	if len(sdk.Toolexec) > 0 {
+		wrapperArgs := append(slices.Clone(sdk.Toolexec[1:]), toolBin)
+		return exec.Command(sdk.Toolexec[0], append(wrapperArgs, args...)...)
+	}
 	return exec.Command(toolBin, args...)
 }
 
@@ -73,11 +375,14 @@ func (sdk *GoSDK) RunGo(args ...string) *exec.Cmd {
 // compilerVersion parses the Go compiler version from the output of "go
 // version".
 func (sdk *GoSDK) compilerVersion() (string, error) {
-	infoBytes, err := sdk.RunGo("version").CombinedOutput()
-	if err != nil {
+	var out bytes.Buffer
+	cmd := sdk.RunGo("version")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := RunCommand(cmd); err != nil {
 		return "", err
 	}
-	info := string(infoBytes)
+	info := out.String()
 
 	// Something like "go version go1.23.5 linux/amd64"
 	fields := strings.Fields(info)
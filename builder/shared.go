@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+)
+
+type ShlibAttrs struct {
+	// Name of the library, written to "lib/lib<name>.so" of the out output.
+	LibName string `nix:"required"`
+
+	// Packages linked into the library, keyed by import path like the deps of
+	// "link". A meta package like "std" links in every package it holds.
+	Packages map[string]string `nix:"required"`
+
+	// Export outputs of Packages, keyed the same way. Their metadata lists
+	// the deps linked in along with each package.
+	Exports map[string]string `nix:"required"`
+
+	// Outputs of other "shlib" derivations which the library links against.
+	// Their packages are left out of it.
+	Shlibs []string
+
+	LinkFlags []string
+}
+
+// sharedLibraryPath returns the path to the metadata of the shared library in
+// the output dir.
+func sharedLibraryPath(dir string) string {
+	return filepath.Join(dir, "shlib.json")
+}
+
+// LoadSharedLibrary reads the metadata of a shared library built by "shlib".
+func LoadSharedLibrary(dir string) (SharedLibrary, error) {
+	var lib SharedLibrary
+	data, err := os.ReadFile(sharedLibraryPath(dir))
+	if err != nil {
+		return lib, fmt.Errorf("%s isn't a shared library: %w", dir, err)
+	}
+	if err := json.Unmarshal(data, &lib); err != nil {
+		return lib, fmt.Errorf("failed to parse %s: %w", sharedLibraryPath(dir), err)
+	}
+
+	return lib.Migrate()
+}
+
+// sharedLibraryPackages maps the import path of every package in the shared
+// libraries dirs to the library holding it.
+func sharedLibraryPackages(dirs []string) (map[string]string, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+
+	shlibs := make(map[string]string)
+	for _, dir := range dirs {
+		lib, err := LoadSharedLibrary(dir)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, "lib", lib.Library)
+		for _, importPath := range lib.Packages {
+			if existing, ok := shlibs[importPath]; ok && existing != path {
+				return nil, fmt.Errorf("package %s is in both %s and %s", importPath, existing, path)
+			}
+			shlibs[importPath] = path
+		}
+	}
+
+	return shlibs, nil
+}
+
+// shlib links packages compiled with "-dynlink" into a shared library, as with
+// "go install -buildmode=shared". Building the standard library this way gives
+// a libstd.so, which plugins and binaries linked with "-linkshared" share.
+func shlib(sdk *GoSDK) {
+	attrs := derivation.GetAttrs[ShlibAttrs]()
+	if !sdk.DynLink {
+		Fatal(&AttrError{"dynLink", errors.New("shared libraries need every package compiled with dynLink")})
+	}
+
+	outDir := derivation.MustOutput("out")
+	libDir := filepath.Join(outDir, "lib")
+	if err := os.Mkdir(libDir, 0755); err != nil {
+		Fatalf("failed to create lib directory: %v", err)
+	}
+
+	shared, err := sharedLibraryPackages(attrs.Shlibs)
+	if err != nil {
+		Fatal(&AttrError{"shlibs", err})
+	}
+	pkgs := maps.Clone(attrs.Packages)
+	if err := ResolveMetaPackages(pkgs, nil, false); err != nil {
+		Fatal(err)
+	}
+	exports, err := resolveExports(attrs.Exports)
+	if err != nil {
+		Fatal(err)
+	}
+
+	// Every package is linked into the library, along with its deps which
+	// aren't already in another library.
+	linked := make(map[string]string)
+	for _, importPath := range SortedKeys(pkgs) {
+		if _, ok := shared[importPath]; ok {
+			continue
+		}
+		if exports[importPath] == "" {
+			Fatal(NewImportError(importPath, importPath, exports))
+		}
+		pkg, err := LoadMetadata[Package](exports[importPath], importPath)
+		if err != nil {
+			Fatal(err)
+		}
+		if err := CheckCompatible(&pkg, sdk); err != nil {
+			Fatal(err)
+		}
+		linked[importPath] = pkgs[importPath]
+		for _, dep := range pkg.Deps {
+			if storePath := pkgs[dep]; storePath != "" {
+				linked[dep] = storePath
+			} else if _, ok := shared[dep]; !ok {
+				Fatal(NewImportError(dep, importPath, pkgs))
+			}
+		}
+	}
+	for importPath := range shared {
+		delete(linked, importPath)
+	}
+	if len(linked) == 0 {
+		Fatal(&AttrError{"packages", errors.New("every package is already in one of shlibs")})
+	}
+	members := SortedKeys(linked)
+
+	cfgPath := filepath.Join(derivation.BuildDir(), "importcfg.link")
+	err = WriteGenerated(cfgPath, func(w io.Writer) error {
+		for _, importPath := range SortedKeys(pkgs) {
+			fmt.Fprintf(w, "packagefile %s=%s/%s.a\n", importPath, pkgs[importPath], filepath.Base(importPath))
+		}
+		for _, importPath := range SortedKeys(shared) {
+			fmt.Fprintf(w, "packageshlib %s=%s\n", importPath, shared[importPath])
+		}
+		return nil
+	})
+	if err != nil {
+		Fatalf("failed to generate linker importcfg: %v", err)
+	}
+	// Archives are named by their import path, or they're taken to be
+	// "main".
+	archives := make([]string, 0, len(members))
+	args := make([]string, 0, len(members))
+	for _, importPath := range members {
+		archive := fmt.Sprintf("%s/%s.a", linked[importPath], filepath.Base(importPath))
+		archives = append(archives, archive)
+		args = append(args, importPath+"="+archive)
+	}
+
+	library := "lib" + attrs.LibName + ".so"
+	out := filepath.Join(libDir, library)
+	cmd := sdk.RunTool("link", attrs.LinkFlags...)
+	// Make sure GOROOT is unset.
+	cmd.Env = append(sdk.Env(), "GOROOT=")
+	cmd.Args = append(cmd.Args, ProfileFlags("link", library)...)
+	cmd.Args = append(
+		cmd.Args,
+		"-o", out,
+		"-importcfg", cfgPath,
+		"-buildmode", "shared",
+		"-linkshared",
+		"-w",
+	)
+	cmd.Args = append(cmd.Args, args...)
+
+	if err := RecordAction(cmd, append([]string{cfgPath}, archives...), []string{out}); err != nil {
+		Fatal(err)
+	}
+	SetPhase("link")
+	if err := RunLogged(cmd); err != nil {
+		Fatalf("failed to link shared library: %v", err)
+	}
+
+	err = WriteGenerated(sharedLibraryPath(outDir), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(SharedLibrary{
+			SchemaVersion: SchemaVersion,
+			Library:       library,
+			Packages:      members,
+		})
+	})
+	if err != nil {
+		Fatalf("failed to write shared library metadata: %v", err)
+	}
+}
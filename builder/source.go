@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// Every SourceTree created during this build. These are rewritten in the
+	// "-trimpath" of the package like any other source directory.
+	sourceTrees []*SourceTree
+)
+
+// A MaterializeMode selects how a source file is placed in the build directory.
+type MaterializeMode int
+
+const (
+	// Symlink the file from the store. This is enough for any tool that only
+	// reads its inputs.
+	MaterializeSymlink MaterializeMode = iota
+
+	// Copy the file and make it writable, for tools which modify their inputs
+	// in place or refuse to follow symlinks (such as cgo).
+	MaterializeCopy
+)
+
+// Materialize places the file src at dst, creating any missing parent
+// directories. Sources in the Nix store are read-only, so anything expecting to
+// write to a file must be given a copy with MaterializeCopy.
+func Materialize(src, dst string, mode MaterializeMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	switch mode {
+	case MaterializeSymlink:
+		return os.Symlink(src, dst)
+	case MaterializeCopy:
+		return copyFile(src, dst)
+	default:
+		panic(fmt.Sprintf("unknown materialize mode %d", mode))
+	}
+}
+
+// copyFile copies the contents of src to a new, writable file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// A SourceTree is a directory inside BuildDir holding sources of a package
+// which had to be moved out of the store, for example after being patched or
+// generated.
+type SourceTree struct {
+	Root       string
+	ImportPath string
+}
+
+// NewSourceTree creates an empty directory name inside BuildDir for the sources
+// of the package importPath.
+func NewSourceTree(name, importPath string) (*SourceTree, error) {
+	root := filepath.Join(derivation.BuildDir(), name)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create source tree: %w", err)
+	}
+
+	tree := &SourceTree{Root: root, ImportPath: importPath}
+	sourceTrees = append(sourceTrees, tree)
+	return tree, nil
+}
+
+// Add materializes src into the tree at the relative path name and returns the
+// new path of the file.
+func (t *SourceTree) Add(src, name string, mode MaterializeMode) (string, error) {
+	dst := filepath.Join(t.Root, name)
+	if err := Materialize(src, dst, mode); err != nil {
+		return "", fmt.Errorf("failed to add %s to source tree: %w", src, err)
+	}
+
+	return dst, nil
+}
+
+// TrimPath returns the "-trimpath" rewrite for the tree, so files in it appear
+// under the package's import path like the rest of its sources.
+func (t *SourceTree) TrimPath() string {
+	return fmt.Sprintf("%s=>%s", t.Root, t.ImportPath)
+}
+
+// ApplyOverlay substitutes sources of the package importPath, like "go build
+// -overlay". Each source which is a key of overlay is replaced by the file it
+// maps to, or removed if it maps to an empty string. Replacements keep the name
+// of the file they replace, so build constraints in file names still apply.
+func ApplyOverlay(srcs []string, overlay map[string]string, importPath string) ([]string, error) {
+	if len(overlay) == 0 {
+		return srcs, nil
+	}
+
+	var tree *SourceTree
+	used := make(map[string]struct{}, len(overlay))
+	overlaid := make([]string, 0, len(srcs))
+	for _, src := range srcs {
+		replacement, ok := overlay[src]
+		if !ok {
+			overlaid = append(overlaid, src)
+			continue
+		}
+		used[src] = struct{}{}
+		if replacement == "" {
+			continue
+		}
+
+		if tree == nil {
+			var err error
+			if tree, err = NewSourceTree("overlay", importPath); err != nil {
+				return nil, err
+			}
+		}
+		dst, err := tree.Add(replacement, filepath.Base(src), MaterializeSymlink)
+		if err != nil {
+			return nil, err
+		}
+		overlaid = append(overlaid, dst)
+	}
+
+	for _, src := range SortedKeys(overlay) {
+		if _, ok := used[src]; !ok {
+			log.Printf("warning: overlay of %s does not match any source", src)
+		}
+	}
+
+	return overlaid, nil
+}
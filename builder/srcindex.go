@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Every source file looked at during this invocation of the builder, keyed
+	// by path. Sources are read from the store, so they never change during a
+	// build and anything learned about them can be reused by later steps.
+	sourceIndex = make(map[string]*SourceFile)
+
+	// File set for every header parsed into the index.
+	sourceFileSet = token.NewFileSet()
+)
+
+// A SourceFile memoizes everything the builder learns about a source file.
+// Each property is computed the first time it's requested.
+type SourceFile struct {
+	Path string
+
+	matched *bool
+	header  *ast.File
+	imports []string
+	hash    []byte
+
+	linkDirectives []string
+}
+
+// IndexSource returns the index entry for the source file at path.
+func IndexSource(path string) *SourceFile {
+	file, ok := sourceIndex[path]
+	if !ok {
+		file = &SourceFile{Path: path}
+		sourceIndex[path] = file
+	}
+
+	return file
+}
+
+// Match reports whether the file is selected for the build by Context.
+func (f *SourceFile) Match() (bool, error) {
+	if f.matched == nil {
+		match, err := Context.MatchFile(filepath.Dir(f.Path), filepath.Base(f.Path))
+		if err != nil {
+			return false, err
+		}
+		f.matched = &match
+	}
+
+	return *f.matched, nil
+}
+
+// Header parses a .go file up to the end of its imports.
+func (f *SourceFile) Header() (*ast.File, error) {
+	if f.header == nil {
+		file, err := os.Open(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		header, err := parser.ParseFile(
+			sourceFileSet,
+			f.Path,
+			file,
+			parser.ImportsOnly|parser.ParseComments,
+		)
+		if err != nil {
+			return nil, err
+		}
+		f.header = header
+	}
+
+	return f.header, nil
+}
+
+// Imports returns the package paths imported by a .go file.
+func (f *SourceFile) Imports() ([]string, error) {
+	if f.imports == nil {
+		header, err := f.Header()
+		if err != nil {
+			return nil, err
+		}
+
+		imports := make([]string, 0, len(header.Imports))
+		for _, pkg := range header.Imports {
+			unquoted, err := strconv.Unquote(pkg.Path.Value)
+			if err != nil {
+				err = fmt.Errorf("parse input at %s: %v", sourceFileSet.Position(pkg.Pos()), err)
+				return nil, err
+			}
+
+			imports = append(imports, unquoted)
+		}
+		f.imports = imports
+	}
+
+	return f.imports, nil
+}
+
+// ImportComment returns the path given by an import comment on the package
+// clause, like `package yaml // import "gopkg.in/yaml.v3"`, or "" if there
+// isn't one. The go command only checks these outside of module mode.
+func (f *SourceFile) ImportComment() (string, error) {
+	header, err := f.Header()
+	if err != nil {
+		return "", err
+	}
+
+	line := sourceFileSet.Position(header.Name.Pos()).Line
+	for _, group := range header.Comments {
+		comment := group.List[0]
+		if comment.Pos() < header.Name.End() {
+			continue
+		}
+		if sourceFileSet.Position(comment.Pos()).Line != line {
+			break
+		}
+
+		text := strings.TrimPrefix(strings.TrimSuffix(comment.Text, "*/"), "//")
+		text = strings.TrimSpace(strings.TrimPrefix(text, "/*"))
+		if quoted, ok := strings.CutPrefix(text, "import"); ok {
+			importPath, err := strconv.Unquote(strings.TrimSpace(quoted))
+			if err != nil {
+				return "", fmt.Errorf("invalid import comment at %s", sourceFileSet.Position(comment.Pos()))
+			}
+			return importPath, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Hash returns the SHA-256 of the file's contents.
+func (f *SourceFile) Hash() ([]byte, error) {
+	if f.hash == nil {
+		file, err := os.Open(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return nil, err
+		}
+		f.hash = hash.Sum(nil)
+	}
+
+	return f.hash, nil
+}
+
+// GodebugDirectives returns the settings of the "//go:debug" directives of a
+// .go file, like "http2client=0". The go command only reads those before the
+// package clause.
+func (f *SourceFile) GodebugDirectives() ([]string, error) {
+	header, err := f.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []string
+	for _, group := range header.Comments {
+		if group.Pos() > header.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if setting, ok := strings.CutPrefix(comment.Text, "//go:debug "); ok {
+				settings = append(settings, strings.TrimSpace(setting))
+			}
+		}
+	}
+
+	return settings, nil
+}
+
+// LinkDirectives returns the "//go:linkname" and "//go:cgo_import_dynamic"
+// directives of a .go file, which reach into the symbols of other packages or
+// libraries. Like the compiler, only comments starting a line are directives.
+func (f *SourceFile) LinkDirectives() ([]string, error) {
+	if f.linkDirectives == nil {
+		// Generated sources, like the zip of time/tzdata, can have lines
+		// too long to scan one at a time.
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		directives := []string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "//go:linkname ") || strings.HasPrefix(line, "//go:cgo_import_dynamic ") {
+				directives = append(directives, strings.Join(strings.Fields(line[2:]), " "))
+			}
+		}
+		f.linkDirectives = directives
+	}
+
+	return f.linkDirectives, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"strings"
+)
+
+// StaticError records why a binary which should be statically linked isn't.
+type StaticError struct {
+	Binary string
+	Reason string
+}
+
+func (e StaticError) Error() string {
+	return fmt.Sprintf("%s is not statically linked: %s", e.Binary, e.Reason)
+}
+
+// staticLinkFlags adds "-static" to the external linker's flags if args
+// selects external linking. The internal linker never produces dynamic
+// binaries unless asked to by cgo, which isn't supported.
+func staticLinkFlags(args []string) []string {
+	return addExternalLinkFlag(args, "-static")
+}
+
+// CheckStatic fails if binary has a dynamic interpreter or needs any shared
+// libraries. Only ELF binaries can be checked.
+func CheckStatic(binary string) error {
+	file, err := elf.Open(binary)
+	if err != nil {
+		return &StaticError{binary, fmt.Sprintf("can only check ELF binaries: %v", err)}
+	}
+	defer file.Close()
+
+	for _, prog := range file.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return &StaticError{binary, "it has a dynamic interpreter"}
+		}
+	}
+
+	libs, err := file.ImportedLibraries()
+	if err != nil {
+		return fmt.Errorf("failed to read dynamic section of %s: %w", binary, err)
+	}
+	if len(libs) > 0 {
+		return &StaticError{binary, fmt.Sprintf("it needs %s", strings.Join(libs, ", "))}
+	}
+
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"nix/derivation"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Bumped whenever the builder changes how it compiles the standard library,
+// so packages from older builds aren't reused. The builder version is left out
+// of standard library actions, since most changes to the builder don't affect
+// them.
+const stdActionVersion = 2
+
+type BuildStdlibAttrs struct {
+	CompileFlags []string
+	AsmFlags     []string
+
+	// Outputs of an earlier "stdlib build". Packages whose actions haven't
+	// changed are copied from it instead of being compiled again.
+	Previous *PackageOutputs
+
+	// Also write the meta package as a pack, including the metadata of every
+	// package in the standard library.
+	PackMetadata bool
+
+	// Write each package to its own pair of outputs, named by
+	// [stdOutputName], instead of to the lib and export outputs. Derivations
+	// can then depend on only the packages they import.
+	SplitOutputs bool
+}
+
+// A StdlibAction records how a package in a standard library build was
+// compiled, so a later build can tell whether it can be reused.
+type StdlibAction struct {
+	// Hash of everything the package was compiled from. See
+	// [Compilation.StdActionID].
+	Action string
+
+	// Hash of the export data, which identifies the package to its
+	// dependents.
+	Export string
+
+	// Outputs the package was written to, if they were split. See
+	// [BuildStdlibAttrs.SplitOutputs].
+	Outputs *PackageOutputs `json:",omitempty"`
+}
+
+// stdOutputName returns the name of the output of kind, either "lib" or
+// "export", holding only the package importPath when a standard library build
+// splits its outputs. No import path in the standard library has a "-".
+func stdOutputName(kind, importPath string) string {
+	return kind + "-" + strings.ReplaceAll(importPath, "/", "-")
+}
+
+// stdActionsPath returns the path to the actions of a standard library build.
+func stdActionsPath(dir string) string {
+	return filepath.Join(dir, "std.actions.json")
+}
+
+// LoadStdlibActions reads the actions of an earlier standard library build.
+func LoadStdlibActions(dir string) (map[string]StdlibAction, error) {
+	data, err := os.ReadFile(stdActionsPath(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var actions map[string]StdlibAction
+	if err := json.Unmarshal(data, &actions); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", stdActionsPath(dir), err)
+	}
+	return actions, nil
+}
+
+// SaveStdlibActions writes the actions of a standard library build.
+func SaveStdlibActions(dir string, actions map[string]StdlibAction) error {
+	return WriteGenerated(stdActionsPath(dir), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(actions)
+	})
+}
+
+// StdActionID is like [Compilation.ActionID], but identifies imports by the
+// hashes of their export data, given in exports. Every package of a standard
+// library build lives in the same output, so its store path says nothing about
+// the package.
+func (c *Compilation) StdActionID(extraArgs []string, exports map[string]string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "std %d\n", stdActionVersion)
+	if err := c.hashAction(h, extraArgs, exports); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stdlibCompilation prepares the compilation of a package from the SDK, with
+// its imports in the already compiled packages.
+func stdlibCompilation(
+	sdk *GoSDK,
+	pkg StdlibPackage,
+	packages map[string]PackageOutputs,
+	asmFlags []string,
+) *Compilation {
+	srcDir := filepath.Join(sdk.Path, "src", filepath.FromSlash(pkg.ImportPath))
+
+	var srcs []string
+	for _, files := range [][]string{pkg.GoFiles, pkg.HFiles, pkg.SFiles} {
+		for _, file := range files {
+			srcs = append(srcs, filepath.Join(srcDir, file))
+		}
+	}
+
+	imports := make(map[string]string, len(pkg.Imports))
+	for _, dep := range pkg.Imports {
+		imports[dep] = packages[dep].Export
+	}
+
+	var embedCfg *EmbedCfg
+	if len(pkg.EmbedPatterns) > 0 {
+		embedCfg = &EmbedCfg{
+			Patterns: make(map[string][]string, len(pkg.EmbedPatterns)),
+			Files:    make(map[string]string, len(pkg.EmbedFiles)),
+		}
+		for _, pattern := range pkg.EmbedPatterns {
+			embedCfg.Patterns[pattern] = matchEmbedPattern(pattern, pkg.EmbedFiles)
+		}
+		for _, file := range pkg.EmbedFiles {
+			embedCfg.Files[file] = filepath.Join(srcDir, file)
+		}
+	}
+
+	return &Compilation{
+		SDK:        sdk,
+		ImportPath: pkg.ImportPath,
+		Srcs:       srcs,
+		Imports:    imports,
+		ImportMap:  pkg.ImportMap,
+		EmbedCfg:   embedCfg,
+		AsmFlags:   asmFlags,
+		Std:        true,
+	}
+}
+
+// matchEmbedPattern returns the files matched by a go:embed pattern, following
+// the rules of the go command. A pattern matching a directory matches every
+// file in it, except for those with a "." or "_" prefix (or in a directory
+// with one), unless the pattern has the "all:" prefix. A file matched by the
+// pattern itself is never left out.
+func matchEmbedPattern(pattern string, files []string) []string {
+	pattern, all := strings.CutPrefix(pattern, "all:")
+
+	var matched []string
+	for _, file := range files {
+		for dir := file; dir != "."; dir = path.Dir(dir) {
+			if ok, _ := path.Match(pattern, dir); !ok {
+				continue
+			}
+			if dir == file || all || !embedHidden(strings.TrimPrefix(file, dir+"/")) {
+				matched = append(matched, file)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// embedHidden reports whether a file is left out when embedding a directory,
+// by a "." or "_" prefix on any element of its path within the directory.
+func embedHidden(rel string) bool {
+	for _, elem := range strings.Split(rel, "/") {
+		if strings.HasPrefix(elem, ".") || strings.HasPrefix(elem, "_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stdlibFiles lists the outputs of the package importPath in a standard
+// library build, keyed by their names in [cacheFiles].
+func stdlibFiles(outputs PackageOutputs, importPath string) map[string]string {
+	name := filepath.Base(importPath)
+	dir := filepath.FromSlash(importPath)
+	return map[string]string{
+		"lib.a":         filepath.Join(outputs.Lib, dir, name+".a"),
+		"export.x":      filepath.Join(outputs.Export, dir, name+".x"),
+		"metadata.json": filepath.Join(outputs.Export, dir, name+".json"),
+	}
+}
+
+// reuseStdlibPackage copies the outputs of a package from an earlier standard
+// library build.
+func reuseStdlibPackage(previous, outputs PackageOutputs, importPath string) error {
+	src := stdlibFiles(previous, importPath)
+	dst := stdlibFiles(outputs, importPath)
+	for _, name := range SortedKeys(dst) {
+		if err := os.MkdirAll(filepath.Dir(dst[name]), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(src[name], dst[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compileStdlibPackage compiles a package in a standard library build and
+// writes its metadata.
+func compileStdlibPackage(compilation *Compilation, outputs PackageOutputs, flags []string) error {
+	files := stdlibFiles(outputs, compilation.ImportPath)
+	for _, name := range SortedKeys(files) {
+		if err := os.MkdirAll(filepath.Dir(files[name]), 0755); err != nil {
+			return err
+		}
+	}
+
+	MapDiagnosticPaths(compilation.ImportPath, compilation.Srcs)
+	if err := compilation.CompilePackage(files["lib.a"], files["export.x"], flags); err != nil {
+		return err
+	}
+
+	pkg, err := compilation.Metadata()
+	if err != nil {
+		return err
+	}
+	return SaveMetadata(filepath.Dir(files["metadata.json"]), pkg)
+}
+
+// buildStdlib compiles the whole standard library in a single derivation,
+// instead of a derivation for every package. Each package is written to
+// "<import path>/" in the lib and export outputs, along with the std meta
+// package and manifest. With split outputs, each package is written to the
+// same path in its own outputs instead, and the meta package refers to them.
+//
+// Changing the builder changes the derivation, which would otherwise compile
+// everything again. Given the outputs of an earlier build as "previous", any
+// package compiled from the same sources, flags, and imports is copied from it
+// instead.
+func buildStdlib(sdk *GoSDK) {
+	attrs := derivation.GetAttrs[BuildStdlibAttrs]()
+
+	outputs := PackageOutputs{
+		Lib:    derivation.MustOutput("lib"),
+		Export: derivation.MustOutput("export"),
+	}
+
+	var previous map[string]StdlibAction
+	if attrs.Previous != nil {
+		var err error
+		previous, err = LoadStdlibActions(attrs.Previous.Lib)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("warning: %s is not a std build, compiling every package", attrs.Previous.Lib)
+		} else if err != nil {
+			Fatalf("failed to read previous std build: %v", err)
+		}
+	}
+
+	plan, err := PlanStdlib(discoverStdlib(sdk))
+	if err != nil {
+		Fatalf("failed to plan stdlib build: %v", err)
+	}
+
+	actions := make(map[string]StdlibAction, len(plan.Packages))
+	exports := make(map[string]string, len(plan.Packages))
+	packages := make(map[string]PackageOutputs, len(plan.Packages))
+	importMap := make(map[string]string)
+	reused := 0
+	for i, pkg := range plan.Packages {
+		SetPhaseProgress("stdlib", i+1, len(plan.Packages))
+
+		compilation := stdlibCompilation(sdk, pkg, packages, attrs.AsmFlags)
+		depExports := make(map[string]string, len(pkg.Imports))
+		for _, dep := range pkg.Imports {
+			depExports[dep] = exports[dep]
+		}
+		actionID, err := compilation.StdActionID(attrs.CompileFlags, depExports)
+		if err != nil {
+			Fatalf("failed to hash compile action of %s: %v", pkg.ImportPath, err)
+		}
+
+		compilation.ActionHash = actionID
+
+		pkgOutputs := outputs
+		if attrs.SplitOutputs {
+			pkgOutputs = PackageOutputs{
+				Lib:    derivation.MustOutput(stdOutputName("lib", pkg.ImportPath)),
+				Export: derivation.MustOutput(stdOutputName("export", pkg.ImportPath)),
+			}
+		}
+
+		if action, ok := previous[pkg.ImportPath]; ok && action.Action == actionID {
+			prev := *attrs.Previous
+			if action.Outputs != nil {
+				prev = *action.Outputs
+			}
+			err = reuseStdlibPackage(prev, pkgOutputs, pkg.ImportPath)
+			if err != nil {
+				Fatalf("failed to reuse %s from previous std build: %v", pkg.ImportPath, err)
+			}
+			reused++
+		} else if err := compileStdlibPackage(compilation, pkgOutputs, attrs.CompileFlags); err != nil {
+			Fatalf("failed to compile %s: %v", pkg.ImportPath, err)
+		}
+
+		files := stdlibFiles(pkgOutputs, pkg.ImportPath)
+		sum, err := IndexSource(files["export.x"]).Hash()
+		if err != nil {
+			Fatalf("failed to hash export data of %s: %v", pkg.ImportPath, err)
+		}
+		exports[pkg.ImportPath] = hex.EncodeToString(sum)
+		action := StdlibAction{Action: actionID, Export: exports[pkg.ImportPath]}
+		if attrs.SplitOutputs {
+			action.Outputs = &pkgOutputs
+		}
+		actions[pkg.ImportPath] = action
+		packages[pkg.ImportPath] = PackageOutputs{
+			Lib:    filepath.Dir(files["lib.a"]),
+			Export: filepath.Dir(files["export.x"]),
+		}
+		for from, to := range pkg.ImportMap {
+			importMap[from] = to
+		}
+	}
+	if attrs.Previous != nil {
+		log.Printf("reused %d of %d packages from previous std build", reused, len(plan.Packages))
+	}
+
+	if err := SaveStdlibActions(outputs.Lib, actions); err != nil {
+		Fatalf("failed to write stdlib actions: %v", err)
+	}
+	err = WriteMetaPackage(outputs.Lib, outputs.Export, "std", packages, importMap, attrs.PackMetadata)
+	if err != nil {
+		Fatalf("failed to generate stdlib package: %v", err)
+	}
+	if err := SaveStdManifest(outputs.Export, sdk, SortedKeys(packages)); err != nil {
+		Fatalf("failed to generate stdlib manifest: %v", err)
+	}
+}
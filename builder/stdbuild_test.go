@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMatchEmbedPattern(t *testing.T) {
+	files := []string{
+		".top",
+		"a.txt",
+		"static/.hidden",
+		"static/_draft.txt",
+		"static/index.html",
+		"static/_private/key.txt",
+		"static/css/.cache/x.css",
+		"static/css/site.css",
+		"static/img/_thumb.png",
+		"static/img/logo.png",
+	}
+
+	// Expected results follow the go command, as documented in the embed
+	// package.
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"a.txt", []string{"a.txt"}},
+		{"*.txt", []string{"a.txt"}},
+		{".top", []string{".top"}},
+		{"static", []string{
+			"static/index.html",
+			"static/css/site.css",
+			"static/img/logo.png",
+		}},
+		{"all:static", []string{
+			"static/.hidden",
+			"static/_draft.txt",
+			"static/index.html",
+			"static/_private/key.txt",
+			"static/css/.cache/x.css",
+			"static/css/site.css",
+			"static/img/_thumb.png",
+			"static/img/logo.png",
+		}},
+		// A file matched by the pattern itself is kept, even if hidden.
+		{"static/.hidden", []string{"static/.hidden"}},
+		// So is a directory, but the hidden files within it still aren't.
+		{"static/*", []string{
+			"static/.hidden",
+			"static/_draft.txt",
+			"static/index.html",
+			"static/_private/key.txt",
+			"static/css/site.css",
+			"static/img/logo.png",
+		}},
+		{"static/_private", []string{"static/_private/key.txt"}},
+		{"static/css", []string{"static/css/site.css"}},
+		{"all:static/css", []string{"static/css/.cache/x.css", "static/css/site.css"}},
+		{"static/img/*.png", []string{"static/img/_thumb.png", "static/img/logo.png"}},
+		{"missing", nil},
+		{"stat", nil},
+	}
+	for _, test := range tests {
+		if got := matchEmbedPattern(test.pattern, files); !slices.Equal(got, test.want) {
+			t.Errorf("matchEmbedPattern(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestEmbedHidden(t *testing.T) {
+	tests := []struct {
+		rel    string
+		hidden bool
+	}{
+		{"a.txt", false},
+		{"a.b/c.txt", false},
+		{"a_b/c.txt", false},
+		{".a", true},
+		{"_a", true},
+		{"sub/.a", true},
+		{"sub/_a", true},
+		{".sub/a", true},
+		{"_sub/a", true},
+		{"sub/deeper/.a", true},
+	}
+	for _, test := range tests {
+		if got := embedHidden(test.rel); got != test.hidden {
+			t.Errorf("embedHidden(%q) = %t, want %t", test.rel, got, test.hidden)
+		}
+	}
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"nix/derivation"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 )
 
 const (
@@ -16,8 +17,11 @@ const (
 Usage: builder stdlib [subcommand]
 
 Subcommands:
+  build
   list 
-  package`
+  manifest
+  package
+  plan`
 )
 
 type StdlibPackage struct {
@@ -36,24 +40,181 @@ type StdlibPackage struct {
 	EmbedFiles    []string `json:",omitempty"`
 }
 
-type PackageStdlibAttrs struct {
-	Packages map[string]struct {
-		Export string
-		Lib    string
+// A StdManifest lists the packages available in a build of the standard
+// library, and the version of Go they came from.
+type StdManifest struct {
+	GoVersion string
+	Packages  []string
+}
+
+// StdVersionError records when a standard library package is missing because
+// std was built from a different version of Go than the current SDK.
+type StdVersionError struct {
+	ImportPath string
+	StdVersion string
+	SDKVersion string
+}
+
+func (e StdVersionError) Error() string {
+	return fmt.Sprintf(
+		"package %s requires go%s std output, but the provided std was built for go%s\n\n  Build std with the same SDK, or add %s to allowMissingStd to compile against an empty stub of it.",
+		e.ImportPath,
+		e.SDKVersion,
+		e.StdVersion,
+		e.ImportPath,
+	)
+}
+
+// isVendoredStdPath reports whether importPath is a copy of another module's
+// package vendored into the SDK, like "vendor/golang.org/x/net/http2/hpack".
+func isVendoredStdPath(importPath string) bool {
+	return strings.HasPrefix(importPath, "vendor/") || strings.HasPrefix(importPath, "cmd/vendor/")
+}
+
+// manifestPath returns the path to the manifest of a std meta package.
+func manifestPath(dir string) string {
+	return filepath.Join(dir, "std.manifest.json")
+}
+
+// SaveStdManifest writes a manifest of the standard library packages built by
+// sdk to a store path.
+func SaveStdManifest(dir string, sdk *GoSDK, packages []string) error {
+	manifest := StdManifest{GoVersion: sdk.Version, Packages: slices.Sorted(slices.Values(packages))}
+
+	return WriteGenerated(manifestPath(dir), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(&manifest)
+	})
+}
+
+// stdGoVersion returns the version of Go the std output at stdPath was built
+// from, recorded by its manifest, or else by the metadata of its packages. It's
+// empty if neither records it.
+func stdGoVersion(stdPath string) string {
+	if data, err := os.ReadFile(manifestPath(stdPath)); err == nil {
+		var manifest StdManifest
+		if err := json.Unmarshal(data, &manifest); err == nil && manifest.GoVersion != "" {
+			return manifest.GoVersion
+		}
 	}
+
+	meta, err := loadMetaPackage(stdPath, "std")
+	if err != nil {
+		return ""
+	}
+	for _, sub := range meta.SubPackages {
+		pkg, err := LoadMetadata[Package](sub.StorePath, sub.ImportPath)
+		if err == nil && pkg.GoVersion != "" {
+			return pkg.GoVersion
+		}
+	}
+
+	return ""
+}
+
+// CheckStdManifest explains why a standard library package is missing from
+// the std output at stdPath. If the package exists in the SDK but std was built
+// from another version of Go, a [StdVersionError] is returned. Otherwise, or if
+// std doesn't record its version, there is nothing more specific to report and
+// it returns nil.
+func CheckStdManifest(stdPath string, sdk *GoSDK, importPath string) error {
+	if !isStdPath(importPath) {
+		return nil
+	}
+
+	version := stdGoVersion(stdPath)
+	if version == "" || version == sdk.Version {
+		return nil
+	}
+
+	if info, err := os.Stat(filepath.Join(sdk.Path, "src", importPath)); err != nil || !info.IsDir() {
+		return nil
+	}
+	return &StdVersionError{importPath, version, sdk.Version}
+}
+
+// compileStdStub compiles an empty package in place of the standard library
+// package importPath, which is missing from std, returning the directory
+// holding it and its metadata. Only blank imports of it can compile, but this
+// is enough to try experimental builds against an older std.
+func (c *Compilation) compileStdStub(importPath string) (string, error) {
+	dir := filepath.Join(derivation.BuildDir(), "std-stubs", filepath.FromSlash(importPath))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	name := importPathName(importPath)
+	src := filepath.Join(dir, "stub.go")
+	err := WriteGenerated(src, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "package %s\n", name)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	cmd := c.SDK.RunTool(
+		"compile",
+		"-std",
+		"-complete",
+		"-p", importPath,
+		"-lang", c.SDK.CompatVersion,
+		"-trimpath", dir+"=>"+importPath,
+		"-o", filepath.Join(dir, filepath.Base(importPath)+".x"),
+		"-pack",
+		src,
+	)
+	cmd.Env = c.SDK.PackageEnv(importPath)
+	if err := RunLogged(cmd); err != nil {
+		return "", fmt.Errorf("failed to compile stub of %s: %w", importPath, err)
+	}
+
+	pkg := &Package{
+		SchemaVersion: SchemaVersion,
+		ImportPath:    importPath,
+		Imports:       []string{},
+		GOOS:          Context.GOOS,
+		GOARCH:        Context.GOARCH,
+		ArchFeatures:  c.SDK.ArchFeatures,
+		Experiments:   c.SDK.Experiments,
+		GoVersion:     c.SDK.Version,
+	}
+	return dir, SaveMetadata(dir, pkg)
+}
+
+type PackageStdlibAttrs struct {
+	Packages  map[string]PackageOutputs
 	ImportMap map[string]string
+
+	// Also write the meta package as a pack, including the metadata of every
+	// package in the standard library.
+	PackMetadata bool
+}
+
+// A StdlibEdge is an import of one standard library package by another.
+type StdlibEdge struct {
+	From string
+	To   string
+}
+
+// A StdlibPlan is the build plan of the standard library. Packages are in
+// dependency order, so every package comes after all of its imports.
+type StdlibPlan struct {
+	Packages []StdlibPackage
+	Edges    []StdlibEdge
 }
 
-// saveStdlibPackages parses the JSON package list generated by the Go, and
-// writes the metadata for each package to the output directory.
-func saveStdlibPackages(in io.Reader, path string) error {
+// decodeStdlibPackages parses the JSON package list generated by the Go
+// command, dropping test-only and internal packages.
+func decodeStdlibPackages(in io.Reader) ([]StdlibPackage, error) {
 	var pkgs []StdlibPackage
 
 	decoder := json.NewDecoder(in)
 	for decoder.More() {
 		var pkg StdlibPackage
 		if err := decoder.Decode(&pkg); err != nil {
-			return err
+			return nil, err
 		}
 
 		// This should only be test-only packages.
@@ -80,94 +241,183 @@ func saveStdlibPackages(in io.Reader, path string) error {
 		}
 	}
 
-	file, err := os.Create(filepath.Join(path, "spec.json"))
+	return pkgs, nil
+}
+
+// saveStdlibPackages writes the metadata for each package to the output
+// directory.
+func saveStdlibPackages(pkgs []StdlibPackage, path string) error {
+	return WriteGenerated(filepath.Join(path, "spec.json"), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		return encoder.Encode(&pkgs)
+	})
+}
+
+// PlanStdlib orders the standard library packages so each comes after its
+// imports, and lists the imports between them.
+func PlanStdlib(pkgs []StdlibPackage) (*StdlibPlan, error) {
+	byPath := make(map[string]StdlibPackage, len(pkgs))
+	for _, pkg := range pkgs {
+		byPath[pkg.ImportPath] = pkg
+	}
+
+	plan := &StdlibPlan{Packages: make([]StdlibPackage, 0, len(pkgs))}
+	visited := make(map[string]bool)
+	var visit func(importPath string, stack []string) error
+	visit = func(importPath string, stack []string) error {
+		done, seen := visited[importPath]
+		if done {
+			return nil
+		} else if seen {
+			return fmt.Errorf("import cycle: %s", strings.Join(append(stack, importPath), " -> "))
+		}
+		visited[importPath] = false
+
+		pkg := byPath[importPath]
+		for _, dep := range pkg.Imports {
+			if _, ok := byPath[dep]; !ok {
+				return fmt.Errorf("package %s imports unknown package %s", importPath, dep)
+			}
+			if err := visit(dep, append(stack, importPath)); err != nil {
+				return err
+			}
+			plan.Edges = append(plan.Edges, StdlibEdge{importPath, dep})
+		}
+
+		visited[importPath] = true
+		plan.Packages = append(plan.Packages, pkg)
+		return nil
+	}
+
+	for _, importPath := range SortedKeys(byPath) {
+		if err := visit(importPath, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// saveStdlibPlan writes the build plan of the standard library to the output
+// directory.
+func saveStdlibPlan(pkgs []StdlibPackage, path string) error {
+	plan, err := PlanStdlib(pkgs)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(&pkgs)
+	return WriteGenerated(filepath.Join(path, "plan.json"), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		return encoder.Encode(plan)
+	})
 }
 
-// listStdlib creates a JSON file defining every package in the standard
-// library, so Nix can produce a build plan for it.
-func listStdlib(sdk *GoSDK) {
-	out := derivation.Outputs["out"]
-	if out == "" {
-		log.Fatalf("derivation was expected to produce an output \"out\"")
-	}
-	if err := os.Mkdir(out, 0755); err != nil {
-		log.Fatalf("failed to create output directory: %v", err)
-	}
+// discoverStdlib lists every package in the standard library with the Go
+// command.
+func discoverStdlib(sdk *GoSDK) []StdlibPackage {
 
-	cmd := sdk.RunGo("list", "-json", "std")
-	cmd.Stderr = os.Stderr
-	cmd.Env = []string{
-		"CGO_ENABLED=0",
+	args := []string{"list", "-json"}
+	if sdk.Instrument != "" {
+		// "-race" and friends require cgo, but only the build tag matters for
+		// selecting files.
+		args = append(args, "-tags", sdk.Instrument)
+	}
+	cmd := sdk.RunGo(append(args, "std")...)
+	diagnostics := NewDiagnosticWriter(os.Stderr)
+	cmd.Stderr = diagnostics
+	cmd.Env = append(
+		sdk.Env(),
 		fmt.Sprintf("GOCACHE=%s/go-cache", os.TempDir()),
 		fmt.Sprintf("GOROOT=%s", sdk.Path),
+	)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	fmt.Fprintln(os.Stderr, cmd)
+	if err := RunCommand(cmd); err != nil {
+		Fatal(err)
 	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+	if err := diagnostics.Close(); err != nil {
+		Fatal(err)
 	}
 
-	fmt.Fprintln(os.Stderr, cmd)
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	pkgs, err := decodeStdlibPackages(&stdout)
+	if err != nil {
+		Fatalf("failed to read stdlib package list: %v", err)
 	}
-	if err := saveStdlibPackages(stdout, out); err != nil {
-		log.Fatalf("failed to generate stdlib package list: %v", err)
+
+	return pkgs
+}
+
+// listStdlib creates a JSON file defining every package in the standard
+// library, so Nix can produce a build plan for it.
+func listStdlib(sdk *GoSDK) {
+	out := derivation.MustOutput("out")
+
+	if err := saveStdlibPackages(discoverStdlib(sdk), out); err != nil {
+		Fatalf("failed to generate stdlib package list: %v", err)
 	}
+}
+
+// planStdlib creates a JSON file with every package in the standard library
+// in dependency order, along with the imports between them. Nix can use this
+// to build each package as its own derivation, so changing the flags of one
+// package only rebuilds it and its dependents.
+func planStdlib(sdk *GoSDK) {
+	out := derivation.MustOutput("out")
 
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	if err := saveStdlibPlan(discoverStdlib(sdk), out); err != nil {
+		Fatalf("failed to generate stdlib build plan: %v", err)
 	}
 }
 
 // packageStdlib creates meta-package output which depends on every package
 // in the standard library. Putting this as deps during compile will load the
 // entire standard library into the workspace.
-func packageStdlib() {
+func packageStdlib(sdk *GoSDK) {
 	attrs := derivation.GetAttrs[PackageStdlibAttrs]()
 
-	libDir, err := OutputPath("lib")
+	err := SaveMetaPackage("std", attrs.Packages, attrs.ImportMap, attrs.PackMetadata)
 	if err != nil {
-		log.Fatal(err)
+		Fatalf("failed to generate stdlib package: %v", err)
 	}
-	exportDir, err := OutputPath("export")
+
+	// Compilations importing std only see the export output.
+	err = SaveStdManifest(derivation.Outputs["export"], sdk, SortedKeys(attrs.Packages))
 	if err != nil {
-		log.Fatal(err)
+		Fatalf("failed to generate stdlib manifest: %v", err)
 	}
+}
 
-	subLibs := make([]Import, 0, len(attrs.Packages))
-	subExports := make([]Import, 0, len(attrs.Packages))
-	for importPath, storePaths := range attrs.Packages {
-		subLibs = append(subLibs, Import{storePaths.Lib, importPath})
-		subExports = append(subExports, Import{storePaths.Export, importPath})
-	}
-	SortImports(subLibs)
-	SortImports(subExports)
+// manifestStdlib creates a JSON file listing every package in the standard
+// library of the SDK, along with its version.
+func manifestStdlib(sdk *GoSDK) {
+	out := derivation.MustOutput("out")
 
-	lib := MetaPackage{"std", subLibs, nil}
-	if err := SaveMetadata(libDir, lib); err != nil {
-		log.Fatalf("failed to generate stdlib package libs: %v", err)
+	pkgs := discoverStdlib(sdk)
+	importPaths := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		importPaths = append(importPaths, pkg.ImportPath)
 	}
-	export := MetaPackage{"std", subExports, attrs.ImportMap}
-	if err := SaveMetadata(exportDir, export); err != nil {
-		log.Fatalf("failed to generate stdlib package exports: %v", err)
+	if err := SaveStdManifest(out, sdk, importPaths); err != nil {
+		Fatalf("failed to generate stdlib manifest: %v", err)
 	}
 }
 
 func stdlib(sdk *GoSDK) {
 	subcommand := os.Args[2]
 	switch subcommand {
+	case "build":
+		buildStdlib(sdk)
 	case "list":
 		listStdlib(sdk)
+	case "manifest":
+		manifestStdlib(sdk)
 	case "package":
-		packageStdlib()
+		packageStdlib(sdk)
+	case "plan":
+		planStdlib(sdk)
 	default:
-		log.Fatalf("unknown subcommand \"%s\"\n%s", subcommand, stdlibUsage)
+		Fatalf("unknown subcommand \"%s\"\n%s", subcommand, stdlibUsage)
 	}
 }
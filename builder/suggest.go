@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	// The most similar packages to list in an ImportError.
+	maxSuggestions = 5
+)
+
+// NewImportError creates an [ImportError] for a missing import, diagnosing
+// likely causes from the packages which were provided instead.
+func NewImportError(importPath, parent string, pkgs map[string]string) *ImportError {
+	err := &ImportError{Import: importPath, Parent: parent}
+
+	if isStdPath(importPath) {
+		if _, ok := pkgs["runtime"]; !ok {
+			err.Hints = append(
+				err.Hints,
+				fmt.Sprintf(
+					"%s looks like a standard library package, but the standard library was not provided. Was noStd set?",
+					importPath,
+				),
+			)
+		}
+	}
+
+	type candidate struct {
+		importPath string
+		distance   int
+	}
+	var candidates []candidate
+	for _, pkg := range SortedKeys(pkgs) {
+		// Vendored copies need an importMap entry to be found.
+		if strings.HasSuffix(pkg, "/vendor/"+importPath) || pkg == "vendor/"+importPath {
+			err.Hints = append(
+				err.Hints,
+				fmt.Sprintf(
+					"A vendored copy was provided as %s. Is importMap.\"%s\" = \"%s\" missing?",
+					pkg,
+					importPath,
+					pkg,
+				),
+			)
+			continue
+		}
+
+		distance := editDistance(importPath, pkg)
+		if distance <= max(2, len(importPath)/8) || path.Base(pkg) == path.Base(importPath) {
+			candidates = append(candidates, candidate{pkg, distance})
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return a.distance - b.distance
+	})
+	for _, c := range candidates[:min(len(candidates), maxSuggestions)] {
+		err.Suggestions = append(err.Suggestions, c.importPath)
+	}
+
+	return err
+}
+
+// isStdPath reports whether an import path looks like it belongs to the
+// standard library. As with the go command, these are the paths without a dot
+// in their first element.
+func isStdPath(importPath string) bool {
+	first, _, _ := strings.Cut(importPath, "/")
+	return !strings.Contains(first, ".")
+}
+
+// editDistance computes the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"nix/derivation"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+type TestAttrs struct {
+	Name string `nix:"required"`
+
+	// Path to the linked test binary.
+	Binary string `nix:"required"`
+
+	// Source directory of the package under test, and globs relative to it of
+	// files the tests read at runtime. Directories are installed recursively.
+	Src      string
+	TestData []string
+
+	// Symlink test data from Src instead of copying it.
+	LinkTestData bool
+
+	TestFlags []string
+}
+
+// InstallTestData places every file matched by the globs under src at the same
+// relative path in dir. Tests expect to run from their package's directory, so
+// dir can then be used as their working directory.
+func InstallTestData(src, dir string, globs []string, mode MaterializeMode) error {
+	for _, glob := range globs {
+		matches, err := filepath.Glob(filepath.Join(src, glob))
+		if err != nil {
+			return err
+		}
+		if matches == nil {
+			return fmt.Errorf("test data %s did not match any files", glob)
+		}
+
+		for _, match := range matches {
+			err := filepath.WalkDir(match, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil || entry.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(src, path)
+				if err != nil {
+					return err
+				}
+				return Materialize(path, filepath.Join(dir, rel), mode)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to install test data %s: %w", match, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// A TestManifest describes how to run a test binary installed by
+// "test-build". Paths are relative to the output, so it can be copied to the
+// machine running the tests.
+type TestManifest struct {
+	Name string
+
+	// The test binary, and the directory to run it from.
+	Binary string
+	Dir    string
+
+	TestFlags []string
+
+	// The platform the binary was built for.
+	GOOS   string
+	GOARCH string
+}
+
+type TestRunAttrs struct {
+	// Output of "test-build" holding the test binary and its manifest. Binaries
+	// built for another platform run under "emulator".
+	Test string `nix:"required"`
+
+	// Flags passed to the test binary after those from the manifest.
+	TestFlags []string
+}
+
+// testManifestPath returns the path to the manifest of a test build.
+func testManifestPath(dir string) string {
+	return filepath.Join(dir, "test.json")
+}
+
+// SaveTestManifest writes the manifest of a test build to its output.
+func SaveTestManifest(dir string, manifest *TestManifest) error {
+	return WriteGenerated(testManifestPath(dir), func(file io.Writer) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(manifest)
+	})
+}
+
+// LoadTestManifest reads the manifest of a test build.
+func LoadTestManifest(dir string) (*TestManifest, error) {
+	data, err := os.ReadFile(testManifestPath(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest TestManifest
+	return &manifest, json.Unmarshal(data, &manifest)
+}
+
+// installTest creates a test runner output holding a test binary, its test
+// data, and a manifest of how to run it.
+func installTest(attrs *TestAttrs) (string, *TestManifest) {
+	outDir := derivation.MustOutput("out")
+
+	// The SDK installing the test may not be the one which built it, so the
+	// binary itself says what it can run on.
+	goos, goarch, err := BinaryPlatform(attrs.Binary)
+	if err != nil {
+		Fatalf("failed to find the platform of the test binary: %v", err)
+	}
+	manifest := &TestManifest{
+		Name:      attrs.Name,
+		Binary:    filepath.Join("bin", attrs.Name),
+		Dir:       filepath.Join("share", attrs.Name),
+		TestFlags: attrs.TestFlags,
+		GOOS:      goos,
+		GOARCH:    goarch,
+	}
+
+	binary := filepath.Join(outDir, manifest.Binary)
+	if err := Materialize(attrs.Binary, binary, MaterializeSymlink); err != nil {
+		Fatalf("failed to install test binary: %v", err)
+	}
+
+	// The working directory always exists, even without any test data.
+	dataDir, err := derivation.EnsureDir(outDir, manifest.Dir)
+	if err != nil {
+		Fatalf("failed to create test data directory: %v", err)
+	}
+	mode := MaterializeCopy
+	if attrs.LinkTestData {
+		mode = MaterializeSymlink
+	}
+	if err := InstallTestData(attrs.Src, dataDir, attrs.TestData, mode); err != nil {
+		Fatal(err)
+	}
+
+	if err := SaveTestManifest(outDir, manifest); err != nil {
+		Fatalf("failed to generate test manifest: %v", err)
+	}
+
+	return outDir, manifest
+}
+
+// runTest runs the test binary installed in dir as described by manifest.
+func runTest(dir string, manifest *TestManifest, extraFlags []string) {
+	binary := filepath.Join(dir, manifest.Binary)
+	args := slices.Concat(manifest.TestFlags, extraFlags)
+	cmd, err := TargetCommand(manifest.GOOS, manifest.GOARCH, binary, args...)
+	if err != nil {
+		Fatal(err)
+	}
+	cmd.Dir = filepath.Join(dir, manifest.Dir)
+	// Tests see the builder's environment, like under "go test", but with the
+	// tools of nativeBuildInputs.
+	cmd.Env = append(os.Environ(), NativeEnv()...)
+	SetPhase("test")
+	if err := RunLogged(cmd); err != nil {
+		Fatalf("tests failed: %v", err)
+	}
+}
+
+// test creates a test runner output holding a test binary and its test data,
+// and runs the tests from it.
+func test() {
+	attrs := derivation.GetAttrs[TestAttrs]()
+
+	dir, manifest := installTest(&attrs)
+	runTest(dir, manifest, nil)
+}
+
+// testBuild creates a test runner output like test, without running the tests.
+// When cross-compiling, they can't run in the build sandbox, so "test-run" or
+// the target machine runs them instead.
+func testBuild() {
+	attrs := derivation.GetAttrs[TestAttrs]()
+
+	installTest(&attrs)
+}
+
+// testRun runs the tests of a "test-build" output, under Emulator if they were
+// built for another platform.
+func testRun() {
+	attrs := derivation.GetAttrs[TestRunAttrs]()
+
+	manifest, err := LoadTestManifest(attrs.Test)
+	if err != nil {
+		Fatalf("failed to read test manifest: %v", err)
+	}
+
+	// Nothing is installed, but the output must exist for the run to succeed.
+	derivation.MustOutput("out")
+	runTest(attrs.Test, manifest, attrs.TestFlags)
+}
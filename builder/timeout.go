@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	// Longest any single tool may run before it's killed. Zero disables the
+	// timeout.
+	ToolTimeout time.Duration
+
+	// How long a tool has to exit after being asked to stop before it's
+	// killed.
+	toolGracePeriod = 5 * time.Second
+)
+
+// ToolTimeoutError records when a tool ran for longer than ToolTimeout.
+type ToolTimeoutError struct {
+	Tool    string
+	Timeout time.Duration
+}
+
+func (e ToolTimeoutError) Error() string {
+	return fmt.Sprintf(
+		"%s did not finish within %s\n\n  It may be stuck, for example waiting on I/O in the sandbox. If it is only slow, raise \"toolTimeout\".",
+		e.Tool,
+		e.Timeout,
+	)
+}
+
+// InterruptedError records when the builder was asked to stop while a tool
+// was running.
+type InterruptedError struct {
+	Tool   string
+	Signal os.Signal
+}
+
+func (e InterruptedError) Error() string {
+	return fmt.Sprintf("%s was stopped: %s", e.Tool, e.Signal)
+}
+
+// RunCommand runs cmd like cmd.Run, but stops it if it runs longer than
+// ToolTimeout or the builder receives SIGINT or SIGTERM.
+func RunCommand(cmd *exec.Cmd) error {
+	// Forwarding starts before the tool does, so a signal in between isn't
+	// lost.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	// Children of the tool may keep its output open after it's killed.
+	if cmd.WaitDelay == 0 {
+		cmd.WaitDelay = toolGracePeriod
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		RecordToolProfile(cmd, time.Since(start))
+		done <- err
+	}()
+
+	var timeout <-chan time.Time
+	if ToolTimeout > 0 {
+		timer := time.NewTimer(ToolTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	tool := filepath.Base(cmd.Path)
+	select {
+	case err := <-done:
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return &ToolError{tool, exitErr}
+		}
+		return err
+	case <-timeout:
+		stopCommand(cmd, done, syscall.SIGTERM)
+		return &ToolTimeoutError{tool, ToolTimeout}
+	case sig := <-signals:
+		stopCommand(cmd, done, sig)
+		return &InterruptedError{tool, sig}
+	}
+}
+
+// stopCommand sends sig to a running cmd, killing it if it doesn't exit within
+// the grace period.
+func stopCommand(cmd *exec.Cmd, done <-chan error, sig os.Signal) {
+	_ = cmd.Process.Signal(sig)
+	select {
+	case <-done:
+	case <-time.After(toolGracePeriod):
+		_ = cmd.Process.Kill()
+		<-done
+	}
+}
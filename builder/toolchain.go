@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Toolchain compiles and links packages for a [GoSDK]. Everything around it,
+// like selecting sources, resolving imports, and writing metadata, is shared,
+// so the same graph of derivations builds with any toolchain. The compile,
+// asm, and link tools of the SDK are the default "gc" toolchain.
+type Toolchain interface {
+	// Name of the toolchain, like "gccgo". It's recorded in the metadata of
+	// every package it compiles, and satisfies build constraints like the
+	// go command's -compiler flag.
+	Name() string
+
+	// Builtin reports whether the toolchain provides the package importPath
+	// itself, like gccgo does with the standard library. Imports of these
+	// aren't resolved from the imports of a package, nor linked from them.
+	Builtin(importPath string) bool
+
+	// Compile compiles the Go sources of c to its export data, and unless it's
+	// only type checked, to its archive along with the objects of its other
+	// sources. The paths of both are set on c.
+	Compile(c *Compilation, args []string) error
+
+	// Assemble assembles srcs of c to the object out, returning its path.
+	Assemble(c *Compilation, srcs []string, out string, args []string) (string, error)
+
+	// Link links the main package of l, and every package it needs from the
+	// deps of l, to the binary out.
+	Link(l *Linkage, out string, args []string) error
+}
+
+// toolchains creates every toolchain which can be selected by name with the
+// "toolchain" attribute.
+var toolchains = map[string]func(sdk *GoSDK) (Toolchain, error){
+	"gc":    func(*GoSDK) (Toolchain, error) { return gcToolchain{}, nil },
+	"gccgo": newGccgoToolchain,
+}
+
+// SelectToolchain sets up the toolchain registered as name for sdk, and
+// selects sources for it with build constraints.
+func SelectToolchain(sdk *GoSDK, name string) error {
+	newToolchain, ok := toolchains[name]
+	if !ok {
+		return fmt.Errorf(
+			"unknown toolchain \"%s\", expected one of %s",
+			name,
+			strings.Join(SortedKeys(toolchains), ", "),
+		)
+	}
+	toolchain, err := newToolchain(sdk)
+	if err != nil {
+		return fmt.Errorf("failed to set up %s toolchain: %w", name, err)
+	}
+
+	sdk.Toolchain = toolchain
+	Context.Compiler = toolchain.Name()
+	return nil
+}
+
+// gcToolchain is the compile, asm, and link tools of the Go SDK.
+type gcToolchain struct{}
+
+func (gcToolchain) Name() string {
+	return "gc"
+}
+
+func (gcToolchain) Builtin(importPath string) bool {
+	return false
+}
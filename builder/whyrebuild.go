@@ -0,0 +1,54 @@
+package main
+
+import (
+	"cmd/builder/gometa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadBuildRecordFile reads the build record of a package from a .build.json
+// file in a lib output.
+func loadBuildRecordFile(path string) (*BuildRecord, error) {
+	name, ok := strings.CutSuffix(filepath.Base(path), ".build.json")
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a build record", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return LoadBuildRecord(filepath.Dir(path), name)
+}
+
+// whyRebuild compares the build records of two builds of a package, given as
+// the paths to their .build.json files, and prints what changed in the
+// second, so derivations can be split to rebuild less.
+func whyRebuild(args []string) {
+	if len(args) != 2 {
+		fatal(CategoryAttr, fmt.Sprintf("why-rebuild needs the build records of two builds\n%s", usage), nil)
+	}
+	old, err := loadBuildRecordFile(args[0])
+	if err != nil {
+		Fatal(err)
+	}
+	new, err := loadBuildRecordFile(args[1])
+	if err != nil {
+		Fatal(err)
+	}
+
+	changes := gometa.Diff(old, new)
+	switch {
+	case len(changes) > 0:
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+	case old.SourceSHA256 == nil || new.SourceSHA256 == nil:
+		fmt.Println("nothing recorded changed, but only records from newer builders have digests of sources and imports")
+	case old.Metadata.ExportSHA256 != new.Metadata.ExportSHA256 || old.ArchiveSHA256 != new.ArchiveSHA256:
+		fmt.Println("nothing recorded changed, yet the compiler's output did, so the build isn't reproducible")
+	default:
+		fmt.Println("nothing changed")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"nix/derivation"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// windowsGUILinkFlags link a binary for the GUI subsystem, so starting it
+// doesn't open a console window.
+var windowsGUILinkFlags = []string{"-H", "windowsgui"}
+
+// windresTarget returns the BFD target windres should produce objects for.
+func windresTarget(goarch string) (string, error) {
+	switch goarch {
+	case "386":
+		return "pe-i386", nil
+	case "amd64":
+		return "pe-x86-64", nil
+	case "arm64":
+		return "pe-aarch64-little", nil
+	default:
+		return "", fmt.Errorf("windows resources are not supported on %s", goarch)
+	}
+}
+
+// compileWindowsResources compiles resource scripts (.rc) with windres from
+// nativeBuildInputs into .syso objects the Go linker understands.
+func compileWindowsResources(rcs []string) ([]string, error) {
+	if Context.GOOS != "windows" {
+		return nil, fmt.Errorf(
+			"windows resources can only be embedded when targeting windows, not %s",
+			Context.GOOS,
+		)
+	}
+	target, err := windresTarget(Context.GOARCH)
+	if err != nil {
+		return nil, err
+	}
+	windres, err := FindNativeTool("windres")
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make([]string, 0, len(rcs))
+	for i, rc := range rcs {
+		base, _ := strings.CutSuffix(filepath.Base(rc), filepath.Ext(rc))
+		obj := filepath.Join(derivation.BuildDir(), fmt.Sprintf("rsrc_%d_%s.syso", i, base))
+
+		cmd := exec.Command(
+			windres,
+			"--input", rc,
+			"--output", obj,
+			"--output-format", "coff",
+			"--target", target,
+			// Resource scripts usually refer to icons and manifests relative to
+			// themselves.
+			"--include-dir", filepath.Dir(rc),
+		)
+		// windres calls out to a C preprocessor.
+		cmd.Env = NativeEnv()
+		if err := RunLogged(cmd); err != nil {
+			return nil, fmt.Errorf("failed to compile windows resource %s: %w", rc, err)
+		}
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
+
+// embedWindowsResources compiles resource scripts and packs them into a copy
+// of archive, returning the path to the copy.
+func embedWindowsResources(sdk *GoSDK, archive string, rcs []string) (string, error) {
+	objs, err := compileWindowsResources(rcs)
+	if err != nil {
+		return "", err
+	}
+
+	// The archive is in the store, so it has to be copied before it can be
+	// modified.
+	copied := filepath.Join(derivation.BuildDir(), "main", filepath.Base(archive))
+	if err := Materialize(archive, copied, MaterializeCopy); err != nil {
+		return "", fmt.Errorf("failed to copy main archive: %w", err)
+	}
+	if err := appendArchive(sdk, copied, objs...); err != nil {
+		return "", err
+	}
+
+	return copied, nil
+}
@@ -3,35 +3,94 @@
   lib,
   go,
   useCaDerivations ? false,
+  archFeatures ? { },
+  goExperiment ? [ ],
+  packStdMetadata ? false,
+  stdGcFlags ? [ ],
+  stdAsmFlags ? [ ],
+  stdInstrument ? null,
+  stdDynLink ? false,
+  stdSingleDerivation ? false,
+  stdSplitOutputs ? false,
+  stdPrevious ? null,
+  defaultGodebug ? { },
+  bootstrapSystem ? system,
+  bootstrapGo ? go,
+  builderPlatforms ? [ ],
 }@pkgs:
 
 let
   inherit (lib)
+    filterAttrs
     mapAttrs
     mergeAttrsList
     optional
     optionalAttrs
     ;
 
+  version = lib.fileContents ./VERSION;
+
+  # Derivations requiring builder features also pass the library version, so a
+  # builder which is too old can say which version is needed.
+  featureAttrs = args: optionalAttrs (args ? requiredFeatures) { libraryVersion = version; };
+
+  # Attributes configuring the toolchain, which must be the same for every
+  # package in the build.
+  toolAttrs = archFeatures // optionalAttrs (goExperiment != [ ]) { inherit goExperiment; };
+
+  # Attributes choosing the SDK, either `go` or the builder's pick of `sdks`.
+  sdkAttrs =
+    go: args:
+    if args ? sdks then
+      { sdks = mapAttrs (_: sdk: "${sdk}/share/go") args.sdks; }
+    else
+      { sdk = "${go}/share/go"; };
+
 in
 rec {
   internal = {
     bootstrap = import ./bootstrap/default.nix {
-      inherit system lib go;
+      inherit system lib go toolAttrs;
+      inherit bootstrapSystem bootstrapGo builderPlatforms;
       inherit buildGoBinary buildGoLibrary;
     };
 
-    stdlib = import ./stdlib.nix {
-      inherit system lib go;
-      inherit builder buildGoLibrary;
-      inherit (internal.bootstrap.stage2.stdlib) spec;
-      inherit useCaDerivations;
-    };
+    stdlib = import ./stdlib.nix (
+      {
+        inherit system lib go;
+        inherit builder buildGoLibrary;
+        inherit useCaDerivations toolAttrs;
+        packMetadata = packStdMetadata;
+        gcFlags = stdGcFlags;
+        asmFlags = stdAsmFlags;
+        instrument = stdInstrument;
+        dynLink = stdDynLink;
+        singleDerivation = stdSingleDerivation;
+        splitOutputs = stdSplitOutputs;
+        previous = stdPrevious;
+      }
+      # Instrumentation selects different files, so the bootstrap's package
+      # list can't be reused.
+      // optionalAttrs (stdInstrument == null) { inherit (internal.bootstrap.stage2.stdlib) spec; }
+    );
+
+    # The standard library a build of args imports. It's compiled by `go`, so
+    # builds picking their SDK from `sdks` can't import it, since which one is
+    # picked isn't known until the builder runs.
+    stdFor =
+      args:
+      if args ? sdks then
+        throw "sdks needs noStd, with a standard library compiled by the SDK it picks in imports"
+      else
+        internal.stdlib.std;
 
     derivation = buildGoLibrary {
       packagePath = "nix/derivation";
       srcs = [
         ./internal/nix/derivation/attrs.go
+        ./internal/nix/derivation/build.go
+        ./internal/nix/derivation/closure.go
+        ./internal/nix/derivation/env.go
         ./internal/nix/derivation/path.go
       ];
     };
@@ -42,6 +101,15 @@ rec {
   */
   inherit (internal.bootstrap.stage2) builder;
 
+  /**
+    Derivations which only succeed if the builder was bootstrapped correctly,
+    like `versionCheck`, which fails unless the builder was stamped with the
+    version in `VERSION`. Build them all with `nix-build -A checks`.
+  */
+  checks = {
+    inherit (internal.bootstrap.stage2) versionCheck;
+  };
+
   /**
     Compile a Go package into an archive usable as a member of `imports` in
     other builds.
@@ -51,12 +119,34 @@ rec {
     ```
     buildGoLibrary
       :: { packagePath :: String
+         , mainPath :: String | Null ? null
          , srcs :: [String | Path]
          , imports :: [Derivation] ? []
          , importMap :: AttrSet ? {}
          , compileFlags :: [String] ? []
+         , coverMode :: String | Null ? null
+         , cgoGenerated :: Derivation | Path | Null ? null
+         , extraObjects :: [String | Path] ? []
+         , allowMissingStd :: [String] ? []
+         , dynLink :: Bool ? false
+         , toolchain :: String ? "gc"
          , go :: Derivation ? pkgs.go
+         , sdks :: AttrSet ? null
+         , sdkVersion :: String ? null
          , noStd :: Bool ? false
+         , std :: Bool ? false
+         , constraintReport :: Bool ? false
+         , excludeTests :: Bool ? false
+         , onlyPlatforms :: [String] ? []
+         , outputLayout :: String ? null
+         , overlay :: AttrSet ? {}
+         , metaConflicts :: String ? "override"
+         , actionCache :: String ? null
+         , strictImports :: Bool ? false
+         , typecheck :: Bool ? false
+         , actionManifests :: Bool ? false
+         , profileTools :: Bool ? false
+         , requiredFeatures :: [String] ? []
          }
       -> Derivation
     ```
@@ -69,13 +159,18 @@ rec {
       : The name of package. This is what will appear for the "import" when
         using the library.
 
+    : `mainPath` (String; optional, default: `null`)
+      : The import path of a main package within its module, like
+        `"example.com/m/cmd/tool"`, since `packagePath` must be `"main"`. It
+        decides which internal packages the command may import.
+
     : `srcs` ([String | Path]; _required_)
       : Paths or store paths to the source files of the package. This must be
         individual files, not a directory of files.
 
     : `imports` ([Derivation]; optional, default: `[]`)
       : Other libraries depended on by the package. These must also be the
-        output of `buildGoLibrary`.
+        output of `buildGoLibrary` or `buildGoMetaPackage`.
 
     : `importMap` (AttrSet; optional, default: `{}`)
       : Overrides for mapping import paths to Go packages. Usually this is only
@@ -89,9 +184,140 @@ rec {
       : The go compiler to use for building the binary. Note that the standard
         library will still be compiled against `pkgs.go` unless `noStd` is set.
 
+    : `sdks` (AttrSet; optional, default: `null`)
+      : Go compilers to choose from instead of `go`, keyed by the version of Go
+        they contain (e.g. `{ "1.22.5" = pkgs.go_1_22; }`). The builder picks
+        `sdkVersion` if set, else the oldest satisfying the `toolchain` or `go`
+        directive of `goMod`, else the newest. Its version is recorded in the
+        metadata of every package, and importing a package compiled by another
+        version fails. The provided standard library is compiled by `go`, so
+        this needs `noStd`, with a standard library compiled by the picked SDK
+        in `imports`.
+
+    : `sdkVersion` (String; optional, default: `null`)
+      : The version to pick from `sdks`, like `"1.22"` for the newest 1.22
+        release.
+
     : `noStd` (Bool; optional, default: `false`)
       : Disable linking against the provided standard library. You must provide
         your own runtime and standard library as `imports`.
+
+    : `std` (Bool; optional, default: `false`)
+      : Compile the package as part of the standard library, which the runtime
+        and packages close to it need. This is detected when every source is in
+        the SDK, but must be set for patched copies of those packages.
+
+    : `constraintReport` (Bool; optional, default: `false`)
+      : Write a report to the `lib` output listing which `srcs` were excluded
+        by build constraints, and why.
+
+    : `excludeTests` (Bool; optional, default: `false`)
+      : Ignore `_test.go` files in `srcs`, so every file of a package's
+        directory can be passed as is.
+
+    : `onlyPlatforms` ([String]; optional, default: `[]`)
+      : Platforms the package is built for, like `[ "linux/amd64" ]`. Files in
+        `srcs` whose `_GOOS` or `_GOARCH` suffix matches none of them are
+        ignored without being read, and building for any other platform fails.
+
+    : `outputLayout` (String; optional, default: `null`)
+      : Also install the archive at `pkg/$GOOS_$GOARCH/<packagePath>.a` of the
+        `lib` output when set to `"gopath"`, so tools expecting GOPATH
+        conventions can use the output as a GOPATH.
+
+    : `overlay` (AttrSet; optional, default: `{}`)
+      : Replacement files for some of `srcs`, keyed by the source they replace
+        as it appears in `srcs`. Mapping a source to `""` removes it. This is
+        useful for patching a single file without copying the whole source
+        tree.
+
+    : `metaConflicts` (String; optional, default: `"override"`)
+      : What to do when a package in `imports` is also part of a meta package,
+        like `std`. With `"override"` the package from `imports` is used, with
+        `"warn"` a warning is also logged, and `"error"` fails the build. Any
+        overrides are listed in `<name>.overrides.json` in the `lib` output.
+
+    : `actionCache` (String; optional, default: `null`)
+      : Absolute path to a directory shared between builds, where compiled
+        packages are stored by a hash of their inputs. A package found there is
+        copied instead of compiled again. The directory must be writable by the
+        build, so this needs the sandbox disabled or the directory added to
+        `extra-sandbox-paths`, and is only meant for local development. A
+        builder without a version, like one built outside of the bootstrap,
+        ignores the cache.
+
+    : `strictImports` (Bool; optional, default: `false`)
+      : Fail if any of `imports` is not imported by the package, instead of
+        only warning. Unused imports are listed in `<name>.unused.json` in the
+        `lib` output.
+
+    : `typecheck` (Bool; optional, default: `false`)
+      : Only compile the export data of the package, skipping its archive and
+        the `lib` output. The result can be imported by other type checked
+        packages, but not linked. This is faster for checking that code
+        compiles, such as in CI.
+
+    : `actionManifests` (Bool; optional, default: `false`)
+      : Add a `manifests` output with `actions.json`, recording the exact
+        arguments, environment, inputs, and outputs of every compiler and
+        assembler run, so build auditing tools can replay or compare them.
+
+    : `coverMode` (String | Null; optional, default: `null`)
+      : Instrument the package for coverage, like `go build -cover`, with the
+        counter mode `set`, `count`, or `atomic`. The mode and the hash of the
+        package's coverage metadata are recorded in its metadata. Binaries
+        must be linked with a main package instrumented the same way, which
+        registers the coverage with the runtime.
+
+    : `cgoGenerated` (Derivation | Path | Null; optional, default: `null`)
+      : Output of running `cgo` on the package ahead of time, such as by a
+        derivation with a C toolchain: `_cgo_gotypes.go`, `_cgo_import.go`,
+        and a `<name>.cgo1.go` for every source importing `"C"`, along with
+        the compiled `.o` objects. The generated Go files replace the sources
+        importing `"C"`, sources are selected as if cgo were enabled, and the
+        objects are packed into the archive. `runtime/cgo` must be in
+        `imports`, built with cgo. The linker flags of `#cgo LDFLAGS` and
+        `#cgo pkg-config` directives are recorded in the archive for linking,
+        with pkg-config from `nativeBuildInputs` searching `buildInputs`, but
+        their C flags must already have been given to cgo.
+
+    : `extraObjects` ([String | Path]; optional, default: `[]`)
+      : Prebuilt host objects or archives of them to pack into the package's
+        archive, like blobs shipped by a vendor, which the linker loads along
+        with the package like `.syso` files. They're added last, in the order
+        given, after the objects assembled from the package's sources and its
+        `.syso` files. Their names must be unique. Packages compiled by the Go
+        compiler can't be merged into another, and must be imported instead.
+
+    : `allowMissingStd` ([String]; optional, default: `[]`)
+      : Standard library packages to compile an empty stub of when `std`
+        doesn't have them, like when it was built by an older Go. Only blank
+        imports of a stub compile, and binaries can't be linked against it,
+        but this lets experimental builds go ahead.
+
+    : `dynLink` (Bool; optional, default: `false`)
+      : Compile the package with `-dynlink`, for linking into a shared library
+        with `buildGoSharedLibrary`, or into a binary linked against one. The
+        standard library must be built with `stdDynLink`, and packages
+        compiled either way can't be mixed.
+
+    : `toolchain` (String; optional, default: `"gc"`)
+      : Compiler backend for the package, instead of the compile, asm, and
+        link tools of `go`. `"gccgo"` needs gccgo, objcopy, and ar in
+        `nativeBuildInputs`, and imports the standard library from gccgo's
+        libgo, so `std` isn't imported. `compileFlags` are passed to gccgo,
+        and assembly sources must be written for the GNU assembler. Packages
+        compiled by different toolchains can't be mixed.
+
+    : `profileTools` (Bool; optional, default: `false`)
+      : Add a `profiles` output with CPU and memory profiles of the compiler,
+        readable by `go tool pprof`, and `tools.json`, recording how long every
+        tool ran and the most memory it used. This helps find out why a
+        package is slow to build.
+
+    : `requiredFeatures` ([String]; optional, default: `[]`)
+      : Builder features needed by the package. The build fails early if the
+        builder does not support one of them.
   */
   buildGoLibrary =
     {
@@ -101,12 +327,18 @@ rec {
       compileFlags ? [ ],
       go ? pkgs.go,
       noStd ? false,
+      typecheck ? false,
       ...
     }@args:
     let
+      # Other toolchains bring their own standard library.
+      withStd = !noStd && (args.toolchain or "gc") == "gc";
       mergedDeps = mergeAttrsList (
         (builtins.map (dep: dep.deps // { "${dep.packagePath}" = dep; }) imports)
-        ++ optional (!noStd) { std = internal.stdlib.std; }
+        ++ optional withStd { std = internal.stdFor args; }
+      );
+      metaPackages = builtins.map (dep: dep.packagePath) (
+        builtins.filter (dep: dep.isMetaPackage or false) imports
       );
 
     in
@@ -119,32 +351,517 @@ rec {
         __contentAddressed = useCaDerivations;
 
         builder = "${builder}/bin/builder";
-        args = [ "compile" ];
+        args = [ (if typecheck then "typecheck" else "compile") ];
+        outputs =
+          optional (!typecheck) "lib"
+          ++ [ "export" ]
+          ++ optional (args.actionManifests or false) "manifests"
+          ++ optional (args.profileTools or false) "profiles";
+
+        imports = builtins.listToAttrs (
+          builtins.map (dep: {
+            name = dep.packagePath;
+            value = dep.export;
+          }) (imports ++ optional withStd (internal.stdFor args))
+        );
+        inherit compileFlags;
+      }
+      // optionalAttrs (metaPackages != [ ]) { inherit metaPackages; }
+      // toolAttrs
+      // sdkAttrs go args
+      // featureAttrs args
+      // (builtins.removeAttrs args [
+        "compileFlags"
+        "go"
+        "imports"
+        "noStd"
+        "sdks"
+        "typecheck"
+      ])
+    )
+    // {
+      deps = mergedDeps;
+    };
+
+  /**
+    Group already compiled Go libraries into a meta package. Like the standard
+    library, a meta package can be used as a single member of `imports` in
+    place of every library it contains.
+
+    # Type
+
+    ```
+    buildGoMetaPackage
+      :: { packagePath :: String
+         , packages :: [Derivation]
+         , importMap :: AttrSet ? {}
+         , packMetadata :: Bool ? false
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `packagePath` (String; _required_)
+      : The name of the meta package. This is never imported from Go, so it only
+        needs to be unique among the imports of a package.
+
+    : `packages` ([Derivation]; _required_)
+      : The libraries contained in the meta package. These must be the output of
+        `buildGoLibrary`.
+
+    : `importMap` (AttrSet; optional, default: `{}`)
+      : Import path overrides applied to any package importing the meta package.
+
+    : `packMetadata` (Bool; optional, default: `false`)
+      : Also write the metadata of every package in a single packed file. This
+        speeds up resolving very large meta packages.
+  */
+  buildGoMetaPackage =
+    {
+      packagePath,
+      packages,
+      ...
+    }@args:
+    derivation (
+      {
+        inherit system;
+        name = builtins.replaceStrings [ "/" ] [ "_" ] "${packagePath}";
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "metapkg" ];
         outputs = [
           "lib"
           "export"
         ];
 
-        sdk = "${go}/share/go";
+        sdk = "${pkgs.go}/share/go";
+        packages = builtins.listToAttrs (
+          builtins.map (pkg: {
+            name = pkg.packagePath;
+            value = { inherit (pkg) lib export; };
+          }) packages
+        );
+      }
+      // featureAttrs args
+      // (builtins.removeAttrs args [ "packages" ])
+    )
+    // {
+      deps = mergeAttrsList (builtins.map (dep: dep.deps // { "${dep.packagePath}" = dep; }) packages);
+      isMetaPackage = true;
+    };
+
+  /**
+    Compile every package of a module in a single derivation, running several
+    compilations at once. Each package is installed under its import path in
+    the outputs, which also form a meta package of the whole module, so the
+    result is used in `imports` like one from `buildGoMetaPackage`. For small
+    modules this avoids the cost of a derivation for every package, at the
+    price of rebuilding the whole module when any of it changes.
+
+    # Type
+
+    ```
+    buildGoModuleLibrary
+      :: { packagePath :: String
+         , packages :: AttrSet
+         , imports :: [Derivation] ? []
+         , compileFlags :: [String] ? []
+         , go :: Derivation ? pkgs.go
+         , sdks :: AttrSet ? null
+         , sdkVersion :: String ? null
+         , noStd :: Bool ? false
+         , packMetadata :: Bool ? false
+         , actionManifests :: Bool ? false
+         , profileTools :: Bool ? false
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `packagePath` (String; _required_)
+      : The path of the module, naming its meta package.
+
+    : `packages` (AttrSet; _required_)
+      : The packages of the module, keyed by import path. Each has `srcs` and,
+        optionally, `imports` (the import paths it imports), `importMap`, and
+        `embedCfg`, as in a lock file. Packages of the module are compiled
+        before those importing them.
+
+    : `imports` ([Derivation]; optional, default: `[]`)
+      : Libraries from outside the module depended on by its packages. These
+        must be the output of `buildGoLibrary` or `buildGoMetaPackage`.
+
+    : `packMetadata` (Bool; optional, default: `false`)
+      : Also write the metadata of every package in a single packed file, as
+        in `buildGoMetaPackage`.
+
+    Any other arguments, like `compileFlags` or `profileTools`, are passed
+    on to the compilation of every package, as in `buildGoLibrary`.
+  */
+  buildGoModuleLibrary =
+    {
+      packagePath,
+      packages,
+      imports ? [ ],
+      compileFlags ? [ ],
+      go ? pkgs.go,
+      noStd ? false,
+      ...
+    }@args:
+    let
+      mergedDeps = mergeAttrsList (
+        (builtins.map (dep: dep.deps // { "${dep.packagePath}" = dep; }) imports)
+        ++ optional (!noStd) { std = internal.stdFor args; }
+      );
+      metaPackages = builtins.map (dep: dep.packagePath) (
+        builtins.filter (dep: dep.isMetaPackage or false) imports
+      );
+
+    in
+    derivation (
+      {
+        inherit system;
+        name = builtins.replaceStrings [ "/" ] [ "_" ] "${packagePath}";
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "module" ];
+        outputs = [
+          "lib"
+          "export"
+        ]
+        ++ optional (args.actionManifests or false) "manifests"
+        ++ optional (args.profileTools or false) "profiles";
+
         imports = builtins.listToAttrs (
           builtins.map (dep: {
             name = dep.packagePath;
             value = dep.export;
-          }) (imports ++ optional (!noStd) internal.stdlib.std)
+          }) (imports ++ optional (!noStd) (internal.stdFor args))
         );
-        inherit compileFlags;
+        inherit compileFlags packages;
       }
+      // optionalAttrs (metaPackages != [ ]) { inherit metaPackages; }
+      // toolAttrs
+      // sdkAttrs go args
+      // featureAttrs args
       // (builtins.removeAttrs args [
         "compileFlags"
         "go"
         "imports"
         "noStd"
+        "packages"
+        "sdks"
       ])
     )
     // {
       deps = mergedDeps;
+      isMetaPackage = true;
+    };
+
+  /**
+    Generate a lock file for a Go workspace. The lock lists every module needed
+    by the workspace, and the sources and imports of every package in its local
+    modules. A workspace is either a single module or a `go.work` file.
+
+    Imports of a local module without its major version suffix, like
+    `example.com/x/foo` for the module `example.com/x/v2`, are rewritten in
+    each package's `ImportMap`, as the go command does outside of module mode.
+    Import comments naming any other path are warned about.
+
+    Besides `lock.json`, the output has a `default.nix` building every local
+    package with `buildGoLibrary`, so they don't need to be written by hand.
+    It's a function of `src`, `buildGoLibrary`, and `deps`, the libraries of
+    other modules keyed by import path, and returns the libraries keyed by
+    import path. Main packages can be linked by passing their library as the
+    `obj` of `buildGoBinary`. For example:
+
+    ```nix
+    import "${generateGoLock { inherit src; }}" {
+      inherit src buildGoLibrary;
+      deps."golang.org/x/sync/errgroup" = errgroup;
+    }
+    ```
+
+    # Type
+
+    ```
+    generateGoLock :: { src :: Path } -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `src` (Path; _required_)
+      : The source tree containing a `go.work` or `go.mod` at its root. Modules
+        used by the workspace or replaced by local directories must be inside
+        this tree.
+  */
+  generateGoLock =
+    { src, ... }@args:
+    derivation (
+      {
+        inherit system;
+        name = "go-lock";
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "lock" ];
+
+        sdk = "${pkgs.go}/share/go";
+      }
+      // args
+    );
+
+  /**
+    Write a signed provenance statement for each of a set of compiled
+    libraries. Each is an in-toto statement with a SLSA provenance predicate,
+    in a DSSE envelope, at `<packagePath>.intoto.json` in the output. Its
+    subjects are the SHA-256 digests of the library's export data and archive,
+    which are checked against those recorded in its metadata first, so caches
+    fetching the libraries from elsewhere can decide whether to trust them.
+
+    # Type
+
+    ```
+    attestGoPackages
+      :: { packages :: [Derivation]
+         , signingKeyFile :: String ? null
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `packages` ([Derivation]; _required_)
+      : The libraries to attest. These must be the output of `buildGoLibrary`.
+
+    : `signingKeyFile` (String; optional, default: `null`)
+      : Absolute path to a secret key from `nix key generate-secret`, which
+        signs every statement. This must not be in the store, so it needs the
+        sandbox disabled or the file added to `extra-sandbox-paths`. The
+        statements are unsigned without it.
+  */
+  attestGoPackages =
+    { packages, ... }@args:
+    derivation (
+      {
+        inherit system;
+        name = "go-attestations";
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "attest" ];
+
+        sdk = "${pkgs.go}/share/go";
+        packages = builtins.listToAttrs (
+          builtins.map (pkg: {
+            name = pkg.packagePath;
+            value = { inherit (pkg) lib export; };
+          }) packages
+        );
+      }
+      // featureAttrs args
+      // (builtins.removeAttrs args [ "packages" ])
+    );
+
+  /**
+    Unpack the source of a single module into its own store path, which the
+    packages of the module can use as their sources. Version control metadata
+    and nested modules are left out, and the source is checked against its
+    hash from `go.sum` before patches are applied.
+
+    # Type
+
+    ```
+    fetchGoModuleSrc
+      :: { modulePath :: String
+         , version :: String
+         , src :: Path
+         , hash :: String ? null
+         , patches :: [Path] ? []
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `modulePath` (String; _required_)
+      : The path of the module.
+
+    : `version` (String; _required_)
+      : The version of the module.
+
+    : `src` (Path; _required_)
+      : Either a module zip, as served by a module proxy, or a directory
+        containing the module, such as a VCS checkout.
+
+    : `hash` (String; optional)
+      : The `h1:` hash of the module from `go.sum`. Without it, the hash of the
+        source is only logged.
+
+    : `patches` (List of Paths; optional, default: `[]`)
+      : Patches applied with `patch -p1`. `patch` must be in
+        `nativeBuildInputs`.
+  */
+  fetchGoModuleSrc =
+    {
+      modulePath,
+      version,
+      ...
+    }@args:
+    derivation (
+      {
+        inherit system;
+        name = "${builtins.replaceStrings [ "/" ] [ "_" ] modulePath}-${version}-src";
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "module-src" ];
+
+        sdk = "${pkgs.go}/share/go";
+      }
+      // featureAttrs args
+      // args
+    );
+
+  /**
+    Export the transitive import graph of a Go package, for finding what is
+    forcing rebuilds or pulling dependencies into a closure. The graph is
+    written to `graph.dot` or `graph.json` in the output.
+
+    # Type
+
+    ```
+    buildGoImportGraph
+      :: { package :: Derivation
+         , format :: String ? "dot"
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `package` (Derivation; _required_)
+      : The package to start from. This must be the output of `buildGoLibrary`.
+
+    : `format` (String; optional, default: `"dot"`)
+      : Either `"dot"` for Graphviz or `"json"`.
+  */
+  buildGoImportGraph =
+    {
+      package,
+      format ? "dot",
+    }:
+    derivation {
+      inherit system;
+      name = "${builtins.replaceStrings [ "/" ] [ "_" ] package.packagePath}-graph";
+
+      __structuredAttrs = true;
+      __contentAddressed = useCaDerivations;
+
+      builder = "${builder}/bin/builder";
+      args = [ "graph" ];
+
+      sdk = "${pkgs.go}/share/go";
+
+      inherit (package) packagePath;
+      main = package.export;
+      deps = mapAttrs (_: dep: dep.export) package.deps;
+      inherit format;
     };
 
+  /**
+    Create a driver for `go/packages`, so gopls and other tools can load Go
+    packages built with this library. Point `GOPACKAGESDRIVER` at
+    `bin/gopackagesdriver` in the output.
+
+    # Type
+
+    ```
+    buildGoPackagesDriver
+      :: { packages :: [Derivation]
+         , sourceRoot :: String ? null
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `packages` ([Derivation]; _required_)
+      : The packages to answer for. These and everything they import must be
+        the output of `buildGoLibrary`.
+
+    : `sourceRoot` (String; optional, default: `null`)
+      : Store path of the source tree the packages were built from. Sources
+        under it are reported relative to the workspace folder of the editor
+        instead, so the files being edited are opened rather than their copy in
+        the store.
+  */
+  buildGoPackagesDriver =
+    {
+      packages,
+      sourceRoot ? null,
+    }:
+    let
+      deps = filterAttrs (name: dep: name != "std" && !(dep.isMetaPackage or false)) (
+        mergeAttrsList (builtins.map (pkg: pkg.deps // { "${pkg.packagePath}" = pkg; }) packages)
+      );
+
+    in
+    derivation (
+      {
+        inherit system;
+        name = "gopackagesdriver";
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [
+          "gopackages-driver"
+          "--install"
+        ];
+
+        sdk = "${pkgs.go}/share/go";
+        # Local paths are kept as they are, so editors open the original files.
+        packages = mapAttrs (_: dep: {
+          srcs = builtins.map toString (dep.srcs or [ ]);
+          inherit (dep) export;
+          importMap = dep.importMap or { };
+        }) deps;
+        std = internal.stdlib.std.export;
+      }
+      // toolAttrs
+      // optionalAttrs (sourceRoot != null) { inherit sourceRoot; }
+    );
+
   /**
     Compile a Go package into a binary.
 
@@ -155,12 +872,40 @@ rec {
       :: { name :: String
          , srcs :: [String | Path] ? obj.srcs
          , packagePath :: String ? "main"
+         , mainPath :: String | Null ? null
          , imports :: [Derivation] ? []
          , importMap :: AttrSet ? {}
          , compileFlags :: [String] ? []
          , obj :: Derivation | Null ? null
          , linkFlags :: [String] ? []
+         , windowsResources :: [String | Path] ? []
+         , codesign :: AttrSet | Null ? null
+         , postLink :: [AttrSet] ? []
+         , emulator :: [String] ? []
+         , defaultGodebug :: AttrSet ? {}
+         , metaConflicts :: String ? "override"
+         , deadcodeReport :: Bool ? false
+         , actionManifests :: Bool ? false
+         , profileTools :: Bool ? false
+         , coverMode :: String | Null ? null
+         , static :: Bool ? false
+         , dwarfEnabled :: Bool ? null
+         , compressDwarf :: Bool ? null
+         , stripSymbols :: Bool ? false
+         , dynamicLinker :: String | Null ? null
+         , rpath :: [String] ? []
+         , windowsGUI :: Bool ? false
+         , darwinHeaderPad :: Bool ? false
+         , checkVendoredStd :: Bool ? false
+         , strictLinknames :: Bool ? false
+         , allowLinknames :: [String] ? []
+         , dynLink :: Bool ? false
+         , toolchain :: String ? "gc"
+         , shlibs :: [Derivation] ? []
+         , postProcess :: [AttrSet] ? []
          , go :: Derivation ? pkgs.go
+         , sdks :: AttrSet ? null
+         , sdkVersion :: String ? null
          , noStd :: Bool ? false
          }
       -> Derivation
@@ -184,7 +929,11 @@ rec {
 
     : `packagePath` (String; optional, default: `main`)
       : The name of package the binary lives in. Usually this shouldn't be
-        changed, but it is available if you need to import internal packages.
+        changed, since the builder only compiles main packages as `"main"`.
+
+    : `mainPath` (String; optional, default: `null`)
+      : The import path of the main package within its module, as in
+        `buildGoLibrary`. Set this to import internal packages of the module.
 
     : `importMap` (AttrSet; optional, default: `{}`)
       : Overrides for mapping import paths to Go packages. Usually this is only
@@ -201,10 +950,162 @@ rec {
     : `linkFlags` ([String]; optional, default: `[]`)
       : Any extra flags to pass to the linker.
 
+    : `windowsResources` ([String | Path]; optional, default: `[]`)
+      : Resource scripts (.rc) to compile with `windres` and embed in the
+        binary. Only supported when targeting Windows. `windres` must be in
+        `nativeBuildInputs`.
+
+    : `codesign` (AttrSet | Null; optional, default: `null`)
+      : Sign the binary after linking, for darwin targets. The set may contain
+        `identity` (default: `"-"`, an ad-hoc signature) and `entitlements`, a
+        path to an entitlements plist. `rcodesign` or `codesign` must be in
+        `nativeBuildInputs`.
+
+    : `postLink` ([AttrSet]; optional, default: `[]`)
+      : Commands to run with the linked binary, whose output is installed. Each
+        set has the binary's `args`, and a `type` of `"bash"`, `"fish"`, or
+        `"zsh"` for shell completions or `"man"` for a manual page. `name`
+        overrides the installed file name, and is required for manual pages
+        (e.g. `"tool.1"`). `output` installs into another output than `out`,
+        which must be listed in `outputs`. The binary must be runnable on the
+        build platform, or under `emulator`.
+
+    : `emulator` ([String]; optional, default: `[]`)
+      : Command running binaries built for another platform than the build
+        platform, such as `[ "${pkgs.qemu}/bin/qemu-aarch64" ]`, used for
+        `postLink` when cross-compiling.
+
+    : `defaultGodebug` (AttrSet; optional, default: `{}`)
+      : `GODEBUG` settings built into the binary as its defaults, like
+        `//go:debug` directives (e.g. `{ http2client = "0"; }`). `GODEBUG` in
+        the environment still overrides them. These are added to the
+        `defaultGodebug` the library was instantiated with, and the
+        `//go:debug` directives of the main package take precedence over
+        both.
+
+    : `metaConflicts` (String; optional, default: `"override"`)
+      : What to do when a package is provided both directly and by a meta
+        package, as for `buildGoLibrary`. Packages linked into the binary from
+        more than one store path are reported with the attributes providing
+        them, as a warning with `"warn"` or a failure with `"error"`. With
+        `"override"` they're left to the linker.
+
+    : `deadcodeReport` (Bool; optional, default: `false`)
+      : Add a `deadcode` output with `deadcode.json`, listing each linked
+        package with how many of its symbols were kept, which functions the
+        linker discarded, and the shortest chain of references from an entry
+        point which kept the package.
+
+    : `actionManifests` (Bool; optional, default: `false`)
+      : Add a `manifests` output with `actions.json`, recording the exact
+        arguments, environment, inputs, and outputs of the linker run. The
+        main package's own derivation records compiling it, unless `obj` is
+        given.
+
+    : `profileTools` (Bool; optional, default: `false`)
+      : Add a `profiles` output with CPU and memory profiles of the linker and
+        `tools.json`, as in `buildGoLibrary`. The main package is profiled in
+        its own derivation, unless `obj` is given.
+
+    : `coverMode` (String | Null; optional, default: `null`)
+      : Instrument the main package for coverage, as in `buildGoLibrary`, so
+        the binary writes coverage data to `$GOCOVERDIR`. Linking fails if
+        any package instrumented with another mode is linked, or if `obj`
+        isn't instrumented while its dependencies are.
+
+    : `static` (Bool; optional, default: `false`)
+      : Fail the build unless the binary is statically linked, with no dynamic
+        interpreter or shared libraries, like for a container built from
+        scratch. When `linkFlags` select external linking, `-static` is added to
+        `-extldflags`. Only ELF binaries can be checked.
+
+    : `dwarfEnabled` (Bool; optional, default: `null`)
+      : Whether to keep DWARF debug information, as with `-w`. Unset keeps
+        the linker's default.
+
+    : `compressDwarf` (Bool; optional, default: `null`)
+      : Whether to compress DWARF sections, as with `-compressdwarf`. Unset
+        keeps the linker's default.
+
+    : `stripSymbols` (Bool; optional, default: `false`)
+      : Leave out the symbol table, as with `-s`. This also drops DWARF unless
+        `dwarfEnabled` is set.
+
+    : `dynamicLinker` (String | Null; optional, default: `null`)
+      : Absolute path to the ELF interpreter of the binary, as with `-I`, like
+        `pkgs.stdenv.cc.bintools.dynamicLinker`. This lets a binary linked
+        against shared libraries run on NixOS without a `patchelf` fixup. It
+        can't be combined with `static`.
+
+    : `rpath` ([String]; optional, default: `[]`)
+      : Absolute directories the binary searches for shared libraries at
+        runtime, as with `-r`, like `"${lib.getLib pkgs.openssl}/lib"`. Both
+        options also apply with external linking, where they're passed on to
+        the external linker.
+
+    : `windowsGUI` (Bool; optional, default: `false`)
+      : Link a Windows binary for the GUI subsystem, as with `-H windowsgui`,
+        so starting it doesn't open a console window.
+
+    : `darwinHeaderPad` (Bool; optional, default: `false`)
+      : Leave room in the Mach-O header of a darwin binary for
+        `install_name_tool` to rewrite its library paths later, as with
+        `-extldflags=-Wl,-headerpad_max_install_names`. This only changes
+        anything with external linking, since the internal linker always
+        leaves room.
+
+    : `checkVendoredStd` (Bool; optional, default: `false`)
+      : Fail if a package the standard library vendors, like
+        `golang.org/x/net/http2/hpack`, is linked both from its module and as
+        the standard library's copy. Only the standard library imports its
+        copies, so other packages always get the module's.
+
+    : `strictLinknames` (Bool; optional, default: `false`)
+      : Fail if any linked package outside the standard library has
+        `//go:linkname` or `//go:cgo_import_dynamic` directives, which reach
+        into the internals of other packages. Every package records its
+        directives in its metadata, whether or not this is set.
+
+    : `allowLinknames` ([String]; optional, default: `[]`)
+      : Import paths of packages allowed to have linkname directives with
+        `strictLinknames`, once they're reviewed.
+
+    : `dynLink` (Bool; optional, default: `false`)
+      : Compile the main package with `-dynlink`, as in `buildGoLibrary`.
+        This is needed to link against `shlibs`.
+
+    : `toolchain` (String; optional, default: `"gc"`)
+      : Compiler backend for the main package and the link, as in
+        `buildGoLibrary`. Every import must be compiled by the same one. With
+        `"gccgo"`, `linkFlags` are passed to gccgo, and the presets producing
+        flags for Go's linker, like `stripSymbols`, `rpath`, or `static`, are
+        rejected.
+
+    : `shlibs` ([Derivation]; optional, default: `[]`)
+      : Outputs of `buildGoSharedLibrary` to link the binary against with
+        `-linkshared`, instead of linking their packages into it. The binary
+        loads them from the store at runtime. DWARF is always left out, as the
+        linker can't describe types from shared libraries.
+
+    : `postProcess` ([AttrSet]; optional, default: `[]`)
+      : Tools to run on the linked binary, in order, before it is installed in
+        `out`. Each set has a `tool` from `nativeBuildInputs` and its `args`,
+        where `"@in@"` and `"@out@"` are replaced by the input and output
+        binary. If neither is used, the binary is appended to `args` and
+        modified in place. For example, `{ tool = "upx"; args = [ "--best" ];
+        }` compresses the binary. Code signing happens after post-processing.
+
     : `go` (Derivation; optional, default: `pkgs.go`)
       : The go compiler to use for building the library. Note that the standard
         library will still be compiled against `pkgs.go` unless `noStd` is set.
 
+    : `sdks` (AttrSet; optional, default: `null`)
+      : Go compilers to choose from instead of `go`, as in `buildGoLibrary`.
+        This should pick the same version as the libraries being linked.
+
+    : `sdkVersion` (String; optional, default: `null`)
+      : The version to pick from `sdks`.
+
     : `noStd` (Bool; optional, default: `false`)
       : Disable linking against the provided standard library. You must provide
         your own runtime and standard library as `imports`.
@@ -234,6 +1135,17 @@ rec {
             inherit (args) srcs;
           }
           // optionalAttrs (args ? "importMap") { importMap = args.importMap or { }; }
+          // optionalAttrs (args.actionManifests or false) { actionManifests = true; }
+          // optionalAttrs (args.profileTools or false) { profileTools = true; }
+          // optionalAttrs (args.coverMode or null != null) { inherit (args) coverMode; }
+          // optionalAttrs (args.dynLink or false) { dynLink = true; }
+          // optionalAttrs (args ? toolchain) { inherit (args) toolchain; }
+          // optionalAttrs (args.mainPath or null != null) { inherit (args) mainPath; }
+          // optionalAttrs (args ? metaConflicts) { inherit (args) metaConflicts; }
+          # The main package must be compiled by the SDK it's linked with.
+          // optionalAttrs (args ? sdks) { inherit (args) sdks; }
+          // optionalAttrs (args ? sdkVersion) { inherit (args) sdkVersion; }
+          // optionalAttrs (args ? goMod) { inherit (args) goMod; }
         ));
     in
     derivation (
@@ -246,24 +1158,330 @@ rec {
         builder = "${builder}/bin/builder";
         args = args.linkArgs or [ "link" ];
 
-        sdk = "${go}/share/go";
-
         inherit (main) packagePath;
         main = main.export;
         inherit name linkFlags;
         deps = mapAttrs (_: dep: dep.lib) (main.deps // { "${main.packagePath}" = main; });
+        # Only read for the metadata of each package, to report import cycles.
+        exports = mapAttrs (_: dep: dep.export) (main.deps // { "${main.packagePath}" = main; });
       }
+      // toolAttrs
+      // sdkAttrs go args
+      // featureAttrs args
       // (builtins.removeAttrs args [
         "compileFlags"
+        "coverMode"
         "go"
         "importMap"
         "imports"
         "linkArgs"
         "linkFlags"
+        "mainPath"
         "name"
         "noStd"
         "obj"
         "packagePath"
+        "sdks"
+      ])
+      // optionalAttrs (
+        (args.deadcodeReport or false) || (args.actionManifests or false) || (args.profileTools or false)
+      ) {
+        outputs =
+          args.outputs or [ "out" ]
+          ++ optional (args.deadcodeReport or false) "deadcode"
+          ++ optional (args.actionManifests or false) "manifests"
+          ++ optional (args.profileTools or false) "profiles";
+      }
+      // optionalAttrs (defaultGodebug != { }) {
+        defaultGodebug = defaultGodebug // args.defaultGodebug or { };
+      }
+    );
+
+  /**
+    Link Go packages into a shared library, like `go install
+    -buildmode=shared`. Every package must be compiled with `dynLink`, so for
+    the standard library, the library must be instantiated with `stdDynLink`.
+    Binaries and other shared libraries link against it with `shlibs`. The
+    library is written to `lib/lib<name>.so` in the output, alongside
+    `shlib.json` listing its packages.
+
+    # Type
+
+    ```
+    buildGoSharedLibrary
+      :: { name :: String
+         , packages :: [Derivation]
+         , shlibs :: [Derivation] ? []
+         , linkFlags :: [String] ? []
+         , go :: Derivation ? pkgs.go
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `name` (String; _required_)
+      : Name of the library, like `"std"` for `libstd.so`.
+
+    : `packages` ([Derivation]; _required_)
+      : Packages linked into the library, along with everything they import.
+        These must be the output of `buildGoLibrary`, or a meta package like
+        `internal.stdlib.std`.
+
+    : `shlibs` ([Derivation]; optional, default: `[]`)
+      : Other outputs of `buildGoSharedLibrary` the library links against.
+        Their packages are left out of it, so a library of an application's
+        packages can share the standard library's `libstd.so`.
+
+    : `linkFlags` ([String]; optional, default: `[]`)
+      : Any extra flags to pass to the linker.
+
+    : `go` (Derivation; optional, default: `pkgs.go`)
+      : The Go SDK to link with, which must be the one the packages were
+        compiled by.
+  */
+  buildGoSharedLibrary =
+    {
+      name,
+      packages,
+      shlibs ? [ ],
+      linkFlags ? [ ],
+      go ? pkgs.go,
+      ...
+    }@args:
+    let
+      deps = mergeAttrsList (
+        builtins.map (pkg: pkg.deps or { } // { "${pkg.packagePath}" = pkg; }) packages
+      );
+
+    in
+    derivation (
+      {
+        inherit system;
+        name = "lib${name}";
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "shlib" ];
+
+        libName = name;
+        inherit shlibs linkFlags;
+        dynLink = true;
+        packages = mapAttrs (_: dep: dep.lib) deps;
+        exports = mapAttrs (_: dep: dep.export) deps;
+      }
+      // toolAttrs
+      // sdkAttrs go args
+      // featureAttrs args
+      // (builtins.removeAttrs args [
+        "go"
+        "linkFlags"
+        "name"
+        "packages"
+        "sdks"
+        "shlibs"
       ])
     );
+
+  /**
+    Run a Go test binary. The binary and any test data it needs are installed
+    in the output, and the tests are run with the test data directory as their
+    working directory, like `go test` running from the package's directory.
+
+    # Type
+
+    ```
+    runGoTest
+      :: { name :: String
+         , binary :: String
+         , src :: Path
+         , testData :: [String] ? []
+         , linkTestData :: Bool ? false
+         , testFlags :: [String] ? []
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `name` (String; _required_)
+      : Name of the output derivation, and of the installed test binary.
+
+    : `binary` (String; _required_)
+      : Path to the linked test binary.
+
+    : `src` (Path; _required_)
+      : The source directory of the package under test.
+
+    : `testData` ([String]; optional, default: `[]`)
+      : Globs relative to `src` of files the tests read at runtime, such as
+        `"testdata"`. Matched directories are installed recursively.
+
+    : `linkTestData` (Bool; optional, default: `false`)
+      : Symlink the test data from `src` instead of copying it.
+
+    : `testFlags` ([String]; optional, default: `[]`)
+      : Flags passed to the test binary, like `"-test.v"`.
+  */
+  runGoTest =
+    {
+      name,
+      binary,
+      src,
+      testData ? [ ],
+      testFlags ? [ ],
+      ...
+    }@args:
+    derivation (
+      {
+        inherit system;
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "test" ];
+
+        sdk = "${pkgs.go}/share/go";
+        inherit testData testFlags;
+      }
+      // args
+    );
+
+  /**
+    Install a Go test binary and its test data like `runGoTest`, without
+    running it. A `test.json` manifest in the output records how to run the
+    tests, so a cross-compiled test binary can be run on the target hardware or
+    with `runBuiltGoTest` under an emulator.
+
+    # Type
+
+    ```
+    buildGoTest
+      :: { name :: String
+         , binary :: String
+         , src :: Path
+         , testData :: [String] ? []
+         , linkTestData :: Bool ? false
+         , testFlags :: [String] ? []
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    The same arguments as `runGoTest`.
+  */
+  buildGoTest =
+    {
+      name,
+      binary,
+      src,
+      testData ? [ ],
+      testFlags ? [ ],
+      ...
+    }@args:
+    derivation (
+      {
+        inherit system;
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "test-build" ];
+
+        sdk = "${pkgs.go}/share/go";
+        inherit testData testFlags;
+      }
+      // args
+    );
+
+  /**
+    Run the tests installed by `buildGoTest`.
+
+    # Type
+
+    ```
+    runBuiltGoTest
+      :: { name :: String
+         , test :: Derivation
+         , emulator :: [String] ? []
+         , testFlags :: [String] ? []
+         }
+      -> Derivation
+    ```
+
+    # Inputs
+
+    An attribute set with the following arguments
+
+    : `name` (String; _required_)
+      : Name of the output derivation.
+
+    : `test` (Derivation; _required_)
+      : Output of `buildGoTest`.
+
+    : `emulator` ([String]; optional, default: `[]`)
+      : Command the test binary is run with when it was built for another
+        platform, such as `[ "${pkgs.qemu}/bin/qemu-aarch64" ]`. Binaries for
+        the build platform run directly.
+
+    : `testFlags` ([String]; optional, default: `[]`)
+      : Flags passed to the test binary after those given to `buildGoTest`.
+  */
+  runBuiltGoTest =
+    {
+      name,
+      test,
+      emulator ? [ ],
+      testFlags ? [ ],
+      ...
+    }@args:
+    derivation (
+      {
+        inherit system;
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [ "test-run" ];
+
+        sdk = "${pkgs.go}/share/go";
+        inherit emulator testFlags;
+      }
+      // args
+    );
+
+  /**
+    Store a large attribute of a builder derivation in a file, so it isn't part
+    of the JSON attributes every build step parses, or of the environment. The
+    builder reads the file in place of the attribute. This suits attributes
+    with thousands of entries, like `srcs` or `imports`.
+
+    The file is written with `builtins.toFile`, so the value may refer to
+    sources in the store but not to the outputs of derivations.
+
+    # Type
+
+    ```
+    goAttrFile :: String -> Any -> { __file :: Path }
+    ```
+
+    # Inputs
+
+    `name`
+    : The name of the file in the store.
+
+    `value`
+    : The value of the attribute, which must be convertible to JSON.
+  */
+  goAttrFile = name: value: { __file = builtins.toFile "${name}.json" (builtins.toJSON value); };
 }
@@ -2,15 +2,24 @@
 // their derivation's inputs using "__structuredAttrs".
 //
 // Programs should only import this if they are intended to be used as a
-// builder. The calling derivation must be built with "__structuredAttrs
-// = true".
+// builder. The calling derivation should be built with "__structuredAttrs
+// = true". Otherwise, attributes are read from the environment instead (see
+// [StructuredAttrs]).
 package derivation
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode"
 )
 
 var (
@@ -21,11 +30,41 @@ var (
 	// __structuredAttrs.
 	AttrJson []byte
 
+	// Whether the derivation was built with __structuredAttrs. If not, every
+	// attribute is an environment variable, and is converted to the type of
+	// the field it's decoded into: lists are split on whitespace, booleans are
+	// true unless empty, and anything else (like attribute sets) must be
+	// passed as JSON, for example with builtins.toJSON.
+	StructuredAttrs = true
+
 	// The expected outputs of the derivation and their store paths.
 	Outputs map[string]string
 
 	// The host-specific input packages.
 	NativeBuildInputs []string
+
+	// The target-specific input packages, such as libraries to link against.
+	BuildInputs []string
+
+	// Whether attributes were found by init or loaded since.
+	loaded bool
+
+	// Why init failed to load the attributes, reported by the first GetAttrs.
+	loadErr error
+
+	// Fatal reports an error which stops the builder, such as invalid
+	// attributes. Programs can replace it to report errors their own way, but
+	// it must not return. By default it panics with err rather than exiting,
+	// so programs running several builds in one process, like a daemon, can
+	// recover and fail only the build which hit it.
+	Fatal = func(err error) {
+		panic(err)
+	}
+
+	// ErrNoAttrs is reported when no derivation attributes were found.
+	ErrNoAttrs = errors.New(`failed to locate $NIX_ATTRS_JSON_FILE
+
+  Is this builder being called as a builder for a derivation?`)
 )
 
 // Instead of requiring consumers to include these attributes in their own
@@ -35,36 +74,430 @@ type wellKnownAttrs struct {
 	Outputs map[string]string `json:"outputs"`
 
 	NativeBuildInputs []string `json:"nativeBuildInputs"`
+	BuildInputs       []string `json:"buildInputs"`
 }
 
+// init loads the attributes from the file given by an "--attrs-file" argument,
+// falling back to $NIX_ATTRS_JSON_FILE, then to the environment. The argument is
+// removed from os.Args, so programs can parse their own arguments without
+// knowing about it. If none are found, or they can't be read, the first
+// [GetAttrs] fails instead, so packages using this can still be tested with
+// [LoadJson], and programs can replace [Fatal] first.
 func init() {
 	log.SetFlags(0)
 	log.SetPrefix(fmt.Sprintf("%s: ", Name))
 
-	file := os.Getenv("NIX_ATTRS_JSON_FILE")
-	if file == "" {
-		log.Fatal(`failed to locate $NIX_ATTRS_JSON_FILE
+	file, args := attrsFileArg(os.Args)
+	os.Args = args
+	if file != "" {
+		if err := LoadFile(file); err != nil {
+			loadErr = fmt.Errorf("failed to read --attrs-file: %w", err)
+		}
+		return
+	}
 
-  Is this builder being called as a builder for a derivation?`)
+	file = os.Getenv("NIX_ATTRS_JSON_FILE")
+	switch {
+	case file != "":
+		if err := LoadFile(file); err != nil {
+			loadErr = fmt.Errorf("failed to read $NIX_ATTRS_JSON_FILE: %w", err)
+		}
+	case os.Getenv("outputs") != "" || os.Getenv("out") != "":
+		if err := LoadEnv(); err != nil {
+			loadErr = err
+		}
 	}
+}
 
-	var err error
-	if AttrJson, err = os.ReadFile(file); err != nil {
-		log.Fatalf("failed to read $NIX_ATTRS_JSON_FILE: %v", err)
+// attrsFileArg finds an "--attrs-file" argument in args, returning its value
+// and the rest of the arguments.
+func attrsFileArg(args []string) (string, []string) {
+	for i := 1; i < len(args); i++ {
+		if args[i] == "--" {
+			break
+		}
+		if file, ok := strings.CutPrefix(args[i], "--attrs-file="); ok {
+			return file, slices.Delete(slices.Clone(args), i, i+1)
+		}
+		if args[i] == "--attrs-file" && i+1 < len(args) {
+			return args[i+1], slices.Delete(slices.Clone(args), i, i+2)
+		}
+	}
+
+	return "", args
+}
+
+// LoadFile loads the JSON attributes in file, as written by Nix for
+// __structuredAttrs.
+func LoadFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return LoadJson(data)
+}
+
+// LoadJson replaces the derivation attributes with the JSON attributes data.
+// This lets the builder run outside of Nix, such as from tests, where outputs
+// and inputs can point to temporary directories.
+func LoadJson(data []byte) error {
+	AttrJson = data
+	StructuredAttrs = true
+	return loadWellKnownAttrs()
+}
+
+// LoadEnv replaces the derivation attributes with those in the environment, as
+// for a derivation without __structuredAttrs.
+func LoadEnv() error {
+	AttrJson = nil
+	StructuredAttrs = false
+	return loadWellKnownAttrs()
+}
+
+// loadWellKnownAttrs parses the well-known attributes and copies them to vars.
+func loadWellKnownAttrs() error {
+	loaded = true
+	attrs, err := decodeAttrs[wellKnownAttrs]()
+	if err != nil {
+		return err
 	}
 
-	// Parse the well-known attributes and copy them to vars.
-	attrs := GetAttrs[wellKnownAttrs]()
 	Outputs = attrs.Outputs
 	NativeBuildInputs = attrs.NativeBuildInputs
+	BuildInputs = attrs.BuildInputs
+	path = ""
+	return nil
 }
 
 // GetAttrs loads and parses structured attributes from the Nix derivation
 // inputs. The provided type should support Unmarshalling from JSON.
+//
+// Fields tagged with `nix:"required"` must be set by the derivation. Every
+// missing field is reported at once.
 func GetAttrs[T any]() T {
-	var attrs T
-	if err := json.Unmarshal(AttrJson, &attrs); err != nil {
-		log.Fatalf("failed to parse attributes: %v", err)
+	attrs, err := LoadAttrs[T]()
+	if err != nil {
+		Fatal(err)
 	}
 	return attrs
 }
+
+// LoadAttrs is like [GetAttrs], but returns the error instead of failing, for
+// builders which diagnose broken attributes.
+func LoadAttrs[T any]() (T, error) {
+	if loadErr != nil {
+		var attrs T
+		return attrs, loadErr
+	}
+	if !loaded {
+		var attrs T
+		return attrs, ErrNoAttrs
+	}
+
+	return decodeAttrs[T]()
+}
+
+// decodeAttrs parses the derivation attributes into T, checking for required
+// fields.
+func decodeAttrs[T any]() (T, error) {
+	var attrs T
+	data := AttrJson
+	if !StructuredAttrs {
+		var err error
+		if data, err = envAttrJson(reflect.TypeFor[T]()); err != nil {
+			return attrs, fmt.Errorf("failed to read attributes from environment: %w", err)
+		}
+	}
+
+	raw, err := rawAttrs(data)
+	if err != nil {
+		return attrs, fmt.Errorf("failed to parse attributes: %w", err)
+	}
+	files := attrFiles(raw)
+	if len(files) > 0 {
+		// References would fail to decode into their fields, so they're only
+		// read after everything else.
+		inline := maps.Clone(raw)
+		for name := range files {
+			delete(inline, name)
+		}
+		if data, err = json.Marshal(inline); err != nil {
+			return attrs, fmt.Errorf("failed to parse attributes: %w", err)
+		}
+	}
+
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return attrs, fmt.Errorf("failed to parse attributes: %w", err)
+	}
+	if err := decodeAttrFiles(&attrs, files); err != nil {
+		return attrs, err
+	}
+
+	attrsErr := &AttrsError{}
+	for _, field := range attrFields(reflect.TypeFor[T]()) {
+		if !field.required {
+			continue
+		}
+		if value, ok := lookupAttr(raw, field.name); !ok || string(value) == "null" {
+			attrsErr.Missing = append(attrsErr.Missing, field.name)
+		}
+	}
+	if len(attrsErr.Missing) > 0 {
+		return attrs, attrsErr
+	}
+
+	return attrs, nil
+}
+
+// Attributes interpreted by Nix itself, or set by it, which are never read by a
+// builder.
+var nixAttrs = []string{
+	"__contentAddressed",
+	"__darwinAllowLocalNetworking",
+	"__impure",
+	"__impureHostDeps",
+	"__noChroot",
+	"__propagatedImpureHostDeps",
+	"__sandboxProfile",
+	"__structuredAttrs",
+	"allowSubstitutes",
+	"allowedReferences",
+	"allowedRequisites",
+	"args",
+	"builder",
+	"disallowedReferences",
+	"disallowedRequisites",
+	"exportReferencesGraph",
+	"impureEnvVars",
+	"name",
+	"outputChecks",
+	"outputHash",
+	"outputHashAlgo",
+	"outputHashMode",
+	"outputs",
+	"passAsFile",
+	"preferLocalBuild",
+	"requiredSystemFeatures",
+	"system",
+	"unsafeDiscardReferences",
+}
+
+// An AttrsError lists every problem found with the derivation attributes.
+type AttrsError struct {
+	// Attributes which no schema reads.
+	Unknown []string
+
+	// Required attributes which were not set.
+	Missing []string
+}
+
+func (e AttrsError) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid derivation attributes:")
+	for _, name := range e.Unknown {
+		fmt.Fprintf(&b, "\n  unknown attribute \"%s\"", name)
+	}
+	for _, name := range e.Missing {
+		fmt.Fprintf(&b, "\n  missing required attribute \"%s\"", name)
+	}
+
+	return b.String()
+}
+
+// CheckUnknownAttrs reports any attribute of the derivation which isn't read by
+// one of the schemas, structs which would be passed to [GetAttrs]. Like
+// encoding/json, attribute names are matched case-insensitively. This catches
+// misspelled attributes, which would otherwise be silently ignored.
+func CheckUnknownAttrs(schemas ...any) error {
+	// Without __structuredAttrs, attributes can't be told apart from the rest
+	// of the environment.
+	if !StructuredAttrs {
+		return fmt.Errorf("checking for unknown attributes requires __structuredAttrs")
+	}
+
+	raw, err := rawAttrs(AttrJson)
+	if err != nil {
+		return fmt.Errorf("failed to parse attributes: %w", err)
+	}
+
+	known := slices.Clone(nixAttrs)
+	for _, schema := range append(schemas, wellKnownAttrs{}) {
+		for _, field := range attrFields(reflect.TypeOf(schema)) {
+			known = append(known, field.name)
+		}
+	}
+
+	attrsErr := &AttrsError{}
+	for name := range raw {
+		if !slices.ContainsFunc(known, func(k string) bool { return strings.EqualFold(k, name) }) {
+			attrsErr.Unknown = append(attrsErr.Unknown, name)
+		}
+	}
+	if len(attrsErr.Unknown) > 0 {
+		slices.Sort(attrsErr.Unknown)
+		return attrsErr
+	}
+
+	return nil
+}
+
+// rawAttrs splits JSON derivation attributes into their unparsed values.
+func rawAttrs(data []byte) (map[string]json.RawMessage, error) {
+	var raw map[string]json.RawMessage
+	return raw, json.Unmarshal(data, &raw)
+}
+
+// lookupAttr finds the attribute name in raw, matching names the same way as
+// encoding/json.
+func lookupAttr(raw map[string]json.RawMessage, name string) (json.RawMessage, bool) {
+	if value, ok := raw[name]; ok {
+		return value, true
+	}
+	for key, value := range raw {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+
+	return nil, false
+}
+
+// An attrField is an attribute decoded into a struct field.
+type attrField struct {
+	name     string
+	typ      reflect.Type
+	index    []int
+	required bool
+}
+
+// An attrFile is the value of an attribute which is stored in a file instead,
+// as the JSON object {"__file": path}. The file holds the JSON the attribute
+// would have had. Attributes with thousands of entries, like long lists of
+// sources, can then be read straight from their file, rather than growing
+// $NIX_ATTRS_JSON_FILE which is parsed as a whole.
+type attrFile struct {
+	Path string `json:"__file"`
+}
+
+// attrFiles finds every attribute in raw which refers to a file, keyed by name.
+func attrFiles(raw map[string]json.RawMessage) map[string]string {
+	files := make(map[string]string)
+	for name, value := range raw {
+		if len(value) == 0 || value[0] != '{' {
+			continue
+		}
+
+		var file attrFile
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&file); err == nil && file.Path != "" {
+			files[name] = file.Path
+		}
+	}
+
+	return files
+}
+
+// decodeAttrFiles decodes attributes stored in files into the fields of attrs,
+// a pointer to a struct. Each file is decoded as it's read, without loading it
+// whole. Attributes without a field are skipped, like encoding/json does.
+func decodeAttrFiles(attrs any, files map[string]string) error {
+	value := reflect.ValueOf(attrs).Elem()
+	fields := attrFields(value.Type())
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		i := slices.IndexFunc(fields, func(field attrField) bool {
+			return strings.EqualFold(field.name, name)
+		})
+		if i < 0 {
+			continue
+		}
+
+		field, err := value.FieldByIndexErr(fields[i].index)
+		if err != nil {
+			return fmt.Errorf("failed to read attribute %s: %w", name, err)
+		}
+		if err := decodeAttrFile(files[name], field.Addr().Interface()); err != nil {
+			return fmt.Errorf("failed to read attribute %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// decodeAttrFile decodes the JSON file at path into v.
+func decodeAttrFile(path string, v any) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewDecoder(bufio.NewReader(file)).Decode(v)
+}
+
+// attrFields lists the attributes encoding/json would decode into the struct
+// type t, including those of embedded structs.
+func attrFields(t reflect.Type) []attrField {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []attrField
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			for _, embedded := range attrFields(field.Type) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = attrName(field.Name)
+		}
+
+		fields = append(fields, attrField{
+			name:     name,
+			typ:      field.Type,
+			index:    []int{i},
+			required: field.Tag.Get("nix") == "required",
+		})
+	}
+
+	return fields
+}
+
+// attrName converts the name of a Go field to the camel case used for Nix
+// attributes, like "PackagePath" to "packagePath", "SDK" to "sdk", or "SDKs"
+// to "sdks".
+func attrName(field string) string {
+	runes := []rune(field)
+	upper := 0
+	for upper < len(runes) && unicode.IsUpper(runes[upper]) {
+		upper++
+	}
+	// The last capital of an acronym starts the next word, unless the word is
+	// only the "s" of a plural acronym.
+	plural := upper < len(runes) && runes[upper] == 's' &&
+		(upper+1 == len(runes) || unicode.IsUpper(runes[upper+1]))
+	if upper > 1 && upper < len(runes) && unicode.IsLower(runes[upper]) && !plural {
+		upper--
+	}
+	for i := range upper {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+
+	return string(runes)
+}
@@ -0,0 +1,24 @@
+package derivation
+
+import "testing"
+
+func TestAttrName(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"ImportPath", "importPath"},
+		{"SDK", "sdk"},
+		{"SDKs", "sdks"},
+		{"SDKVersion", "sdkVersion"},
+		{"URLsFile", "urlsFile"},
+		{"CFlags", "cFlags"},
+		{"Std", "std"},
+		{"X", "x"},
+	}
+	for _, test := range tests {
+		if got := attrName(test.field); got != test.want {
+			t.Errorf("attrName(%q) = %q, want %q", test.field, got, test.want)
+		}
+	}
+}
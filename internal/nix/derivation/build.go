@@ -0,0 +1,158 @@
+package derivation
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+var (
+	// Directory for generated files, relative to $NIX_BUILD_TOP. It's removed
+	// once the build succeeds, so it must stay within $NIX_BUILD_TOP. See
+	// [CheckBuildDirPath].
+	BuildDirPath = "go-build"
+
+	// Lazily initialized, temporary directory for generated files.
+	buildDir string
+)
+
+// OutputPath looks up a derivation output and creates an empty directory there.
+func OutputPath(output string) (string, error) {
+	dir := Outputs[output]
+	if dir == "" {
+		return "", fmt.Errorf(
+			"derivation was expected to produce an output \"%s\"",
+			output,
+		)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	return dir, nil
+}
+
+// MustOutput is like [OutputPath], but exits the builder if the output can't be
+// created.
+func MustOutput(output string) string {
+	dir, err := OutputPath(output)
+	if err != nil {
+		Fatal(err)
+	}
+
+	return dir
+}
+
+// EnsureDir creates the directory elem joined under dir, along with any missing
+// parents, and returns its path. This is useful for laying out subdirectories
+// of an output, such as "bin" or "share/man".
+func EnsureDir(dir string, elem ...string) (string, error) {
+	path := filepath.Join(append([]string{dir}, elem...)...)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	return path, nil
+}
+
+// BuildDir creates a shared temporary directory for build-related files. If
+// BuildDir has already been called, it will return the same directory that was
+// previously generated.
+//
+// Within Nix, this is BuildDirPath under $NIX_BUILD_TOP, so the path is the
+// same every build. Outside of Nix, a new random directory is used instead.
+func BuildDir() string {
+	if buildDir == "" {
+		top := os.Getenv("NIX_BUILD_TOP")
+		err := CheckBuildDirPath(BuildDirPath)
+		switch {
+		case err != nil:
+		case top != "":
+			buildDir = filepath.Join(top, BuildDirPath)
+			err = os.MkdirAll(buildDir, 0755)
+		default:
+			buildDir, err = os.MkdirTemp(os.TempDir(), Name)
+		}
+		if err != nil {
+			Fatal(fmt.Errorf("failed to initialize build directory: %w", err))
+		}
+	}
+
+	return buildDir
+}
+
+// CheckBuildDirPath fails unless path names a directory within, but not the
+// same as, $NIX_BUILD_TOP, so removing it can't delete anything else.
+func CheckBuildDirPath(path string) error {
+	if !filepath.IsLocal(path) || filepath.Clean(path) == "." {
+		return fmt.Errorf("%s is not a relative path within $NIX_BUILD_TOP", path)
+	}
+
+	return nil
+}
+
+// CleanBuildDir removes the build directory, if one was created. This should
+// only be called once the build has succeeded, so the directory is left for
+// inspection (e.g. with "nix build --keep-failed") after a failure.
+func CleanBuildDir() {
+	if buildDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(buildDir); err != nil {
+		log.Printf("warning: failed to clean up build directory: %v", err)
+	}
+	buildDir = ""
+}
+
+// ForgetBuildDir makes the next [BuildDir] create a new directory, leaving the
+// current one in place. This lets a process building more than once keep the
+// directory of a failed build for inspection.
+func ForgetBuildDir() {
+	buildDir = ""
+}
+
+// UseDirs points the derivation's outputs and build directory under root
+// rather than where Nix put them: each output in outputs is the directory of
+// its name in root, and [BuildDir] is BuildDirPath in root. This lets code
+// calling [MustOutput] and [BuildDir] run outside of Nix, such as in tests
+// with a temporary directory. Calling restore puts back the previous outputs
+// and build directory.
+func UseDirs(root string, outputs ...string) (restore func(), err error) {
+	dir := filepath.Join(root, BuildDirPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to initialize build directory: %w", err)
+	}
+
+	oldOutputs, oldBuildDir := Outputs, buildDir
+	Outputs = make(map[string]string, len(outputs))
+	for _, output := range outputs {
+		Outputs[output] = filepath.Join(root, output)
+	}
+	buildDir = dir
+
+	return func() {
+		Outputs, buildDir = oldOutputs, oldBuildDir
+	}, nil
+}
+
+// BuildParallelism returns the number of CPU cores Nix has asked us to use. If
+// NIX_BUILD_CORES is not present, this is 1.
+func BuildParallelism() int {
+	cores := os.Getenv("NIX_BUILD_CORES")
+	switch cores {
+	case "":
+		return 1
+	case "0":
+		return runtime.NumCPU()
+	default:
+		cores, err := strconv.ParseInt(cores, 10, 32)
+		if err != nil {
+			Fatal(fmt.Errorf("failed to parse NIX_BUILD_CORES: %w", err))
+		}
+		return int(cores)
+	}
+}
@@ -0,0 +1,145 @@
+package derivation
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestOutputPath(t *testing.T) {
+	dir := t.TempDir()
+	Outputs = map[string]string{"out": filepath.Join(dir, "out")}
+	defer func() { Outputs = nil }()
+
+	out, err := OutputPath("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(out); err != nil || !info.IsDir() {
+		t.Errorf("OutputPath(%q) didn't create a directory at %s", "out", out)
+	}
+	if _, err := OutputPath("out"); err == nil {
+		t.Errorf("OutputPath(%q) succeeded twice, want an error", "out")
+	}
+	if _, err := OutputPath("lib"); err == nil {
+		t.Errorf("OutputPath(%q) of an undeclared output succeeded", "lib")
+	}
+}
+
+func TestMustOutput(t *testing.T) {
+	Outputs = map[string]string{}
+	defer func() { Outputs = nil }()
+
+	var fatalErr error
+	defer func(fatal func(error)) { Fatal = fatal }(Fatal)
+	Fatal = func(err error) { fatalErr = err }
+
+	MustOutput("lib")
+	if fatalErr == nil {
+		t.Errorf("MustOutput(%q) of an undeclared output didn't call Fatal", "lib")
+	}
+}
+
+func TestEnsureDir(t *testing.T) {
+	dir := t.TempDir()
+	for range 2 {
+		path, err := EnsureDir(dir, "share", "man")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(dir, "share", "man"); path != want {
+			t.Errorf("EnsureDir = %s, want %s", path, want)
+		}
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			t.Errorf("EnsureDir didn't create %s", path)
+		}
+	}
+}
+
+func TestCheckBuildDirPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"go-build", true},
+		{"a/b", true},
+		{"a/../b", true},
+		{"", false},
+		{".", false},
+		{"a/..", false},
+		{"..", false},
+		{"../go-build", false},
+		{"/tmp/go-build", false},
+	}
+	for _, test := range tests {
+		err := CheckBuildDirPath(test.path)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("CheckBuildDirPath(%q) = %v, want ok %t", test.path, err, test.ok)
+		}
+	}
+}
+
+func TestBuildDir(t *testing.T) {
+	top := t.TempDir()
+	t.Setenv("NIX_BUILD_TOP", top)
+	defer ForgetBuildDir()
+
+	dir := BuildDir()
+	if want := filepath.Join(top, BuildDirPath); dir != want {
+		t.Errorf("BuildDir() = %s, want %s", dir, want)
+	}
+	if again := BuildDir(); again != dir {
+		t.Errorf("second BuildDir() = %s, want %s", again, dir)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("BuildDir() didn't create %s: %v", dir, err)
+	}
+
+	CleanBuildDir()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("CleanBuildDir() left %s behind", dir)
+	}
+}
+
+func TestBuildParallelism(t *testing.T) {
+	tests := []struct {
+		cores string
+		want  int
+	}{
+		{"", 1},
+		{"1", 1},
+		{"8", 8},
+		{"0", runtime.NumCPU()},
+	}
+	for _, test := range tests {
+		t.Setenv("NIX_BUILD_CORES", test.cores)
+		if got := BuildParallelism(); got != test.want {
+			t.Errorf("BuildParallelism() with NIX_BUILD_CORES=%q = %d, want %d", test.cores, got, test.want)
+		}
+	}
+}
+
+func TestUseDirs(t *testing.T) {
+	root := t.TempDir()
+	restore, err := UseDirs(root, "lib", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dir := BuildDir(); dir != filepath.Join(root, BuildDirPath) {
+		t.Errorf("BuildDir() = %s, want it in %s", dir, root)
+	}
+	for _, output := range []string{"lib", "export"} {
+		if dir, err := OutputPath(output); err != nil {
+			t.Error(err)
+		} else if dir != filepath.Join(root, output) {
+			t.Errorf("OutputPath(%q) = %s, want it in %s", output, dir, root)
+		}
+	}
+
+	restore()
+	if Outputs != nil || buildDir != "" {
+		t.Errorf("restore left outputs %v and build directory %q", Outputs, buildDir)
+	}
+}
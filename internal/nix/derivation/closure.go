@@ -0,0 +1,154 @@
+package derivation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// A PathInfo describes a store path in a closure exported by Nix.
+type PathInfo struct {
+	Path       string   `json:"path"`
+	References []string `json:"references"`
+
+	// The derivation which produced the path, if known.
+	Deriver string `json:"deriver"`
+
+	// The hash and size of the path's serialization. Only known with
+	// __structuredAttrs.
+	NarHash string `json:"narHash"`
+	NarSize int64  `json:"narSize"`
+}
+
+// A Closure is a set of store paths along with everything they reference,
+// keyed by path.
+type Closure map[string]PathInfo
+
+// ReferencesGraph returns the closure Nix exported as name, for the derivation
+// attribute `exportReferencesGraph.<name> = [ paths ]`. This lets builders
+// reason about the runtime dependencies of their inputs.
+//
+// With __structuredAttrs, Nix replaces the attribute name with the closure.
+// Otherwise, it writes the closure to a file of that name in $NIX_BUILD_TOP.
+func ReferencesGraph(name string) (Closure, error) {
+	var infos []PathInfo
+	if StructuredAttrs {
+		raw, err := rawAttrs(AttrJson)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse attributes: %w", err)
+		}
+		value, ok := raw[name]
+		if !ok {
+			return nil, fmt.Errorf("references graph %s was not exported", name)
+		}
+		if err := json.Unmarshal(value, &infos); err != nil {
+			return nil, fmt.Errorf("failed to parse references graph %s: %w", name, err)
+		}
+	} else {
+		var err error
+		infos, err = readReferencesGraph(filepath.Join(os.Getenv("NIX_BUILD_TOP"), name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read references graph %s: %w", name, err)
+		}
+	}
+
+	closure := make(Closure, len(infos))
+	for _, info := range infos {
+		closure[info.Path] = info
+	}
+
+	return closure, nil
+}
+
+// readReferencesGraph parses a closure written by Nix for a derivation without
+// __structuredAttrs. Each path is listed on its own line, followed by its
+// deriver (or an empty line), the number of references, and the references.
+func readReferencesGraph(file string) ([]PathInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	next := func() (string, bool) {
+		if !scanner.Scan() {
+			return "", false
+		}
+		return scanner.Text(), true
+	}
+
+	var infos []PathInfo
+	for {
+		path, ok := next()
+		if !ok {
+			break
+		}
+
+		deriver, ok := next()
+		if !ok {
+			return nil, fmt.Errorf("%s: missing deriver of %s", file, path)
+		}
+		line, ok := next()
+		if !ok {
+			return nil, fmt.Errorf("%s: missing references of %s", file, path)
+		}
+		count, err := strconv.Atoi(line)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("%s: invalid reference count %q of %s", file, line, path)
+		}
+
+		info := PathInfo{Path: path, Deriver: deriver, References: make([]string, 0, count)}
+		for range count {
+			reference, ok := next()
+			if !ok {
+				return nil, fmt.Errorf("%s: missing references of %s", file, path)
+			}
+			info.References = append(info.References, reference)
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, scanner.Err()
+}
+
+// Paths returns every path in the closure, sorted.
+func (c Closure) Paths() []string {
+	return slices.Sorted(maps.Keys(c))
+}
+
+// Requisites returns path and every path it references, directly or not,
+// sorted. Paths outside the closure are listed, but not followed.
+func (c Closure) Requisites(path string) []string {
+	seen := make(map[string]bool)
+
+	var visit func(path string)
+	visit = func(path string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		for _, reference := range c[path].References {
+			visit(reference)
+		}
+	}
+	visit(path)
+
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// ReferencesOnlySelf reports whether path references nothing besides itself,
+// such as a statically linked binary. It's false for a path outside the
+// closure, whose references aren't known.
+func (c Closure) ReferencesOnlySelf(path string) bool {
+	if _, ok := c[path]; !ok {
+		return false
+	}
+
+	return len(c.Requisites(path)) == 1
+}
@@ -0,0 +1,35 @@
+package derivation
+
+import "testing"
+
+func TestReferencesOnlySelf(t *testing.T) {
+	closure := Closure{
+		"/nix/store/static": {Path: "/nix/store/static", References: []string{"/nix/store/static"}},
+		"/nix/store/empty":  {Path: "/nix/store/empty"},
+		"/nix/store/libc":   {Path: "/nix/store/libc", References: []string{"/nix/store/libc"}},
+		"/nix/store/dynamic": {
+			Path:       "/nix/store/dynamic",
+			References: []string{"/nix/store/dynamic", "/nix/store/libc"},
+		},
+		"/nix/store/outside": {
+			Path:       "/nix/store/outside",
+			References: []string{"/nix/store/unknown"},
+		},
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/nix/store/static", true},
+		{"/nix/store/empty", true},
+		{"/nix/store/dynamic", false},
+		{"/nix/store/outside", false},
+		{"/nix/store/unknown", false},
+	}
+	for _, test := range tests {
+		if got := closure.ReferencesOnlySelf(test.path); got != test.want {
+			t.Errorf("ReferencesOnlySelf(%q) = %t, want %t", test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package derivation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// envOutputs finds the outputs of a derivation without __structuredAttrs.
+// Nix lists their names in $outputs, and sets a variable of each name to its
+// store path.
+func envOutputs() map[string]string {
+	names := strings.Fields(os.Getenv("outputs"))
+	if len(names) == 0 {
+		names = []string{"out"}
+	}
+
+	outputs := make(map[string]string, len(names))
+	for _, name := range names {
+		outputs[name] = os.Getenv(name)
+	}
+
+	return outputs
+}
+
+// lookupEnvAttr returns the value of the attribute name. Attributes listed in
+// $passAsFile aren't set directly; Nix writes them to a file instead, named by
+// the variable "<name>Path".
+func lookupEnvAttr(name string, passAsFile []string) (string, bool, error) {
+	if !slices.Contains(passAsFile, name) {
+		value, ok := os.LookupEnv(name)
+		return value, ok, nil
+	}
+
+	path, ok := os.LookupEnv(name + "Path")
+	if !ok {
+		return "", false, nil
+	}
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read attribute %s: %w", name, err)
+	}
+	return string(value), true, nil
+}
+
+// envAttrJson builds JSON attributes for the struct type t from environment
+// variables, converting each to the type of its field. See [StructuredAttrs].
+func envAttrJson(t reflect.Type) ([]byte, error) {
+	attrs := make(map[string]any)
+	passAsFile := strings.Fields(os.Getenv("passAsFile"))
+	for _, field := range attrFields(t) {
+		if strings.EqualFold(field.name, "outputs") {
+			attrs[field.name] = envOutputs()
+			continue
+		}
+		// Unlike with JSON, names must match exactly, so variables like $GOARM
+		// aren't mistaken for attributes.
+		value, ok, err := lookupEnvAttr(field.name, passAsFile)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		typ := field.typ
+		for typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		switch {
+		case typ.Kind() == reflect.String:
+			attrs[field.name] = value
+		case typ.Kind() == reflect.Bool:
+			attrs[field.name] = value != ""
+		case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String:
+			attrs[field.name] = strings.Fields(value)
+		default:
+			if !json.Valid([]byte(value)) {
+				return nil, fmt.Errorf("attribute %s must be passed as JSON", field.name)
+			}
+			attrs[field.name] = json.RawMessage(value)
+		}
+	}
+
+	return json.Marshal(attrs)
+}
@@ -4,30 +4,109 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
 var (
-	// The memoized path string.
+	// The memoized path string. Cleared whenever attributes are loaded.
 	path string
+
+	// Files of an input listing the inputs it propagates, which must also be
+	// available to anything using it. With cross-compilation, stdenv puts
+	// inputs propagated by native inputs in either.
+	propagatedFiles = []string{
+		"nix-support/propagated-native-build-inputs",
+		"nix-support/propagated-build-inputs",
+	}
 )
 
-// Path generates a colon-separated list of inputs, suitable for setting to
-// $PATH.
-func Path() string {
-	var b strings.Builder
+// NativeInputs returns NativeBuildInputs followed by every input they
+// propagate, recursively, in the order stdenv would find them. Each input is
+// only listed once.
+func NativeInputs() []string {
+	var inputs []string
+	seen := make(map[string]bool)
+
+	var visit func(dep string)
+	visit = func(dep string) {
+		if dep == "" || seen[dep] {
+			return
+		}
+		seen[dep] = true
+		inputs = append(inputs, dep)
+
+		for _, file := range propagatedFiles {
+			data, err := os.ReadFile(filepath.Join(dep, file))
+			if err != nil {
+				continue
+			}
+			for _, propagated := range strings.Fields(string(data)) {
+				visit(propagated)
+			}
+		}
+	}
+	for _, dep := range NativeBuildInputs {
+		visit(dep)
+	}
 
-	for i, dep := range NativeBuildInputs {
-		if i != 0 {
-			fmt.Fprint(&b, ":")
+	return inputs
+}
+
+// Path generates a list of the bin directories of [NativeInputs], separated
+// like $PATH. Inputs without a bin directory are left out.
+func Path() string {
+	if path == "" {
+		var dirs []string
+		for _, dep := range NativeInputs() {
+			bin := filepath.Join(dep, "bin")
+			if info, err := os.Stat(bin); err == nil && info.IsDir() {
+				dirs = append(dirs, bin)
+			}
 		}
-		fmt.Fprintf(&b, filepath.Join(dep, "bin"))
+		path = strings.Join(dirs, string(os.PathListSeparator))
 	}
 
-	return b.String()
+	return path
 }
 
 // SetPath sets the $PATH environment variable to the output of [Path].
 func SetPath() error {
 	return os.Setenv("PATH", Path())
 }
+
+// PrependPath adds dirs to the start of $PATH, so they are searched first.
+func PrependPath(dirs ...string) error {
+	return updatePath(func(current []string) []string {
+		return slices.Concat(dirs, current)
+	})
+}
+
+// AppendPath adds dirs to the end of $PATH, so they are searched last.
+func AppendPath(dirs ...string) error {
+	return updatePath(func(current []string) []string {
+		return slices.Concat(current, dirs)
+	})
+}
+
+// updatePath replaces $PATH with the result of update, given its current
+// entries. Empty entries, which would mean the working directory, and any
+// entry repeated after its first appearance are dropped.
+func updatePath(update func(current []string) []string) error {
+	var current []string
+	if value := os.Getenv("PATH"); value != "" {
+		current = filepath.SplitList(value)
+	}
+
+	var entries []string
+	for _, entry := range update(current) {
+		if strings.ContainsRune(entry, os.PathListSeparator) {
+			return fmt.Errorf("path entry %s contains %q", entry, os.PathListSeparator)
+		}
+		if entry != "" && !slices.Contains(entries, entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return os.Setenv("PATH", strings.Join(entries, string(os.PathListSeparator)))
+}
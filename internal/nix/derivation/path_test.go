@@ -0,0 +1,103 @@
+package derivation
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNativeInputs(t *testing.T) {
+	dir := t.TempDir()
+	input := func(name string, propagated ...string) string {
+		dep := filepath.Join(dir, name)
+		support := filepath.Join(dep, "nix-support")
+		if err := os.MkdirAll(support, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if len(propagated) > 0 {
+			file := filepath.Join(support, "propagated-native-build-inputs")
+			if err := os.WriteFile(file, []byte(strings.Join(propagated, " ")), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dep
+	}
+	leaf := input("leaf")
+	middle := input("middle", leaf)
+	top := input("top", middle, leaf)
+	other := input("other", leaf)
+
+	tests := []struct {
+		name   string
+		inputs []string
+		want   []string
+	}{
+		{"empty", nil, nil},
+		{"no propagation", []string{leaf}, []string{leaf}},
+		{"depth first", []string{top}, []string{top, middle, leaf}},
+		{"shared input listed once", []string{top, other}, []string{top, middle, leaf, other}},
+		{"repeated input", []string{leaf, other, leaf}, []string{leaf, other}},
+		{"empty input", []string{"", leaf}, []string{leaf}},
+	}
+	for _, test := range tests {
+		NativeBuildInputs = test.inputs
+		if got := NativeInputs(); !slices.Equal(got, test.want) {
+			t.Errorf("%s: NativeInputs() = %q, want %q", test.name, got, test.want)
+		}
+	}
+	NativeBuildInputs = nil
+}
+
+func TestUpdatePath(t *testing.T) {
+	list := func(entries ...string) string {
+		return strings.Join(entries, string(os.PathListSeparator))
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		prepend []string
+		append  []string
+		want    string
+	}{
+		{"empty path", "", []string{"/a"}, nil, "/a"},
+		{"empty path append", "", nil, []string{"/a"}, "/a"},
+		{"prepend", list("/a", "/b"), []string{"/c"}, nil, list("/c", "/a", "/b")},
+		{"append", list("/a", "/b"), nil, []string{"/c"}, list("/a", "/b", "/c")},
+		{"prepend keeps order", "/a", []string{"/b", "/c"}, nil, list("/b", "/c", "/a")},
+		{"prepend moves existing", list("/a", "/b"), []string{"/b"}, nil, list("/b", "/a")},
+		{"append keeps existing", list("/a", "/b"), nil, []string{"/a"}, list("/a", "/b")},
+		{"duplicates dropped", list("/a", "/a", "/b"), nil, []string{"/b", "/b"}, list("/a", "/b")},
+		{"empty entries dropped", list("/a", "", "/b"), []string{""}, nil, list("/a", "/b")},
+		{"nothing added", list("/a", "/b"), nil, nil, list("/a", "/b")},
+	}
+	for _, test := range tests {
+		t.Setenv("PATH", test.path)
+		var err error
+		if test.prepend != nil {
+			err = PrependPath(test.prepend...)
+		} else {
+			err = AppendPath(test.append...)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := os.Getenv("PATH"); got != test.want {
+			t.Errorf("%s: PATH = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUpdatePathSeparator(t *testing.T) {
+	t.Setenv("PATH", "/a")
+	bad := "/b" + string(os.PathListSeparator) + "/c"
+	if err := AppendPath(bad); err == nil {
+		t.Errorf("AppendPath(%q) succeeded, want an error", bad)
+	}
+	if got := os.Getenv("PATH"); got != "/a" {
+		t.Errorf("PATH = %q after a failed update, want %q", got, "/a")
+	}
+}
@@ -8,6 +8,17 @@ let
     inherit (prev) lib go;
     useCaDerivations =
       prev.config.contentAddressedByDefault || (prev.config.contentAddressedGoPackages or false);
+    archFeatures = prev.config.goArchFeatures or { };
+    goExperiment = prev.config.goExperiment or [ ];
+    packStdMetadata = prev.config.packGoStdMetadata or false;
+    stdGcFlags = prev.config.goStdGcFlags or [ ];
+    stdAsmFlags = prev.config.goStdAsmFlags or [ ];
+    stdInstrument = prev.config.goStdInstrument or null;
+    stdDynLink = prev.config.goStdDynLink or false;
+    stdSingleDerivation = prev.config.goStdSingleDerivation or false;
+    stdSplitOutputs = prev.config.goStdSplitOutputs or false;
+    stdPrevious = prev.config.goStdPrevious or null;
+    defaultGodebug = prev.config.goDefaultGodebug or { };
   };
 
 in
@@ -31,10 +42,24 @@ in
   # };
 
   gopkg2nix-builder = goLib.builder;
+  gopkg2nix-checks = goLib.checks;
 
   goPackages = makeExtensible (
     final: goLib.internal.stdlib // { "nix/derivation" = goLib.internal.derivation; }
   );
 
-  inherit (goLib) buildGoLibrary buildGoBinary;
+  inherit (goLib)
+    attestGoPackages
+    buildGoLibrary
+    buildGoBinary
+    buildGoImportGraph
+    buildGoMetaPackage
+    buildGoModuleLibrary
+    buildGoSharedLibrary
+    buildGoTest
+    generateGoLock
+    goAttrFile
+    runGoTest
+    runBuiltGoTest
+    ;
 }
@@ -5,38 +5,84 @@
   builder,
   buildGoLibrary,
   useCaDerivations ? false,
+  toolAttrs ? { },
+  packMetadata ? false,
+  gcFlags ? [ ],
+  asmFlags ? [ ],
+  instrument ? null,
+  # Compile every package with `-dynlink`, to link into a shared library.
+  dynLink ? false,
+  # Compile every package in one derivation instead of a derivation each.
+  singleDerivation ? false,
+  # Write each package of a single derivation build to its own outputs, so
+  # derivations can depend on only the packages they import.
+  splitOutputs ? false,
+  # An earlier single derivation std build, whose packages are reused where
+  # their inputs haven't changed.
+  previous ? null,
   ...
 }@args:
 
 let
   inherit (lib)
+    concatMap
     importJSON
     mapAttrs
     mergeAttrsList
     nameValuePair
     optionalAttrs
+    optionals
+    replaceStrings
     ;
 
-  specFile = derivation {
-    inherit system;
-    name = "std-spec";
+  # Instrumentation changes which files are in each package, so it applies to
+  # listing the packages as well as building them.
+  stdAttrs = toolAttrs // optionalAttrs (instrument != null) { inherit instrument; };
 
-    __structuredAttrs = true;
-    __contentAddressed = useCaDerivations;
+  specFile = derivation (
+    {
+      inherit system;
+      name = "std-spec";
 
-    builder = "${builder}/bin/builder";
-    args = [
-      "stdlib"
-      "list"
-    ];
+      __structuredAttrs = true;
+      __contentAddressed = useCaDerivations;
 
-    sdk = "${go}/share/go";
-  };
+      builder = "${builder}/bin/builder";
+      args = [
+        "stdlib"
+        "list"
+      ];
+
+      sdk = "${go}/share/go";
+    }
+    // stdAttrs
+  );
 
   # IFD, but since it's only once at the beginning it shouldn't slow things
   # down much.
   spec = args.spec or (importJSON "${specFile}/spec.json");
 
+  # Same packages as the spec, but in dependency order and with the imports
+  # between them as a flat list of edges. Only read when requested.
+  planFile = derivation (
+    {
+      inherit system;
+      name = "std-plan";
+
+      __structuredAttrs = true;
+      __contentAddressed = useCaDerivations;
+
+      builder = "${builder}/bin/builder";
+      args = [
+        "stdlib"
+        "plan"
+      ];
+
+      sdk = "${go}/share/go";
+    }
+    // stdAttrs
+  );
+
   pkgs = builtins.listToAttrs (
     builtins.map (pkg: {
       name = pkg.ImportPath;
@@ -48,11 +94,15 @@ let
           );
           imports = builtins.map (dep: pkgs."${dep}") (pkg.Imports or [ ]);
 
-          compileFlags = [ "-std" ];
+          std = true;
+          compileFlags = gcFlags;
+          inherit asmFlags;
 
           noStd = true;
           builder = "${builder}/bin/builder";
         }
+        // optionalAttrs (instrument != null) { inherit instrument; }
+        // optionalAttrs dynLink { inherit dynLink; }
         // optionalAttrs (pkg ? "ImportMap") { importMap = pkg.ImportMap or { }; }
         // optionalAttrs (pkg ? "EmbedPatterns" && pkg ? "EmbedFiles") {
           embedCfg = {
@@ -71,34 +121,97 @@ let
     }) spec
   );
 
+  # Name of the output holding only one package of a split build, matching
+  # stdOutputName in the builder.
+  outputName = kind: importPath: "${kind}-${replaceStrings [ "/" ] [ "-" ] importPath}";
+
+  # Every package built by a single derivation. Each is compiled in the
+  # builder, so only the packages whose inputs changed since `previous` are
+  # compiled again.
+  stdSingle =
+    derivation (
+      {
+        inherit system;
+        name = "std-obj";
+
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
+
+        builder = "${builder}/bin/builder";
+        args = [
+          "stdlib"
+          "build"
+        ];
+        outputs = [
+          "lib"
+          "export"
+        ]
+        ++ optionals splitOutputs (
+          concatMap (pkg: [
+            (outputName "lib" pkg.ImportPath)
+            (outputName "export" pkg.ImportPath)
+          ]) spec
+        );
+
+        sdk = "${go}/share/go";
+        compileFlags = gcFlags;
+        inherit asmFlags packMetadata splitOutputs;
+      }
+      // stdAttrs
+      // optionalAttrs dynLink { inherit dynLink; }
+      // optionalAttrs (previous != null) { previous = { inherit (previous) lib export; }; }
+    )
+    // {
+      packagePath = "std";
+    };
+
+  # The outputs of each package of a split build, standing in for the
+  # derivations compiling them alone.
+  splitPkgs = builtins.listToAttrs (
+    builtins.map (pkg: {
+      name = pkg.ImportPath;
+      value = {
+        packagePath = pkg.ImportPath;
+        lib = stdSingle.${outputName "lib" pkg.ImportPath};
+        export = stdSingle.${outputName "export" pkg.ImportPath};
+      }
+      // optionalAttrs (pkg ? "ImportMap") { importMap = pkg.ImportMap; };
+    }) spec
+  );
+
 in
-pkgs
+(if singleDerivation && splitOutputs then splitPkgs else pkgs)
 // {
   inherit spec;
+  plan = importJSON "${planFile}/plan.json";
 
   std =
-    derivation {
-      inherit system;
-      name = "std-obj";
+    if singleDerivation then
+      stdSingle
+    else
+      derivation {
+        inherit system;
+        name = "std-obj";
 
-      __structuredAttrs = true;
-      __contentAddressed = useCaDerivations;
+        __structuredAttrs = true;
+        __contentAddressed = useCaDerivations;
 
-      builder = "${builder}/bin/builder";
-      args = [
-        "stdlib"
-        "package"
-      ];
-      outputs = [
-        "lib"
-        "export"
-      ];
+        builder = "${builder}/bin/builder";
+        args = [
+          "stdlib"
+          "package"
+        ];
+        outputs = [
+          "lib"
+          "export"
+        ];
 
-      sdk = "${go}/share/go";
-      packages = mapAttrs (_: pkg: { inherit (pkg) lib export; }) pkgs;
-      importMap = mergeAttrsList (builtins.map (dep: dep.importMap or { }) (builtins.attrValues pkgs));
-    }
-    // {
-      packagePath = "std";
-    };
+        sdk = "${go}/share/go";
+        packages = mapAttrs (_: pkg: { inherit (pkg) lib export; }) pkgs;
+        importMap = mergeAttrsList (builtins.map (dep: dep.importMap or { }) (builtins.attrValues pkgs));
+        inherit packMetadata;
+      }
+      // {
+        packagePath = "std";
+      };
 }